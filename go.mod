@@ -1,6 +1,6 @@
 module github.com/Azure/run-command-extension-linux
 
-go 1.17
+go 1.24
 
 require (
 	github.com/Azure/azure-docker-extension v0.0.0-20160802215703-0dd2f199467d
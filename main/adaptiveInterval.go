@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// adaptiveInterval lengthens the probe interval while the application is
+// persistently Unhealthy, doubling it after each probe cycle up to the
+// maximum interval, to reduce the pressure on the struggling application. The
+// interval is shortened back as soon as a probe succeeds, so that the
+// recovery is confirmed without waiting for a long interval.
+type adaptiveInterval struct {
+	base, max time.Duration
+	current   time.Duration
+}
+
+// newAdaptiveInterval returns the adaptive interval between base and max, or
+// nil when the interval is fixed.
+func newAdaptiveInterval(base, max time.Duration) *adaptiveInterval {
+	if max <= base {
+		return nil
+	}
+	return &adaptiveInterval{base: base, max: max, current: base}
+}
+
+// observe returns the interval until the next probe cycle given the committed
+// state of the cycle and the applications.
+func (a *adaptiveInterval) observe(ctx *log.Context, state HealthStatus, apps []*application) time.Duration {
+	next := a.base
+	if state == Unhealthy && !anyProbeSucceeded(apps) {
+		next = a.current * 2
+		if next > a.max {
+			next = a.max
+		}
+	}
+	if next != a.current {
+		ctx.Log("event", fmt.Sprintf("Probe interval changed from %v to %v", a.current, next), "state", state)
+		a.current = next
+	}
+	return a.current
+}
+
+// anyProbeSucceeded reports whether the last probe of an application found it
+// Healthy, which shows the recovery of an Unhealthy application.
+func anyProbeSucceeded(apps []*application) bool {
+	for _, app := range apps {
+		if app.lastResponse.ApplicationHealthState == Healthy {
+			return true
+		}
+	}
+	return false
+}
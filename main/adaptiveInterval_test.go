@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveInterval(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	a := newAdaptiveInterval(5*time.Second, 30*time.Second)
+	app := &application{}
+	apps := []*application{app}
+
+	app.lastResponse.ApplicationHealthState = Healthy
+	require.Equal(t, 5*time.Second, a.observe(ctx, Healthy, apps))
+
+	// lengthened while persistently Unhealthy
+	app.lastResponse.ApplicationHealthState = Unhealthy
+	require.Equal(t, 10*time.Second, a.observe(ctx, Unhealthy, apps))
+	require.Equal(t, 20*time.Second, a.observe(ctx, Unhealthy, apps))
+	require.Equal(t, 30*time.Second, a.observe(ctx, Unhealthy, apps))
+	require.Equal(t, 30*time.Second, a.observe(ctx, Unhealthy, apps))
+
+	// shortened back once a probe succeeds, before the state is committed
+	app.lastResponse.ApplicationHealthState = Healthy
+	require.Equal(t, 5*time.Second, a.observe(ctx, Unhealthy, apps))
+	app.lastResponse.ApplicationHealthState = Unhealthy
+	require.Equal(t, 10*time.Second, a.observe(ctx, Unhealthy, apps))
+	require.Equal(t, 5*time.Second, a.observe(ctx, Unknown, apps))
+
+	require.Nil(t, newAdaptiveInterval(5*time.Second, 0))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAggregatorRequestPath     = "/checks"
+	maxAggregatorResponseSizeInBytes = 64 * 1024
+)
+
+// aggregatorResponse is the response of a health aggregator: the named checks
+// it runs, each with its state, detail and whether it is optional.
+type aggregatorResponse struct {
+	Checks []ProbeDependency `json:"checks"`
+}
+
+// AggregatorHealthProbe delegates the health of the VM to a local health
+// aggregator daemon, queried over http on a local port or unix socket. Each
+// check of the aggregator is reported as a dependency substatus and the health
+// state is computed from the checks with the dependency aggregation.
+type AggregatorHealthProbe struct {
+	HttpClient            *http.Client
+	Network               string
+	Address               string
+	RequestPath           string
+	DependencyAggregation string
+}
+
+// NewAggregatorHealthProbe creates the probe of a local port, or of a unix
+// socket when socketPath is set.
+func NewAggregatorHealthProbe(socketPath string, port int, requestPath string, dependencyAggregation string, timeout time.Duration) *AggregatorHealthProbe {
+	if requestPath == "" {
+		requestPath = defaultAggregatorRequestPath
+	}
+	p := &AggregatorHealthProbe{
+		Network:               "tcp",
+		Address:               "localhost:" + strconv.Itoa(port),
+		RequestPath:           requestPath,
+		DependencyAggregation: dependencyAggregation,
+	}
+	if socketPath != "" {
+		p.Network, p.Address = "unix", socketPath
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	p.HttpClient = &http.Client{
+		CheckRedirect: noRedirect,
+		Timeout:       timeout,
+		Transport: &http.Transport{
+			// the host of the request url is ignored, the aggregator is
+			// always dialed at its configured address
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, p.Network, p.Address)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	return p
+}
+
+func (p *AggregatorHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unknown
+
+	req, err := http.NewRequest("GET", "http://localhost"+p.RequestPath, nil)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureConnection
+		return probeResponse, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", defaultUserAgent)
+	resp, err := p.HttpClient.Do(req)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, err
+	}
+	defer resp.Body.Close()
+	probeResponse.ProbeDetails.StatusCode = resp.StatusCode
+
+	b, err := ioutil.ReadAll(newSizeLimitedReader(resp.Body, maxAggregatorResponseSizeInBytes))
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureBadBody
+		return probeResponse, err
+	}
+
+	// aggregators commonly answer 503 when a check fails, the checks of the
+	// body are reported whatever the status code
+	var aggregated aggregatorResponse
+	if err := json.Unmarshal(b, &aggregated); err != nil || len(aggregated.Checks) == 0 {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			probeResponse.ProbeDetails.Failure = probeFailureBadStatus
+			probeResponse.ProbeDetails.BodyExcerpt = bodyExcerpt(b)
+			return probeResponse, errors.New(fmt.Sprintf("Unsuccessful response status code %v", resp.StatusCode))
+		}
+		probeResponse.ProbeDetails.Failure = probeFailureBadBody
+		if err == nil {
+			err = errors.New("Response body of the aggregator does not contain any 'checks'")
+		}
+		return probeResponse, withBodyExcerpt(err, b)
+	}
+
+	probeResponse.Dependencies = aggregated.Checks
+	probeResponse.normalizeDependencies()
+	probeResponse.ApplicationHealthState = probeResponse.dependenciesState(p.DependencyAggregation)
+	return probeResponse, nil
+}
+
+func (p *AggregatorHealthProbe) address() string {
+	return p.Address + p.RequestPath
+}
+
+func (p *AggregatorHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unknown
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func serveAggregator(l net.Listener) {
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/checks":
+			w.Write([]byte(`{"checks": [{"name": "disk", "state": "healthy"}, {"name": "ntp", "state": "Unhealthy", "detail": "clock skew 3s", "optional": true}]}`))
+		case "/failing":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"checks": [{"name": "disk", "state": "Unhealthy", "detail": "disk full"}]}`))
+		case "/empty":
+			w.Write([]byte(`{"checks": []}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("internal error"))
+		}
+	}))
+}
+
+func TestAggregatorHealthProbe_evaluate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	serveAggregator(l)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewAggregatorHealthProbe("", l.Addr().(*net.TCPAddr).Port, "", dependencyAggregationIgnoreOptional, 5*time.Second)
+	require.Equal(t, "/checks", probe.RequestPath)
+	probe.Address = l.Addr().String()
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, []ProbeDependency{
+		{Name: "disk", State: Healthy},
+		{Name: "ntp", State: Unhealthy, Detail: "clock skew 3s", Optional: true},
+	}, probeResponse.Dependencies)
+
+	probe.DependencyAggregation = "worstOf"
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	// the checks are reported along with an unsuccessful status code
+	probe.RequestPath = "/failing"
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, []ProbeDependency{{Name: "disk", State: Unhealthy, Detail: "disk full"}}, probeResponse.Dependencies)
+
+	probe.RequestPath = "/empty"
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not contain any 'checks'")
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureBadBody, probeResponse.ProbeDetails.Failure)
+
+	probe.RequestPath = "/unknown"
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, "Unsuccessful response status code 500", err.Error())
+	require.Equal(t, probeFailureBadStatus, probeResponse.ProbeDetails.Failure)
+	require.Equal(t, "internal error", probeResponse.ProbeDetails.BodyExcerpt)
+}
+
+func TestAggregatorHealthProbe_evaluate_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aggregator")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "health.sock")
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewAggregatorHealthProbe(socketPath, 0, "/checks", dependencyAggregationIgnoreOptional, 5*time.Second)
+	require.Equal(t, socketPath+"/checks", probe.address())
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+
+	l, err := net.Listen("unix", socketPath)
+	require.Nil(t, err)
+	defer l.Close()
+	serveAggregator(l)
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Len(t, probeResponse.Dependencies, 2)
+}
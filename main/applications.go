@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	aggregationWorstOf        = "worstOf"
+	aggregationWeighted       = "weighted"
+	aggregationRequiredSubset = "requiredSubset"
+
+	// maxConcurrentProbes bounds the number of probes evaluated at once.
+	maxConcurrentProbes = 8
+)
+
+// healthStatusSeverity orders the health states from best to worst for
+// aggregation purposes.
+var healthStatusSeverity = map[HealthStatus]int{
+	Empty:        0,
+	Healthy:      1,
+	Initializing: 2,
+	Unknown:      3,
+	Unhealthy:    4,
+}
+
+// applicationSettings describes one of several applications probed on the VM.
+// Besides its name and aggregation attributes, it accepts the same probe
+// settings as the top level of the public settings.
+type applicationSettings struct {
+	Name     string  `json:"name"`
+	Weight   float64 `json:"weight"`
+	Required bool    `json:"required"`
+	publicSettings
+}
+
+// application is a probed application along with the evaluation of its
+// health state over time.
+type application struct {
+	name      string
+	weight    float64
+	required  bool
+	ctx       *log.Context
+	probe     HealthProbe
+	evaluator *healthEvaluator
+
+	// failureStates overrides the health state of the probe failures.
+	failureStates map[probeFailure]HealthStatus
+
+	lastResponse   ProbeResponse
+	committedState HealthStatus
+
+	// lastProbeStart and lastProbeDuration time the last completed probe run.
+	lastProbeStart    time.Time
+	lastProbeDuration time.Duration
+
+	// inFlight receives the result of a probe which exceeded its deadline.
+	inFlight         chan probeResult
+	skippedRuns      int
+	deadlineExceeded int
+}
+
+// probeResult is the outcome of the evaluation of a probe, along with when the
+// evaluation started and how long it took.
+type probeResult struct {
+	probeResponse ProbeResponse
+	err           error
+	start         time.Time
+	duration      time.Duration
+}
+
+// newApplications creates the applications probed according to the settings.
+// Without 'applications' in the settings, a single unnamed application is
+// probed as configured by the top level settings.
+func newApplications(ctx *log.Context, cfg *handlerSettings, seqNum int) []*application {
+	var apps []*application
+	for _, a := range cfg.applications() {
+		appCtx := ctx
+		if a.Name != "" {
+			appCtx = ctx.With("application", a.Name)
+		}
+		appCfg := a.handlerSettings(cfg)
+		// the protected settings, such as the database password, are shared
+		appCfg.protectedSettings = cfg.protectedSettings
+		probe := NewHealthProbe(appCtx, &appCfg, seqNum)
+		apps = append(apps, &application{
+			name:      a.Name,
+			weight:    a.weight(),
+			required:  a.Required,
+			ctx:       appCtx,
+			probe:     probe,
+			evaluator: newHealthEvaluator(appCtx, probe, appCfg.numberOfProbes(), appCfg.gracePeriod()),
+
+			failureStates: appCfg.failureStates(),
+		})
+	}
+	return apps
+}
+
+// evaluate runs the probe of the application and updates its committed state.
+// A probe not completing within deadline is considered failed, and the runs
+// happening while it is still running are skipped. A zero deadline waits for
+// the probe to complete.
+func (a *application) evaluate(deadline time.Duration) {
+	result, ok := a.probeResult(deadline)
+	if !ok {
+		return
+	}
+	// the result of a late probe is timed from the run which started it
+	a.lastProbeStart, a.lastProbeDuration = result.start, result.duration
+	probeStats.record(a.name, result.probeResponse.ProbeDetails, a.lastProbeDuration)
+	if result.err != nil {
+		a.ctx.Log("error", result.err)
+	}
+	result.probeResponse.ApplicationHealthState = mapFailureState(a.failureStates, result.probeResponse)
+	a.lastResponse = result.probeResponse
+	a.committedState = a.evaluator.observe(a.ctx, result.probeResponse.ApplicationHealthState)
+}
+
+// probeResult returns the result of the probe run, or false when the run is
+// skipped because the probe of a previous run is still running.
+func (a *application) probeResult(deadline time.Duration) (probeResult, bool) {
+	if a.inFlight != nil {
+		select {
+		case result := <-a.inFlight:
+			a.inFlight = nil
+			return result, true
+		default:
+			a.skippedRuns++
+			a.ctx.Log("event", "Skipped probe run, the previous probe is still running")
+			return probeResult{}, false
+		}
+	}
+
+	start := time.Now()
+	if deadline == 0 {
+		probeResponse, err := a.probe.evaluate(a.ctx)
+		return probeResult{probeResponse, err, start, time.Since(start)}, true
+	}
+
+	results := make(chan probeResult, 1)
+	go func() {
+		probeResponse, err := a.probe.evaluate(a.ctx)
+		results <- probeResult{probeResponse, err, start, time.Since(start)}
+	}()
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		return result, true
+	case <-timer.C:
+		a.inFlight = results
+		a.deadlineExceeded++
+		var probeResponse ProbeResponse
+		probeResponse.ApplicationHealthState = a.probe.healthStatusAfterGracePeriodExpires()
+		probeResponse.ProbeDetails.Failure = probeFailureTimeout
+		return probeResult{probeResponse, errors.New(fmt.Sprintf("Probe did not complete within %v", deadline)), start, time.Since(start)}, true
+	}
+}
+
+// evaluateApplications evaluates the applications concurrently, at most
+// maxConcurrency at a time, so that a slow probe doesn't delay the others.
+func evaluateApplications(apps []*application, maxConcurrency int, deadline time.Duration) {
+	if len(apps) == 1 {
+		apps[0].evaluate(deadline)
+		return
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrency)
+	for _, app := range apps {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(app *application) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			app.evaluate(deadline)
+		}(app)
+	}
+	wg.Wait()
+}
+
+// substatus returns the named substatus reporting the application state.
+func (a *application) substatus() SubstatusItem {
+	return NewSubstatus(fmt.Sprintf("%s/%s", SubstatusKeyNameApplicationHealthState, a.name), a.committedState.GetStatusType(), string(a.committedState))
+}
+
+// gracePeriodSubstatus returns the substatus reporting the grace period of
+// the application, if any. Substatuses of named applications are suffixed
+// with the application name.
+func (a *application) gracePeriodSubstatus() (SubstatusItem, bool, error) {
+	name := SubstatusKeyNameGracePeriod
+	if a.name != "" {
+		name = fmt.Sprintf("%s/%s", SubstatusKeyNameGracePeriod, a.name)
+	}
+	return a.evaluator.gracePeriodSubstatus(name)
+}
+
+// pendingTransitionSubstatus returns the substatus reporting the progress of a
+// transition of the committed state of the application, if any. Substatuses
+// of named applications are suffixed with the application name.
+func (a *application) pendingTransitionSubstatus() (SubstatusItem, bool, error) {
+	name := SubstatusKeyNamePendingTransition
+	if a.name != "" {
+		name = fmt.Sprintf("%s/%s", SubstatusKeyNamePendingTransition, a.name)
+	}
+	return a.evaluator.pendingTransitionSubstatus(name)
+}
+
+// aggregateHealthStates computes the overall health state from the committed
+// states of the applications:
+//   - worstOf: the worst state of all applications
+//   - weighted: Healthy when the weight of healthy applications is at least
+//     healthyWeightThreshold of the total weight, otherwise the worst state
+//   - requiredSubset: the worst state of the required applications
+func aggregateHealthStates(apps []*application, aggregation string, healthyWeightThreshold float64) HealthStatus {
+	switch aggregation {
+	case aggregationWeighted:
+		if weightedScore(apps) >= healthyWeightThreshold {
+			return Healthy
+		}
+		return worstHealthState(apps)
+	case aggregationRequiredSubset:
+		var required []*application
+		for _, a := range apps {
+			if a.required {
+				required = append(required, a)
+			}
+		}
+		return worstHealthState(required)
+	default:
+		return worstHealthState(apps)
+	}
+}
+
+// weightedScore returns the fraction of the total weight of the applications
+// which is healthy.
+func weightedScore(apps []*application) float64 {
+	var healthyWeight, totalWeight float64
+	for _, a := range apps {
+		totalWeight += a.weight
+		if a.committedState == Healthy {
+			healthyWeight += a.weight
+		}
+	}
+	if totalWeight == 0 {
+		return 0
+	}
+	return healthyWeight / totalWeight
+}
+
+// degradedHealthState returns the health state of the weighted aggregation
+// when its weighted score is between the unhealthy and the healthy weight
+// thresholds: Healthy, the applications being degraded rather than
+// unhealthy. It returns false when the score is below the unhealthy threshold,
+// the aggregated state being the worst state of the applications.
+func degradedHealthState(apps []*application, unhealthyWeightThreshold float64) (HealthStatus, float64, bool) {
+	score := weightedScore(apps)
+	if unhealthyWeightThreshold == 0 || score < unhealthyWeightThreshold {
+		return Empty, score, false
+	}
+	return Healthy, score, true
+}
+
+func worstHealthState(apps []*application) HealthStatus {
+	worst := Empty
+	for _, a := range apps {
+		if healthStatusSeverity[a.committedState] > healthStatusSeverity[worst] {
+			worst = a.committedState
+		}
+	}
+	return worst
+}
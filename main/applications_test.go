@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestApplication(committedState HealthStatus, weight float64, required bool) *application {
+	return &application{committedState: committedState, weight: weight, required: required}
+}
+
+func TestAggregateHealthStates_worstOf(t *testing.T) {
+	apps := []*application{
+		newTestApplication(Healthy, 1, false),
+		newTestApplication(Unknown, 1, false),
+		newTestApplication(Initializing, 1, false),
+	}
+	require.Equal(t, Unknown, aggregateHealthStates(apps, aggregationWorstOf, 0.5))
+
+	apps = append(apps, newTestApplication(Unhealthy, 1, false))
+	require.Equal(t, Unhealthy, aggregateHealthStates(apps, aggregationWorstOf, 0.5))
+
+	require.Equal(t, Healthy, aggregateHealthStates([]*application{newTestApplication(Healthy, 1, false)}, aggregationWorstOf, 0.5))
+}
+
+func TestAggregateHealthStates_weighted(t *testing.T) {
+	apps := []*application{
+		newTestApplication(Healthy, 3, false),
+		newTestApplication(Unhealthy, 1, false),
+	}
+	require.Equal(t, Healthy, aggregateHealthStates(apps, aggregationWeighted, 0.75))
+	require.Equal(t, Unhealthy, aggregateHealthStates(apps, aggregationWeighted, 0.8))
+}
+
+func TestDegradedHealthState(t *testing.T) {
+	apps := []*application{
+		newTestApplication(Healthy, 3, false),
+		newTestApplication(Unhealthy, 1, false),
+	}
+	// without unhealthy threshold, there is no degraded state
+	_, _, ok := degradedHealthState(apps, 0)
+	require.False(t, ok)
+
+	state, score, ok := degradedHealthState(apps, 0.5)
+	require.True(t, ok)
+	require.Equal(t, Healthy, state)
+	require.Equal(t, 0.75, score)
+
+	_, score, ok = degradedHealthState(apps, 0.8)
+	require.False(t, ok)
+	require.Equal(t, 0.75, score)
+
+	require.Equal(t, 0.0, weightedScore(nil))
+}
+
+func TestAggregateHealthStates_requiredSubset(t *testing.T) {
+	apps := []*application{
+		newTestApplication(Healthy, 1, true),
+		newTestApplication(Unhealthy, 1, false),
+	}
+	require.Equal(t, Healthy, aggregateHealthStates(apps, aggregationRequiredSubset, 0.5))
+
+	apps[0].committedState = Initializing
+	require.Equal(t, Initializing, aggregateHealthStates(apps, aggregationRequiredSubset, 0.5))
+}
+
+func TestNewApplications_singleApplication(t *testing.T) {
+	ctx := log.NewContext(log.NewLogfmtLogger(os.Stdout))
+	cfg := handlerSettings{publicSettings: publicSettings{Protocol: "tcp", Port: 8080}}
+
+	apps := newApplications(ctx, &cfg, 0)
+	require.Len(t, apps, 1)
+	require.Equal(t, "", apps[0].name)
+	require.Equal(t, "localhost:8080", apps[0].probe.address())
+}
+
+func TestNewApplications_multipleApplications(t *testing.T) {
+	ctx := log.NewContext(log.NewLogfmtLogger(os.Stdout))
+	cfg := handlerSettings{publicSettings: publicSettings{
+		Applications: []applicationSettings{
+			{Name: "web", Weight: 2, publicSettings: publicSettings{Protocol: "http", Port: 8080, RequestPath: "health"}},
+			{Name: "db", Required: true, publicSettings: publicSettings{Protocol: "tcp", Port: 5432}},
+		},
+	}}
+
+	apps := newApplications(ctx, &cfg, 0)
+	require.Len(t, apps, 2)
+	require.Equal(t, "web", apps[0].name)
+	require.Equal(t, float64(2), apps[0].weight)
+	require.Equal(t, "http://localhost:8080/health", apps[0].probe.address())
+	require.Equal(t, "db", apps[1].name)
+	require.Equal(t, float64(1), apps[1].weight)
+	require.True(t, apps[1].required)
+
+	apps[1].committedState = Healthy
+	substatus := apps[1].substatus()
+	require.Equal(t, "ApplicationHealthState/db", substatus.Name)
+}
+
+func TestHealthEvaluator_observe(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	e := newHealthEvaluator(ctx, &TcpHealthProbe{}, 2, 0)
+
+	// first observation is committed right away
+	require.Equal(t, Healthy, e.observe(ctx, Healthy))
+	// a different state must be observed numberOfProbes consecutive times
+	require.Equal(t, Healthy, e.observe(ctx, Unhealthy))
+	require.Equal(t, Unhealthy, e.observe(ctx, Unhealthy))
+}
+
+func TestHealthEvaluator_observeDuringGracePeriod(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	e := newHealthEvaluator(ctx, &TcpHealthProbe{}, 2, time.Hour)
+
+	require.Equal(t, Initializing, e.observe(ctx, Healthy))
+	require.Equal(t, Healthy, e.observe(ctx, Healthy))
+	require.False(t, e.honorGracePeriod)
+}
+
+func TestHealthEvaluator_gracePeriodClockJump(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	c := newFakeClock()
+	e := newHealthEvaluator(ctx, &TcpHealthProbe{}, 2, time.Minute)
+	e.clock, e.gracePeriodStart = c, c.monotonic()
+
+	// stepping the wall clock forward doesn't expire the grace period
+	c.step(time.Hour)
+	require.Equal(t, Initializing, e.observe(ctx, Initializing))
+	require.True(t, e.honorGracePeriod)
+
+	// nor does stepping it backward extend it
+	c.step(-2 * time.Hour)
+	c.advance(time.Minute)
+	require.Equal(t, Unhealthy, e.observe(ctx, Initializing))
+	require.False(t, e.honorGracePeriod)
+
+	// the expiry is reported at the wall clock time
+	require.Equal(t, c.now(), e.gracePeriodExpiredAt)
+}
+
+func TestHealthEvaluator_gracePeriodSubstatus(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+
+	e := newHealthEvaluator(ctx, &TcpHealthProbe{}, 2, time.Hour)
+	e.observe(ctx, Unhealthy)
+	substatus, ok, err := e.gracePeriodSubstatus(SubstatusKeyNameGracePeriod)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, StatusTransitioning, substatus.Status)
+	require.Contains(t, []string{`{"state":"active","remainingInSeconds":3599}`, `{"state":"active","remainingInSeconds":3600}`}, substatus.FormattedMessage.Message)
+
+	// ended with consecutive valid probes
+	e.observe(ctx, Unhealthy)
+	e.observe(ctx, Healthy)
+	e.observe(ctx, Healthy)
+	_, ok, err = e.gracePeriodSubstatus(SubstatusKeyNameGracePeriod)
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// expired
+	e = newHealthEvaluator(ctx, &TcpHealthProbe{}, 2, time.Nanosecond)
+	require.Equal(t, Unhealthy, e.observe(ctx, Initializing))
+	substatus, ok, err = e.gracePeriodSubstatus("GracePeriod/web")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "GracePeriod/web", substatus.Name)
+	require.Equal(t, StatusWarning, substatus.Status)
+	require.Contains(t, substatus.FormattedMessage.Message, `"state":"expired"`)
+	require.Contains(t, substatus.FormattedMessage.Message, `"healthState":"Unhealthy"`)
+}
+
+func TestHealthEvaluator_pendingTransitionSubstatus(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	e := newHealthEvaluator(ctx, &TcpHealthProbe{}, 3, 0)
+	require.Equal(t, Healthy, e.observe(ctx, Healthy))
+	_, ok, err := e.pendingTransitionSubstatus(SubstatusKeyNamePendingTransition)
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// building up to the transition
+	for observed := 1; observed < 3; observed++ {
+		require.Equal(t, Healthy, e.observe(ctx, Unhealthy))
+		substatus, ok, err := e.pendingTransitionSubstatus("PendingTransition/web")
+		require.Nil(t, err)
+		require.True(t, ok)
+		require.Equal(t, "PendingTransition/web", substatus.Name)
+		require.Equal(t, StatusTransitioning, substatus.Status)
+		require.Equal(t, fmt.Sprintf(`{"committedState":"Healthy","candidateState":"Unhealthy","observed":%d,"required":3}`, observed), substatus.FormattedMessage.Message)
+	}
+
+	// committed
+	require.Equal(t, Unhealthy, e.observe(ctx, Unhealthy))
+	_, ok, err = e.pendingTransitionSubstatus(SubstatusKeyNamePendingTransition)
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// the committed state observed again
+	require.Equal(t, Unhealthy, e.observe(ctx, Healthy))
+	require.Equal(t, Unhealthy, e.observe(ctx, Unhealthy))
+	_, ok, err = e.pendingTransitionSubstatus(SubstatusKeyNamePendingTransition)
+	require.Nil(t, err)
+	require.False(t, ok)
+}
+
+func TestNewApplications_gracePeriodPerApplication(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	cfg := handlerSettings{publicSettings: publicSettings{
+		Applications: []applicationSettings{
+			{Name: "web", publicSettings: publicSettings{Protocol: "tcp", Port: 8080, GracePeriod: seconds(600)}},
+			{Name: "db", publicSettings: publicSettings{Protocol: "tcp", Port: 5432}},
+		},
+	}}
+
+	apps := newApplications(ctx, &cfg, 0)
+	require.Equal(t, 600*time.Second, apps[0].evaluator.gracePeriod)
+	require.Equal(t, 5*time.Second, apps[1].evaluator.gracePeriod)
+
+	substatus, ok, err := apps[0].gracePeriodSubstatus()
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "GracePeriod/web", substatus.Name)
+}
+
+// slowProbe is a probe taking delay to evaluate, which records the number of
+// probes being evaluated concurrently.
+type slowProbe struct {
+	delay         time.Duration
+	mu            *sync.Mutex
+	running       *int
+	maxConcurrent *int
+}
+
+func (p slowProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	p.mu.Lock()
+	*p.running++
+	if *p.running > *p.maxConcurrent {
+		*p.maxConcurrent = *p.running
+	}
+	p.mu.Unlock()
+
+	time.Sleep(p.delay)
+
+	p.mu.Lock()
+	*p.running--
+	p.mu.Unlock()
+	return ProbeResponse{ApplicationHealthState: Healthy}, nil
+}
+
+func (p slowProbe) address() string {
+	return "slow"
+}
+
+func (p slowProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unknown
+}
+
+func TestEvaluateApplications_concurrently(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	var (
+		mu                     sync.Mutex
+		running, maxConcurrent int
+	)
+	var apps []*application
+	for i := 0; i < 4; i++ {
+		probe := slowProbe{delay: 100 * time.Millisecond, mu: &mu, running: &running, maxConcurrent: &maxConcurrent}
+		apps = append(apps, &application{ctx: ctx, probe: probe, evaluator: newHealthEvaluator(ctx, probe, 1, 0)})
+	}
+
+	start := time.Now()
+	evaluateApplications(apps, 2, 0)
+	elapsed := time.Since(start)
+
+	require.Equal(t, 2, maxConcurrent)
+	require.True(t, elapsed >= 200*time.Millisecond, "elapsed %v", elapsed)
+	require.True(t, elapsed < 400*time.Millisecond, "elapsed %v", elapsed)
+	for _, app := range apps {
+		require.Equal(t, Healthy, app.committedState)
+	}
+}
+
+// blockingProbe is a Healthy probe which completes once released.
+type blockingProbe struct {
+	release chan struct{}
+}
+
+func (p blockingProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	<-p.release
+	return ProbeResponse{ApplicationHealthState: Healthy}, nil
+}
+
+func (p blockingProbe) address() string {
+	return "blocking"
+}
+
+func (p blockingProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
+
+func TestApplicationEvaluate_deadline(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	probe := blockingProbe{release: make(chan struct{})}
+	app := &application{ctx: ctx, probe: probe, evaluator: newHealthEvaluator(ctx, probe, 1, 0)}
+
+	// a probe exceeding its deadline is considered failed
+	app.evaluate(10 * time.Millisecond)
+	require.Equal(t, Unhealthy, app.committedState)
+	require.Equal(t, 1, app.deadlineExceeded)
+	lateStart := app.lastProbeStart
+
+	// runs are skipped while the probe is still running
+	app.evaluate(10 * time.Millisecond)
+	require.Equal(t, 1, app.skippedRuns)
+	require.Equal(t, Unhealthy, app.committedState)
+
+	// the result of the late probe is used once available, timed from the
+	// run which started it
+	time.Sleep(10 * time.Millisecond)
+	close(probe.release)
+	time.Sleep(10 * time.Millisecond)
+	app.evaluate(10 * time.Millisecond)
+	require.Equal(t, Healthy, app.committedState)
+	require.Nil(t, app.inFlight)
+	require.Equal(t, lateStart, app.lastProbeStart)
+	require.True(t, app.lastProbeDuration >= 20*time.Millisecond, "duration %v", app.lastProbeDuration)
+
+	app.evaluate(10 * time.Millisecond)
+	require.Equal(t, Healthy, app.committedState)
+	require.Equal(t, 1, app.deadlineExceeded)
+	require.Equal(t, 1, app.skippedRuns)
+}
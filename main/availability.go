@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	availabilityRetention       = 24 * time.Hour
+	availabilityLoggingInterval = time.Hour
+)
+
+// statePeriod is a period of time during which the committed health state
+// did not change, between two monotonic times.
+type statePeriod struct {
+	state HealthStatus
+	start time.Duration
+	end   time.Duration
+}
+
+// availabilityMetrics are the availability figures reported in the
+// 'Availability' substatus. Availabilities are percentages of the time the
+// application was observed Healthy, excluding the time it was Initializing.
+type availabilityMetrics struct {
+	AvailabilityLastHour        *float64 `json:"availabilityLastHour,omitempty"`
+	AvailabilityLastDay         *float64 `json:"availabilityLastDay,omitempty"`
+	UnhealthyEpisodesLastDay    int      `json:"unhealthyEpisodesLastDay"`
+	MeanTimeToRecoveryInSeconds *float64 `json:"meanTimeToRecoveryInSeconds,omitempty"`
+}
+
+// availabilityTracker keeps the history of the committed health state over
+// the last day to compute rolling availability metrics.
+type availabilityTracker struct {
+	periods    []statePeriod
+	lastLogged time.Duration
+
+	// clock measures the time in each state on its monotonic time, replaced
+	// in tests.
+	clock clock
+}
+
+func newAvailabilityTracker() *availabilityTracker {
+	return &availabilityTracker{clock: systemClock{}}
+}
+
+// record adds the committed state observed at the current time to the
+// history. The end of an unhealthy episode and, periodically, the
+// availability metrics are logged as events.
+func (a *availabilityTracker) record(ctx *log.Context, state HealthStatus) {
+	t := a.clock.monotonic()
+	if len(a.periods) == 0 {
+		a.lastLogged = t
+	}
+	if n := len(a.periods); n > 0 && a.periods[n-1].state == state {
+		a.periods[n-1].end = t
+	} else {
+		if n > 0 {
+			last := &a.periods[n-1]
+			last.end = t
+			if last.state == Unhealthy {
+				ctx.Log("event", fmt.Sprintf("Recovered from unhealthy state after %v", t-last.start))
+			}
+		}
+		a.periods = append(a.periods, statePeriod{state: state, start: t, end: t})
+	}
+
+	// drop the periods which ended before the retention window
+	i := 0
+	for i < len(a.periods)-1 && a.periods[i].end < t-availabilityRetention {
+		i++
+	}
+	a.periods = a.periods[i:]
+
+	if t-a.lastLogged >= availabilityLoggingInterval {
+		a.lastLogged = t
+		if b, err := json.Marshal(a.metrics()); err == nil {
+			ctx.Log("event", "Availability", "metrics", string(b))
+		}
+	}
+}
+
+// availability returns the percentage of the observed time within the window
+// during which the application was healthy.
+func (a *availabilityTracker) availability(window time.Duration) (float64, bool) {
+	from := a.clock.monotonic() - window
+	var healthy, observed time.Duration
+	for _, p := range a.periods {
+		if p.state == Empty || p.state == Initializing || p.end <= from {
+			continue
+		}
+		start := p.start
+		if start < from {
+			start = from
+		}
+		d := p.end - start
+		observed += d
+		if p.state == Healthy {
+			healthy += d
+		}
+	}
+	if observed == 0 {
+		return 0, false
+	}
+	return float64(healthy) / float64(observed) * 100, true
+}
+
+// metrics computes the availability metrics from the history.
+func (a *availabilityTracker) metrics() availabilityMetrics {
+	var m availabilityMetrics
+	if v, ok := a.availability(time.Hour); ok {
+		m.AvailabilityLastHour = roundedPercentage(v)
+	}
+	if v, ok := a.availability(availabilityRetention); ok {
+		m.AvailabilityLastDay = roundedPercentage(v)
+	}
+
+	// an unhealthy episode is over when it is followed by another state
+	var totalRecovery time.Duration
+	for i := 0; i < len(a.periods)-1; i++ {
+		if a.periods[i].state == Unhealthy {
+			m.UnhealthyEpisodesLastDay++
+			totalRecovery += a.periods[i].end - a.periods[i].start
+		}
+	}
+	if m.UnhealthyEpisodesLastDay > 0 {
+		mttr := math.Round((totalRecovery / time.Duration(m.UnhealthyEpisodesLastDay)).Seconds())
+		m.MeanTimeToRecoveryInSeconds = &mttr
+	}
+	return m
+}
+
+// substatus returns the substatus reporting the availability metrics.
+func (a *availabilityTracker) substatus() (SubstatusItem, error) {
+	b, err := json.Marshal(a.metrics())
+	if err != nil {
+		return SubstatusItem{}, err
+	}
+	return NewSubstatus(SubstatusKeyNameAvailability, StatusSuccess, string(b)), nil
+}
+
+func roundedPercentage(v float64) *float64 {
+	r := math.Round(v*100) / 100
+	return &r
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// recordStates records each state for the given duration on the fake clock
+// of the tracker.
+func recordStates(a *availabilityTracker, states []HealthStatus, duration time.Duration) {
+	ctx := log.NewContext(log.NewNopLogger())
+	c := a.clock.(*fakeClock)
+	for i, state := range states {
+		if i > 0 {
+			c.advance(duration)
+		}
+		a.record(ctx, state)
+	}
+}
+
+func newTestAvailabilityTracker() (*availabilityTracker, *fakeClock) {
+	a := newAvailabilityTracker()
+	c := newFakeClock()
+	a.clock = c
+	return a, c
+}
+
+func TestAvailabilityTracker_noObservation(t *testing.T) {
+	a := newAvailabilityTracker()
+	a.record(log.NewContext(log.NewNopLogger()), Initializing)
+
+	m := a.metrics()
+	require.Nil(t, m.AvailabilityLastHour)
+	require.Nil(t, m.AvailabilityLastDay)
+	require.Equal(t, 0, m.UnhealthyEpisodesLastDay)
+	require.Nil(t, m.MeanTimeToRecoveryInSeconds)
+}
+
+func TestAvailabilityTracker_metrics(t *testing.T) {
+	a, _ := newTestAvailabilityTracker()
+
+	// 10 minutes initializing, 30 healthy, 10 unhealthy, 10 healthy, 20 unhealthy, then healthy
+	var states []HealthStatus
+	for _, s := range []struct {
+		state   HealthStatus
+		minutes int
+	}{{Initializing, 10}, {Healthy, 30}, {Unhealthy, 10}, {Healthy, 10}, {Unhealthy, 20}, {Healthy, 1}} {
+		for i := 0; i < s.minutes; i++ {
+			states = append(states, s.state)
+		}
+	}
+	recordStates(a, states, time.Minute)
+
+	m := a.metrics()
+	// 70 minutes observed (10 initializing excluded), 40 healthy
+	require.Equal(t, 57.14, *m.AvailabilityLastDay)
+	require.Equal(t, 2, m.UnhealthyEpisodesLastDay)
+	require.Equal(t, float64(15*60), *m.MeanTimeToRecoveryInSeconds)
+
+	// the last hour starts 10 minutes after the end of the grace period
+	require.Equal(t, 50.0, *m.AvailabilityLastHour)
+
+	substatus, err := a.substatus()
+	require.Nil(t, err)
+	require.Equal(t, SubstatusKeyNameAvailability, substatus.Name)
+	require.Equal(t, `{"availabilityLastHour":50,"availabilityLastDay":57.14,"unhealthyEpisodesLastDay":2,"meanTimeToRecoveryInSeconds":900}`, substatus.FormattedMessage.Message)
+}
+
+func TestAvailabilityTracker_retention(t *testing.T) {
+	a, c := newTestAvailabilityTracker()
+
+	recordStates(a, []HealthStatus{Unhealthy, Unhealthy, Healthy}, time.Hour)
+	c.advance(26 * time.Hour)
+	recordStates(a, []HealthStatus{Healthy}, time.Hour)
+
+	m := a.metrics()
+	require.Equal(t, 0, m.UnhealthyEpisodesLastDay)
+	require.Equal(t, 100.0, *m.AvailabilityLastDay)
+	require.Len(t, a.periods, 1)
+}
+
+func TestAvailabilityTracker_clockJump(t *testing.T) {
+	a, c := newTestAvailabilityTracker()
+
+	recordStates(a, []HealthStatus{Healthy, Healthy}, 30*time.Minute)
+	c.step(-time.Hour)
+	recordStates(a, []HealthStatus{Unhealthy}, 0)
+	c.advance(10 * time.Minute)
+	c.step(48 * time.Hour)
+	recordStates(a, []HealthStatus{Healthy}, 0)
+
+	// the history is not dropped by the forward step and the unhealthy
+	// episode lasted the 10 minutes elapsed
+	m := a.metrics()
+	require.Equal(t, 1, m.UnhealthyEpisodesLastDay)
+	require.Equal(t, float64(10*60), *m.MeanTimeToRecoveryInSeconds)
+	require.Equal(t, 75.0, *m.AvailabilityLastDay)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// CircuitBreakerHealthProbe stops probing an application whose probes
+// consistently time out, so that the health checker doesn't add load to an
+// overloaded application. After Threshold consecutive timeouts, the circuit
+// opens: the last response is reported without probing for Cooldown. Then a
+// single trial probe is made (half-open): the circuit closes if it doesn't
+// time out and opens again otherwise.
+type CircuitBreakerHealthProbe struct {
+	Probe     HealthProbe
+	Threshold int
+	Cooldown  time.Duration
+
+	consecutiveTimeouts int
+	// openUntil is the monotonic time at which the circuit becomes half-open,
+	// zero while the circuit is closed.
+	openUntil    time.Duration
+	lastResponse ProbeResponse
+
+	// clock measures the cooldown on its monotonic time, replaced in tests.
+	clock clock
+}
+
+func NewCircuitBreakerHealthProbe(probe HealthProbe, threshold int, cooldown time.Duration) *CircuitBreakerHealthProbe {
+	return &CircuitBreakerHealthProbe{
+		Probe:     probe,
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		clock:     systemClock{},
+	}
+}
+
+func (p *CircuitBreakerHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	if p.openUntil != 0 && p.clock.monotonic() < p.openUntil {
+		return p.lastResponse, nil
+	}
+	halfOpen := p.openUntil != 0
+
+	probeResponse, err := p.Probe.evaluate(ctx)
+	if err == nil || !isTimeout(err) {
+		if halfOpen {
+			ctx.Log("event", "Circuit closed, trial probe did not time out")
+		}
+		p.consecutiveTimeouts, p.openUntil = 0, 0
+		return probeResponse, err
+	}
+
+	p.consecutiveTimeouts++
+	p.lastResponse = probeResponse
+	if halfOpen || p.consecutiveTimeouts >= p.Threshold {
+		p.openUntil = p.clock.monotonic() + p.Cooldown
+		ctx.Log("event", fmt.Sprintf("Circuit opened after %d consecutive probe timeouts, probing again in %v", p.consecutiveTimeouts, p.Cooldown))
+	}
+	return probeResponse, err
+}
+
+func (p *CircuitBreakerHealthProbe) address() string {
+	return p.Probe.address()
+}
+
+func (p *CircuitBreakerHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return p.Probe.healthStatusAfterGracePeriodExpires()
+}
+
+// isTimeout reports whether err is caused by a timeout.
+func isTimeout(err error) bool {
+	netErr, ok := errors.Cause(err).(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// scriptedProbe returns the given errors in sequence, responding Unknown on
+// errors and Healthy otherwise.
+type scriptedProbe struct {
+	errs        []error
+	evaluations int
+}
+
+func (p *scriptedProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	err := p.errs[p.evaluations]
+	p.evaluations++
+	if err != nil {
+		return ProbeResponse{ApplicationHealthState: Unknown}, err
+	}
+	return ProbeResponse{ApplicationHealthState: Healthy}, nil
+}
+
+func (p *scriptedProbe) address() string {
+	return "scripted"
+}
+
+func (p *scriptedProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unknown
+}
+
+func TestCircuitBreakerHealthProbe(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	timeout := errors.Wrap(timeoutError{}, "failed to probe")
+	inner := &scriptedProbe{errs: []error{timeout, errors.New("refused"), timeout, timeout, timeout, nil}}
+	p := NewCircuitBreakerHealthProbe(inner, 2, time.Minute)
+	c := newFakeClock()
+	p.clock = c
+
+	// a failure other than a timeout resets the count
+	_, err := p.evaluate(ctx)
+	require.Equal(t, timeout, err)
+	_, err = p.evaluate(ctx)
+	require.EqualError(t, err, "refused")
+	_, err = p.evaluate(ctx)
+	require.Equal(t, timeout, err)
+	require.Zero(t, p.openUntil)
+
+	// opens after 2 consecutive timeouts
+	_, err = p.evaluate(ctx)
+	require.Equal(t, timeout, err)
+	require.Equal(t, c.monotonic()+time.Minute, p.openUntil)
+
+	// reports the last response without probing while open
+	c.advance(30 * time.Second)
+	r, err := p.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Unknown, r.ApplicationHealthState)
+	require.Equal(t, 4, inner.evaluations)
+
+	// a timing out trial probe opens it again
+	c.advance(30 * time.Second)
+	_, err = p.evaluate(ctx)
+	require.Equal(t, timeout, err)
+	require.Equal(t, c.monotonic()+time.Minute, p.openUntil)
+
+	// a successful trial probe closes it
+	c.advance(time.Minute)
+	r, err = p.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, r.ApplicationHealthState)
+	require.Zero(t, p.openUntil)
+	require.Equal(t, 0, p.consecutiveTimeouts)
+}
+
+func TestCircuitBreakerHealthProbe_clockJump(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	timeout := errors.Wrap(timeoutError{}, "failed to probe")
+	inner := &scriptedProbe{errs: []error{timeout, nil}}
+	p := NewCircuitBreakerHealthProbe(inner, 1, time.Minute)
+	c := newFakeClock()
+	p.clock = c
+
+	_, err := p.evaluate(ctx)
+	require.Equal(t, timeout, err)
+
+	// stepping the wall clock forward doesn't end the cooldown
+	c.step(time.Hour)
+	_, err = p.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, inner.evaluations)
+
+	// nor does stepping it backward extend it
+	c.step(-2 * time.Hour)
+	c.advance(time.Minute)
+	_, err = p.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 2, inner.evaluations)
+	require.Zero(t, p.openUntil)
+}
+
+func TestIsTimeout(t *testing.T) {
+	require.True(t, isTimeout(timeoutError{}))
+	require.True(t, isTimeout(errors.Wrap(timeoutError{}, "wrapped")))
+	require.False(t, isTimeout(errors.New("refused")))
+	require.False(t, isTimeout(&net.OpError{Op: "dial", Err: errors.New("refused")}))
+}
+
+func TestNewHealthProbe_circuitBreaker(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	cfg := handlerSettings{publicSettings: publicSettings{Protocol: "tcp", Port: 80, CircuitBreakerTimeouts: 3}}
+	p, ok := NewHealthProbe(ctx, &cfg, 0).(*CircuitBreakerHealthProbe)
+	require.True(t, ok)
+	require.Equal(t, 3, p.Threshold)
+	require.Equal(t, time.Minute, p.Cooldown)
+	require.IsType(t, &TcpHealthProbe{}, p.Probe)
+}
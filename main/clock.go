@@ -0,0 +1,30 @@
+package main
+
+import "time"
+
+// clock provides the wall clock time, for timestamps, and the monotonic clock
+// time, for durations. Durations must not be computed from wall clock times,
+// which jump when the clock is stepped (e.g. by chrony, or when the VM is
+// resumed), as grace periods and windows would then expire early or never.
+type clock interface {
+	// now returns the wall clock time.
+	now() time.Time
+	// monotonic returns the time elapsed since an arbitrary origin, which
+	// only increases at the rate of real time.
+	monotonic() time.Duration
+}
+
+// processStart is the origin of the monotonic time of systemClock.
+var processStart = time.Now()
+
+// systemClock is the clock of the system. Its monotonic time is measured with
+// the monotonic clock reading of time.Time values, which time.Since uses.
+type systemClock struct{}
+
+func (systemClock) now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) monotonic() time.Duration {
+	return time.Since(processStart)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock whose time only changes when advanced, and whose wall
+// clock can be stepped without affecting its monotonic time.
+type fakeClock struct {
+	wall time.Time
+	mono time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{wall: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), mono: time.Hour}
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.wall
+}
+
+func (c *fakeClock) monotonic() time.Duration {
+	return c.mono
+}
+
+// advance makes d elapse.
+func (c *fakeClock) advance(d time.Duration) {
+	c.wall = c.wall.Add(d)
+	c.mono += d
+}
+
+// step steps the wall clock by d, as a time synchronization daemon would.
+func (c *fakeClock) step(d time.Duration) {
+	c.wall = c.wall.Add(d)
+}
+
+func TestSystemClock(t *testing.T) {
+	c := systemClock{}
+	start := c.monotonic()
+	time.Sleep(10 * time.Millisecond)
+	require.True(t, c.monotonic()-start >= 10*time.Millisecond)
+	require.WithinDuration(t, time.Now(), c.now(), time.Second)
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
-	"strings"
+	"syscall"
 	"time"
 
-	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
-type cmdFunc func(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int) (msg string, err error)
+type cmdFunc func(ctx *log.Context, paths handlerPaths, seqNum int) (msg string, err error)
 type preFunc func(ctx *log.Context, seqNum int) error
 
 type cmd struct {
@@ -40,26 +40,26 @@ var (
 	}
 )
 
-func noop(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, error) {
+func noop(ctx *log.Context, paths handlerPaths, seqNum int) (string, error) {
 	ctx.Log("event", "noop")
 	return "", nil
 }
 
-func install(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, error) {
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+func install(ctx *log.Context, paths handlerPaths, seqNum int) (string, error) {
+	if err := os.MkdirAll(paths.dataFolder(), 0755); err != nil {
 		return "", errors.Wrap(err, "failed to create data dir")
 	}
 
-	ctx.Log("event", "created data dir", "path", dataDir)
+	ctx.Log("event", "created data dir", "path", paths.dataFolder())
 	ctx.Log("event", "installed")
 	return "", nil
 }
 
-func uninstall(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, error) {
+func uninstall(ctx *log.Context, paths handlerPaths, seqNum int) (string, error) {
 	{ // a new context scope with path
-		ctx = ctx.With("path", dataDir)
-		ctx.Log("event", "removing data dir", "path", dataDir)
-		if err := os.RemoveAll(dataDir); err != nil {
+		ctx = ctx.With("path", paths.dataFolder())
+		ctx.Log("event", "removing data dir", "path", paths.dataFolder())
+		if err := os.RemoveAll(paths.dataFolder()); err != nil {
 			return "", errors.Wrap(err, "failed to delete data dir")
 		}
 		ctx.Log("event", "removed data dir")
@@ -70,129 +70,422 @@ func uninstall(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (
 
 const (
 	statusMessage = "Successfully polling for application health"
+
+	unhealthyStatusMessageFormat = "Application unhealthy for %v"
+	degradedStatusMessageFormat  = "Application degraded, weighted health score %.2f"
+	loopbackStatusMessage        = "Probes failed because the loopback networking of the VM is broken, the application may not be down"
+	healthProbeDisabledMessage   = "Health monitoring disabled"
 )
 
 var (
 	errTerminated = errors.New("Application health process terminated")
 )
 
-func enable(ctx *log.Context, h vmextension.HandlerEnvironment, seqNum int) (string, error) {
+func enable(ctx *log.Context, paths handlerPaths, seqNum int) (string, error) {
 	// parse the extension handler settings (not available prior to 'enable')
-	cfg, err := parseAndValidateSettings(ctx, h.HandlerEnvironment.ConfigFolder)
+	cfg, err := parseAndValidateSettings(ctx, paths.configFolder())
 	if err != nil {
 		return "", errors.Wrap(err, "failed to get configuration")
 	}
 
-	probe := NewHealthProbe(ctx, &cfg)
-	var (
-		intervalBetweenProbesInMs = time.Duration(cfg.intervalInSeconds()) * time.Millisecond * 1000
-		numberOfProbes            = cfg.numberOfProbes()
-		gracePeriodInSeconds      = time.Duration(cfg.gracePeriod()) * time.Second
-		numConsecutiveProbes      = 0
-		prevState                 = Empty
-		committedState            = Empty
-		honorGracePeriod          = gracePeriodInSeconds > 0
-		gracePeriodStartTime      = time.Now()
-	)
+	if identity := cfg.identity(); len(identity) > 0 {
+		ctx = ctx.With(identity...)
+	}
 
-	if !honorGracePeriod {
-		ctx.Log("event", "Grace period not set")
-	} else {
-		ctx.Log("event", fmt.Sprintf("Grace period set to %v", gracePeriodInSeconds))
-	}
-	// The committed health status (the state written to the status file) initially does not have a state
-	// In order to change the state in the status file, the following must be observed:
-	//  1. Healthy status observed once when committed state is unknown
-	//  2. A different status is observed numberOfProbes consecutive times
-	// Example: Committed state = healthy, numberOfProbes = 3
-	// In order to change committed state to unhealthy, the probe needs to be unhealthy 3 consecutive times
-	//
-	// The committed health state will remain in 'Initializing' state until any of the following occurs:
-	//	1. Grace period expires, then application will either be Unknown/Unhealthy depending on probe type
-	//	2. A valid health state is observed numberOfProbes consecutive times
-	for {
-		startTime := time.Now()
-		probeResponse, err := probe.evaluate(ctx)
-		state := probeResponse.ApplicationHealthState
-		if err != nil {
+	if cfg.mirrorLogsToSyslog() {
+		if syslogLogger, err := newSyslogLogger(); err != nil {
 			ctx.Log("error", err)
+		} else {
+			eventLogger.setMirror(syslogLogger)
+			ctx.Log("event", "mirroring events to syslog", "tag", syslogTag)
 		}
+	}
 
-		if shutdown {
-			return "", errTerminated
+	if intervals := cfg.logDeduplication(); len(intervals) > 0 {
+		logDeduplicator.configure(intervals)
+		defer logDeduplicator.flush()
+	}
+
+	// the services are stopped, the last started first, once the prober stops
+	defer runningServices.stopAll(ctx)
+	if port := cfg.diagnosticsPort(); port != 0 {
+		if err := runningServices.start(ctx, &diagnosticsService{port: port}); err != nil {
+			ctx.Log("error", err)
 		}
+	}
 
-		// Only increment if it's a repeat of the previous
-		if prevState == state {
-			numConsecutiveProbes++
-			// Log stage changes and also reset consecutive count to 1 as a new state was observed
-		} else {
-			ctx.Log("event", "Health state changed to "+strings.ToLower(string(state)))
-			numConsecutiveProbes = 1
-			prevState = state
+	if janitor := newEventsJanitor(ctx, cfg.eventsRetention(), paths.eventsFolder(), cfg.eventFilesFolder()); janitor != nil {
+		if err := runningServices.start(ctx, janitor); err != nil {
+			ctx.Log("error", err)
 		}
+	}
 
-		if honorGracePeriod {
-			timeElapsed := time.Now().Sub(gracePeriodStartTime)
-			// If grace period expires, application didn't initialize on time
-			if timeElapsed >= gracePeriodInSeconds {
-				ctx.Log("event", fmt.Sprintf("No longer honoring grace period - expired. Time elapsed = %v", timeElapsed))
-				honorGracePeriod = false
-				state = probe.healthStatusAfterGracePeriodExpires()
-				prevState = probe.healthStatusAfterGracePeriodExpires()
-				numConsecutiveProbes = 1
-				committedState = Empty
-				// If grace period has not expired, check if we have consecutive valid probes
-			} else if (numConsecutiveProbes == numberOfProbes) && (state != probe.healthStatusAfterGracePeriodExpires()) {
-				ctx.Log("event", fmt.Sprintf("No longer honoring grace period - successful probes. Time elapsed = %v", timeElapsed))
-				honorGracePeriod = false
-				// Application will be in Initializing state since we have not received consecutive valid health states
-			} else {
-				ctx.Log("event", fmt.Sprintf("Honoring grace period. Time elapsed = %v", timeElapsed))
-				state = Initializing
+	if cfg.healthProbeDisabled() {
+		return runWithoutHealthProbe(ctx, paths, seqNum)
+	}
+
+	// report the self-test before the first probes, which may only find the
+	// application unhealthy once the grace period expired
+	selfTest := runSelfTest(paths, &cfg)
+	ctx.Log("event", "self-test", "ready", selfTest.Ready, "message", selfTest.message())
+	selfTestSubstatus, err := selfTest.substatus()
+	if err != nil {
+		ctx.Log("error", err)
+	} else if err := reportStatusWithSubstatuses(ctx, paths, seqNum, StatusTransitioning, "enable", selfTest.message(), []SubstatusItem{selfTestSubstatus}); err != nil {
+		ctx.Log("error", err)
+	}
+	listenerHint := noListenerHint("/proc", &cfg)
+	if listenerHint != "" {
+		ctx.Log("event", "probing a port with nothing listening", "hint", listenerHint)
+	}
+
+	intervalBetweenProbesInMs := cfg.interval()
+	apps := newApplications(ctx, &cfg, seqNum)
+	availability := newAvailabilityTracker()
+	telemetry := newTelemetryEmitter(&cfg, paths.eventsFolder())
+	if err := runningServices.start(ctx, telemetry); err != nil {
+		return "", err
+	}
+	exporter := newOtlpExporter(&cfg)
+	if exporter != nil {
+		if err := runningServices.start(ctx, exporter); err != nil {
+			return "", err
+		}
+	}
+	monitor := newResourceMonitor(&cfg, paths.dataFolder())
+	stateFile := newStateFileWriter(&cfg)
+	readiness := newReadinessGate(ctx, &cfg)
+	statusWriter := newStatusWriter(&cfg)
+
+	// the sinks of the probe results are notified through the bus
+	bus := newEventBus()
+	telemetry.subscribe(bus)
+	bus.subscribe(busEventStateTransition, func(ctx *log.Context, e busEvent) {
+		if err := appendTransition(paths.dataFolder(), e.Transition); err != nil {
+			ctx.Log("error", err)
+		}
+	})
+	if stateFile != nil {
+		stateFile.subscribe(bus)
+	}
+	if readiness != nil {
+		readiness.subscribe(bus)
+	}
+	if exporter != nil {
+		exporter.subscribe(bus)
+	}
+	bus.subscribe(busEventStatus, func(ctx *log.Context, e busEvent) {
+		latestStatus.set(e.Status)
+		if statusWriter.shouldWrite(e.Status) {
+			if err := statusWriter.write(ctx, e.Status, func(s StatusReport) error {
+				return writeStatus(ctx, paths, seqNum, s)
+			}); err != nil {
+				ctx.Log("error", err)
 			}
 		}
+	})
+
+	adaptive := newAdaptiveInterval(cfg.interval(), cfg.maxInterval())
+	debouncer := newStateDebouncer(time.Duration(cfg.minimumStateDurationInSeconds()) * time.Second)
+	// the templates are validated with the settings
+	messages, err := newStatusMessages(cfg.statusMessages())
+	if err != nil {
+		return "", err
+	}
+	clock := systemClock{}
+	scheduler := newProbeScheduler(intervalBetweenProbesInMs, clock)
+	signals, stopSignals := notifyOperatorSignals()
+	defer stopSignals()
+	var (
+		multipleApplications = cfg.multipleApplications()
+		unhealthy            bool
+		unhealthySince       time.Duration
+		prevCommittedState   = Empty
+		// outOfBand is set while running the probe cycle requested with SIGUSR1
+		outOfBand bool
+		// iterations counts the probe cycles, reported by the heartbeat
+		iterations int
+	)
+
+	prober := newLoopService("prober", func(stop <-chan struct{}) error {
+		for {
+			startTime, cycleStart := clock.monotonic(), clock.now()
+			// each probe must complete within the interval
+			evaluateApplications(apps, maxConcurrentProbes, intervalBetweenProbesInMs)
+			if shuttingDown() {
+				return errTerminated
+			}
+			iterations++
+
+			committedState := apps[0].committedState
+			degraded, score := false, 0.0
+			if multipleApplications {
+				committedState = aggregateHealthStates(apps, cfg.aggregation(), cfg.healthyWeightThreshold())
+				if committedState != Healthy && cfg.aggregation() == aggregationWeighted {
+					if state, s, ok := degradedHealthState(apps, cfg.unhealthyWeightThreshold()); ok {
+						committedState, degraded, score = state, true, s
+					}
+				}
+			}
+			if reported := debouncer.observe(ctx, committedState, clock.monotonic()); reported != committedState {
+				committedState, degraded = reported, false
+			}
+			availability.record(ctx, committedState)
+
+			bus.publish(ctx, busEvent{Kind: busEventProbeCycle, Start: cycleStart, End: clock.now(), CommittedState: committedState, Apps: apps})
+			if committedState != prevCommittedState {
+				bus.publish(ctx, busEvent{Kind: busEventStateTransition, Transition: stateTransition{Time: clock.now().UTC(), From: prevCommittedState, To: committedState}})
+				prevCommittedState = committedState
+			}
+
+			messageFields := newStatusMessageFields(&cfg, committedState, apps)
+			statusType, message := StatusSuccess, messages.message(statusMessagePolling, statusMessage, messageFields)
+			if degraded {
+				statusType, message = StatusWarning, fmt.Sprintf(degradedStatusMessageFormat, score)
+			}
+			for _, app := range apps {
+				if app.lastResponse.ProbeDetails.Failure == probeFailureLoopback {
+					statusType, message = StatusWarning, loopbackStatusMessage
+				}
+			}
+			if statusType == StatusSuccess && len(handlerEnvDegradation) > 0 {
+				statusType, message = StatusWarning, fmt.Sprintf(degradedEnvironmentStatusMessage, handlerEnvDegradation[0])
+			}
+			if committedState != Unhealthy {
+				unhealthy = false
+			} else if escalateAfter := time.Duration(cfg.escalateToErrorAfterMinutes()) * time.Minute; escalateAfter > 0 {
+				if !unhealthy {
+					unhealthy, unhealthySince = true, startTime
+				}
+				unhealthyFor := (clock.monotonic() - unhealthySince).Round(time.Second)
+				statusType, message = escalatedStatusType(unhealthyFor, escalateAfter), fmt.Sprintf(unhealthyStatusMessageFormat, unhealthyFor)
+			}
+
+			appHealthStatusMessage := messages.appHealthStatusMessage(messageFields)
+			if listenerHint != "" && committedState == Initializing {
+				// checked again until the application listens, so that the
+				// hint doesn't outlive its cause
+				if listenerHint = noListenerHint("/proc", &cfg); listenerHint != "" {
+					appHealthStatusMessage += " (" + listenerHint + ")"
+				}
+			}
+
+			substatuses := []SubstatusItem{
+				// For V2 of extension, to remain backwards compatible with HostGAPlugin and to have HealthStore signals
+				// decided by extension instead of taking a change in HostGAPlugin, first substatus will be dedicated
+				// for health store.
+				NewSubstatus(SubstatusKeyNameAppHealthStatus, committedState.GetStatusTypeForAppHealthStatus(), appHealthStatusMessage),
+				NewSubstatus(SubstatusKeyNameApplicationHealthState, committedState.GetStatusType(), string(committedState)),
+			}
 
-		if (numConsecutiveProbes == numberOfProbes) || (committedState == Empty) {
-			if state != committedState {
-				committedState = state
-				ctx.Log("event", fmt.Sprintf("Committed health state is %s", strings.ToLower(string(committedState))))
+			if name := cfg.applicationName(); name != "" {
+				substatuses = append(substatuses, applicationSubstatus(name, cfg.environment(), committedState))
 			}
-			// Only reset if we've observed consecutive probes in order to preserve previous observations when handling grace period
-			if numConsecutiveProbes == numberOfProbes {
-				numConsecutiveProbes = 0
+
+			if multipleApplications {
+				for _, app := range apps {
+					substatuses = append(substatuses, app.substatus())
+				}
+			} else {
+				substatuses = append(substatuses, probeResponseSubstatuses(ctx, apps[0].lastResponse)...)
+			}
+
+			for _, app := range apps {
+				if gracePeriodSubstatus, ok, err := app.gracePeriodSubstatus(); err != nil {
+					ctx.Log("error", err)
+				} else if ok {
+					substatuses = append(substatuses, gracePeriodSubstatus)
+				}
+				if pendingSubstatus, ok, err := app.pendingTransitionSubstatus(); err != nil {
+					ctx.Log("error", err)
+				} else if ok {
+					substatuses = append(substatuses, pendingSubstatus)
+				}
+			}
+
+			if availabilitySubstatus, err := availability.substatus(); err != nil {
+				ctx.Log("error", err)
+			} else {
+				substatuses = append(substatuses, availabilitySubstatus)
+			}
+
+			if schedulingSubstatus, ok, err := scheduler.substatus(apps); err != nil {
+				ctx.Log("error", err)
+			} else if ok {
+				substatuses = append(substatuses, schedulingSubstatus)
+			}
+
+			if selfTestSubstatus.Name != "" {
+				substatuses = append(substatuses, selfTestSubstatus)
+			}
+
+			if handlerEnvSubstatus, ok := handlerEnvSubstatus(handlerEnvDegradation); ok {
+				substatuses = append(substatuses, handlerEnvSubstatus)
+			}
+
+			if cfg.heartbeatSubstatus() {
+				if heartbeatSubstatus, err := heartbeatSubstatus(cycleStart, iterations); err != nil {
+					ctx.Log("error", err)
+				} else {
+					substatuses = append(substatuses, heartbeatSubstatus)
+				}
+			}
+
+			status := newStatusWithSubstatuses(statusType, "enable", message, substatuses)
+			prepareStatus(ctx, status)
+			if outOfBand {
+				statusWriter.reset()
+			}
+			bus.publish(ctx, busEvent{Kind: busEventStatus, Status: status})
+
+			if monitor != nil {
+				if exceeded := monitor.check(ctx, clock.monotonic()); len(exceeded) > 0 {
+					bus.publish(ctx, busEvent{Kind: busEventResourceLimitExceeded, Exceeded: exceeded})
+					if cfg.restartOnResourceLimit() {
+						return errResourceLimitRestart
+					}
+				}
+			}
+
+			if adaptive != nil {
+				scheduler.setInterval(adaptive.observe(ctx, committedState, apps))
+			}
+			var durationToWait time.Duration
+			if outOfBand {
+				durationToWait, outOfBand = scheduler.remaining(), false
+			} else {
+				var skipped int
+				durationToWait, skipped = scheduler.advance()
+				if skipped > 0 {
+					ctx.Log("event", fmt.Sprintf("Skipped %d probe runs, the previous run was late", skipped))
+				}
+			}
+			timer := time.NewTimer(durationToWait)
+		wait:
+			for {
+				select {
+				case <-stop:
+					timer.Stop()
+					return errTerminated
+				case <-shutdown:
+					timer.Stop()
+					return errTerminated
+				case <-timer.C:
+					break wait
+				case sig := <-signals:
+					if sig != syscall.SIGUSR1 {
+						logInternalState(ctx, apps, scheduler, clock.monotonic())
+						continue
+					}
+					ctx.Log("event", "SIGUSR1 received, probing and writing the status now")
+					timer.Stop()
+					outOfBand = true
+					break wait
+				}
+			}
+
+			if shuttingDown() {
+				return errTerminated
 			}
 		}
+	})
+	if err := runningServices.start(ctx, prober); err != nil {
+		return "", err
+	}
+	if err := prober.wait(); err != errResourceLimitRestart {
+		return "", err
+	}
+	runningServices.stopAll(ctx)
+	ctx.Log("event", errResourceLimitRestart.Error())
+	return "", restartSelf()
+}
 
-		substatuses := []SubstatusItem{
-			// For V2 of extension, to remain backwards compatible with HostGAPlugin and to have HealthStore signals
-			// decided by extension instead of taking a change in HostGAPlugin, first substatus will be dedicated
-			// for health store.
-			NewSubstatus(SubstatusKeyNameAppHealthStatus, committedState.GetStatusTypeForAppHealthStatus(), committedState.GetMessageForAppHealthStatus()),
-			NewSubstatus(SubstatusKeyNameApplicationHealthState, committedState.GetStatusType(), string(committedState)),
+// runWithoutHealthProbe reports that the application health is not monitored
+// and keeps the extension services started by enable running until the
+// extension is terminated, rather than reporting the application Healthy
+// without probing it.
+func runWithoutHealthProbe(ctx *log.Context, paths handlerPaths, seqNum int) (string, error) {
+	ctx.Log("event", "health probe disabled")
+	if err := reportStatusWithSubstatuses(ctx, paths, seqNum, StatusSuccess, "enable", healthProbeDisabledMessage, nil); err != nil {
+		ctx.Log("error", err)
+	}
+	idle := newLoopService("idle", func(stop <-chan struct{}) error {
+		select {
+		case <-stop:
+		case <-shutdown:
 		}
+		return errTerminated
+	})
+	if err := runningServices.start(ctx, idle); err != nil {
+		return "", err
+	}
+	return "", idle.wait()
+}
 
-		if probeResponse.CustomMetrics != "" {
-			customMetricsStatusType := StatusError
-			if probeResponse.validateCustomMetrics() == nil {
-				customMetricsStatusType = StatusSuccess
-			}
-			substatuses = append(substatuses, NewSubstatus(SubstatusKeyNameCustomMetrics, customMetricsStatusType, probeResponse.CustomMetrics))
+// escalatedStatusType returns the status type of the extension while the
+// application is Unhealthy: a warning at first, escalated to an error once it
+// has been unhealthy for escalateAfter.
+func escalatedStatusType(unhealthyFor, escalateAfter time.Duration) StatusType {
+	if unhealthyFor >= escalateAfter {
+		return StatusError
+	}
+	return StatusWarning
+}
+
+// applicationSubstatus returns the substatus reporting the committed health
+// state under the logical application name and environment tag, the
+// AppHealthStatus and ApplicationHealthState substatus names being read by the
+// platform.
+func applicationSubstatus(name, environment string, state HealthStatus) SubstatusItem {
+	substatusName := fmt.Sprintf("%s/%s", SubstatusKeyNameApplication, name)
+	if environment != "" {
+		substatusName += "/" + environment
+	}
+	return NewSubstatus(substatusName, state.GetStatusType(), string(state))
+}
+
+// probeResponseSubstatuses returns the substatuses reporting the custom
+// metrics, details and dependencies of the probe response, if any.
+func probeResponseSubstatuses(ctx *log.Context, probeResponse ProbeResponse) []SubstatusItem {
+	var substatuses []SubstatusItem
+	if probeResponse.CustomMetrics != "" {
+		customMetricsStatusType := StatusError
+		if probeResponse.validateCustomMetrics() == nil {
+			customMetricsStatusType = StatusSuccess
 		}
+		substatuses = append(substatuses, NewSubstatus(SubstatusKeyNameCustomMetrics, customMetricsStatusType, probeResponse.CustomMetrics))
+	}
 
-		err = reportStatusWithSubstatuses(ctx, h, seqNum, StatusSuccess, "enable", statusMessage, substatuses)
+	if probeResponse.hasDetails() {
+		details, err := probeResponse.details()
 		if err != nil {
 			ctx.Log("error", err)
 		}
+		if b, err := json.Marshal(details); err != nil {
+			ctx.Log("error", err)
+		} else {
+			substatuses = append(substatuses, NewSubstatus(SubstatusKeyNameApplicationHealthDetails, StatusSuccess, string(b)))
+		}
+	}
+
+	for _, d := range probeResponse.Dependencies {
+		substatuses = append(substatuses, d.substatus())
+	}
 
-		endTime := time.Now()
-		durationToWait := intervalBetweenProbesInMs - endTime.Sub(startTime)
-		if durationToWait > 0 {
-			time.Sleep(durationToWait)
+	if !probeResponse.ProbeDetails.isEmpty() {
+		if b, err := json.Marshal(probeResponse.ProbeDetails); err != nil {
+			ctx.Log("error", err)
+		} else {
+			substatuses = append(substatuses, NewSubstatus(SubstatusKeyNameProbeDetails, StatusSuccess, string(b)))
 		}
+	}
 
-		if shutdown {
-			return "", errTerminated
+	if c := probeResponse.ProbeDetails.Certificate; c != nil {
+		if substatus, err := c.substatus(); err != nil {
+			ctx.Log("error", err)
+		} else {
+			substatuses = append(substatuses, substatus)
 		}
 	}
+	return substatuses
 }
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/require"
 )
 
@@ -29,3 +35,47 @@ func Test_commands_shouldReportStatus(t *testing.T) {
 	require.True(t, cmds["disable"].shouldReportStatus, "disable should report status")
 	require.True(t, cmds["update"].shouldReportStatus, "update should report status")
 }
+
+func Test_escalatedStatusType(t *testing.T) {
+	require.Equal(t, StatusWarning, escalatedStatusType(0, 10*time.Minute))
+	require.Equal(t, StatusWarning, escalatedStatusType(9*time.Minute, 10*time.Minute))
+	require.Equal(t, StatusError, escalatedStatusType(10*time.Minute, 10*time.Minute))
+	require.Equal(t, StatusError, escalatedStatusType(time.Hour, 10*time.Minute))
+}
+
+func Test_applicationSubstatus(t *testing.T) {
+	s := applicationSubstatus("checkout", "", Unhealthy)
+	require.Equal(t, "Application/checkout", s.Name)
+	require.Equal(t, Unhealthy.GetStatusType(), s.Status)
+	require.Equal(t, "Unhealthy", s.FormattedMessage.Message)
+
+	s = applicationSubstatus("checkout", "production", Healthy)
+	require.Equal(t, "Application/checkout/production", s.Name)
+	require.Equal(t, StatusSuccess, s.Status)
+}
+
+func Test_runWithoutHealthProbe(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	ctx := log.NewContext(log.NewNopLogger())
+	defer runningServices.stopAll(ctx)
+	defer func(c chan struct{}) { shutdown = c }(shutdown)
+	terminate := make(chan struct{})
+	shutdown = terminate
+	time.AfterFunc(50*time.Millisecond, func() { close(terminate) })
+	_, err = runWithoutHealthProbe(ctx, handlerPaths{status: tmpDir}, 1)
+	require.Equal(t, errTerminated, err)
+
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "1.status"))
+	require.Nil(t, err)
+	var report StatusReport
+	require.Nil(t, json.Unmarshal(b, &report))
+	require.Equal(t, StatusSuccess, report[0].Status.Status)
+	require.Equal(t, healthProbeDisabledMessage, report[0].Status.FormattedMessage.Message)
+	// no health state is reported
+	for _, substatus := range report[0].Status.SubstatusList {
+		require.NotEqual(t, SubstatusKeyNameApplicationHealthState, substatus.Name)
+	}
+}
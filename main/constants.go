@@ -1,10 +1,31 @@
 package main
 
 const (
-	SubstatusKeyNameAppHealthStatus        = "AppHealthStatus"
-	SubstatusKeyNameApplicationHealthState = "ApplicationHealthState"
-	SubstatusKeyNameCustomMetrics          = "CustomMetrics"
+	SubstatusKeyNameAppHealthStatus          = "AppHealthStatus"
+	SubstatusKeyNameApplicationHealthState   = "ApplicationHealthState"
+	SubstatusKeyNameCustomMetrics            = "CustomMetrics"
+	SubstatusKeyNameApplicationHealthDetails = "ApplicationHealthDetails"
+	SubstatusKeyNameProbeDetails             = "ProbeDetails"
+	SubstatusKeyNameAvailability             = "Availability"
+	SubstatusKeyNameGracePeriod              = "GracePeriod"
+	SubstatusKeyNamePendingTransition        = "PendingTransition"
+	SubstatusKeyNameExtensionVersion         = "ExtensionVersion"
+	SubstatusKeyNameProbeScheduling          = "ProbeScheduling"
+	SubstatusKeyNameDependency               = "Dependency"
+	SubstatusKeyNameCertificate              = "Certificate"
+	SubstatusKeyNameApplication              = "Application"
+	SubstatusKeyNameSelfTest                 = "SelfTest"
+	SubstatusKeyNameHandlerEnvironment       = "HandlerEnvironment"
+	SubstatusKeyNameStatusWrites             = "StatusWrites"
+	SubstatusKeyNameHeartbeat                = "Heartbeat"
 
 	ProbeResponseKeyNameApplicationHealthState = "ApplicationHealthState"
 	ProbeResponseKeyNameCustomMetrics          = "CustomMetrics"
+	ProbeResponseKeyNameReadinessScore         = "ReadinessScore"
+	ProbeResponseKeyNameAnnotations            = "Annotations"
+	ProbeResponseKeyNameDependencies           = "Dependencies"
+
+	IdentificationHeaderExtensionVersion = "X-ApplicationHealth-Extension-Version"
+	IdentificationHeaderVMName           = "X-ApplicationHealth-VM-Name"
+	IdentificationHeaderSequenceNumber   = "X-ApplicationHealth-Sequence-Number"
 )
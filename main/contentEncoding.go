@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// acceptedContentEncodings is sent in the Accept-Encoding header of the probe
+// requests. Setting it disables the transparent gzip decompression of the
+// http transport, which doesn't handle deflate, so responses are decoded by
+// decodedBody instead.
+const acceptedContentEncodings = "gzip, deflate"
+
+// decodedBody returns the body of the response decompressed according to its
+// Content-Encoding header. The size of the decompressed body is meant to be
+// limited by the caller.
+func decodedBody(resp *http.Response) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress gzip response body")
+		}
+		return r, nil
+	case "deflate":
+		// deflate is meant to be zlib wrapped, but some servers send raw
+		// deflate data
+		br := bufio.NewReader(resp.Body)
+		if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+			r, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to decompress deflate response body")
+			}
+			return r, nil
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported response Content-Encoding '%s'", encoding))
+	}
+}
+
+// isZlibHeader reports whether b starts with a zlib header using the deflate
+// compression method.
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
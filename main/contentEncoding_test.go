@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func compress(t *testing.T, encoding string, body string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		require.Nil(t, err)
+		w = fw
+	}
+	_, err := w.Write([]byte(body))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestHttpHealthProbe_evaluate_ContentEncoding(t *testing.T) {
+	var acceptEncoding string
+	var encoding, contentEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		body := `{"ApplicationHealthState": "Healthy"}`
+		if encoding == "" {
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", contentEncoding)
+		w.Write(compress(t, encoding, body))
+	}))
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewHttpHealthProbe("http", "/health", 80)
+	probe.Address = server.URL + "/health"
+
+	for _, tc := range []struct{ encoding, contentEncoding string }{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip", "x-gzip"},
+		{"deflate", "deflate"},
+		{"raw-deflate", "Deflate"},
+	} {
+		encoding, contentEncoding = tc.encoding, tc.contentEncoding
+		probeResponse, err := probe.evaluate(ctx)
+		require.Nil(t, err, tc.encoding)
+		require.Equal(t, Healthy, probeResponse.ApplicationHealthState, tc.encoding)
+		require.Equal(t, "gzip, deflate", acceptEncoding)
+	}
+
+	// corrupted body
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	})
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureBadBody, probeResponse.ProbeDetails.Failure)
+
+	// unsupported encoding
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	})
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Unsupported response Content-Encoding 'br'")
+	require.Equal(t, probeFailureBadBody, probeResponse.ProbeDetails.Failure)
+}
+
+func TestHttpHealthProbe_evaluate_DecompressedSizeLimited(t *testing.T) {
+	// a small compressed body expanding beyond the size limit
+	body := `{"ApplicationHealthState": "Healthy", "padding": "` + strings.Repeat("a", 10000) + `"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compress(t, "gzip", body))
+	}))
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewHttpHealthProbe("http", "/health", 80)
+	probe.Address = server.URL + "/health"
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+
+	probe.MaxResponseBodySizeInBytes = int64(len(body))
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+}
+
+func TestMetricsHealthProbe_evaluate_ContentEncoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "gzip, deflate", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compress(t, "gzip", "up 1\n"))
+	}))
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	rule, err := parseMetricsRule("up == 1")
+	require.Nil(t, err)
+	probe := NewMetricsHealthProbe("/metrics", 80, []metricsRule{rule})
+	probe.Address = server.URL + "/metrics"
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// maxDatabaseMessageSize bounds the messages read from database servers, which
+// are small during the handshake.
+const maxDatabaseMessageSize = 64 * 1024
+
+var (
+	defaultDatabaseUsers = map[string]string{"mysql": "root", "postgresql": "postgres"}
+
+	databaseHandshakes = map[string]databaseHandshake{
+		"mysql":      mysqlHandshake,
+		"postgresql": postgresqlHandshake,
+		"redis":      redisHandshake,
+	}
+)
+
+// databaseHandshake completes the handshake of a database protocol on conn.
+// Without a password it only checks that the server accepts connections,
+// otherwise it authenticates as well.
+type databaseHandshake func(conn net.Conn, user, password, database string) error
+
+// databaseError is an error reported by the database server or a malformed
+// message from it, as opposed to a connection error.
+type databaseError struct {
+	failure probeFailure
+	message string
+}
+
+func (e *databaseError) Error() string {
+	return e.message
+}
+
+// DatabaseHealthProbe completes the handshake of a local MySQL, PostgreSQL or
+// Redis server and considers it healthy when the server accepts the
+// connection, and the credentials if a password is set.
+type DatabaseHealthProbe struct {
+	Protocol string
+	Address  string
+	User     string
+	Password string
+	Database string
+	Timeout  time.Duration
+}
+
+func NewDatabaseHealthProbe(protocol string, port int, user, password, database string, timeout time.Duration) *DatabaseHealthProbe {
+	return &DatabaseHealthProbe{
+		Protocol: protocol,
+		Address:  "localhost:" + strconv.Itoa(port),
+		User:     user,
+		Password: password,
+		Database: database,
+		Timeout:  timeout,
+	}
+}
+
+func (p *DatabaseHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unhealthy
+
+	conn, err := net.DialTimeout("tcp", p.address(), p.Timeout)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(p.Timeout)); err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureConnection
+		return probeResponse, err
+	}
+
+	if err := databaseHandshakes[p.Protocol](conn, p.User, p.Password, p.Database); err != nil {
+		if dbErr, ok := err.(*databaseError); ok {
+			probeResponse.ProbeDetails.Failure = dbErr.failure
+		} else {
+			probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		}
+		return probeResponse, err
+	}
+
+	probeResponse.ApplicationHealthState = Healthy
+	return probeResponse, nil
+}
+
+func (p *DatabaseHealthProbe) address() string {
+	return p.Address
+}
+
+func (p *DatabaseHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
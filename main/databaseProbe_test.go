@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// evaluateDatabaseProbe probes a fake database server handling the connection
+// of the probe with serve.
+func evaluateDatabaseProbe(t *testing.T, protocol, user, password, database string, serve func(conn net.Conn)) (ProbeResponse, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		serve(conn)
+	}()
+
+	probe := NewDatabaseHealthProbe(protocol, l.Addr().(*net.TCPAddr).Port, user, password, database, 5*time.Second)
+	probeResponse, err := probe.evaluate(log.NewContext(log.NewNopLogger()))
+	<-done
+	return probeResponse, err
+}
+
+func serveRedis(replies map[string]string) func(net.Conn) {
+	return func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			// *<n>, then $<len> and the argument for each argument
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var args []string
+			for n := int(line[1] - '0'); n > 0; n-- {
+				r.ReadString('\n')
+				arg, _ := r.ReadString('\n')
+				args = append(args, strings.TrimSpace(arg))
+			}
+			conn.Write([]byte(replies[strings.Join(args, " ")] + "\r\n"))
+		}
+	}
+}
+
+func TestDatabaseHealthProbe_redis(t *testing.T) {
+	probeResponse, err := evaluateDatabaseProbe(t, "redis", "", "", "", serveRedis(map[string]string{"PING": "+PONG"}))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// the server answers, authentication is not checked
+	probeResponse, err = evaluateDatabaseProbe(t, "redis", "", "", "", serveRedis(map[string]string{"PING": "-NOAUTH Authentication required."}))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probeResponse, err = evaluateDatabaseProbe(t, "redis", "probe", "secret", "", serveRedis(map[string]string{"AUTH probe secret": "+OK", "PING": "+PONG"}))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probeResponse, err = evaluateDatabaseProbe(t, "redis", "", "wrong", "", serveRedis(map[string]string{"AUTH wrong": "-WRONGPASS invalid username-password pair"}))
+	require.NotNil(t, err)
+	require.Equal(t, "Redis authentication failed: WRONGPASS invalid username-password pair", err.Error())
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureBadStatus, probeResponse.ProbeDetails.Failure)
+
+	probeResponse, err = evaluateDatabaseProbe(t, "redis", "", "", "", serveRedis(map[string]string{"PING": "-LOADING Redis is loading the dataset in memory"}))
+	require.NotNil(t, err)
+	require.Equal(t, "Redis replied with error: LOADING Redis is loading the dataset in memory", err.Error())
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
+
+func mysqlGreeting(nonce []byte, plugin string) []byte {
+	var b bytes.Buffer
+	b.WriteByte(mysqlProtocolVersion)
+	b.WriteString("8.0.36\x00")
+	b.Write([]byte{1, 0, 0, 0})
+	b.Write(nonce[:8])
+	b.WriteByte(0)
+	b.Write([]byte{0xff, 0xff, mysqlCharsetUtf8mb4, 2, 0, 0xff, 0xdf, 21})
+	b.Write(make([]byte, 10))
+	b.Write(nonce[8:])
+	b.WriteByte(0)
+	b.WriteString(plugin + "\x00")
+	return b.Bytes()
+}
+
+// mysqlHandshakeResponse returns the user, auth response and plugin of a
+// handshake response.
+func mysqlHandshakeResponse(t *testing.T, packet []byte) (string, []byte, string) {
+	b := packet[4+4+1+23:]
+	i := bytes.IndexByte(b, 0)
+	user := string(b[:i])
+	b = b[i+1:]
+	authResponse := b[1 : 1+int(b[0])]
+	b = b[1+int(b[0]):]
+	if binary.LittleEndian.Uint32(packet)&mysqlClientConnectWithDB != 0 {
+		b = b[bytes.IndexByte(b, 0)+1:]
+	}
+	return user, authResponse, strings.TrimRight(string(b), "\x00")
+}
+
+func TestDatabaseHealthProbe_mysql(t *testing.T) {
+	nonce := []byte("abcdefghijklmnopqrst")
+	mysqlErr := append([]byte{mysqlPacketError, 0x10, 0x04}, []byte("#08004Too many connections")...)
+
+	probeResponse, err := evaluateDatabaseProbe(t, "mysql", "root", "", "", func(conn net.Conn) {
+		writeMysqlPacket(conn, 0, mysqlGreeting(nonce, mysqlNativePassword))
+	})
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probeResponse, err = evaluateDatabaseProbe(t, "mysql", "root", "", "", func(conn net.Conn) {
+		writeMysqlPacket(conn, 0, mysqlErr)
+	})
+	require.NotNil(t, err)
+	require.Equal(t, "MySQL error 1040: Too many connections", err.Error())
+	require.Equal(t, probeFailureBadStatus, probeResponse.ProbeDetails.Failure)
+
+	// mysql_native_password, verified the way the server does
+	stage1 := sha1.Sum([]byte("secret"))
+	stored := sha1.Sum(stage1[:])
+	serveNative := func(conn net.Conn) {
+		writeMysqlPacket(conn, 0, mysqlGreeting(nonce, mysqlNativePassword))
+		seq, packet, _ := readMysqlPacket(conn)
+		user, authResponse, plugin := mysqlHandshakeResponse(t, packet)
+		hash := sha1.Sum(append(append([]byte{}, nonce...), stored[:]...))
+		candidate := sha1.Sum(xorBytes(authResponse, hash[:]))
+		if user == "probe" && plugin == mysqlNativePassword && candidate == stored {
+			writeMysqlPacket(conn, seq+1, []byte{mysqlPacketOK, 0, 0, 2, 0, 0, 0})
+		} else {
+			writeMysqlPacket(conn, seq+1, append([]byte{mysqlPacketError, 0x15, 0x04}, []byte("#28000Access denied for user")...))
+		}
+	}
+	probeResponse, err = evaluateDatabaseProbe(t, "mysql", "probe", "secret", "app", serveNative)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probeResponse, err = evaluateDatabaseProbe(t, "mysql", "probe", "wrong", "", serveNative)
+	require.NotNil(t, err)
+	require.Equal(t, "MySQL error 1045: Access denied for user", err.Error())
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
+
+func TestDatabaseHealthProbe_mysqlCachingSha2FullAuth(t *testing.T) {
+	nonce := []byte("ABCDEFGHIJKLMNOPQRST")
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+
+	var decrypted []byte
+	probeResponse, err := evaluateDatabaseProbe(t, "mysql", "probe", "secret", "", func(conn net.Conn) {
+		writeMysqlPacket(conn, 0, mysqlGreeting(nonce, mysqlCachingSha2Password))
+		seq, packet, _ := readMysqlPacket(conn)
+		_, authResponse, plugin := mysqlHandshakeResponse(t, packet)
+		require.Equal(t, mysqlCachingSha2Password, plugin)
+		require.Equal(t, mysqlScramble(mysqlCachingSha2Password, "secret", nonce), authResponse)
+
+		// the password is not cached, full authentication over RSA
+		writeMysqlPacket(conn, seq+1, []byte{mysqlPacketAuthMore, mysqlPerformFullAuth})
+		seq, packet, _ = readMysqlPacket(conn)
+		require.Equal(t, []byte{mysqlRequestPublicKey}, packet)
+		writeMysqlPacket(conn, seq+1, append([]byte{mysqlPacketAuthMore}, publicKeyPEM...))
+		seq, packet, _ = readMysqlPacket(conn)
+		decrypted, _ = rsa.DecryptOAEP(sha1.New(), rand.Reader, key, packet, nil)
+		writeMysqlPacket(conn, seq+1, []byte{mysqlPacketOK, 0, 0, 2, 0, 0, 0})
+	})
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, []byte("secret\x00"), xorBytes(decrypted, nonce[:len(decrypted)]))
+}
+
+func TestMysqlEncryptPassword_emptyNonce(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+
+	_, err = mysqlEncryptPassword(publicKeyPEM, "secret", nil)
+	require.EqualError(t, err, "Empty MySQL authentication nonce")
+	require.Equal(t, probeFailureBadBody, err.(*databaseError).failure)
+}
+
+func TestMysqlScramble_cachingSha2(t *testing.T) {
+	nonce := []byte("01234567890123456789")
+	// verified the way the server does with the cached SHA256(SHA256(password))
+	stage1 := sha256.Sum256([]byte("secret"))
+	stored := sha256.Sum256(stage1[:])
+	hash := sha256.Sum256(append(stored[:], nonce...))
+	candidate := xorBytes(mysqlScramble(mysqlCachingSha2Password, "secret", nonce), hash[:])
+	require.Equal(t, stage1[:], candidate)
+}
+
+func servePostgresql(messages ...[]byte) func(net.Conn) {
+	return func(conn net.Conn) {
+		// startup message
+		header := make([]byte, 4)
+		conn.Read(header)
+		conn.Read(make([]byte, binary.BigEndian.Uint32(header)-4))
+		for _, m := range messages {
+			if m == nil {
+				readPostgresqlMessage(conn)
+				continue
+			}
+			conn.Write(m)
+		}
+	}
+}
+
+func postgresqlMessage(messageType byte, message []byte) []byte {
+	var b bytes.Buffer
+	writePostgresqlMessage(&b, messageType, message)
+	return b.Bytes()
+}
+
+func postgresqlAuthRequest(method uint32, data []byte) []byte {
+	m := make([]byte, 4)
+	binary.BigEndian.PutUint32(m, method)
+	return postgresqlMessage('R', append(m, data...))
+}
+
+func TestDatabaseHealthProbe_postgresql(t *testing.T) {
+	ready := postgresqlMessage('Z', []byte{'I'})
+
+	// the server asks for a password which isn't set
+	probeResponse, err := evaluateDatabaseProbe(t, "postgresql", "postgres", "", "", servePostgresql(postgresqlAuthRequest(postgresqlAuthMD5Password, []byte{1, 2, 3, 4})))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// the role doesn't exist
+	probeResponse, err = evaluateDatabaseProbe(t, "postgresql", "postgres", "", "", servePostgresql(postgresqlMessage('E', []byte("SFATAL\x00C28000\x00Mrole \"postgres\" does not exist\x00\x00"))))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probeResponse, err = evaluateDatabaseProbe(t, "postgresql", "postgres", "", "", servePostgresql(postgresqlMessage('E', []byte("SFATAL\x00C57P03\x00Mthe database system is starting up\x00\x00"))))
+	require.NotNil(t, err)
+	require.Equal(t, "PostgreSQL error 57P03: the database system is starting up", err.Error())
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureBadStatus, probeResponse.ProbeDetails.Failure)
+
+	// md5 authentication
+	var response []byte
+	probeResponse, err = evaluateDatabaseProbe(t, "postgresql", "probe", "secret", "app", func(conn net.Conn) {
+		servePostgresql(postgresqlAuthRequest(postgresqlAuthMD5Password, []byte{1, 2, 3, 4}))(conn)
+		_, response, _ = readPostgresqlMessage(conn)
+		conn.Write(postgresqlAuthRequest(postgresqlAuthOk, nil))
+		conn.Write(postgresqlMessage('S', []byte("server_version\x0016.2\x00")))
+		conn.Write(ready)
+	})
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, postgresqlMD5Password("probe", "secret", []byte{1, 2, 3, 4})+"\x00", string(response))
+}
+
+func TestPostgresqlMD5Password(t *testing.T) {
+	// md5(md5("secretprobe") + salt)
+	require.Equal(t, "md5549d201a36e0ebb5f0dfdc4a36b362b2", postgresqlMD5Password("probe", "secret", []byte{1, 2, 3, 4}))
+}
+
+func TestScramClient(t *testing.T) {
+	// example of RFC 7677
+	c := &scramClient{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	require.Equal(t, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", c.clientFirst())
+
+	clientFinal, err := c.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	require.Nil(t, err)
+	require.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", clientFinal)
+	require.Nil(t, c.verifyServerFinal("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+
+	err = c.verifyServerFinal("v=AAAA")
+	require.NotNil(t, err)
+	require.Equal(t, "Invalid SCRAM server signature", err.Error())
+
+	_, err = c.clientFinal("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	require.NotNil(t, err)
+	require.Equal(t, "Invalid SCRAM server nonce", err.Error())
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// stateDebouncer holds a reported health state for a minimum duration, so that
+// automation reacting to the health state (such as autoheal or load balancer
+// rotation) does not react to short oscillations. It is distinct from the
+// thresholds of the health evaluator, which decide when the committed state of
+// an application changes.
+type stateDebouncer struct {
+	minDuration time.Duration
+
+	state HealthStatus
+	since time.Duration
+	// held is the state whose report is held back, to log it only once.
+	held HealthStatus
+}
+
+func newStateDebouncer(minDuration time.Duration) *stateDebouncer {
+	return &stateDebouncer{minDuration: minDuration}
+}
+
+// observe returns the state to report given the committed state, at the
+// monotonic time now. A transition is held back until the reported state has
+// been reported for the minimum duration, except the end of the
+// initialization.
+func (d *stateDebouncer) observe(ctx *log.Context, state HealthStatus, now time.Duration) HealthStatus {
+	if state == d.state {
+		d.held = Empty
+		return state
+	}
+	if d.state == Empty || d.state == Initializing || now-d.since >= d.minDuration {
+		d.state, d.since, d.held = state, now, Empty
+		return state
+	}
+	if state != d.held {
+		d.held = state
+		remaining := (d.minDuration - (now - d.since)).Round(time.Second)
+		ctx.Log("event", fmt.Sprintf("Holding the %s state for %v before reporting %s", d.state, remaining, state))
+	}
+	return d.state
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateDebouncer(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	d := newStateDebouncer(time.Minute)
+
+	// the end of the initialization is not delayed
+	require.Equal(t, Initializing, d.observe(ctx, Initializing, 0))
+	require.Equal(t, Healthy, d.observe(ctx, Healthy, 5*time.Second))
+
+	// oscillations within the minimum duration are not reported
+	require.Equal(t, Healthy, d.observe(ctx, Unhealthy, 10*time.Second))
+	require.Equal(t, Unhealthy, d.held)
+	require.Equal(t, Healthy, d.observe(ctx, Healthy, 15*time.Second))
+	require.Equal(t, Empty, d.held)
+	require.Equal(t, Healthy, d.observe(ctx, Unhealthy, 60*time.Second))
+
+	// reported once the state was reported for the minimum duration
+	require.Equal(t, Unhealthy, d.observe(ctx, Unhealthy, 65*time.Second))
+	require.Equal(t, Unhealthy, d.observe(ctx, Healthy, 70*time.Second))
+	require.Equal(t, Healthy, d.observe(ctx, Healthy, 125*time.Second))
+}
+
+func TestStateDebouncer_disabled(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	d := newStateDebouncer(0)
+	require.Equal(t, Healthy, d.observe(ctx, Healthy, 0))
+	require.Equal(t, Unhealthy, d.observe(ctx, Unhealthy, 0))
+	require.Equal(t, Healthy, d.observe(ctx, Healthy, time.Millisecond))
+}
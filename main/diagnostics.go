@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// newDiagnosticsHandler serves the pprof profiles under /debug/pprof/, the
+// expvar variables, including the memory statistics, under /debug/vars, the
+// latest status of the extension under /status, the probe metrics, in the
+// Prometheus text format, under /metrics and the health of the services of the
+// extension under /services.
+func newDiagnosticsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/status", serveLatestStatus)
+	mux.HandleFunc("/metrics", serveProbeMetrics)
+	mux.HandleFunc("/services", serveServices)
+	return mux
+}
+
+// serveLatestStatus serves the latest status of the extension, which is more
+// recent than the status file when the status is only written on change.
+func serveLatestStatus(w http.ResponseWriter, r *http.Request) {
+	s := latestStatus.get()
+	if s == nil {
+		http.Error(w, "no status reported yet", http.StatusServiceUnavailable)
+		return
+	}
+	b, err := s.Marshal()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func serveProbeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	probeStats.writePrometheus(w)
+}
+
+func serveServices(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(runningServices.report(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// startDiagnosticsServer serves the diagnostics endpoint on the loopback
+// interface only, so that it is not reachable from outside the VM. Closing the
+// returned listener stops the server.
+func startDiagnosticsServer(port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for diagnostics")
+	}
+	go http.Serve(l, newDiagnosticsHandler())
+	return l, nil
+}
+
+// diagnosticsService serves the diagnostics endpoint as a service of the
+// extension.
+type diagnosticsService struct {
+	port     int
+	listener net.Listener
+}
+
+func (s *diagnosticsService) name() string {
+	return "diagnostics"
+}
+
+func (s *diagnosticsService) start(ctx *log.Context) error {
+	l, err := startDiagnosticsServer(s.port)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	ctx.Log("event", "serving diagnostics", "address", l.Addr())
+	return nil
+}
+
+func (s *diagnosticsService) stop() {
+	s.listener.Close()
+}
+
+func (s *diagnosticsService) health() serviceHealth {
+	return serviceHealth{Name: s.name(), Running: true}
+}
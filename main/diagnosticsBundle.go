@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// diagnosticsBundlePrefix prefixes the name of the bundles, which are not
+	// included in the later bundles.
+	diagnosticsBundlePrefix = "diagnostics-"
+	// maxBundledStatusFiles is the number of most recent status files bundled.
+	maxBundledStatusFiles = 5
+	// maxBundledFileSize bounds the bundled content of a file, its end being
+	// the most recent for logs.
+	maxBundledFileSize = 4 * 1024 * 1024
+)
+
+// diagnosticsSources are the folders the troubleshooting bundle is collected
+// from.
+type diagnosticsSources struct {
+	statusFolder string
+	configFolder string
+	logFolder    string
+	dataFolder   string
+	procFolder   string
+}
+
+// diagnosticsBundle writes a gzipped tarball of the files needed to
+// troubleshoot the extension. The protected settings, and their values found
+// in the bundled files, are redacted.
+type diagnosticsBundle struct {
+	tw        *tar.Writer
+	modTime   time.Time
+	redactor  *redactor
+	collected []string
+	failures  []string
+}
+
+// collectDiagnostics writes the bundle of the sources to w: the latest status
+// files, the extension logs, the persisted state, the current settings and
+// the process tree. Sources which can't be read are listed in the bundle
+// rather than failing the collection.
+func collectDiagnostics(w io.Writer, sources diagnosticsSources, now time.Time) error {
+	gz := gzip.NewWriter(w)
+	b := &diagnosticsBundle{tw: tar.NewWriter(gz), modTime: now, redactor: &redactor{}}
+
+	// read the settings first, to redact their secrets from the other files
+	b.addSettings(sources.configFolder)
+	b.addStatusFiles(sources.statusFolder)
+	b.addFolder("logs", sources.logFolder)
+	b.addFolder("data", sources.dataFolder)
+	b.addProcessTree(sources.procFolder)
+	b.addSummary(now)
+
+	if err := b.tw.Close(); err != nil {
+		return errors.Wrap(err, "failed to write diagnostics bundle")
+	}
+	return errors.Wrap(gz.Close(), "failed to write diagnostics bundle")
+}
+
+// addSettings bundles the public settings and the redacted protected settings.
+func (b *diagnosticsBundle) addSettings(configFolder string) {
+	pubJSON, protJSON, err := readSettings(configFolder)
+	if err != nil {
+		b.fail("settings.json", err)
+		return
+	}
+	b.redactor.add(secretValues(protJSON)...)
+	settings, err := json.MarshalIndent(map[string]interface{}{
+		"publicSettings":    pubJSON,
+		"protectedSettings": redacted(protJSON),
+	}, "", "  ")
+	if err != nil {
+		b.fail("settings.json", err)
+		return
+	}
+	b.add("settings.json", settings)
+}
+
+// addStatusFiles bundles the status files with the highest sequence numbers.
+func (b *diagnosticsBundle) addStatusFiles(statusFolder string) {
+	files, err := filepath.Glob(filepath.Join(statusFolder, "*.status"))
+	if err != nil || len(files) == 0 {
+		b.fail("status", errors.New(fmt.Sprintf("No status file found in '%s'", statusFolder)))
+		return
+	}
+	seqNum := func(f string) int {
+		n, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(f), ".status"))
+		return n
+	}
+	sort.Slice(files, func(i, j int) bool { return seqNum(files[i]) > seqNum(files[j]) })
+	if len(files) > maxBundledStatusFiles {
+		files = files[:maxBundledStatusFiles]
+	}
+	for _, f := range files {
+		b.addFile(filepath.Join("status", filepath.Base(f)), f)
+	}
+}
+
+// addFolder bundles the files of a folder, except the earlier bundles.
+func (b *diagnosticsBundle) addFolder(name, folder string) {
+	if folder == "" {
+		return
+	}
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			b.fail(path, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), diagnosticsBundlePrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(folder, path)
+		if err != nil {
+			return err
+		}
+		b.addFile(filepath.Join(name, rel), path)
+		return nil
+	})
+	if err != nil {
+		b.fail(name, err)
+	}
+}
+
+// addProcessTree bundles the process tree read from procFolder.
+func (b *diagnosticsBundle) addProcessTree(procFolder string) {
+	tree, err := processTree(procFolder)
+	if err != nil {
+		b.fail("processes.txt", err)
+		return
+	}
+	b.add("processes.txt", []byte(tree))
+}
+
+// addSummary bundles the description of the bundle: the version of the
+// extension, the bundled files and the sources which could not be collected.
+func (b *diagnosticsBundle) addSummary(now time.Time) {
+	var s bytes.Buffer
+	fmt.Fprintf(&s, "Collected at: %s\n", now.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&s, "Version: %s\n", DetailedVersionString())
+	fmt.Fprintln(&s, "Files:")
+	for _, f := range b.collected {
+		fmt.Fprintf(&s, "  %s\n", f)
+	}
+	if len(b.failures) > 0 {
+		fmt.Fprintln(&s, "Not collected:")
+		for _, f := range b.failures {
+			fmt.Fprintf(&s, "  %s\n", f)
+		}
+	}
+	b.add("summary.txt", s.Bytes())
+}
+
+// addFile bundles the end of a file, at most maxBundledFileSize bytes.
+func (b *diagnosticsBundle) addFile(name, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() > maxBundledFileSize {
+		f.Seek(-maxBundledFileSize, io.SeekEnd)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, content)
+}
+
+func (b *diagnosticsBundle) add(name string, content []byte) {
+	content = []byte(b.redactor.redact(string(content)))
+	err := b.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: b.modTime,
+	})
+	if err == nil {
+		_, err = b.tw.Write(content)
+	}
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.collected = append(b.collected, name)
+}
+
+func (b *diagnosticsBundle) fail(name string, err error) {
+	b.failures = append(b.failures, fmt.Sprintf("%s: %v", name, err))
+}
+
+// process is a process read from /proc.
+type process struct {
+	pid, ppid int
+	command   string
+}
+
+// processTree returns the processes of procFolder, indented under their
+// parent process.
+func processTree(procFolder string) (string, error) {
+	entries, err := ioutil.ReadDir(procFolder)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list processes")
+	}
+	byPid := make(map[int]process)
+	children := make(map[int][]int)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		p, err := readProcess(filepath.Join(procFolder, e.Name()), pid)
+		if err != nil {
+			// the process exited
+			continue
+		}
+		byPid[pid] = p
+	}
+	for pid, p := range byPid {
+		parent := p.ppid
+		if _, ok := byPid[parent]; !ok {
+			// the parent is not visible, list the process as a root
+			parent = 0
+		}
+		children[parent] = append(children[parent], pid)
+	}
+
+	var tree strings.Builder
+	fmt.Fprintf(&tree, "%7s %7s %s\n", "PID", "PPID", "COMMAND")
+	var walk func(ppid, depth int)
+	walk = func(ppid, depth int) {
+		pids := children[ppid]
+		sort.Ints(pids)
+		for _, pid := range pids {
+			p := byPid[pid]
+			fmt.Fprintf(&tree, "%7d %7d %s%s\n", p.pid, p.ppid, strings.Repeat("  ", depth), p.command)
+			walk(pid, depth+1)
+		}
+	}
+	walk(0, 0)
+	return tree.String(), nil
+}
+
+// readProcess reads the parent and the command line of a process from its
+// /proc folder, the command line being its name for kernel threads.
+func readProcess(folder string, pid int) (process, error) {
+	stat, err := ioutil.ReadFile(filepath.Join(folder, "stat"))
+	if err != nil {
+		return process{}, err
+	}
+	// the name, in parentheses, may contain spaces and parentheses
+	lparen, rparen := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+	if lparen < 0 || rparen < lparen {
+		return process{}, errors.New("invalid process stat")
+	}
+	fields := strings.Fields(string(stat[rparen+1:]))
+	if len(fields) < 2 {
+		return process{}, errors.New("invalid process stat")
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return process{}, errors.Wrap(err, "invalid process stat")
+	}
+
+	p := process{pid: pid, ppid: ppid, command: "[" + string(stat[lparen+1:rparen]) + "]"}
+	if cmdline, err := ioutil.ReadFile(filepath.Join(folder, "cmdline")); err == nil && len(cmdline) > 0 {
+		p.command = strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))
+	}
+	return p, nil
+}
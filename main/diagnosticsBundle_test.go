@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readBundle returns the content of the files of a diagnostics bundle.
+func readBundle(t *testing.T, r io.Reader) map[string]string {
+	gz, err := gzip.NewReader(r)
+	require.Nil(t, err)
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.Nil(t, err)
+		b, err := ioutil.ReadAll(tr)
+		require.Nil(t, err)
+		files[h.Name] = string(b)
+	}
+}
+
+// writeDiagnosticsSources creates the folders of an extension: 7 status files,
+// a settings file, a log, the state history, an earlier bundle and a fake
+// /proc of two processes.
+func writeDiagnosticsSources(t *testing.T) diagnosticsSources {
+	root, err := ioutil.TempDir("", "diagnostics")
+	require.Nil(t, err)
+	s := diagnosticsSources{
+		statusFolder: filepath.Join(root, "status"),
+		configFolder: filepath.Join(root, "config"),
+		logFolder:    filepath.Join(root, "log"),
+		dataFolder:   filepath.Join(root, "data"),
+		procFolder:   filepath.Join(root, "proc"),
+	}
+	for _, folder := range []string{s.statusFolder, s.configFolder, s.logFolder, s.dataFolder, filepath.Join(s.procFolder, "1"), filepath.Join(s.procFolder, "42")} {
+		require.Nil(t, os.MkdirAll(folder, 0755))
+	}
+	for i := 0; i < 7; i++ {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(s.statusFolder, fmt.Sprintf("%d.status", i)), []byte(`[]`), 0644))
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.configFolder, "0.settings"), []byte(`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"protocol": "tcp", "port": 80}}}]}`), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.logFolder, "extension.log"), []byte("event=enable\nmessage=\"password=hunter22\"\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.logFolder, diagnosticsBundlePrefix+"old.tar.gz"), []byte("old"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.dataFolder, "transitions.json"), []byte(`[]`), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.procFolder, "1", "stat"), []byte("1 (systemd) S 0 1 1"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.procFolder, "1", "cmdline"), []byte("/sbin/init\x00splash\x00"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.procFolder, "42", "stat"), []byte("42 (kworker (0)) S 1 0 0"), 0644))
+	return s
+}
+
+func TestCollectDiagnostics(t *testing.T) {
+	s := writeDiagnosticsSources(t)
+	defer os.RemoveAll(filepath.Dir(s.statusFolder))
+
+	var b bytes.Buffer
+	require.Nil(t, collectDiagnostics(&b, s, time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)))
+	files := readBundle(t, &b)
+
+	// the 5 latest status files
+	for i := 2; i < 7; i++ {
+		require.Contains(t, files, fmt.Sprintf("status/%d.status", i))
+	}
+	require.NotContains(t, files, "status/1.status")
+
+	require.Contains(t, files["settings.json"], `"protocol": "tcp"`)
+	require.Equal(t, "event=enable\nmessage=\"password=<redacted>\"\n", files["logs/extension.log"])
+	require.NotContains(t, files, "logs/"+diagnosticsBundlePrefix+"old.tar.gz")
+	require.Equal(t, `[]`, files["data/transitions.json"])
+
+	require.Equal(t, ""+
+		"    PID    PPID COMMAND\n"+
+		"      1       0 /sbin/init splash\n"+
+		"     42       1   [kworker (0)]\n", files["processes.txt"])
+
+	require.Contains(t, files["summary.txt"], "Collected at: 2026-10-17T00:00:00Z\n")
+	require.Contains(t, files["summary.txt"], "  processes.txt\n")
+	require.NotContains(t, files["summary.txt"], "Not collected:")
+}
+
+func TestCollectDiagnostics_missingSources(t *testing.T) {
+	var b bytes.Buffer
+	require.Nil(t, collectDiagnostics(&b, diagnosticsSources{
+		statusFolder: "/nonexistent/status",
+		configFolder: "/nonexistent/config",
+		procFolder:   "/nonexistent/proc",
+	}, time.Now()))
+	files := readBundle(t, &b)
+
+	require.Len(t, files, 1)
+	require.Contains(t, files["summary.txt"], "Not collected:\n  settings.json: ")
+	require.Contains(t, files["summary.txt"], "  status: No status file found in '/nonexistent/status'\n")
+	require.Contains(t, files["summary.txt"], "  processes.txt: failed to list processes")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartDiagnosticsServer(t *testing.T) {
+	l, err := startDiagnosticsServer(0)
+	require.Nil(t, err)
+	defer l.Close()
+	addr := l.Addr()
+
+	resp, err := http.Get("http://" + addr.String() + "/debug/pprof/goroutine?debug=1")
+	require.Nil(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(b), "goroutine profile")
+
+	resp, err = http.Get("http://" + addr.String() + "/debug/vars")
+	require.Nil(t, err)
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Contains(t, string(b), `"memstats"`)
+
+	resp, err = http.Get("http://" + addr.String() + "/status")
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	latestStatus.set(NewStatus(StatusSuccess, "enable", "Application health found"))
+	defer latestStatus.set(nil)
+	resp, err = http.Get("http://" + addr.String() + "/status")
+	require.Nil(t, err)
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(b), `"message": "Application health found"`)
+
+	resp, err = http.Get("http://" + addr.String() + "/metrics")
+	require.Nil(t, err)
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Contains(t, string(b), "# TYPE apphealth_probe_results_total counter")
+
+	resp, err = http.Get("http://" + addr.String() + "/services")
+	require.Nil(t, err)
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "[]", string(b))
+
+	_, err = startDiagnosticsServer(addr.(*net.TCPAddr).Port)
+	require.NotNil(t, err)
+}
+
+// TestServeLatestStatus_droppedWrites serves the latest status while the
+// status writes are being dropped, which is only safe as long as the status
+// reporting the dropped writes is not shared with the diagnostics endpoint;
+// run with -race.
+func TestServeLatestStatus_droppedWrites(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	w := newStatusWriter(&handlerSettings{})
+	w.sleep = func(time.Duration) {}
+	failing := func(StatusReport) error { return errors.New("disk full") }
+
+	s := newTestStatus(StatusSuccess, Healthy, "Application health found")
+	latestStatus.set(s)
+	defer latestStatus.set(nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			w.write(ctx, s, failing)
+		}
+	}()
+	handler := newDiagnosticsHandler()
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	<-done
+	require.Len(t, latestStatus.get()[0].Status.SubstatusList, 2)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// DnsHealthProbe resolves a name, either with the system resolver or against
+// a specific server, and considers the resolver healthy when the name resolves
+// within MaxLatency (if set) to addresses including ExpectedAddresses (if set).
+type DnsHealthProbe struct {
+	Name              string
+	Server            string
+	MaxLatency        time.Duration
+	ExpectedAddresses []string
+	Timeout           time.Duration
+
+	resolver *net.Resolver
+}
+
+func NewDnsHealthProbe(name, server string, maxLatency time.Duration, expectedAddresses []string, timeout time.Duration) *DnsHealthProbe {
+	p := &DnsHealthProbe{
+		Name:              name,
+		Server:            server,
+		MaxLatency:        maxLatency,
+		ExpectedAddresses: expectedAddresses,
+		Timeout:           timeout,
+		resolver:          net.DefaultResolver,
+	}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			p.Server = net.JoinHostPort(server, "53")
+		}
+		p.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, p.Server)
+			},
+		}
+	}
+	return p
+}
+
+func (p *DnsHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unhealthy
+
+	lookupCtx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	addrs, err := p.resolver.LookupHost(lookupCtx, p.Name)
+	latency := time.Since(start)
+	if err != nil {
+		return probeResponse, errors.Wrapf(err, "failed to resolve '%s'", p.Name)
+	}
+
+	if p.MaxLatency > 0 && latency > p.MaxLatency {
+		return probeResponse, errors.New(fmt.Sprintf("Resolving '%s' took %v, exceeding %v", p.Name, latency, p.MaxLatency))
+	}
+
+	if missing := missingAddresses(addrs, p.ExpectedAddresses); len(missing) > 0 {
+		return probeResponse, errors.New(fmt.Sprintf("Resolving '%s' returned %s, missing expected %s", p.Name, strings.Join(addrs, ", "), strings.Join(missing, ", ")))
+	}
+
+	probeResponse.ApplicationHealthState = Healthy
+	return probeResponse, nil
+}
+
+func (p *DnsHealthProbe) address() string {
+	if p.Server != "" {
+		return p.Name + "@" + p.Server
+	}
+	return p.Name
+}
+
+func (p *DnsHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
+
+// missingAddresses returns the expected addresses not found in addrs. IP
+// addresses are compared in their canonical form.
+func missingAddresses(addrs, expected []string) []string {
+	found := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		found[canonicalIP(a)] = true
+	}
+	var missing []string
+	for _, e := range expected {
+		if !found[canonicalIP(e)] {
+			missing = append(missing, e)
+		}
+	}
+	return missing
+}
+
+func canonicalIP(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
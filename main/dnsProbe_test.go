@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// serveDns answers every A query received on conn with ip and every other
+// query with no answers.
+func serveDns(conn net.PacketConn, ip net.IP) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := buf[:n]
+		// skip the question name to find its type
+		i := 12
+		for i < n && query[i] != 0 {
+			i += int(query[i]) + 1
+		}
+		question := query[12 : i+5]
+		qtype := binary.BigEndian.Uint16(query[i+1 : i+3])
+
+		resp := make([]byte, 12)
+		copy(resp, query[:2])                        // id
+		binary.BigEndian.PutUint16(resp[2:], 0x8180) // response, recursion available
+		binary.BigEndian.PutUint16(resp[4:], 1)      // questions
+		resp = append(resp, question...)
+		if qtype == 1 {
+			binary.BigEndian.PutUint16(resp[6:], 1) // answers
+			resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			resp = append(resp, ip.To4()...)
+		}
+		conn.WriteTo(resp, addr)
+	}
+}
+
+func TestDnsHealthProbe_evaluate(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+	go serveDns(conn, net.ParseIP("10.0.0.7"))
+
+	ctx := log.NewContext(log.NewNopLogger())
+	probe := NewDnsHealthProbe("app.contoso.internal", conn.LocalAddr().String(), 0, nil, 5*time.Second)
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probe.ExpectedAddresses = []string{"10.0.0.7"}
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probe.ExpectedAddresses = []string{"10.0.0.8"}
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "returned 10.0.0.7, missing expected 10.0.0.8")
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	probe.ExpectedAddresses = nil
+	probe.MaxLatency = time.Nanosecond
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "exceeding 1ns")
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
+
+func TestDnsHealthProbe_evaluate_ServerDown(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	server := conn.LocalAddr().String()
+	conn.Close()
+
+	probe := NewDnsHealthProbe("app.contoso.internal", server, 0, nil, time.Second)
+	probeResponse, err := probe.evaluate(log.NewContext(log.NewNopLogger()))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to resolve 'app.contoso.internal'")
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
+
+func TestNewDnsHealthProbe_DefaultServerPort(t *testing.T) {
+	require.Equal(t, "10.0.0.10:53", NewDnsHealthProbe("a", "10.0.0.10", 0, nil, time.Second).Server)
+	require.Equal(t, "10.0.0.10:5353", NewDnsHealthProbe("a", "10.0.0.10:5353", 0, nil, time.Second).Server)
+	require.Equal(t, "a", NewDnsHealthProbe("a", "", 0, nil, time.Second).address())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// durationSettingPattern matches the Go duration strings accepted by the
+// duration settings, such as "500ms", "1m30s" or "2h".
+const durationSettingPattern = `^([0-9]+(\\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$`
+
+// durationSetting is a duration setting, either an integer number of seconds
+// or a Go duration string such as "500ms" or "2m", which can express
+// sub-second durations.
+type durationSetting time.Duration
+
+// seconds returns the duration setting of n seconds.
+func seconds(n int) durationSetting {
+	return durationSetting(time.Duration(n) * time.Second)
+}
+
+func (d durationSetting) duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d *durationSetting) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(b, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.Wrapf(err, "invalid duration '%s'", s)
+		}
+		*d = durationSetting(v)
+		return nil
+	}
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return errors.Wrapf(err, "invalid number of seconds '%s'", b)
+	}
+	*d = seconds(n)
+	return nil
+}
+
+// MarshalJSON normalizes the duration as a number of seconds when it is a
+// whole number of seconds, as a Go duration string otherwise.
+func (d durationSetting) MarshalJSON() ([]byte, error) {
+	if d.duration()%time.Second == 0 {
+		return []byte(strconv.FormatInt(int64(d.duration()/time.Second), 10)), nil
+	}
+	return json.Marshal(d.duration().String())
+}
+
+// validateDurationSetting checks that the duration setting, when set, is
+// within its range, the schema only checking the range of the integer
+// numbers of seconds.
+func validateDurationSetting(name string, d durationSetting, min, max time.Duration) error {
+	if d == 0 || (d.duration() >= min && d.duration() <= max) {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("'%s' must be between %v and %v", name, min, max))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurationSetting_json(t *testing.T) {
+	for _, tc := range []struct {
+		json       string
+		value      durationSetting
+		normalized string
+	}{
+		{`30`, seconds(30), `30`},
+		{`"30s"`, seconds(30), `30`},
+		{`"1m30s"`, seconds(90), `90`},
+		{`"500ms"`, durationSetting(500 * time.Millisecond), `"500ms"`},
+		{`"1.5s"`, durationSetting(1500 * time.Millisecond), `"1.5s"`},
+	} {
+		var d durationSetting
+		require.Nil(t, json.Unmarshal([]byte(tc.json), &d), tc.json)
+		require.Equal(t, tc.value, d, tc.json)
+		b, err := json.Marshal(d)
+		require.Nil(t, err)
+		require.Equal(t, tc.normalized, string(b), tc.json)
+	}
+
+	var d durationSetting
+	require.NotNil(t, json.Unmarshal([]byte(`"5 seconds"`), &d))
+	require.NotNil(t, json.Unmarshal([]byte(`1.5`), &d))
+}
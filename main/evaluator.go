@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// healthEvaluator turns the states observed by consecutive evaluations of a
+// probe into the committed health state (the state written to the status file).
+//
+// The committed health status initially does not have a state. In order to
+// change the state in the status file, the following must be observed:
+//  1. Healthy status observed once when committed state is unknown
+//  2. A different status is observed numberOfProbes consecutive times
+//
+// Example: Committed state = healthy, numberOfProbes = 3
+// In order to change committed state to unhealthy, the probe needs to be unhealthy 3 consecutive times
+//
+// The committed health state will remain in 'Initializing' state until any of the following occurs:
+//  1. Grace period expires, then application will either be Unknown/Unhealthy depending on probe type
+//  2. A valid health state is observed numberOfProbes consecutive times
+type healthEvaluator struct {
+	probe                HealthProbe
+	numberOfProbes       int
+	gracePeriod          time.Duration
+	honorGracePeriod     bool
+	gracePeriodStart     time.Duration
+	gracePeriodExpiredAt time.Time
+	numConsecutiveProbes int
+	prevState            HealthStatus
+	committedState       HealthStatus
+
+	// clock measures the grace period on its monotonic time, replaced in tests.
+	clock clock
+}
+
+func newHealthEvaluator(ctx *log.Context, probe HealthProbe, numberOfProbes int, gracePeriod time.Duration) *healthEvaluator {
+	e := &healthEvaluator{
+		probe:            probe,
+		numberOfProbes:   numberOfProbes,
+		gracePeriod:      gracePeriod,
+		honorGracePeriod: gracePeriod > 0,
+		gracePeriodStart: systemClock{}.monotonic(),
+		prevState:        Empty,
+		committedState:   Empty,
+		clock:            systemClock{},
+	}
+
+	if !e.honorGracePeriod {
+		ctx.Log("event", "Grace period not set")
+	} else {
+		ctx.Log("event", fmt.Sprintf("Grace period set to %v", e.gracePeriod))
+	}
+	return e
+}
+
+// observe records the state returned by the latest probe evaluation and
+// returns the resulting committed state.
+func (e *healthEvaluator) observe(ctx *log.Context, state HealthStatus) HealthStatus {
+	// Only increment if it's a repeat of the previous
+	if e.prevState == state {
+		e.numConsecutiveProbes++
+		// Log stage changes and also reset consecutive count to 1 as a new state was observed
+	} else {
+		ctx.Log("event", "Health state changed to "+strings.ToLower(string(state)))
+		e.numConsecutiveProbes = 1
+		e.prevState = state
+	}
+
+	if e.honorGracePeriod {
+		timeElapsed := e.clock.monotonic() - e.gracePeriodStart
+		// If grace period expires, application didn't initialize on time
+		if timeElapsed >= e.gracePeriod {
+			ctx.Log("event", fmt.Sprintf("No longer honoring grace period - expired. Time elapsed = %v", timeElapsed))
+			e.honorGracePeriod = false
+			state = e.probe.healthStatusAfterGracePeriodExpires()
+			e.prevState = e.probe.healthStatusAfterGracePeriodExpires()
+			e.numConsecutiveProbes = 1
+			e.committedState = Empty
+			e.gracePeriodExpiredAt = e.clock.now()
+			ctx.Log("event", "Grace period expired", "healthState", state)
+			// If grace period has not expired, check if we have consecutive valid probes
+		} else if (e.numConsecutiveProbes == e.numberOfProbes) && (state != e.probe.healthStatusAfterGracePeriodExpires()) && (state != Initializing) {
+			ctx.Log("event", fmt.Sprintf("No longer honoring grace period - successful probes. Time elapsed = %v", timeElapsed))
+			e.honorGracePeriod = false
+			// Application will be in Initializing state since we have not received consecutive valid health states
+		} else {
+			ctx.Log("event", fmt.Sprintf("Honoring grace period. Time elapsed = %v", timeElapsed))
+			state = Initializing
+		}
+	}
+
+	if (e.numConsecutiveProbes == e.numberOfProbes) || (e.committedState == Empty) {
+		if state != e.committedState {
+			e.committedState = state
+			ctx.Log("event", fmt.Sprintf("Committed health state is %s", strings.ToLower(string(e.committedState))))
+		}
+		// Only reset if we've observed consecutive probes in order to preserve previous observations when handling grace period
+		if e.numConsecutiveProbes == e.numberOfProbes {
+			e.numConsecutiveProbes = 0
+		}
+	}
+	return e.committedState
+}
+
+// pendingTransitionStatus describes, in the 'PendingTransition' substatus, the
+// progress of a transition of the committed state.
+type pendingTransitionStatus struct {
+	CommittedState HealthStatus `json:"committedState"`
+	CandidateState HealthStatus `json:"candidateState"`
+	Observed       int          `json:"observed"`
+	Required       int          `json:"required"`
+}
+
+// pendingTransitionSubstatus returns the substatus reporting the consecutive
+// observations of a state other than the committed state, while fewer than
+// numberOfProbes were observed, so that a transition can be seen building
+// rather than a sudden flip. The transitions of the grace period are reported
+// by its substatus instead.
+func (e *healthEvaluator) pendingTransitionSubstatus(name string) (SubstatusItem, bool, error) {
+	if e.honorGracePeriod || e.committedState == Empty || e.prevState == e.committedState ||
+		e.numConsecutiveProbes == 0 || e.numConsecutiveProbes >= e.numberOfProbes {
+		return SubstatusItem{}, false, nil
+	}
+	b, err := json.Marshal(pendingTransitionStatus{
+		CommittedState: e.committedState,
+		CandidateState: e.prevState,
+		Observed:       e.numConsecutiveProbes,
+		Required:       e.numberOfProbes,
+	})
+	if err != nil {
+		return SubstatusItem{}, false, err
+	}
+	return NewSubstatus(name, StatusTransitioning, string(b)), true, nil
+}
+
+// gracePeriodStatus describes the grace period in the 'GracePeriod' substatus.
+type gracePeriodStatus struct {
+	State              string       `json:"state"`
+	RemainingInSeconds *int         `json:"remainingInSeconds,omitempty"`
+	ExpiredAt          string       `json:"expiredAt,omitempty"`
+	HealthState        HealthStatus `json:"healthState,omitempty"`
+}
+
+// gracePeriodSubstatus returns the substatus reporting the remaining grace
+// period while it is honored, or its expiry once it expired. There is no
+// substatus once the grace period ended with consecutive valid probes.
+func (e *healthEvaluator) gracePeriodSubstatus(name string) (SubstatusItem, bool, error) {
+	var (
+		status     gracePeriodStatus
+		statusType StatusType
+	)
+	if e.honorGracePeriod {
+		remaining := int((e.gracePeriod - (e.clock.monotonic() - e.gracePeriodStart)).Seconds())
+		if remaining < 0 {
+			remaining = 0
+		}
+		status = gracePeriodStatus{State: "active", RemainingInSeconds: &remaining}
+		statusType = StatusTransitioning
+	} else if !e.gracePeriodExpiredAt.IsZero() {
+		status = gracePeriodStatus{
+			State:       "expired",
+			ExpiredAt:   e.gracePeriodExpiredAt.UTC().Format(time.RFC3339),
+			HealthState: e.probe.healthStatusAfterGracePeriodExpires(),
+		}
+		statusType = StatusWarning
+	} else {
+		return SubstatusItem{}, false, nil
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		return SubstatusItem{}, false, err
+	}
+	return NewSubstatus(name, statusType, string(b)), true, nil
+}
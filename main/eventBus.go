@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// busEventProbeCycle is published once the probes of a cycle were
+	// evaluated and the committed state decided.
+	busEventProbeCycle = "ProbeCycle"
+	// busEventStateTransition is published when the committed state changes.
+	busEventStateTransition = "StateTransition"
+	// busEventStatus is published with the status of each probe cycle.
+	busEventStatus = "Status"
+	// busEventResourceLimitExceeded is published when the extension exceeds
+	// one of its resource limits.
+	busEventResourceLimitExceeded = "ResourceLimitExceeded"
+)
+
+// busEvent is a notification published on the event bus. Only the fields of
+// its kind are set.
+type busEvent struct {
+	Kind string
+
+	// Start and End are the times of the probe cycle.
+	Start, End     time.Time
+	CommittedState HealthStatus
+	Apps           []*application
+
+	Transition stateTransition
+	Status     StatusReport
+	Exceeded   []string
+}
+
+// busHandler handles the events of a kind it subscribed to.
+type busHandler func(ctx *log.Context, e busEvent)
+
+// eventBus notifies the components of the extension, such as the status
+// writer, the telemetry emitter or the state file, of the probe results and
+// state transitions, so that a new sink subscribes to the bus rather than
+// being called from the prober loop. Events are delivered synchronously, in
+// the order of the subscriptions, on the goroutine publishing them: the
+// handlers run on the prober goroutine and must not block.
+type eventBus struct {
+	handlers map[string][]busHandler
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{handlers: make(map[string][]busHandler)}
+}
+
+// subscribe registers a handler of the events of kind.
+func (b *eventBus) subscribe(kind string, h busHandler) {
+	b.handlers[kind] = append(b.handlers[kind], h)
+}
+
+// publish delivers the event to the handlers of its kind.
+func (b *eventBus) publish(ctx *log.Context, e busEvent) {
+	for _, h := range b.handlers[e.Kind] {
+		h(ctx, e)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBus(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	bus := newEventBus()
+	// without subscribers, events are dropped
+	bus.publish(ctx, busEvent{Kind: busEventProbeCycle})
+
+	var received []string
+	bus.subscribe(busEventStateTransition, func(ctx *log.Context, e busEvent) {
+		received = append(received, "first "+string(e.Transition.To))
+	})
+	bus.subscribe(busEventStateTransition, func(ctx *log.Context, e busEvent) {
+		received = append(received, "second "+string(e.Transition.To))
+	})
+	bus.subscribe(busEventStatus, func(ctx *log.Context, e busEvent) {
+		received = append(received, "status")
+	})
+
+	bus.publish(ctx, busEvent{Kind: busEventStateTransition, Transition: stateTransition{From: Empty, To: Healthy}})
+	require.Equal(t, []string{"first Healthy", "second Healthy"}, received)
+}
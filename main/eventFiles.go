@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	eventFilePrefix = "events-"
+	eventFileSuffix = ".jsonl"
+)
+
+// eventFileSink writes each batch of telemetry events to its own file of the
+// events folder, one json event per line, for the agents of the VM collecting
+// the events from files. The files are named after an increasing sequence
+// number, resumed from the files already in the folder, and are optionally
+// gzip compressed. The folder is pruned after each file written, so that
+// frequent probes don't exhaust the disk or its inodes.
+type eventFileSink struct {
+	folder    string
+	compress  bool
+	retention eventsRetention
+	sequence  uint64
+}
+
+type eventFileRecord struct {
+	Name       string            `json:"name"`
+	Time       string            `json:"time"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+func newEventFileSink(folder string, compress bool, retention eventsRetention) *eventFileSink {
+	s := &eventFileSink{folder: folder, compress: compress, retention: retention}
+	files, _ := s.files()
+	if len(files) > 0 {
+		s.sequence = files[len(files)-1].sequence
+	}
+	return s
+}
+
+func (s *eventFileSink) name() string {
+	return "event files"
+}
+
+func (s *eventFileSink) send(events []telemetryEvent) error {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if s.compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	encoder := json.NewEncoder(w)
+	for _, event := range events {
+		if err := encoder.Encode(eventFileRecord{
+			Name:       event.Name,
+			Time:       event.Time.UTC().Format(time.RFC3339Nano),
+			Properties: event.Properties,
+		}); err != nil {
+			return err
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(s.folder, 0755); err != nil {
+		return errors.Wrap(err, "failed to create events folder")
+	}
+	s.sequence++
+	name := fmt.Sprintf("%s%010d%s", eventFilePrefix, s.sequence, eventFileSuffix)
+	if s.compress {
+		name += ".gz"
+	}
+	// written to a temporary file first, so that a collector never reads a
+	// partial batch
+	tmpFile, err := ioutil.TempFile(s.folder, "."+name)
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	tmpFile.Close()
+	err = ioutil.WriteFile(tmpFile.Name(), buf.Bytes(), 0644)
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "failed to write event file")
+	}
+	if err := os.Rename(tmpFile.Name(), filepath.Join(s.folder, name)); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "failed to move event file")
+	}
+	_, err = s.retention.prune(s.folder, time.Now())
+	return err
+}
+
+// eventFile is a file of the events folder.
+type eventFile struct {
+	name     string
+	sequence uint64
+}
+
+// files returns the event files of the folder, by increasing sequence number.
+func (s *eventFileSink) files() ([]eventFile, error) {
+	entries, err := ioutil.ReadDir(s.folder)
+	if err != nil {
+		return nil, err
+	}
+	var files []eventFile
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, eventFilePrefix) {
+			continue
+		}
+		i := strings.Index(name, eventFileSuffix)
+		if i < 0 {
+			continue
+		}
+		sequence, err := strconv.ParseUint(name[len(eventFilePrefix):i], 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, eventFile{name: name, sequence: sequence})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].sequence < files[j].sequence })
+	return files, nil
+}
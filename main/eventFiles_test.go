@@ -0,0 +1,66 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventFileSink_send(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	folder := filepath.Join(dir, "events")
+
+	s := newEventFileSink(folder, false, (&handlerSettings{}).eventsRetention())
+	events := []telemetryEvent{
+		{Name: telemetryEventProbeResult, Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Properties: map[string]string{"healthState": "Healthy"}},
+		{Name: telemetryEventHealthStateTransition, Time: time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC)},
+	}
+	require.Nil(t, s.send(events))
+	b, err := ioutil.ReadFile(filepath.Join(folder, "events-0000000001.jsonl"))
+	require.Nil(t, err)
+	require.Equal(t, `{"name":"ProbeResult","time":"2024-01-01T00:00:00Z","properties":{"healthState":"Healthy"}}
+{"name":"HealthStateTransition","time":"2024-01-01T00:00:01Z"}
+`, string(b))
+
+	// the sequence is resumed from the files of the folder
+	s = newEventFileSink(folder, true, (&handlerSettings{}).eventsRetention())
+	require.Nil(t, s.send(events[:1]))
+	f, err := os.Open(filepath.Join(folder, "events-0000000002.jsonl.gz"))
+	require.Nil(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.Nil(t, err)
+	b, err = ioutil.ReadAll(gz)
+	require.Nil(t, err)
+	require.Equal(t, `{"name":"ProbeResult","time":"2024-01-01T00:00:00Z","properties":{"healthState":"Healthy"}}
+`, string(b))
+}
+
+func TestEventFileSink_prune(t *testing.T) {
+	folder, err := ioutil.TempDir("", "events")
+	require.Nil(t, err)
+	defer os.RemoveAll(folder)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(folder, "collector.state"), nil, 0644))
+	old := time.Now().Add(-time.Hour)
+	require.Nil(t, os.Chtimes(filepath.Join(folder, "collector.state"), old, old))
+
+	// the folder is pruned after each file written, the oldest files first
+	s := newEventFileSink(folder, false, eventsRetention{maxFiles: 3, maxAge: time.Hour, maxBytes: 1024 * 1024})
+	for i := 0; i < 5; i++ {
+		require.Nil(t, s.send([]telemetryEvent{{Name: telemetryEventProbeResult}}))
+	}
+	entries, err := ioutil.ReadDir(folder)
+	require.Nil(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{"events-0000000003.jsonl", "events-0000000004.jsonl", "events-0000000005.jsonl"}, names)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// eventsJanitorInterval is the interval at which the events folders are
+	// pruned, besides the pruning following each event file written.
+	eventsJanitorInterval = time.Hour
+
+	defaultEventsMaxFiles    = 100
+	defaultEventsMaxAge      = 7 * 24 * time.Hour
+	defaultEventsMaxSizeInMB = 64
+)
+
+// eventsRetention bounds the files of an events folder, which the agents of
+// the VM don't always collect, so that it doesn't fill up the disk or exhaust
+// its inodes over months.
+type eventsRetention struct {
+	maxFiles int
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+// retainedFile is a file of an events folder.
+type retainedFile struct {
+	name    string
+	modTime time.Time
+	size    int64
+}
+
+// prune removes the files of the folder older than maxAge, then the oldest
+// files until at most maxFiles, of at most maxBytes in total, are left. The
+// temporary files, whose name starts with a dot, and the subfolders are left
+// alone. It returns the number of files removed.
+func (r eventsRetention) prune(folder string, now time.Time) (int, error) {
+	entries, err := ioutil.ReadDir(folder)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "failed to list events folder")
+	}
+	var files []retainedFile
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		files = append(files, retainedFile{name: e.Name(), modTime: e.ModTime(), size: e.Size()})
+		total += e.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.Before(files[j].modTime)
+		}
+		return files[i].name < files[j].name
+	})
+
+	removed := 0
+	for len(files) > 0 && (now.Sub(files[0].modTime) > r.maxAge || len(files) > r.maxFiles || total > r.maxBytes) {
+		if err := os.Remove(filepath.Join(folder, files[0].name)); err != nil && !os.IsNotExist(err) {
+			return removed, errors.Wrap(err, "failed to remove event file")
+		}
+		removed++
+		total -= files[0].size
+		files = files[1:]
+	}
+	return removed, nil
+}
+
+// newEventsJanitor returns the service pruning the events folders, when
+// started and then every eventsJanitorInterval, or nil without any folder.
+func newEventsJanitor(ctx *log.Context, retention eventsRetention, folders ...string) *loopService {
+	var pruned []string
+	for _, folder := range folders {
+		if folder != "" && !containsString(pruned, folder) {
+			pruned = append(pruned, folder)
+		}
+	}
+	if len(pruned) == 0 {
+		return nil
+	}
+	return newLoopService("events janitor", func(stop <-chan struct{}) error {
+		ticker := time.NewTicker(eventsJanitorInterval)
+		defer ticker.Stop()
+		for {
+			for _, folder := range pruned {
+				if removed, err := retention.prune(folder, time.Now()); err != nil {
+					ctx.Log("error", err, "folder", folder)
+				} else if removed > 0 {
+					ctx.Log("event", "pruned events folder", "folder", folder, "removed", removed)
+				}
+			}
+			select {
+			case <-stop:
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// writeEventFile writes a file of the events folder, last modified age ago.
+func writeEventFile(t *testing.T, folder, name string, size int, age time.Duration) {
+	path := filepath.Join(folder, name)
+	require.Nil(t, ioutil.WriteFile(path, make([]byte, size), 0644))
+	modTime := time.Now().Add(-age)
+	require.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+func eventFileNames(t *testing.T, folder string) []string {
+	entries, err := ioutil.ReadDir(folder)
+	require.Nil(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestEventsRetention_prune(t *testing.T) {
+	folder, err := ioutil.TempDir("", "events")
+	require.Nil(t, err)
+	defer os.RemoveAll(folder)
+	r := eventsRetention{maxFiles: 3, maxAge: 24 * time.Hour, maxBytes: 1000}
+
+	// older than the maximum age
+	writeEventFile(t, folder, "a.json", 10, 48*time.Hour)
+	writeEventFile(t, folder, "b.json", 10, time.Hour)
+	removed, err := r.prune(folder, time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, []string{"b.json"}, eventFileNames(t, folder))
+
+	// beyond the maximum number of files, the oldest first
+	writeEventFile(t, folder, "c.json", 10, 50*time.Minute)
+	writeEventFile(t, folder, "d.json", 10, 40*time.Minute)
+	writeEventFile(t, folder, "e.json", 10, 30*time.Minute)
+	removed, err = r.prune(folder, time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, []string{"c.json", "d.json", "e.json"}, eventFileNames(t, folder))
+
+	// beyond the maximum size
+	writeEventFile(t, folder, "f.json", 1000, 20*time.Minute)
+	removed, err = r.prune(folder, time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 3, removed)
+	require.Equal(t, []string{"f.json"}, eventFileNames(t, folder))
+
+	// the temporary files and the subfolders are left alone
+	writeEventFile(t, folder, ".events-0000000001.jsonl123", 10, 48*time.Hour)
+	require.Nil(t, os.Mkdir(filepath.Join(folder, "signals"), 0755))
+	removed, err = r.prune(folder, time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 0, removed)
+	require.Equal(t, []string{".events-0000000001.jsonl123", "f.json", "signals"}, eventFileNames(t, folder))
+
+	// a missing folder has nothing to prune
+	removed, err = r.prune(filepath.Join(folder, "missing"), time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 0, removed)
+}
+
+func TestNewEventsJanitor(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	require.Nil(t, newEventsJanitor(ctx, eventsRetention{}, "", ""))
+
+	folder, err := ioutil.TempDir("", "events")
+	require.Nil(t, err)
+	defer os.RemoveAll(folder)
+	writeEventFile(t, folder, "a.json", 10, 48*time.Hour)
+	writeEventFile(t, folder, "b.json", 10, time.Hour)
+
+	// the folders are pruned once started
+	janitor := newEventsJanitor(ctx, eventsRetention{maxFiles: 10, maxAge: 24 * time.Hour, maxBytes: 1000}, folder, folder)
+	require.NotNil(t, janitor)
+	require.Nil(t, janitor.start(ctx))
+	janitor.stop()
+	require.Equal(t, []string{"b.json"}, eventFileNames(t, folder))
+	require.Equal(t, serviceHealth{Name: "events janitor"}, janitor.health())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+)
+
+// FallbackHealthProbe probes a primary target and, when nothing listens on it
+// (the connection is refused), a fallback target, such as the old and the new
+// port of an application during an in-place deployment. The response reports
+// the target which produced it.
+type FallbackHealthProbe struct {
+	Primary  HealthProbe
+	Fallback HealthProbe
+
+	// usingFallback records whether the last response came from the fallback
+	// target, to log the switches between targets.
+	usingFallback bool
+}
+
+func NewFallbackHealthProbe(primary, fallback HealthProbe) *FallbackHealthProbe {
+	return &FallbackHealthProbe{Primary: primary, Fallback: fallback}
+}
+
+func (p *FallbackHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	probeResponse, err := p.Primary.evaluate(ctx)
+	if err == nil || probeResponse.ProbeDetails.Failure != probeFailureConnectionRefused {
+		if p.usingFallback {
+			ctx.Log("event", "probing the primary target "+p.Primary.address()+" again")
+			p.usingFallback = false
+		}
+		probeResponse.ProbeDetails.Target = p.Primary.address()
+		return probeResponse, err
+	}
+
+	if !p.usingFallback {
+		ctx.Log("event", "primary target "+p.Primary.address()+" refused the connection, probing the fallback target "+p.Fallback.address())
+		p.usingFallback = true
+	}
+	probeResponse, err = p.Fallback.evaluate(ctx)
+	probeResponse.ProbeDetails.Target = p.Fallback.address()
+	return probeResponse, err
+}
+
+func (p *FallbackHealthProbe) address() string {
+	return p.Primary.address()
+}
+
+func (p *FallbackHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return p.Primary.healthStatusAfterGracePeriodExpires()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackHealthProbe(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	fallback, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	defer fallback.Close()
+	// a port nothing listens on
+	primary, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	primaryPort := primary.Addr().(*net.TCPAddr).Port
+	fallbackPort := fallback.Addr().(*net.TCPAddr).Port
+	primary.Close()
+
+	p := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{Protocol: "tcp", Port: primaryPort, FallbackPort: fallbackPort}}, 0)
+	require.IsType(t, &FallbackHealthProbe{}, p)
+	require.Equal(t, "localhost:"+strconv.Itoa(primaryPort), p.address())
+
+	// the primary target refuses the connection
+	probeResponse, err := p.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, "localhost:"+strconv.Itoa(fallbackPort), probeResponse.ProbeDetails.Target)
+
+	// the primary target is back
+	primary, err = net.Listen("tcp", "localhost:"+strconv.Itoa(primaryPort))
+	require.Nil(t, err)
+	defer primary.Close()
+	probeResponse, err = p.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, "localhost:"+strconv.Itoa(primaryPort), probeResponse.ProbeDetails.Target)
+
+	// other failures of the primary target are reported as is
+	inner := &scriptedProbe{errs: []error{timeoutError{}}}
+	p = NewFallbackHealthProbe(inner, &scriptedProbe{})
+	probeResponse, err = p.evaluate(ctx)
+	require.Equal(t, timeoutError{}, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+	require.Equal(t, "scripted", probeResponse.ProbeDetails.Target)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultFastcgiRequestPath      = "/ping"
+	maxFastcgiResponseSizeInBytes  = 64 * 1024
+	fastcgiVersion                 = 1
+	fastcgiRequestID               = 1
+	fastcgiRoleResponder           = 1
+	fastcgiRequestComplete         = 0
+	fastcgiMaxRecordContentLength  = 65535
+	fastcgiTypeBeginRequest        = 1
+	fastcgiTypeEndRequest          = 3
+	fastcgiTypeParams              = 4
+	fastcgiTypeStdin               = 5
+	fastcgiTypeStdout              = 6
+	fastcgiTypeStderr              = 7
+	fastcgiRecordHeaderLength      = 8
+	fastcgiEndRequestContentLength = 8
+)
+
+// FastcgiHealthProbe sends a GET request over the FastCGI protocol to a local
+// port or unix socket, such as the ping path of php-fpm, and considers the
+// application healthy when the response status is 2xx.
+type FastcgiHealthProbe struct {
+	Network     string
+	Address     string
+	RequestPath string
+	Timeout     time.Duration
+}
+
+// NewFastcgiHealthProbe creates the probe of a local port, or of a unix socket
+// when socketPath is set.
+func NewFastcgiHealthProbe(socketPath string, port int, requestPath string, timeout time.Duration) *FastcgiHealthProbe {
+	if requestPath == "" {
+		requestPath = defaultFastcgiRequestPath
+	}
+	p := &FastcgiHealthProbe{
+		Network:     "tcp",
+		Address:     "localhost:" + strconv.Itoa(port),
+		RequestPath: requestPath,
+		Timeout:     timeout,
+	}
+	if socketPath != "" {
+		p.Network, p.Address = "unix", socketPath
+	}
+	return p
+}
+
+func (p *FastcgiHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unhealthy
+
+	conn, err := net.DialTimeout(p.Network, p.Address, p.Timeout)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(p.Timeout)); err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureConnection
+		return probeResponse, err
+	}
+
+	if _, err := conn.Write(fastcgiRequest(p.params())); err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, err
+	}
+	stdout, stderr, err := readFastcgiResponse(conn)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, err
+	}
+	if len(stderr) > 0 {
+		ctx.Log("event", "FastCGI application error output", "stderr", bodyExcerpt(stderr))
+	}
+
+	status, body, err := parseCgiResponse(stdout)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureBadBody
+		return probeResponse, err
+	}
+	if status < 200 || status > 299 {
+		probeResponse.ProbeDetails.Failure = probeFailureBadStatus
+		probeResponse.ProbeDetails.BodyExcerpt = bodyExcerpt(body)
+		return probeResponse, errors.New(fmt.Sprintf("Unsuccessful FastCGI response status code %v", status))
+	}
+
+	probeResponse.ApplicationHealthState = Healthy
+	return probeResponse, nil
+}
+
+func (p *FastcgiHealthProbe) address() string {
+	return p.Address + p.RequestPath
+}
+
+func (p *FastcgiHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
+
+// params returns the CGI variables of the request. php-fpm resolves the
+// script, or its ping and status paths, from SCRIPT_NAME and SCRIPT_FILENAME.
+func (p *FastcgiHealthProbe) params() [][2]string {
+	path, query := p.RequestPath, ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	return [][2]string{
+		{"GATEWAY_INTERFACE", "CGI/1.1"},
+		{"SERVER_SOFTWARE", defaultUserAgent},
+		{"SERVER_PROTOCOL", "HTTP/1.1"},
+		{"SERVER_NAME", "localhost"},
+		{"REMOTE_ADDR", "127.0.0.1"},
+		{"REQUEST_METHOD", "GET"},
+		{"REQUEST_URI", p.RequestPath},
+		{"SCRIPT_NAME", path},
+		{"SCRIPT_FILENAME", path},
+		{"QUERY_STRING", query},
+	}
+}
+
+// fastcgiRequest encodes a responder request with the given parameters and
+// an empty body.
+func fastcgiRequest(params [][2]string) []byte {
+	var buf bytes.Buffer
+	beginRequest := []byte{0, fastcgiRoleResponder, 0, 0, 0, 0, 0, 0}
+	writeFastcgiRecord(&buf, fastcgiTypeBeginRequest, beginRequest)
+
+	var encoded bytes.Buffer
+	for _, param := range params {
+		writeFastcgiLength(&encoded, len(param[0]))
+		writeFastcgiLength(&encoded, len(param[1]))
+		encoded.WriteString(param[0])
+		encoded.WriteString(param[1])
+	}
+	for b := encoded.Bytes(); len(b) > 0; {
+		n := len(b)
+		if n > fastcgiMaxRecordContentLength {
+			n = fastcgiMaxRecordContentLength
+		}
+		writeFastcgiRecord(&buf, fastcgiTypeParams, b[:n])
+		b = b[n:]
+	}
+	// empty records terminate the params and stdin streams
+	writeFastcgiRecord(&buf, fastcgiTypeParams, nil)
+	writeFastcgiRecord(&buf, fastcgiTypeStdin, nil)
+	return buf.Bytes()
+}
+
+func writeFastcgiRecord(buf *bytes.Buffer, recordType byte, content []byte) {
+	padding := (8 - len(content)%8) % 8
+	header := []byte{fastcgiVersion, recordType, 0, fastcgiRequestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	buf.Write(header)
+	buf.Write(content)
+	buf.Write(make([]byte, padding))
+}
+
+// writeFastcgiLength encodes the length of a name or value: in one byte below
+// 128, in four bytes with the high bit set otherwise.
+func writeFastcgiLength(buf *bytes.Buffer, n int) {
+	if n < 128 {
+		buf.WriteByte(byte(n))
+		return
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n)|1<<31)
+	buf.Write(b[:])
+}
+
+// readFastcgiResponse reads the records of the response until the end of the
+// request and returns the stdout and stderr streams.
+func readFastcgiResponse(r io.Reader) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	header := make([]byte, fastcgiRecordHeaderLength)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, nil, errors.New("FastCGI connection closed before the end of the request")
+			}
+			return nil, nil, err
+		}
+		if header[0] != fastcgiVersion {
+			return nil, nil, errors.New(fmt.Sprintf("Unsupported FastCGI record version %d", header[0]))
+		}
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:6]))+int(header[6]))
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read FastCGI record")
+		}
+		content = content[:binary.BigEndian.Uint16(header[4:6])]
+
+		switch header[1] {
+		case fastcgiTypeStdout:
+			stdout.Write(content)
+		case fastcgiTypeStderr:
+			stderr.Write(content)
+		case fastcgiTypeEndRequest:
+			if len(content) < fastcgiEndRequestContentLength {
+				return nil, nil, errors.New("Invalid FastCGI end request record")
+			}
+			if protocolStatus := content[4]; protocolStatus != fastcgiRequestComplete {
+				return nil, nil, errors.New(fmt.Sprintf("FastCGI request rejected with protocol status %d", protocolStatus))
+			}
+			return stdout.Bytes(), stderr.Bytes(), nil
+		}
+		if stdout.Len()+stderr.Len() > maxFastcgiResponseSizeInBytes {
+			return nil, nil, errors.New(fmt.Sprintf("FastCGI response exceeds the maximum allowed size of %d bytes", maxFastcgiResponseSizeInBytes))
+		}
+	}
+}
+
+// parseCgiResponse parses the headers of a CGI response and returns its
+// status, 200 unless a Status header is set, and its body.
+func parseCgiResponse(stdout []byte) (int, []byte, error) {
+	r := bufio.NewReader(bytes.NewReader(stdout))
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return 0, nil, errors.Wrap(err, "Invalid FastCGI response headers")
+	}
+	body, _ := ioutil.ReadAll(r)
+
+	status := 200
+	if value := header.Get("Status"); value != "" {
+		fields := strings.Fields(value)
+		if status, err = strconv.Atoi(fields[0]); err != nil {
+			return 0, nil, errors.New(fmt.Sprintf("Invalid FastCGI response status '%s'", value))
+		}
+	}
+	return status, body, nil
+}
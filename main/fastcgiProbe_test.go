@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func serveFastcgi(t *testing.T, l net.Listener) {
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.Write([]byte("pong"))
+		case "/status":
+			require.Equal(t, "json", r.URL.Query().Get("format"))
+			w.Write([]byte(`{"pool": "www"}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("pool is shutting down"))
+		}
+	}))
+}
+
+func TestFastcgiHealthProbe_evaluate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	serveFastcgi(t, l)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewFastcgiHealthProbe("", l.Addr().(*net.TCPAddr).Port, "", 5*time.Second)
+	require.Equal(t, "/ping", probe.RequestPath)
+	probe.Address = l.Addr().String()
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probe.RequestPath = "/status?format=json"
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probe.RequestPath = "/unknown"
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, "Unsuccessful FastCGI response status code 503", err.Error())
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureBadStatus, probeResponse.ProbeDetails.Failure)
+	require.Equal(t, "pool is shutting down", probeResponse.ProbeDetails.BodyExcerpt)
+}
+
+func TestFastcgiHealthProbe_evaluate_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fastcgi")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "php-fpm.sock")
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewFastcgiHealthProbe(socketPath, 0, "/ping", 5*time.Second)
+	require.Equal(t, socketPath+"/ping", probe.address())
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	l, err := net.Listen("unix", socketPath)
+	require.Nil(t, err)
+	defer l.Close()
+	serveFastcgi(t, l)
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+}
+
+func TestFastcgiRequest_longParams(t *testing.T) {
+	value := strings.Repeat("a", 200)
+	request := fastcgiRequest([][2]string{{"QUERY_STRING", value}})
+
+	// begin request record, then the params record
+	params := request[fastcgiRecordHeaderLength+8:]
+	require.Equal(t, byte(fastcgiTypeParams), params[1])
+	content := params[fastcgiRecordHeaderLength:]
+	require.Equal(t, byte(len("QUERY_STRING")), content[0])
+	require.Equal(t, []byte{0x80, 0, 0, 200}, content[1:5])
+	require.True(t, bytes.HasPrefix(content[5:], []byte("QUERY_STRING"+value)))
+}
+
+func TestParseCgiResponse(t *testing.T) {
+	status, body, err := parseCgiResponse([]byte("Content-Type: text/plain\r\n\r\npong"))
+	require.Nil(t, err)
+	require.Equal(t, 200, status)
+	require.Equal(t, "pong", string(body))
+
+	status, body, err = parseCgiResponse([]byte("Status: 404 Not Found\r\nContent-Type: text/html\r\n\r\nFile not found."))
+	require.Nil(t, err)
+	require.Equal(t, 404, status)
+	require.Equal(t, "File not found.", string(body))
+
+	_, _, err = parseCgiResponse([]byte("Status: ok\r\n\r\n"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Invalid FastCGI response status 'ok'")
+}
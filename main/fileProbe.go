@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// FileHealthProbe considers the application healthy while a sentinel file
+// exists and, if MaxAge is set, has been modified recently. When ParseState is
+// set, the file content is parsed like the body of an http probe response.
+type FileHealthProbe struct {
+	Path                       string
+	MaxAge                     time.Duration
+	ParseState                 bool
+	MaxResponseBodySizeInBytes int64
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+}
+
+func NewFileHealthProbe(path string, maxAge time.Duration, parseState bool) *FileHealthProbe {
+	return &FileHealthProbe{
+		Path:                       path,
+		MaxAge:                     maxAge,
+		ParseState:                 parseState,
+		MaxResponseBodySizeInBytes: int64(defaultMaxResponseBodySizeInBytes),
+		now:                        time.Now,
+	}
+}
+
+func (p *FileHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unhealthy
+
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return probeResponse, errors.Wrap(err, "failed to open sentinel file")
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return probeResponse, errors.Wrap(err, "failed to stat sentinel file")
+	}
+	if age := p.now().Sub(fi.ModTime()); p.MaxAge > 0 && age > p.MaxAge {
+		return probeResponse, errors.New(fmt.Sprintf("Sentinel file was last modified %v ago, exceeding %v", age.Round(time.Second), p.MaxAge))
+	}
+
+	if !p.ParseState {
+		probeResponse.ApplicationHealthState = Healthy
+		return probeResponse, nil
+	}
+
+	probeResponse, err = parseProbeResponse(newSizeLimitedReader(f, p.MaxResponseBodySizeInBytes), dependencyAggregationIgnoreOptional)
+	if err != nil {
+		if err == errEmptyResponseBody {
+			err = errors.New("Sentinel file is empty")
+		}
+		probeResponse.ApplicationHealthState = Unknown
+		return probeResponse, err
+	}
+
+	if err := probeResponse.validateCustomMetrics(); err != nil {
+		ctx.Log("error", err)
+	}
+	return probeResponse, nil
+}
+
+func (p *FileHealthProbe) address() string {
+	return p.Path
+}
+
+func (p *FileHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
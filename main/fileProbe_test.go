@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileHealthProbe_evaluate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "healthy")
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewFileHealthProbe(path, time.Minute, false)
+
+	// missing file
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	// fresh file
+	require.Nil(t, ioutil.WriteFile(path, nil, 0644))
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// stale file
+	probe.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "exceeding 1m0s")
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	// no maximum age
+	probe.MaxAge = 0
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+}
+
+func TestFileHealthProbe_evaluate_ParseState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewFileHealthProbe(path, time.Minute, true)
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(`{"ApplicationHealthState": "Unhealthy"}`), 0644))
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(`{"ApplicationHealthState": "Healthy"}`), 0644))
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(`{"ApplicationHealthState": "Busy"}`), 0644))
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+
+	require.Nil(t, ioutil.WriteFile(path, nil, 0644))
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, "Sentinel file is empty", err.Error())
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+}
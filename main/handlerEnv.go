@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+)
+
+// degradedEnvironmentStatusMessage is the status message of an extension
+// running with a degraded handler environment.
+const degradedEnvironmentStatusMessage = "Extension running degraded, the handler environment is invalid: %s"
+
+// handlerEnvDegradation holds the reasons the extension runs with a degraded
+// handler environment, empty when HandlerEnvironment.json is valid.
+var handlerEnvDegradation []string
+
+// handlerPathsEnvPrefix prefixes the environment variables overriding the
+// folders of the handler environment, such as APPHEALTH_STATUS_FOLDER, for
+// tests and non-standard agent layouts.
+const handlerPathsEnvPrefix = "APPHEALTH_"
+
+// handlerPaths are the folders the extension reads its settings from and
+// writes its status, logs, events and state to, as given by the handler
+// environment unless overridden.
+type handlerPaths struct {
+	config string
+	status string
+	log    string
+	events string
+	data   string
+}
+
+// newHandlerPaths returns the folders of the handler environment, with the
+// eventsFolder the vmextension package doesn't parse, overridden by the
+// environment variables returned by getenv.
+func newHandlerPaths(hEnv vmextension.HandlerEnvironment, eventsFolder string, getenv func(string) string) handlerPaths {
+	p := handlerPaths{
+		config: hEnv.HandlerEnvironment.ConfigFolder,
+		status: hEnv.HandlerEnvironment.StatusFolder,
+		log:    hEnv.HandlerEnvironment.LogFolder,
+		events: eventsFolder,
+		data:   dataDir,
+	}
+	for name, folder := range map[string]*string{
+		"CONFIG_FOLDER": &p.config,
+		"STATUS_FOLDER": &p.status,
+		"LOG_FOLDER":    &p.log,
+		"EVENTS_FOLDER": &p.events,
+		"DATA_FOLDER":   &p.data,
+	} {
+		if v := getenv(handlerPathsEnvPrefix + name); v != "" {
+			*folder = v
+		}
+	}
+	return p
+}
+
+// findHandlerPaths returns the folders of the handler environment, failing
+// when it can't be parsed.
+func findHandlerPaths() (handlerPaths, error) {
+	hEnv, eventsFolder, err := getHandlerEnv()
+	if err != nil {
+		return handlerPaths{}, err
+	}
+	return newHandlerPaths(hEnv, eventsFolder, os.Getenv), nil
+}
+
+// getHandlerEnv reads the handler environment the way
+// vmextension.GetHandlerEnv does, next to or one level above the executable,
+// also returning its eventsFolder which the vmextension package predates.
+func getHandlerEnv() (vmextension.HandlerEnvironment, string, error) {
+	var hEnv vmextension.HandlerEnvironment
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		return hEnv, "", fmt.Errorf("cannot find base directory of the running process: %v", err)
+	}
+	paths := []string{
+		filepath.Join(dir, vmextension.HandlerEnvFileName),
+		filepath.Join(dir, "..", vmextension.HandlerEnvFileName),
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return hEnv, "", fmt.Errorf("error examining HandlerEnvironment at '%s': %v", path, err)
+		}
+		hEnv, err = vmextension.ParseHandlerEnv(b)
+		if err != nil {
+			return hEnv, "", err
+		}
+		return hEnv, parseEventsFolder(b), nil
+	}
+	return hEnv, "", fmt.Errorf("cannot find HandlerEnvironment at paths: %s", strings.Join(paths, ", "))
+}
+
+// parseEventsFolder returns the eventsFolder of a parsed handler environment,
+// "" when the agent doesn't provide one.
+func parseEventsFolder(b []byte) string {
+	var hf []struct {
+		HandlerEnvironment struct {
+			EventsFolder string `json:"eventsFolder"`
+		} `json:"handlerEnvironment"`
+	}
+	if err := json.Unmarshal(b, &hf); err != nil || len(hf) != 1 {
+		return ""
+	}
+	return hf[0].HandlerEnvironment.EventsFolder
+}
+
+// configFolder returns the folder of the settings files.
+func (p handlerPaths) configFolder() string {
+	return p.config
+}
+
+// statusFolder returns the folder the status files are written to.
+func (p handlerPaths) statusFolder() string {
+	return p.status
+}
+
+// logFolder returns the folder of the extension logs.
+func (p handlerPaths) logFolder() string {
+	return p.log
+}
+
+// eventsFolder returns the folder the agent collects extension events from, ""
+// when the agent doesn't provide one.
+func (p handlerPaths) eventsFolder() string {
+	return p.events
+}
+
+// dataFolder returns the folder of the persisted extension state.
+func (p handlerPaths) dataFolder() string {
+	return p.data
+}
+
+// loadHandlerPaths returns the folders of the handler environment along with
+// the reasons it is degraded. Rather than failing outright when
+// HandlerEnvironment.json is malformed or names missing folders, the extension
+// falls back to the folders of the extension next to the executable and to a
+// temporary log folder, so that it still probes and reports the application.
+func loadHandlerPaths() (handlerPaths, []string) {
+	hEnv, eventsFolder, err := getHandlerEnv()
+	if err != nil {
+		hEnv, eventsFolder = vmextension.HandlerEnvironment{}, ""
+	}
+	return newHandlerPaths(hEnv, eventsFolder, os.Getenv).resolve(err, extensionDir(), filepath.Join(os.TempDir(), "apphealth"))
+}
+
+// resolve replaces the folders which are not usable by the folders of extDir
+// and tempLogFolder, parseErr being the failure to parse the handler
+// environment.
+func (p handlerPaths) resolve(parseErr error, extDir, tempLogFolder string) (handlerPaths, []string) {
+	var reasons []string
+	if parseErr != nil {
+		reasons = append(reasons, fmt.Sprintf("failed to parse %s: %v", vmextension.HandlerEnvFileName, parseErr))
+	}
+
+	// the settings are only read, a missing config folder isn't created, and
+	// the events folder is optional and left to the agent
+	p.config = resolveFolder("configFolder", p.config, filepath.Join(extDir, "config"), false, &reasons)
+	p.status = resolveFolder("statusFolder", p.status, filepath.Join(extDir, "status"), true, &reasons)
+	p.log = resolveFolder("logFolder", p.log, tempLogFolder, true, &reasons)
+	return p, reasons
+}
+
+// resolveFolder returns folder when it exists, or could be created, and
+// fallback otherwise, recording the reason.
+func resolveFolder(name, folder, fallback string, create bool, reasons *[]string) string {
+	if folder == "" {
+		*reasons = append(*reasons, fmt.Sprintf("'%s' is not specified, using '%s'", name, fallback))
+	} else if err := checkFolder(folder, create); err != nil {
+		*reasons = append(*reasons, fmt.Sprintf("'%s' is not usable: %v, using '%s'", name, err, fallback))
+	} else {
+		return folder
+	}
+	if create {
+		// the fallback is checked when writing to it, by the self-test
+		os.MkdirAll(fallback, 0755)
+	}
+	return fallback
+}
+
+func checkFolder(folder string, create bool) error {
+	if create {
+		return os.MkdirAll(folder, 0755)
+	}
+	info, err := os.Stat(folder)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a folder", folder)
+	}
+	return nil
+}
+
+// extensionDir returns the folder of the extension, the parent of the 'bin'
+// folder of the executable, the way the handler environment is located.
+func extensionDir() string {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		return "."
+	}
+	if filepath.Base(dir) == "bin" {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
+
+// handlerEnvSubstatus returns the substatus reporting the degraded handler
+// environment, false when it is not degraded.
+func handlerEnvSubstatus(reasons []string) (SubstatusItem, bool) {
+	if len(reasons) == 0 {
+		return SubstatusItem{}, false
+	}
+	return NewSubstatus(SubstatusKeyNameHandlerEnvironment, StatusWarning, strings.Join(reasons, "; ")), true
+}
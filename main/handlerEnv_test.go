@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newHandlerPaths(t *testing.T) {
+	var hEnv vmextension.HandlerEnvironment
+	hEnv.HandlerEnvironment.ConfigFolder = "/var/lib/waagent/ext/config"
+	hEnv.HandlerEnvironment.StatusFolder = "/var/lib/waagent/ext/status"
+	hEnv.HandlerEnvironment.LogFolder = "/var/log/azure/ext"
+
+	p := newHandlerPaths(hEnv, "/var/log/azure/ext/events", func(string) string { return "" })
+	require.Equal(t, "/var/lib/waagent/ext/config", p.configFolder())
+	require.Equal(t, "/var/lib/waagent/ext/status", p.statusFolder())
+	require.Equal(t, "/var/log/azure/ext", p.logFolder())
+	require.Equal(t, "/var/log/azure/ext/events", p.eventsFolder())
+	require.Equal(t, dataDir, p.dataFolder())
+
+	env := map[string]string{"APPHEALTH_STATUS_FOLDER": "/tmp/status", "APPHEALTH_DATA_FOLDER": "/tmp/data", "APPHEALTH_EVENTS_FOLDER": "/tmp/events"}
+	p = newHandlerPaths(hEnv, "", func(name string) string { return env[name] })
+	require.Equal(t, "/var/lib/waagent/ext/config", p.configFolder())
+	require.Equal(t, "/tmp/status", p.statusFolder())
+	require.Equal(t, "/var/log/azure/ext", p.logFolder())
+	require.Equal(t, "/tmp/events", p.eventsFolder())
+	require.Equal(t, "/tmp/data", p.dataFolder())
+}
+
+func Test_parseEventsFolder(t *testing.T) {
+	require.Equal(t, "/var/log/azure/ext/events", parseEventsFolder([]byte(`[{"version": 1.0, "handlerEnvironment": {"logFolder": "/var/log/azure/ext", "eventsFolder": "/var/log/azure/ext/events"}}]`)))
+	// older agents don't provide one
+	require.Equal(t, "", parseEventsFolder([]byte(`[{"version": 1.0, "handlerEnvironment": {"logFolder": "/var/log/azure/ext"}}]`)))
+	require.Equal(t, "", parseEventsFolder([]byte(`{`)))
+}
+
+func Test_handlerPaths_resolve(t *testing.T) {
+	extDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(extDir)
+	tempLogFolder := filepath.Join(extDir, "tmp")
+
+	p := handlerPaths{config: extDir, status: filepath.Join(extDir, "status"), log: filepath.Join(extDir, "log")}
+	resolved, reasons := p.resolve(nil, extDir, tempLogFolder)
+	require.Empty(t, reasons)
+	require.Equal(t, p, resolved)
+	// the status and log folders are created
+	require.True(t, isDir(p.statusFolder()))
+	require.True(t, isDir(p.logFolder()))
+
+	// malformed handler environment
+	resolved, reasons = handlerPaths{}.resolve(errors.New("unexpected end of JSON input"), extDir, tempLogFolder)
+	require.Equal(t, []string{
+		"failed to parse HandlerEnvironment.json: unexpected end of JSON input",
+		"'configFolder' is not specified, using '" + filepath.Join(extDir, "config") + "'",
+		"'statusFolder' is not specified, using '" + filepath.Join(extDir, "status") + "'",
+		"'logFolder' is not specified, using '" + tempLogFolder + "'",
+	}, reasons)
+	require.Equal(t, filepath.Join(extDir, "config"), resolved.configFolder())
+	require.Equal(t, filepath.Join(extDir, "status"), resolved.statusFolder())
+	require.Equal(t, tempLogFolder, resolved.logFolder())
+	require.True(t, isDir(tempLogFolder))
+	require.False(t, isDir(filepath.Join(extDir, "config")))
+
+	// missing config folder, which isn't created
+	p.config = filepath.Join(extDir, "missing")
+	resolved, reasons = p.resolve(nil, extDir, tempLogFolder)
+	require.Len(t, reasons, 1)
+	require.Contains(t, reasons[0], "'configFolder' is not usable")
+	require.Equal(t, filepath.Join(extDir, "config"), resolved.configFolder())
+	require.False(t, isDir(filepath.Join(extDir, "missing")))
+}
+
+func Test_handlerEnvSubstatus(t *testing.T) {
+	_, ok := handlerEnvSubstatus(nil)
+	require.False(t, ok)
+
+	substatus, ok := handlerEnvSubstatus([]string{"a", "b"})
+	require.True(t, ok)
+	require.Equal(t, NewSubstatus(SubstatusKeyNameHandlerEnvironment, StatusWarning, "a; b"), substatus)
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
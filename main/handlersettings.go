@@ -1,7 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 	"github.com/go-kit/kit/log"
@@ -9,12 +18,99 @@ import (
 )
 
 var (
-	errTcpMustNotIncludeRequestPath    = errors.New("'requestPath' cannot be specified when using 'tcp' protocol")
-	errTcpConfigurationMustIncludePort = errors.New("'port' must be specified when using 'tcp' protocol")
-	errProbeSettleTimeExceedsThreshold = errors.New("Probe settle time (intervalInSeconds * numberOfProbes) cannot exceed 240 seconds")
-	defaultIntervalInSeconds           = 5
-	defaultNumberOfProbes              = 1
-	maximumProbeSettleTime             = 240
+	errTcpMustNotIncludeRequestPath      = errors.New("'requestPath' cannot be specified when using 'tcp' protocol")
+	errTcpConfigurationMustIncludePort   = errors.New("'port' must be specified when using 'tcp' protocol")
+	errProbeSettleTimeExceedsThreshold   = errors.New("Probe settle time (intervalInSeconds * numberOfProbes) cannot exceed 240 seconds")
+	errTcpMustNotIncludeExpectedHeaders  = errors.New("'expectedHeaders' cannot be specified when using 'tcp' protocol")
+	errTcpMustNotIncludeUserAgent        = errors.New("'userAgent' cannot be specified when using 'tcp' protocol")
+	errTcpMustNotIncludeHttpVersion      = errors.New("'httpVersion' cannot be specified when using 'tcp' protocol")
+	errTcpProbeModeRequiresTcp           = errors.New("'tcpProbeMode' can only be specified when using 'tcp' protocol")
+	errTcpSocketOptionsRequireTcp        = errors.New("'tcpNoDelay', 'tcpConnectTimeoutInSeconds' and 'tcpLingerInSeconds' can only be specified when using 'tcp' protocol")
+	errUdpConfigurationMustIncludePort   = errors.New("'port' must be specified when using 'udp' protocol")
+	errUdpMustNotIncludeRequestPath      = errors.New("'requestPath' cannot be specified when using 'udp' protocol")
+	errUdpSettingsRequireUdp             = errors.New("'udpPayload' and 'udpExpectedResponse' can only be specified when using 'udp' protocol")
+	errSystemdMustIncludeUnitName        = errors.New("'unitName' must be specified when using 'systemd' protocol")
+	errSystemdMustNotIncludePort         = errors.New("'port' and 'requestPath' cannot be specified when using 'systemd' protocol")
+	errUnitNameRequiresSystemd           = errors.New("'unitName' can only be specified when using 'systemd' protocol")
+	errProcessMustIncludeOneIdentifier   = errors.New("exactly one of 'pidFile' and 'processName' must be specified when using 'process' protocol")
+	errProcessMustNotIncludePort         = errors.New("'port' and 'requestPath' cannot be specified when using 'process' protocol")
+	errProcessSettingsRequireProcess     = errors.New("'pidFile', 'processName' and 'minimumUptimeInSeconds' can only be specified when using 'process' protocol")
+	errFileMustIncludeFilePath           = errors.New("'filePath' must be specified when using 'file' protocol")
+	errFileMustNotIncludePort            = errors.New("'port' and 'requestPath' cannot be specified when using 'file' protocol")
+	errFileSettingsRequireFile           = errors.New("'filePath', 'maxFileAgeInSeconds' and 'parseFileState' can only be specified when using 'file' protocol")
+	errDnsMustIncludeDnsName             = errors.New("'dnsName' must be specified when using 'dns' protocol")
+	errDnsMustNotIncludePort             = errors.New("'port' and 'requestPath' cannot be specified when using 'dns' protocol, use 'dnsServer' instead")
+	errDnsSettingsRequireDns             = errors.New("'dnsName', 'dnsServer' and 'expectedAddresses' can only be specified when using 'dns' protocol")
+	errMaxLatencyRequiresDnsOrIcmp       = errors.New("'maxLatencyInMilliseconds' can only be specified when using 'dns' or 'icmp' protocol")
+	errIcmpMustIncludeAddress            = errors.New("'icmpAddress' must be specified when using 'icmp' protocol")
+	errIcmpMustNotIncludePort            = errors.New("'port' and 'requestPath' cannot be specified when using 'icmp' protocol")
+	errIcmpSettingsRequireIcmp           = errors.New("'icmpAddress', 'icmpCount' and 'maxPacketLossPercent' can only be specified when using 'icmp' protocol")
+	errMetricsMustIncludePort            = errors.New("'port' must be specified when using 'metrics' protocol")
+	errMetricsMustIncludeRules           = errors.New("'metricsRules' must be specified when using 'metrics' protocol")
+	errMetricsRulesRequireMetrics        = errors.New("'metricsRules' can only be specified when using 'metrics' protocol")
+	errFastcgiMustIncludeOneAddress      = errors.New("exactly one of 'port' and 'fastcgiSocket' must be specified when using 'fastcgi' protocol")
+	errFastcgiSocketRequiresFastcgi      = errors.New("'fastcgiSocket' can only be specified when using 'fastcgi' protocol")
+	errAggregatorMustIncludeOneAddress   = errors.New("exactly one of 'port' and 'aggregatorSocket' must be specified when using 'aggregator' protocol")
+	errSocketRequiresAggregator          = errors.New("'aggregatorSocket' can only be specified when using 'aggregator' protocol")
+	errDatabaseMustNotIncludeRequestPath = errors.New("'requestPath' cannot be specified when using 'mysql', 'postgresql' or 'redis' protocol")
+	errDatabaseSettingsRequireDatabase   = errors.New("'databaseUser' and 'databaseName' can only be specified when using 'mysql', 'postgresql' or 'redis' protocol")
+	errRedisMustNotIncludeDatabaseName   = errors.New("'databaseName' cannot be specified when using 'redis' protocol")
+	errDatabasePasswordRequiresDatabase  = errors.New("'databasePassword' can only be specified when using 'mysql', 'postgresql' or 'redis' protocol")
+	errSecretHeadersRequireHttp          = errors.New("protected 'requestHeaders' can only be specified when using 'http' or 'https' protocol")
+	errClientCertificateRequiresHttps    = errors.New("'clientCertificate' and 'clientKey' can only be specified when using 'https' protocol")
+	errSshMustNotIncludeRequestPath      = errors.New("'requestPath' cannot be specified when using 'ssh' protocol")
+	errLogAnalyticsIncomplete            = errors.New("'logAnalyticsWorkspaceId' and 'logAnalyticsSharedKey' must be specified together")
+	errDiscoverPortRequiresTcpOrHttp     = errors.New("'discoverPortOfProcess' can only be specified when using 'tcp', 'http' or 'https' protocol")
+	errDiscoverPortMustNotIncludePort    = errors.New("'port' and 'discoverPortOfProcess' cannot both be specified")
+	errFallbackPortRequiresTcpOrHttp     = errors.New("'fallbackPort' can only be specified when using 'tcp', 'http' or 'https' protocol")
+	errFallbackPortWithDiscoverPort      = errors.New("'fallbackPort' and 'discoverPortOfProcess' cannot both be specified")
+	errFallbackPortSameAsPort            = errors.New("'fallbackPort' must be different from 'port'")
+	errLoopbackCheckRequiresHttp         = errors.New("'checkLoopbackOnFailure' can only be specified when using 'http' or 'https' protocol")
+	errApplicationsMustNotIncludeProbe   = errors.New("probe settings cannot be specified at the top level when 'applications' are specified")
+	errAggregationRequiresApplications   = errors.New("'aggregation' and 'healthyWeightThreshold' can only be specified when 'applications' are specified")
+	errRequiredSubsetMustIncludeRequired = errors.New("at least one application must be 'required' when using 'requiredSubset' aggregation")
+	errUnhealthyWeightRequiresWeighted   = errors.New("'unhealthyWeightThreshold' can only be specified when using 'weighted' aggregation")
+	errUnhealthyWeightAboveHealthy       = errors.New("'unhealthyWeightThreshold' must be lower than 'healthyWeightThreshold'")
+	errFailureStatesRequireNetwork       = errors.New("'failureStates' can only be specified when using 'tcp', 'udp', 'http', 'https', 'metrics' or 'icmp' protocol")
+	errSettingsV2MustNotIncludeFlat      = errors.New("probe, 'applications' and observability settings cannot be specified at the top level when 'schemaVersion' is 2, use 'probes' and 'observability' instead")
+	errSettingsV2MustIncludeProbes       = errors.New("'probes' must be specified when 'schemaVersion' is 2")
+	errSettingsV2RequireSchemaVersion2   = errors.New("'probes' and 'observability' can only be specified when 'schemaVersion' is 2")
+	errProbesMustBeNamed                 = errors.New("each of the 'probes' must have a 'name' when several probes are specified")
+	errAggregationRequiresNamedProbes    = errors.New("'aggregation' and 'healthyWeightThreshold' can only be specified when the 'probes' are named")
+	errHeartbeatRequiresOnChange         = errors.New("'statusHeartbeatIntervals' can only be specified when 'statusWriteMode' is 'onChange'")
+	errRestartRequiresResourceLimit      = errors.New("'restartOnResourceLimit' can only be specified when 'maxMemoryInMB', 'maxGoroutines' or 'maxOpenFiles' is specified")
+	errStateFileFormatRequiresPath       = errors.New("'stateFileFormat' can only be specified when 'stateFilePath' is specified")
+	errReadinessFileIsStateFile          = errors.New("'readinessFilePath' and 'stateFilePath' must be different files")
+	errDisabledProbeMustNotIncludeProbe  = errors.New("probe settings, 'applications' and 'probes' cannot be specified when 'disableHealthProbe' is true")
+	errLogDeduplicationInvalidLevel      = errors.New("'logDeduplication' levels must be 'error', 'warning' or 'info'")
+	errCooldownRequiresCircuitBreaker    = errors.New("'circuitBreakerCooldownInSeconds' can only be specified when 'circuitBreakerTimeouts' is specified")
+	errRichStatesRequireHttp             = errors.New("'richStates' can only be specified when using 'http' or 'https' protocol")
+	errJsonPathRequireHttp               = errors.New("'responseJsonPath' can only be specified when using 'http' or 'https' protocol")
+	errJsonPathRequiresRichStates        = errors.New("'responseJsonPath' cannot be specified when 'richStates' is false")
+	errJsonPathRequiresExpectedValue     = errors.New("'responseJsonPath' and 'expectedJsonPathValue' must be specified together")
+	errDependencyAggregationRequireHttp  = errors.New("'dependencyAggregation' can only be specified when using 'http', 'https' or 'aggregator' protocol")
+	errThumbprintsRequireHttps           = errors.New("'certificateThumbprints' can only be specified when using 'https' protocol")
+	errExpiryWarningRequiresHttps        = errors.New("'certificateExpiryWarningInDays' can only be specified when using 'https' protocol")
+	errProxyRequiresHttp                 = errors.New("'proxyUrl' can only be specified when using 'http' or 'https' protocol")
+	errProxyCredentialsRequireProxy      = errors.New("'proxyUsername' and 'proxyPassword' can only be specified when 'proxyUrl' is specified")
+	errMaxIntervalNotAboveInterval       = errors.New("'maxIntervalInSeconds' must be greater than 'intervalInSeconds'")
+	defaultIntervalInSeconds             = 5
+	minimumIntervalInSeconds             = 5
+	maximumIntervalInSeconds             = 60
+	maximumAdaptiveIntervalInSeconds     = 600
+	defaultNumberOfProbes                = 1
+	maximumProbeSettleTime               = 240
+	defaultMaxResponseBodySizeInBytes    = 4096
+	defaultUserAgent                     = "ApplicationHealthExtension/1.0"
+	tcpProbeModeConnect                  = "connect"
+	tcpProbeModeHalfOpen                 = "halfOpen"
+	defaultApplicationWeight             = 1.0
+	defaultHealthyWeightThreshold        = 0.5
+	defaultCircuitBreakerCooldown        = 60
+	defaultTcpConnectTimeoutInSeconds    = 30
+	defaultIcmpCount                     = 3
+	defaultMaxPacketLossPercent          = 50
+	settingsSchemaVersion2               = 2
 )
 
 // handlerSettings holds the configuration of the extension handler.
@@ -35,12 +131,32 @@ func (s *handlerSettings) port() int {
 	return s.publicSettings.Port
 }
 
-func (s *handlerSettings) intervalInSeconds() int {
-	var intervalInSeconds = s.publicSettings.IntervalInSeconds
-	if intervalInSeconds == 0 {
-		return defaultIntervalInSeconds
+// healthProbeDisabled returns whether the application health is not
+// monitored, the extension only running its other services.
+func (s *handlerSettings) healthProbeDisabled() bool {
+	return s.publicSettings.DisableHealthProbe
+}
+
+// probePort returns the port probed on localhost: 'port', or the default port
+// of the protocol when it is not set or 0. The default port is the one of the
+// protocol in 'defaultPorts', or its well-known port. It is 0 for the
+// protocols without a default port.
+func (s *handlerSettings) probePort() int {
+	if port := s.port(); port != 0 {
+		return port
+	}
+	if port := s.publicSettings.DefaultPorts[s.protocol()]; port != 0 {
+		return port
+	}
+	return wellKnownPorts[s.protocol()]
+}
+
+func (s *handlerSettings) interval() time.Duration {
+	var interval = s.publicSettings.IntervalInSeconds
+	if interval == 0 {
+		return time.Duration(defaultIntervalInSeconds) * time.Second
 	} else {
-		return intervalInSeconds
+		return interval.duration()
 	}
 }
 
@@ -53,19 +169,981 @@ func (s *handlerSettings) numberOfProbes() int {
 	}
 }
 
-func (s *handlerSettings) gracePeriod() int {
+func (s *handlerSettings) gracePeriod() time.Duration {
 	var gracePeriod = s.publicSettings.GracePeriod
 	if gracePeriod == 0 {
-		return s.intervalInSeconds() * s.numberOfProbes()
+		return s.interval() * time.Duration(s.numberOfProbes())
+	} else {
+		return gracePeriod.duration()
+	}
+}
+
+func (s *handlerSettings) maxResponseBodySizeInBytes() int {
+	var maxResponseBodySizeInBytes = s.publicSettings.MaxResponseBodySizeInBytes
+	if maxResponseBodySizeInBytes == 0 {
+		return defaultMaxResponseBodySizeInBytes
+	} else {
+		return maxResponseBodySizeInBytes
+	}
+}
+
+func (s *handlerSettings) expectedHeaders() map[string]string {
+	return s.publicSettings.ExpectedHeaders
+}
+
+func (s *handlerSettings) userAgent() string {
+	var userAgent = s.publicSettings.UserAgent
+	if userAgent == "" {
+		return defaultUserAgent
+	} else {
+		return userAgent
+	}
+}
+
+func (s *handlerSettings) includeIdentificationHeaders() bool {
+	return s.publicSettings.IncludeIdentificationHeaders
+}
+
+// richStates reports whether the health state of http/https probes is read
+// from the response body. When disabled, any 2xx response is Healthy.
+func (s *handlerSettings) richStates() bool {
+	if s.publicSettings.RichStates == nil {
+		return true
+	} else {
+		return *s.publicSettings.RichStates
+	}
+}
+
+// dependencyAggregation returns how the health state of http/https probes is
+// computed from the dependencies of a response without a health state, and the
+// health state of aggregator probes from the checks of the aggregator.
+func (s *handlerSettings) dependencyAggregation() string {
+	if s.publicSettings.DependencyAggregation == "" {
+		return dependencyAggregationIgnoreOptional
+	} else {
+		return s.publicSettings.DependencyAggregation
+	}
+}
+
+func (s *handlerSettings) httpVersion() string {
+	return s.publicSettings.HttpVersion
+}
+
+// certificateThumbprints returns the SHA-256 thumbprints the certificate of the
+// https endpoint is pinned to, as lowercase hex without separators.
+func (s *handlerSettings) certificateThumbprints() []string {
+	var thumbprints []string
+	for _, t := range s.publicSettings.CertificateThumbprints {
+		thumbprints = append(thumbprints, strings.ToLower(strings.Replace(t, ":", "", -1)))
+	}
+	return thumbprints
+}
+
+// certificateExpiryWarningInDays returns the number of days before the expiry
+// of the certificate of the https endpoint it is reported as a warning, 0
+// meaning the expiry is only reported.
+func (s *handlerSettings) certificateExpiryWarningInDays() int {
+	return s.publicSettings.CertificateExpiryWarning
+}
+
+// proxyURL returns the HTTP proxy the http/https probes connect through, or
+// nil when they connect directly.
+func (s *handlerSettings) proxyURL() *url.URL {
+	if s.publicSettings.ProxyUrl == "" {
+		return nil
+	}
+	// validated with the settings
+	u, _ := url.Parse(s.publicSettings.ProxyUrl)
+	return u
+}
+
+func (s *handlerSettings) proxyUsername() string {
+	return s.protectedSettings.ProxyUsername
+}
+
+func (s *handlerSettings) proxyPassword() string {
+	return s.protectedSettings.ProxyPassword.reveal()
+}
+
+func (s *handlerSettings) tcpProbeMode() string {
+	var tcpProbeMode = s.publicSettings.TcpProbeMode
+	if tcpProbeMode == "" {
+		return tcpProbeModeConnect
+	} else {
+		return tcpProbeMode
+	}
+}
+
+func (s *handlerSettings) tcpNoDelay() bool {
+	if s.publicSettings.TcpNoDelay == nil {
+		return true
+	} else {
+		return *s.publicSettings.TcpNoDelay
+	}
+}
+
+func (s *handlerSettings) tcpConnectTimeout() time.Duration {
+	var tcpConnectTimeout = s.publicSettings.TcpConnectTimeout
+	if tcpConnectTimeout == 0 {
+		return time.Duration(defaultTcpConnectTimeoutInSeconds) * time.Second
+	} else {
+		return tcpConnectTimeout.duration()
+	}
+}
+
+// tcpLingerInSeconds returns how long closing the connection of the 'tcp'
+// probe waits for unsent data: 0 resets the connection, a negative value
+// closes it gracefully in the background.
+func (s *handlerSettings) tcpLingerInSeconds() int {
+	return s.publicSettings.TcpLingerInSeconds
+}
+
+func (s *handlerSettings) udpPayload() []byte {
+	b, _ := base64.StdEncoding.DecodeString(s.publicSettings.UdpPayload)
+	return b
+}
+
+func (s *handlerSettings) udpExpectedResponse() []byte {
+	b, _ := base64.StdEncoding.DecodeString(s.publicSettings.UdpExpectedResponse)
+	return b
+}
+
+func (s *handlerSettings) unitName() string {
+	return s.publicSettings.UnitName
+}
+
+func (s *handlerSettings) pidFile() string {
+	return s.publicSettings.PidFile
+}
+
+func (s *handlerSettings) processName() string {
+	return s.publicSettings.ProcessName
+}
+
+func (s *handlerSettings) minimumUptimeInSeconds() int {
+	return s.publicSettings.MinimumUptimeInSeconds
+}
+
+func (s *handlerSettings) filePath() string {
+	return s.publicSettings.FilePath
+}
+
+func (s *handlerSettings) maxFileAgeInSeconds() int {
+	return s.publicSettings.MaxFileAgeInSeconds
+}
+
+func (s *handlerSettings) parseFileState() bool {
+	return s.publicSettings.ParseFileState
+}
+
+func (s *handlerSettings) dnsName() string {
+	return s.publicSettings.DnsName
+}
+
+func (s *handlerSettings) dnsServer() string {
+	return s.publicSettings.DnsServer
+}
+
+func (s *handlerSettings) maxLatencyInMilliseconds() int {
+	return s.publicSettings.MaxLatencyInMilliseconds
+}
+
+func (s *handlerSettings) expectedAddresses() []string {
+	return s.publicSettings.ExpectedAddresses
+}
+
+func (s *handlerSettings) icmpAddress() string {
+	return s.publicSettings.IcmpAddress
+}
+
+// icmpCount returns the number of echo requests of an icmp probe.
+func (s *handlerSettings) icmpCount() int {
+	if s.publicSettings.IcmpCount == 0 {
+		return defaultIcmpCount
+	}
+	return s.publicSettings.IcmpCount
+}
+
+// maxPacketLossPercent returns the packet loss above which an icmp probe
+// fails, 0 being a valid value.
+func (s *handlerSettings) maxPacketLossPercent() int {
+	if s.publicSettings.MaxPacketLossPercent == nil {
+		return defaultMaxPacketLossPercent
+	}
+	return *s.publicSettings.MaxPacketLossPercent
+}
+
+// metricsRules returns the parsed 'metricsRules', which are expected to have
+// been validated already.
+func (s *handlerSettings) metricsRules() []metricsRule {
+	var rules []metricsRule
+	for _, expression := range s.publicSettings.MetricsRules {
+		if rule, err := parseMetricsRule(expression); err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// jsonPathRule returns the rule deriving the health state of http/https
+// probes from the 'responseJsonPath' of the response body, nil when the body
+// follows the ApplicationHealthState schema. The path is expected to have been
+// validated already.
+func (s *handlerSettings) jsonPathRule() *jsonPathRule {
+	if s.publicSettings.ResponseJsonPath == "" {
+		return nil
+	}
+	var expected string
+	if s.publicSettings.ExpectedJsonPathValue != nil {
+		expected = *s.publicSettings.ExpectedJsonPathValue
+	}
+	rule, err := newJsonPathRule(s.publicSettings.ResponseJsonPath, expected)
+	if err != nil {
+		return nil
+	}
+	return rule
+}
+
+// simulationFile returns the file of the health states reported instead of
+// probing the application, or "" when the application is probed.
+func (s *handlerSettings) simulationFile() string {
+	return s.publicSettings.SimulationFile
+}
+
+func (s *handlerSettings) fastcgiSocket() string {
+	return s.publicSettings.FastcgiSocket
+}
+
+// aggregatorSocket returns the unix socket of the health aggregator queried by
+// aggregator probes, empty when it listens on 'port'.
+func (s *handlerSettings) aggregatorSocket() string {
+	return s.publicSettings.AggregatorSocket
+}
+
+// databasePort returns the port of the database probes, which defaults to the
+// standard port of the protocol.
+func (s *handlerSettings) databasePort() int {
+	return s.probePort()
+}
+
+func (s *handlerSettings) databaseUser() string {
+	var databaseUser = s.publicSettings.DatabaseUser
+	if databaseUser == "" {
+		return defaultDatabaseUsers[s.protocol()]
+	} else {
+		return databaseUser
+	}
+}
+
+func (s *handlerSettings) databaseName() string {
+	return s.publicSettings.DatabaseName
+}
+
+func (s *handlerSettings) isDatabaseProtocol() bool {
+	_, ok := databaseHandshakes[s.protocol()]
+	return ok
+}
+
+func (s *handlerSettings) discoverPortOfProcess() string {
+	return s.publicSettings.DiscoverPortOfProcess
+}
+
+// checkLoopbackOnFailure reports whether http/https probes check the loopback
+// networking of the VM when the endpoint could not be reached, to tell a
+// broken networking stack from an application which is down.
+func (s *handlerSettings) checkLoopbackOnFailure() bool {
+	return s.publicSettings.CheckLoopbackOnFailure
+}
+
+// fallbackPort returns the port probed when the connection to the configured
+// port is refused, 0 when there is none.
+func (s *handlerSettings) fallbackPort() int {
+	return s.publicSettings.FallbackPort
+}
+
+// failureStates returns the health states the probe failures are mapped to,
+// instead of the default state of the protocol.
+func (s *handlerSettings) failureStates() map[probeFailure]HealthStatus {
+	states := make(map[probeFailure]HealthStatus)
+	for failure, state := range s.publicSettings.FailureStates {
+		states[probeFailure(failure)] = HealthStatus(state)
+	}
+	return states
+}
+
+func (s *handlerSettings) circuitBreakerTimeouts() int {
+	return s.publicSettings.CircuitBreakerTimeouts
+}
+
+func (s *handlerSettings) circuitBreakerCooldown() time.Duration {
+	var cooldown = s.publicSettings.CircuitBreakerCooldown
+	if cooldown == 0 {
+		return time.Duration(defaultCircuitBreakerCooldown) * time.Second
+	} else {
+		return cooldown.duration()
+	}
+}
+
+func (s *handlerSettings) applicationInsightsInstrumentationKey() string {
+	return s.protectedSettings.ApplicationInsightsInstrumentationKey.reveal()
+}
+
+func (s *handlerSettings) logAnalyticsWorkspaceId() string {
+	return s.protectedSettings.LogAnalyticsWorkspaceId
+}
+
+func (s *handlerSettings) logAnalyticsSharedKey() string {
+	return s.protectedSettings.LogAnalyticsSharedKey.reveal()
+}
+
+func (s *handlerSettings) databasePassword() string {
+	return s.protectedSettings.DatabasePassword.reveal()
+}
+
+// secretRequestHeaders returns the headers of the protected settings sent
+// with the requests of the http/https probes, such as API keys.
+func (s *handlerSettings) secretRequestHeaders() http.Header {
+	headers := http.Header{}
+	for name, value := range s.protectedSettings.RequestHeaders {
+		headers.Set(name, value.reveal())
+	}
+	return headers
+}
+
+// clientCertificate returns the client certificate of the protected settings
+// presented by the https probes, if any.
+func (s *handlerSettings) clientCertificate() (*tls.Certificate, error) {
+	if s.protectedSettings.ClientCertificate == "" && !s.protectedSettings.ClientKey.isSet() {
+		return nil, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(s.protectedSettings.ClientCertificate), []byte(s.protectedSettings.ClientKey.reveal()))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid 'clientCertificate' or 'clientKey'")
+	}
+	return &cert, nil
+}
+
+// applications returns the probed applications: the 'probes' of the settings
+// migrated to version 2, which is a single unnamed one when the probe
+// settings are flat.
+func (s *handlerSettings) applications() []applicationSettings {
+	return s.publicSettings.migrateToV2().Probes
+}
+
+// multipleApplications reports whether the applications are reported as
+// named substatuses, with the top level state aggregated from theirs.
+func (s *handlerSettings) multipleApplications() bool {
+	apps := s.applications()
+	return len(apps) > 1 || apps[0].Name != ""
+}
+
+func (s *handlerSettings) aggregation() string {
+	var aggregation = s.publicSettings.Aggregation
+	if aggregation == "" {
+		return aggregationWorstOf
+	} else {
+		return aggregation
+	}
+}
+
+func (s *handlerSettings) healthyWeightThreshold() float64 {
+	var healthyWeightThreshold = s.publicSettings.HealthyWeightThreshold
+	if healthyWeightThreshold == 0 {
+		return defaultHealthyWeightThreshold
+	} else {
+		return healthyWeightThreshold
+	}
+}
+
+// unhealthyWeightThreshold returns the weighted score from which the top level
+// state is degraded rather than unhealthy when using 'weighted' aggregation, 0
+// meaning there is no degraded state.
+func (s *handlerSettings) unhealthyWeightThreshold() float64 {
+	return s.publicSettings.UnhealthyWeightThreshold
+}
+
+// minimumStateDurationInSeconds returns the time a health state is reported
+// for at least before another transition is reported, 0 reporting transitions
+// immediately.
+func (s *handlerSettings) minimumStateDurationInSeconds() int {
+	return s.publicSettings.MinimumStateDuration
+}
+
+// maxInterval returns the longest interval the probe interval is lengthened
+// to while the application is persistently Unhealthy, 0 meaning the interval
+// is not adaptive.
+func (s *handlerSettings) maxInterval() time.Duration {
+	return s.publicSettings.MaxInterval.duration()
+}
+
+// observability returns the observability settings of the settings migrated
+// to version 2.
+func (s *handlerSettings) observability() observabilitySettings {
+	if o := s.publicSettings.migrateToV2().Observability; o != nil {
+		return *o
+	}
+	return observabilitySettings{}
+}
+
+func (s *handlerSettings) escalateToErrorAfterMinutes() int {
+	return s.observability().EscalateToErrorAfterMinutes
+}
+
+func (s *handlerSettings) mirrorLogsToSyslog() bool {
+	return s.observability().MirrorLogsToSyslog
+}
+
+func (s *handlerSettings) diagnosticsPort() int {
+	return s.observability().DiagnosticsPort
+}
+
+func (s *handlerSettings) statusWriteMode() string {
+	if mode := s.observability().StatusWriteMode; mode == "" {
+		return statusWriteModeEveryInterval
+	} else {
+		return mode
+	}
+}
+
+// statusHeartbeatIntervals returns the number of probe intervals after which
+// the status is written even though it did not change, in 'onChange' mode.
+func (s *handlerSettings) statusHeartbeatIntervals() int {
+	if intervals := s.observability().StatusHeartbeatIntervals; intervals == 0 {
+		return defaultStatusHeartbeatIntervals
+	} else {
+		return intervals
+	}
+}
+
+// applicationName returns the logical name of the application the VM runs,
+// which tags the events and names a substatus so that health dashboards can
+// group VMs by application.
+func (s *handlerSettings) applicationName() string {
+	return s.observability().ApplicationName
+}
+
+// environment returns the environment tag of the VM, such as 'production'.
+func (s *handlerSettings) environment() string {
+	return s.observability().Environment
+}
+
+// otlpEndpoint returns the base URL of the OpenTelemetry collector the probe
+// cycles are exported to, using OTLP/HTTP, or "" when they are not exported.
+func (s *handlerSettings) otlpEndpoint() string {
+	return s.observability().OtlpEndpoint
+}
+
+// resourceLimits returns the soft limits of the resources used by the
+// extension process, the zero limits not being checked.
+func (s *handlerSettings) resourceLimits() resourceLimits {
+	o := s.observability()
+	return resourceLimits{
+		RssBytes:   int64(o.MaxMemoryInMB) * 1024 * 1024,
+		Goroutines: o.MaxGoroutines,
+		OpenFiles:  o.MaxOpenFiles,
+	}
+}
+
+// restartOnResourceLimit returns whether the extension restarts itself when it
+// exceeds one of its resource limits.
+func (s *handlerSettings) restartOnResourceLimit() bool {
+	return s.observability().RestartOnResourceLimit
+}
+
+// stateFilePath returns the path the health state is continuously written to
+// for the other agents of the VM, or "" when it is not written.
+func (s *handlerSettings) stateFilePath() string {
+	return s.observability().StateFilePath
+}
+
+// stateFileFormat returns the format of the state file.
+func (s *handlerSettings) stateFileFormat() string {
+	if format := s.observability().StateFileFormat; format != "" {
+		return format
+	}
+	return stateFileFormatJson
+}
+
+// readinessFilePath returns the path of the marker file written once the
+// application is ready, or "" when it is not written.
+func (s *handlerSettings) readinessFilePath() string {
+	return s.observability().ReadinessFilePath
+}
+
+// eventFilesFolder returns the folder the telemetry events are written to in
+// batched files, or "" when they are written to the events folder of the
+// handler environment, if any.
+func (s *handlerSettings) eventFilesFolder() string {
+	return s.observability().EventFilesFolder
+}
+
+// compressEventFiles returns whether the event files are gzip compressed.
+func (s *handlerSettings) compressEventFiles() bool {
+	return s.observability().CompressEventFiles
+}
+
+// telemetryFlushInterval returns the longest time the telemetry events are
+// queued before being sent to the sinks.
+func (s *handlerSettings) telemetryFlushInterval() time.Duration {
+	if d := s.observability().TelemetryFlushInterval; d != 0 {
+		return d.duration()
+	}
+	return telemetryFlushInterval
+}
+
+// eventsRetention returns the bounds of the files of the events folders.
+func (s *handlerSettings) eventsRetention() eventsRetention {
+	o := s.observability()
+	r := eventsRetention{maxFiles: defaultEventsMaxFiles, maxAge: defaultEventsMaxAge, maxBytes: defaultEventsMaxSizeInMB * 1024 * 1024}
+	if o.EventsMaxFiles != 0 {
+		r.maxFiles = o.EventsMaxFiles
+	}
+	if o.EventsMaxAge != 0 {
+		r.maxAge = o.EventsMaxAge.duration()
+	}
+	if o.EventsMaxSizeInMB != 0 {
+		r.maxBytes = int64(o.EventsMaxSizeInMB) * 1024 * 1024
+	}
+	return r
+}
+
+// heartbeatSubstatus returns whether the status includes the heartbeat of the
+// prober loop.
+func (s *handlerSettings) heartbeatSubstatus() bool {
+	return s.observability().HeartbeatSubstatus
+}
+
+// logDeduplication returns the summary interval of the repeated events, by
+// deduplicated log level.
+func (s *handlerSettings) logDeduplication() map[string]time.Duration {
+	if len(s.observability().LogDeduplication) == 0 {
+		return nil
+	}
+	intervals := make(map[string]time.Duration)
+	for level, d := range s.observability().LogDeduplication {
+		intervals[level] = d.duration()
+	}
+	return intervals
+}
+
+// validateLogDeduplication checks the levels and the intervals of
+// 'logDeduplication'.
+func (h handlerSettings) validateLogDeduplication() error {
+	for level, d := range h.observability().LogDeduplication {
+		switch level {
+		case logLevelError, logLevelWarning, logLevelInfo:
+		default:
+			return errLogDeduplicationInvalidLevel
+		}
+		if err := validateDurationSetting("logDeduplication."+level, d, time.Second, time.Hour); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusMessages returns the templates overriding the status messages, by
+// message.
+func (s *handlerSettings) statusMessages() map[string]string {
+	return s.observability().StatusMessages
+}
+
+// identity returns the key/value pairs of the application name and
+// environment tag which are set, as added to the events.
+func (s *handlerSettings) identity() []interface{} {
+	var keyvals []interface{}
+	if name := s.applicationName(); name != "" {
+		keyvals = append(keyvals, "applicationName", name)
+	}
+	if environment := s.environment(); environment != "" {
+		keyvals = append(keyvals, "environment", environment)
+	}
+	return keyvals
+}
+
+func (a applicationSettings) weight() float64 {
+	if a.Weight == 0 {
+		return defaultApplicationWeight
 	} else {
-		return gracePeriod
+		return a.Weight
 	}
 }
 
+// handlerSettings returns the settings of the application probe, sharing the
+// probe interval and the default ports of the top level settings.
+func (a applicationSettings) handlerSettings(top *handlerSettings) handlerSettings {
+	s := handlerSettings{publicSettings: a.publicSettings}
+	s.publicSettings.IntervalInSeconds = durationSetting(top.interval())
+	s.publicSettings.DefaultPorts = top.publicSettings.DefaultPorts
+	return s
+}
+
+// The scopes of the settings, set in the 'settings' tag of the publicSettings
+// fields, from which the version 1 and 2 settings are told apart and migrated.
+// The fields without a scope are the probe settings, and the version 2 only
+// ones are tagged 'v2'.
+const (
+	settingsScopeProbe         = ""
+	settingsScopeTop           = "top"           // top level in both versions
+	settingsScopeApplications  = "applications"  // version 1 only, the version 2 'probes'
+	settingsScopeObservability = "observability" // version 1 only, grouped in the version 2 'observability'
+)
+
+// migrateToV2 normalizes the settings into the version 2 structure: the flat
+// probe settings, or the 'applications', become the 'probes' and the
+// observability settings are grouped. Version 2 settings are returned as is.
+func (p publicSettings) migrateToV2() publicSettings {
+	if p.SchemaVersion >= settingsSchemaVersion2 {
+		return p
+	}
+	v2 := p.withScopes(settingsScopeTop)
+	v2.SchemaVersion = settingsSchemaVersion2
+	v2.Probes = p.Applications
+	v2.Observability = &observabilitySettings{}
+	o := reflect.ValueOf(v2.Observability).Elem()
+	forEachSettingsField(p, func(f reflect.StructField, v reflect.Value) {
+		if f.Tag.Get("settings") == settingsScopeObservability {
+			o.FieldByName(f.Name).Set(v)
+		}
+	})
+	if len(v2.Probes) == 0 {
+		v2.Probes = []applicationSettings{{publicSettings: p.probeSettings()}}
+	}
+	return v2
+}
+
+// probeSettings returns the settings without the top level settings which are
+// not probe settings.
+func (p publicSettings) probeSettings() publicSettings {
+	return p.withScopes(settingsScopeProbe)
+}
+
+// withScopes returns the settings of the scopes, the others being zeroed.
+func (p publicSettings) withScopes(scopes ...string) publicSettings {
+	var s publicSettings
+	dst := reflect.ValueOf(&s).Elem()
+	forEachSettingsField(p, func(f reflect.StructField, v reflect.Value) {
+		if containsString(scopes, f.Tag.Get("settings")) {
+			dst.FieldByIndex(f.Index).Set(v)
+		}
+	})
+	return s
+}
+
+// forEachSettingsField calls fn with each of the fields of the settings.
+func forEachSettingsField(p publicSettings, fn func(reflect.StructField, reflect.Value)) {
+	v := reflect.ValueOf(p)
+	for i := 0; i < v.NumField(); i++ {
+		fn(v.Type().Field(i), v.Field(i))
+	}
+}
+
+// hasProbe reports whether the probe, or the probe of any application, uses
+// one of the protocols.
+func (h handlerSettings) hasProbe(protocols ...string) bool {
+	for _, a := range h.applications() {
+		if containsString(protocols, a.Protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasProxy reports whether the probe, or the probe of any application,
+// connects through a proxy.
+func (h handlerSettings) hasProxy() bool {
+	for _, a := range h.applications() {
+		if a.ProxyUrl != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDatabaseProbe reports whether the probe, or the probe of any application,
+// is a database probe.
+func (h handlerSettings) hasDatabaseProbe() bool {
+	for _, a := range h.applications() {
+		appCfg := a.handlerSettings(&h)
+		if appCfg.isDatabaseProtocol() {
+			return true
+		}
+	}
+	return false
+}
+
+// validateApplications makes logical validation of the 'applications'
+// settings, including the probe settings of each application.
+func (h handlerSettings) validateApplications() error {
+	if len(h.publicSettings.Applications) == 0 {
+		if h.publicSettings.Aggregation != "" || h.publicSettings.HealthyWeightThreshold != 0 || h.publicSettings.UnhealthyWeightThreshold != 0 {
+			return errAggregationRequiresApplications
+		}
+		return nil
+	}
+
+	if !reflect.DeepEqual(h.publicSettings.probeSettings(), publicSettings{}) {
+		return errApplicationsMustNotIncludeProbe
+	}
+	return h.validateNamedApplications(h.publicSettings.Applications)
+}
+
+// validateV2 makes logical validation of version 2 settings, whose probes are
+// validated as the 'applications' when they are named and as the top level
+// probe otherwise.
+func (h handlerSettings) validateV2() error {
+	flat := h.publicSettings.withScopes(settingsScopeProbe, settingsScopeApplications, settingsScopeObservability)
+	if !reflect.DeepEqual(flat, publicSettings{}) {
+		return errSettingsV2MustNotIncludeFlat
+	}
+
+	if err := h.validateMaxInterval(); err != nil {
+		return err
+	}
+
+	if h.observability().StatusHeartbeatIntervals != 0 && h.statusWriteMode() != statusWriteModeOnChange {
+		return errHeartbeatRequiresOnChange
+	}
+
+	if h.restartOnResourceLimit() && h.resourceLimits() == (resourceLimits{}) {
+		return errRestartRequiresResourceLimit
+	}
+
+	if h.observability().StateFileFormat != "" && h.stateFilePath() == "" {
+		return errStateFileFormatRequiresPath
+	}
+
+	if h.readinessFilePath() != "" && h.readinessFilePath() == h.stateFilePath() {
+		return errReadinessFileIsStateFile
+	}
+
+	if err := validateDurationSetting("telemetryFlushInterval", h.observability().TelemetryFlushInterval, time.Second, time.Hour); err != nil {
+		return err
+	}
+
+	if err := validateDurationSetting("eventsMaxAge", h.observability().EventsMaxAge, time.Minute, 365*24*time.Hour); err != nil {
+		return err
+	}
+
+	if err := h.validateLogDeduplication(); err != nil {
+		return err
+	}
+
+	if _, err := newStatusMessages(h.statusMessages()); err != nil {
+		return err
+	}
+
+	if err := h.validateSecrets(); err != nil {
+		return err
+	}
+
+	probes := h.publicSettings.Probes
+	if h.healthProbeDisabled() {
+		if len(probes) > 0 {
+			return errDisabledProbeMustNotIncludeProbe
+		}
+		return nil
+	}
+	if len(probes) == 0 {
+		return errSettingsV2MustIncludeProbes
+	}
+	if !h.multipleApplications() {
+		if h.publicSettings.Aggregation != "" || h.publicSettings.HealthyWeightThreshold != 0 || h.publicSettings.UnhealthyWeightThreshold != 0 {
+			return errAggregationRequiresNamedProbes
+		}
+		return probes[0].handlerSettings(&h).validate()
+	}
+	for _, p := range probes {
+		if p.Name == "" {
+			return errProbesMustBeNamed
+		}
+	}
+	return h.validateNamedApplications(probes)
+}
+
+// validateMaxInterval validates the longest interval of the adaptive interval,
+// which must be longer than the interval.
+func (h handlerSettings) validateMaxInterval() error {
+	if h.publicSettings.MaxInterval == 0 {
+		return nil
+	}
+	if err := validateDurationSetting("maxIntervalInSeconds", h.publicSettings.MaxInterval, time.Duration(minimumIntervalInSeconds)*time.Second, time.Duration(maximumAdaptiveIntervalInSeconds)*time.Second); err != nil {
+		return err
+	}
+	if h.maxInterval() <= h.interval() {
+		return errMaxIntervalNotAboveInterval
+	}
+	return nil
+}
+
+// validateSecrets makes logical validation of the protected settings, which
+// apply to the probes of all the applications.
+func (h handlerSettings) validateSecrets() error {
+	if (h.logAnalyticsWorkspaceId() == "") != (h.logAnalyticsSharedKey() == "") {
+		return errLogAnalyticsIncomplete
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(h.logAnalyticsSharedKey()); err != nil {
+		return errors.Wrap(err, "'logAnalyticsSharedKey' is not valid base64")
+	}
+
+	if h.databasePassword() != "" && !h.hasDatabaseProbe() {
+		return errDatabasePasswordRequiresDatabase
+	}
+
+	if len(h.protectedSettings.RequestHeaders) > 0 && !h.hasProbe("http", "https") {
+		return errSecretHeadersRequireHttp
+	}
+
+	if cert, err := h.clientCertificate(); err != nil {
+		return err
+	} else if cert != nil && !h.hasProbe("https") {
+		return errClientCertificateRequiresHttps
+	}
+
+	if (h.proxyUsername() != "" || h.protectedSettings.ProxyPassword.isSet()) && !h.hasProxy() {
+		return errProxyCredentialsRequireProxy
+	}
+	return nil
+}
+
+// validateNamedApplications validates the names and the probe settings of the
+// applications and their consistency with the aggregation.
+func (h handlerSettings) validateNamedApplications(apps []applicationSettings) error {
+	names := make(map[string]bool)
+	hasRequired := false
+	for _, a := range apps {
+		if names[a.Name] {
+			return errors.New(fmt.Sprintf("application name '%s' is not unique", a.Name))
+		}
+		names[a.Name] = true
+		hasRequired = hasRequired || a.Required
+
+		if err := a.handlerSettings(&h).validate(); err != nil {
+			return errors.Wrapf(err, "application '%s'", a.Name)
+		}
+	}
+
+	if h.aggregation() == aggregationRequiredSubset && !hasRequired {
+		return errRequiredSubsetMustIncludeRequired
+	}
+
+	if h.unhealthyWeightThreshold() != 0 && h.aggregation() != aggregationWeighted {
+		return errUnhealthyWeightRequiresWeighted
+	}
+
+	if h.unhealthyWeightThreshold() >= h.healthyWeightThreshold() {
+		return errUnhealthyWeightAboveHealthy
+	}
+	return nil
+}
+
+// effectivePublicSettings returns the public settings with the default values
+// of the settings which apply to the configured probes resolved.
+func (s *handlerSettings) effectivePublicSettings() publicSettings {
+	if s.publicSettings.SchemaVersion < settingsSchemaVersion2 && len(s.publicSettings.Applications) == 0 {
+		return s.effectiveProbeSettings()
+	}
+
+	e := s.publicSettings
+	e.IntervalInSeconds = durationSetting(s.interval())
+	multiple := s.multipleApplications()
+	if multiple {
+		e.Aggregation = s.aggregation()
+		if e.Aggregation == aggregationWeighted {
+			e.HealthyWeightThreshold = s.healthyWeightThreshold()
+			e.UnhealthyWeightThreshold = s.unhealthyWeightThreshold()
+		}
+	}
+	var apps []applicationSettings
+	for _, a := range s.applications() {
+		appCfg := a.handlerSettings(s)
+		a.publicSettings = appCfg.effectiveProbeSettings()
+		a.publicSettings.IntervalInSeconds, a.publicSettings.DefaultPorts = 0, nil
+		if multiple {
+			a.Weight = a.weight()
+		}
+		apps = append(apps, a)
+	}
+	if e.SchemaVersion >= settingsSchemaVersion2 {
+		e.Probes = apps
+	} else {
+		e.Applications = apps
+	}
+	return e
+}
+
+// effectiveProbeSettings returns the probe settings with their default values
+// resolved.
+func (s *handlerSettings) effectiveProbeSettings() publicSettings {
+	e := s.publicSettings
+	e.IntervalInSeconds = durationSetting(s.interval())
+	e.NumberOfProbes = s.numberOfProbes()
+	e.GracePeriod = durationSetting(s.gracePeriod())
+	switch s.protocol() {
+	case "tcp":
+		e.TcpProbeMode = s.tcpProbeMode()
+		tcpNoDelay := s.tcpNoDelay()
+		e.TcpNoDelay = &tcpNoDelay
+		e.TcpConnectTimeout = durationSetting(s.tcpConnectTimeout())
+	case "http", "https":
+		e.MaxResponseBodySizeInBytes = s.maxResponseBodySizeInBytes()
+		e.UserAgent = s.userAgent()
+		richStates := s.richStates()
+		e.RichStates = &richStates
+		e.DependencyAggregation = s.dependencyAggregation()
+		e.Port = s.probePort()
+		if e.HttpVersion == "" {
+			e.HttpVersion = "1.1"
+		}
+	case "file":
+		if s.parseFileState() {
+			e.MaxResponseBodySizeInBytes = s.maxResponseBodySizeInBytes()
+		}
+	case "metrics":
+		if e.RequestPath == "" {
+			e.RequestPath = defaultMetricsRequestPath
+		}
+	case "fastcgi":
+		if e.RequestPath == "" {
+			e.RequestPath = defaultFastcgiRequestPath
+		}
+	case "aggregator":
+		if e.RequestPath == "" {
+			e.RequestPath = defaultAggregatorRequestPath
+		}
+		e.DependencyAggregation = s.dependencyAggregation()
+	case "ssh":
+		e.Port = s.probePort()
+	case "icmp":
+		e.IcmpCount = s.icmpCount()
+		maxPacketLossPercent := s.maxPacketLossPercent()
+		e.MaxPacketLossPercent = &maxPacketLossPercent
+	case "mysql", "postgresql", "redis":
+		e.Port = s.databasePort()
+		e.DatabaseUser = s.databaseUser()
+	}
+	if s.circuitBreakerTimeouts() > 0 {
+		e.CircuitBreakerCooldown = durationSetting(s.circuitBreakerCooldown())
+	}
+	return e
+}
+
 // validate makes logical validation on the handlerSettings which already passed
 // the schema validation.
 func (h handlerSettings) validate() error {
-	if h.protocol() == "tcp" && h.port() == 0 {
+	if h.publicSettings.SchemaVersion >= settingsSchemaVersion2 {
+		return h.validateV2()
+	}
+	if h.publicSettings.Probes != nil || h.publicSettings.Observability != nil {
+		return errSettingsV2RequireSchemaVersion2
+	}
+
+	if h.healthProbeDisabled() && (len(h.publicSettings.Applications) > 0 || !reflect.DeepEqual(h.publicSettings.probeSettings(), publicSettings{})) {
+		return errDisabledProbeMustNotIncludeProbe
+	}
+
+	if h.protocol() == "tcp" && h.port() == 0 && h.discoverPortOfProcess() == "" {
 		return errTcpConfigurationMustIncludePort
 	}
 
@@ -73,28 +1151,386 @@ func (h handlerSettings) validate() error {
 		return errTcpMustNotIncludeRequestPath
 	}
 
-	probeSettlingTime := h.intervalInSeconds() * h.numberOfProbes()
-	if probeSettlingTime > maximumProbeSettleTime {
+	if h.protocol() == "tcp" && len(h.expectedHeaders()) > 0 {
+		return errTcpMustNotIncludeExpectedHeaders
+	}
+
+	if h.protocol() == "tcp" && h.publicSettings.UserAgent != "" {
+		return errTcpMustNotIncludeUserAgent
+	}
+
+	if h.protocol() == "tcp" && h.httpVersion() != "" {
+		return errTcpMustNotIncludeHttpVersion
+	}
+
+	if h.protocol() != "tcp" && h.publicSettings.TcpProbeMode != "" {
+		return errTcpProbeModeRequiresTcp
+	}
+
+	if h.protocol() != "tcp" && (h.publicSettings.TcpNoDelay != nil || h.publicSettings.TcpConnectTimeout != 0 || h.publicSettings.TcpLingerInSeconds != 0) {
+		return errTcpSocketOptionsRequireTcp
+	}
+
+	if h.protocol() == "udp" && h.port() == 0 {
+		return errUdpConfigurationMustIncludePort
+	}
+
+	if h.protocol() == "udp" && h.requestPath() != "" {
+		return errUdpMustNotIncludeRequestPath
+	}
+
+	if h.protocol() != "udp" && (h.publicSettings.UdpPayload != "" || h.publicSettings.UdpExpectedResponse != "") {
+		return errUdpSettingsRequireUdp
+	}
+
+	if h.protocol() == "systemd" && h.unitName() == "" {
+		return errSystemdMustIncludeUnitName
+	}
+
+	if h.protocol() == "systemd" && (h.port() != 0 || h.requestPath() != "") {
+		return errSystemdMustNotIncludePort
+	}
+
+	if h.protocol() != "systemd" && h.unitName() != "" {
+		return errUnitNameRequiresSystemd
+	}
+
+	if h.protocol() == "process" && (h.pidFile() == "") == (h.processName() == "") {
+		return errProcessMustIncludeOneIdentifier
+	}
+
+	if h.protocol() == "process" && (h.port() != 0 || h.requestPath() != "") {
+		return errProcessMustNotIncludePort
+	}
+
+	if h.protocol() != "process" && (h.pidFile() != "" || h.processName() != "" || h.minimumUptimeInSeconds() != 0) {
+		return errProcessSettingsRequireProcess
+	}
+
+	if h.protocol() == "file" && h.filePath() == "" {
+		return errFileMustIncludeFilePath
+	}
+
+	if h.protocol() == "file" && (h.port() != 0 || h.requestPath() != "") {
+		return errFileMustNotIncludePort
+	}
+
+	if h.protocol() != "file" && (h.filePath() != "" || h.maxFileAgeInSeconds() != 0 || h.parseFileState()) {
+		return errFileSettingsRequireFile
+	}
+
+	if h.protocol() == "dns" && h.dnsName() == "" {
+		return errDnsMustIncludeDnsName
+	}
+
+	if h.protocol() == "dns" && (h.port() != 0 || h.requestPath() != "") {
+		return errDnsMustNotIncludePort
+	}
+
+	if h.protocol() != "dns" && (h.dnsName() != "" || h.dnsServer() != "" || len(h.expectedAddresses()) > 0) {
+		return errDnsSettingsRequireDns
+	}
+
+	if h.protocol() != "dns" && h.protocol() != "icmp" && h.maxLatencyInMilliseconds() != 0 {
+		return errMaxLatencyRequiresDnsOrIcmp
+	}
+
+	if h.protocol() == "icmp" && h.icmpAddress() == "" {
+		return errIcmpMustIncludeAddress
+	}
+
+	if h.protocol() == "icmp" && (h.port() != 0 || h.requestPath() != "") {
+		return errIcmpMustNotIncludePort
+	}
+
+	if h.protocol() != "icmp" && (h.icmpAddress() != "" || h.publicSettings.IcmpCount != 0 || h.publicSettings.MaxPacketLossPercent != nil) {
+		return errIcmpSettingsRequireIcmp
+	}
+
+	if h.protocol() == "metrics" && h.port() == 0 {
+		return errMetricsMustIncludePort
+	}
+
+	if h.protocol() == "metrics" && len(h.publicSettings.MetricsRules) == 0 {
+		return errMetricsMustIncludeRules
+	}
+
+	if h.protocol() != "metrics" && len(h.publicSettings.MetricsRules) > 0 {
+		return errMetricsRulesRequireMetrics
+	}
+
+	if h.protocol() == "fastcgi" && (h.port() == 0) == (h.fastcgiSocket() == "") {
+		return errFastcgiMustIncludeOneAddress
+	}
+
+	if h.protocol() != "fastcgi" && h.fastcgiSocket() != "" {
+		return errFastcgiSocketRequiresFastcgi
+	}
+
+	if h.protocol() == "aggregator" && (h.port() == 0) == (h.aggregatorSocket() == "") {
+		return errAggregatorMustIncludeOneAddress
+	}
+
+	if h.protocol() != "aggregator" && h.aggregatorSocket() != "" {
+		return errSocketRequiresAggregator
+	}
+
+	if h.protocol() == "ssh" && h.requestPath() != "" {
+		return errSshMustNotIncludeRequestPath
+	}
+
+	if h.isDatabaseProtocol() && h.requestPath() != "" {
+		return errDatabaseMustNotIncludeRequestPath
+	}
+
+	if !h.isDatabaseProtocol() && (h.publicSettings.DatabaseUser != "" || h.databaseName() != "") {
+		return errDatabaseSettingsRequireDatabase
+	}
+
+	if h.protocol() == "redis" && h.databaseName() != "" {
+		return errRedisMustNotIncludeDatabaseName
+	}
+
+	for _, expression := range h.publicSettings.MetricsRules {
+		if _, err := parseMetricsRule(expression); err != nil {
+			return err
+		}
+	}
+
+	if h.discoverPortOfProcess() != "" && h.protocol() != "tcp" && h.protocol() != "http" && h.protocol() != "https" {
+		return errDiscoverPortRequiresTcpOrHttp
+	}
+
+	if h.discoverPortOfProcess() != "" && h.port() != 0 {
+		return errDiscoverPortMustNotIncludePort
+	}
+
+	if h.fallbackPort() != 0 && h.protocol() != "tcp" && h.protocol() != "http" && h.protocol() != "https" {
+		return errFallbackPortRequiresTcpOrHttp
+	}
+
+	if h.fallbackPort() != 0 && h.discoverPortOfProcess() != "" {
+		return errFallbackPortWithDiscoverPort
+	}
+
+	if h.fallbackPort() != 0 && h.fallbackPort() == h.port() {
+		return errFallbackPortSameAsPort
+	}
+
+	if h.checkLoopbackOnFailure() && h.protocol() != "http" && h.protocol() != "https" {
+		return errLoopbackCheckRequiresHttp
+	}
+
+	if len(h.publicSettings.FailureStates) > 0 {
+		switch h.protocol() {
+		case "tcp", "udp", "http", "https", "metrics", "icmp":
+		default:
+			return errFailureStatesRequireNetwork
+		}
+	}
+
+	if h.observability().StatusHeartbeatIntervals != 0 && h.statusWriteMode() != statusWriteModeOnChange {
+		return errHeartbeatRequiresOnChange
+	}
+
+	if h.publicSettings.CircuitBreakerCooldown != 0 && h.circuitBreakerTimeouts() == 0 {
+		return errCooldownRequiresCircuitBreaker
+	}
+
+	if h.publicSettings.RichStates != nil && h.protocol() != "http" && h.protocol() != "https" {
+		return errRichStatesRequireHttp
+	}
+
+	if h.publicSettings.ResponseJsonPath != "" && h.protocol() != "http" && h.protocol() != "https" {
+		return errJsonPathRequireHttp
+	}
+
+	if (h.publicSettings.ResponseJsonPath == "") != (h.publicSettings.ExpectedJsonPathValue == nil) {
+		return errJsonPathRequiresExpectedValue
+	}
+
+	if h.publicSettings.ResponseJsonPath != "" && !h.richStates() {
+		return errJsonPathRequiresRichStates
+	}
+
+	if h.publicSettings.ResponseJsonPath != "" {
+		if _, err := parseJsonPath(h.publicSettings.ResponseJsonPath); err != nil {
+			return err
+		}
+	}
+
+	if h.publicSettings.DependencyAggregation != "" && h.protocol() != "http" && h.protocol() != "https" && h.protocol() != "aggregator" {
+		return errDependencyAggregationRequireHttp
+	}
+
+	if len(h.publicSettings.CertificateThumbprints) > 0 && h.protocol() != "https" {
+		return errThumbprintsRequireHttps
+	}
+
+	if h.certificateExpiryWarningInDays() != 0 && h.protocol() != "https" {
+		return errExpiryWarningRequiresHttps
+	}
+
+	if h.publicSettings.ProxyUrl != "" && h.protocol() != "http" && h.protocol() != "https" {
+		return errProxyRequiresHttp
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(h.publicSettings.UdpPayload); err != nil {
+		return errors.Wrap(err, "'udpPayload' is not valid base64")
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(h.publicSettings.UdpExpectedResponse); err != nil {
+		return errors.Wrap(err, "'udpExpectedResponse' is not valid base64")
+	}
+
+	if err := h.validateSecrets(); err != nil {
+		return err
+	}
+
+	if err := h.validateMaxInterval(); err != nil {
+		return err
+	}
+
+	for _, d := range []struct {
+		name     string
+		value    durationSetting
+		min, max time.Duration
+	}{
+		{"intervalInSeconds", h.publicSettings.IntervalInSeconds, time.Duration(minimumIntervalInSeconds) * time.Second, time.Duration(maximumIntervalInSeconds) * time.Second},
+		{"gracePeriod", h.publicSettings.GracePeriod, 5 * time.Second, 4 * time.Hour},
+		{"tcpConnectTimeoutInSeconds", h.publicSettings.TcpConnectTimeout, 10 * time.Millisecond, 30 * time.Second},
+		{"circuitBreakerCooldownInSeconds", h.publicSettings.CircuitBreakerCooldown, time.Second, time.Hour},
+	} {
+		if err := validateDurationSetting(d.name, d.value, d.min, d.max); err != nil {
+			return err
+		}
+	}
+
+	probeSettlingTime := h.interval() * time.Duration(h.numberOfProbes())
+	if probeSettlingTime > time.Duration(maximumProbeSettleTime)*time.Second {
 		return errProbeSettleTimeExceedsThreshold
 	}
 
-	return nil
+	return h.validateApplications()
 }
 
 // publicSettings is the type deserialized from public configuration section of
 // the extension handler. This should be in sync with publicSettingsSchema.
 type publicSettings struct {
-	Protocol          string `json:"protocol"`
-	Port              int    `json:"port,int"`
-	RequestPath       string `json:"requestPath"`
-	IntervalInSeconds int    `json:"intervalInSeconds,int"`
-	NumberOfProbes    int    `json:"numberOfProbes,int"`
-	GracePeriod       int    `json:"gracePeriod,int"`
+	Protocol                     string            `json:"protocol"`
+	Port                         int               `json:"port,int"`
+	RequestPath                  string            `json:"requestPath"`
+	IntervalInSeconds            durationSetting   `json:"intervalInSeconds" settings:"top"`
+	NumberOfProbes               int               `json:"numberOfProbes,int"`
+	GracePeriod                  durationSetting   `json:"gracePeriod"`
+	MaxResponseBodySizeInBytes   int               `json:"maxResponseBodySizeInBytes,int"`
+	ExpectedHeaders              map[string]string `json:"expectedHeaders"`
+	UserAgent                    string            `json:"userAgent"`
+	IncludeIdentificationHeaders bool              `json:"includeIdentificationHeaders"`
+	RichStates                   *bool             `json:"richStates"`
+	ResponseJsonPath             string            `json:"responseJsonPath"`
+	ExpectedJsonPathValue        *string           `json:"expectedJsonPathValue"`
+	DependencyAggregation        string            `json:"dependencyAggregation"`
+	HttpVersion                  string            `json:"httpVersion"`
+	CertificateThumbprints       []string          `json:"certificateThumbprints"`
+	CertificateExpiryWarning     int               `json:"certificateExpiryWarningInDays,int"`
+	ProxyUrl                     string            `json:"proxyUrl"`
+	TcpProbeMode                 string            `json:"tcpProbeMode"`
+	TcpNoDelay                   *bool             `json:"tcpNoDelay"`
+	TcpConnectTimeout            durationSetting   `json:"tcpConnectTimeoutInSeconds"`
+	TcpLingerInSeconds           int               `json:"tcpLingerInSeconds,int"`
+	UdpPayload                   string            `json:"udpPayload"`
+	UdpExpectedResponse          string            `json:"udpExpectedResponse"`
+	UnitName                     string            `json:"unitName"`
+	PidFile                      string            `json:"pidFile"`
+	ProcessName                  string            `json:"processName"`
+	MinimumUptimeInSeconds       int               `json:"minimumUptimeInSeconds,int"`
+	FilePath                     string            `json:"filePath"`
+	MaxFileAgeInSeconds          int               `json:"maxFileAgeInSeconds,int"`
+	ParseFileState               bool              `json:"parseFileState"`
+	DnsName                      string            `json:"dnsName"`
+	DnsServer                    string            `json:"dnsServer"`
+	MaxLatencyInMilliseconds     int               `json:"maxLatencyInMilliseconds,int"`
+	ExpectedAddresses            []string          `json:"expectedAddresses"`
+	IcmpAddress                  string            `json:"icmpAddress"`
+	IcmpCount                    int               `json:"icmpCount,int"`
+	MaxPacketLossPercent         *int              `json:"maxPacketLossPercent"`
+	MetricsRules                 []string          `json:"metricsRules"`
+	FastcgiSocket                string            `json:"fastcgiSocket"`
+	AggregatorSocket             string            `json:"aggregatorSocket"`
+	DatabaseUser                 string            `json:"databaseUser"`
+	DatabaseName                 string            `json:"databaseName"`
+	DiscoverPortOfProcess        string            `json:"discoverPortOfProcess"`
+	FallbackPort                 int               `json:"fallbackPort,int"`
+	CheckLoopbackOnFailure       bool              `json:"checkLoopbackOnFailure"`
+	FailureStates                map[string]string `json:"failureStates"`
+	CircuitBreakerTimeouts       int               `json:"circuitBreakerTimeouts,int"`
+	CircuitBreakerCooldown       durationSetting   `json:"circuitBreakerCooldownInSeconds"`
+	SimulationFile               string            `json:"simulationFile"`
+
+	Applications             []applicationSettings `json:"applications" settings:"applications"`
+	Aggregation              string                `json:"aggregation" settings:"top"`
+	HealthyWeightThreshold   float64               `json:"healthyWeightThreshold" settings:"top"`
+	UnhealthyWeightThreshold float64               `json:"unhealthyWeightThreshold" settings:"top"`
+	MinimumStateDuration     int                   `json:"minimumStateDurationInSeconds,int" settings:"top"`
+	MaxInterval              durationSetting       `json:"maxIntervalInSeconds" settings:"top"`
+	DefaultPorts             map[string]int        `json:"defaultPorts" settings:"top"`
+	DisableHealthProbe       bool                  `json:"disableHealthProbe" settings:"top"`
+
+	EscalateToErrorAfterMinutes int  `json:"escalateToErrorAfterMinutes,int" settings:"observability"`
+	MirrorLogsToSyslog          bool `json:"mirrorLogsToSyslog" settings:"observability"`
+	DiagnosticsPort             int  `json:"diagnosticsPort,int" settings:"observability"`
+
+	StatusWriteMode          string `json:"statusWriteMode" settings:"observability"`
+	StatusHeartbeatIntervals int    `json:"statusHeartbeatIntervals,int" settings:"observability"`
+
+	// version 2 settings, the flat settings being migrated into them
+	SchemaVersion int                    `json:"schemaVersion,int" settings:"v2"`
+	Probes        []applicationSettings  `json:"probes" settings:"v2"`
+	Observability *observabilitySettings `json:"observability" settings:"v2"`
+}
+
+// observabilitySettings groups, in the version 2 settings, the settings of
+// how the extension reports and exposes the health of the VM.
+type observabilitySettings struct {
+	EscalateToErrorAfterMinutes int                        `json:"escalateToErrorAfterMinutes,int"`
+	MirrorLogsToSyslog          bool                       `json:"mirrorLogsToSyslog"`
+	DiagnosticsPort             int                        `json:"diagnosticsPort,int"`
+	StatusWriteMode             string                     `json:"statusWriteMode"`
+	StatusHeartbeatIntervals    int                        `json:"statusHeartbeatIntervals,int"`
+	ApplicationName             string                     `json:"applicationName"`
+	Environment                 string                     `json:"environment"`
+	OtlpEndpoint                string                     `json:"otlpEndpoint"`
+	MaxMemoryInMB               int                        `json:"maxMemoryInMB,int"`
+	MaxGoroutines               int                        `json:"maxGoroutines,int"`
+	MaxOpenFiles                int                        `json:"maxOpenFiles,int"`
+	RestartOnResourceLimit      bool                       `json:"restartOnResourceLimit"`
+	StatusMessages              map[string]string          `json:"statusMessages"`
+	StateFilePath               string                     `json:"stateFilePath"`
+	StateFileFormat             string                     `json:"stateFileFormat"`
+	LogDeduplication            map[string]durationSetting `json:"logDeduplication"`
+	HeartbeatSubstatus          bool                       `json:"heartbeatSubstatus"`
+	EventFilesFolder            string                     `json:"eventFilesFolder"`
+	CompressEventFiles          bool                       `json:"compressEventFiles"`
+	TelemetryFlushInterval      durationSetting            `json:"telemetryFlushInterval"`
+	ReadinessFilePath           string                     `json:"readinessFilePath"`
+	EventsMaxFiles              int                        `json:"eventsMaxFiles,int"`
+	EventsMaxAge                durationSetting            `json:"eventsMaxAge"`
+	EventsMaxSizeInMB           int                        `json:"eventsMaxSizeInMB,int"`
 }
 
 // protectedSettings is the type decoded and deserialized from protected
 // configuration section. This should be in sync with protectedSettingsSchema.
 type protectedSettings struct {
+	ApplicationInsightsInstrumentationKey secretRef            `json:"applicationInsightsInstrumentationKey"`
+	LogAnalyticsWorkspaceId               string               `json:"logAnalyticsWorkspaceId"`
+	LogAnalyticsSharedKey                 secretRef            `json:"logAnalyticsSharedKey"`
+	DatabasePassword                      secretRef            `json:"databasePassword"`
+	RequestHeaders                        map[string]secretRef `json:"requestHeaders"`
+	ClientCertificate                     string               `json:"clientCertificate"`
+	ClientKey                             secretRef            `json:"clientKey"`
+	ProxyUsername                         string               `json:"proxyUsername"`
+	ProxyPassword                         secretRef            `json:"proxyPassword"`
 }
 
 // parseAndValidateSettings reads configuration from configFolder, decrypts it,
@@ -106,7 +1542,13 @@ func parseAndValidateSettings(ctx *log.Context, configFolder string) (h handlerS
 		return h, err
 	}
 	ctx.Log("event", "read configuration")
+	secrets.add(secretValues(protJSON)...)
+	return validateSettings(ctx, pubJSON, protJSON)
+}
 
+// validateSettings runs JSON-schema and logical validation on the public and
+// protected settings JSON objects and returns the parsed settings.
+func validateSettings(ctx *log.Context, pubJSON, protJSON map[string]interface{}) (h handlerSettings, _ error) {
 	ctx.Log("event", "validating json schema")
 	if err := validateSettingsSchema(pubJSON, protJSON); err != nil {
 		return h, errors.Wrap(err, "json validation error")
@@ -127,6 +1569,33 @@ func parseAndValidateSettings(ctx *log.Context, configFolder string) (h handlerS
 	return h, nil
 }
 
+// readSettingsFile reads the public and protected settings from a JSON file,
+// either as an object with 'publicSettings' and 'protectedSettings' (both
+// unencrypted), or as the public settings object itself.
+func readSettingsFile(path string) (pubSettingsJSON, protSettingsJSON map[string]interface{}, _ error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read settings file")
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse settings file")
+	}
+
+	pub, hasPub := settings["publicSettings"]
+	prot, hasProt := settings["protectedSettings"]
+	if !hasPub && !hasProt {
+		return settings, nil, nil
+	}
+	if pubSettingsJSON, _ = pub.(map[string]interface{}); pub != nil && pubSettingsJSON == nil {
+		return nil, nil, errors.New("'publicSettings' in settings file is not an object")
+	}
+	if protSettingsJSON, _ = prot.(map[string]interface{}); prot != nil && protSettingsJSON == nil {
+		return nil, nil, errors.New("'protectedSettings' in settings file is not an object")
+	}
+	return pubSettingsJSON, protSettingsJSON, nil
+}
+
 // readSettings uses specified configFolder (comes from HandlerEnvironment) to
 // decrypt and parse the public/protected settings of the extension handler into
 // JSON objects.
@@ -1,7 +1,14 @@
 package main
 
-import "testing"
-import "github.com/stretchr/testify/require"
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
 
 func Test_handlerSettingsValidate(t *testing.T) {
 	// tcp includes request path
@@ -16,9 +23,386 @@ func Test_handlerSettingsValidate(t *testing.T) {
 		protectedSettings{},
 	}.validate())
 
+	// tcp includes expected headers
+	require.Equal(t, errTcpMustNotIncludeExpectedHeaders, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, ExpectedHeaders: map[string]string{"Content-Type": ""}},
+		protectedSettings{},
+	}.validate())
+
+	// tcp includes user agent
+	require.Equal(t, errTcpMustNotIncludeUserAgent, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, UserAgent: "contoso"},
+		protectedSettings{},
+	}.validate())
+
+	// tcp includes http version
+	require.Equal(t, errTcpMustNotIncludeHttpVersion, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, HttpVersion: "2"},
+		protectedSettings{},
+	}.validate())
+
+	// tcp probe mode with http
+	require.Equal(t, errTcpProbeModeRequiresTcp, handlerSettings{
+		publicSettings{Protocol: "http", TcpProbeMode: "halfOpen"},
+		protectedSettings{},
+	}.validate())
+
+	// fastcgi without or with both a port and a socket
+	require.Equal(t, errFastcgiMustIncludeOneAddress, handlerSettings{
+		publicSettings{Protocol: "fastcgi"},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errFastcgiMustIncludeOneAddress, handlerSettings{
+		publicSettings{Protocol: "fastcgi", Port: 9000, FastcgiSocket: "/run/php/php-fpm.sock"},
+		protectedSettings{},
+	}.validate())
+
+	// fastcgi socket with tcp
+	require.Equal(t, errFastcgiSocketRequiresFastcgi, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, FastcgiSocket: "/run/php/php-fpm.sock"},
+		protectedSettings{},
+	}.validate())
+
+	// aggregator without or with both a port and a socket
+	require.Equal(t, errAggregatorMustIncludeOneAddress, handlerSettings{
+		publicSettings{Protocol: "aggregator"},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errAggregatorMustIncludeOneAddress, handlerSettings{
+		publicSettings{Protocol: "aggregator", Port: 8500, AggregatorSocket: "/run/health.sock"},
+		protectedSettings{},
+	}.validate())
+
+	// aggregator socket with fastcgi
+	require.Equal(t, errSocketRequiresAggregator, handlerSettings{
+		publicSettings{Protocol: "fastcgi", Port: 9000, AggregatorSocket: "/run/health.sock"},
+		protectedSettings{},
+	}.validate())
+
+	// ssh with a request path
+	require.Equal(t, errSshMustNotIncludeRequestPath, handlerSettings{
+		publicSettings{Protocol: "ssh", RequestPath: "health"},
+		protectedSettings{},
+	}.validate())
+
+	// database probes with a request path
+	require.Equal(t, errDatabaseMustNotIncludeRequestPath, handlerSettings{
+		publicSettings{Protocol: "mysql", RequestPath: "health"},
+		protectedSettings{},
+	}.validate())
+
+	// database settings with tcp
+	require.Equal(t, errDatabaseSettingsRequireDatabase, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 5432, DatabaseUser: "probe"},
+		protectedSettings{},
+	}.validate())
+
+	// redis with a database name
+	require.Equal(t, errRedisMustNotIncludeDatabaseName, handlerSettings{
+		publicSettings{Protocol: "redis", DatabaseName: "0"},
+		protectedSettings{},
+	}.validate())
+
+	// database password without database probe
+	require.Equal(t, errDatabasePasswordRequiresDatabase, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 5432},
+		protectedSettings{DatabasePassword: newSecretRef("secret")},
+	}.validate())
+
+	// secret request headers without http probe
+	require.Equal(t, errSecretHeadersRequireHttp, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 8080},
+		protectedSettings{RequestHeaders: map[string]secretRef{"X-Api-Key": newSecretRef("key")}},
+	}.validate())
+
+	// client key without client certificate
+	err := handlerSettings{
+		publicSettings{Protocol: "https", RequestPath: "/health"},
+		protectedSettings{ClientKey: newSecretRef("key")},
+	}.validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid 'clientCertificate' or 'clientKey'")
+
+	// client certificate with http
+	certPEM, keyPEM := testClientCertificate(t)
+	require.Equal(t, errClientCertificateRequiresHttps, handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/health"},
+		protectedSettings{ClientCertificate: certPEM, ClientKey: newSecretRef(keyPEM)},
+	}.validate())
+
+	// proxy with tcp
+	require.Equal(t, errProxyRequiresHttp, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, ProxyUrl: "http://localhost:3128"},
+		protectedSettings{},
+	}.validate())
+
+	// proxy credentials without proxy
+	require.Equal(t, errProxyCredentialsRequireProxy, handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/health"},
+		protectedSettings{ProxyUsername: "user", ProxyPassword: newSecretRef("password")},
+	}.validate())
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/health", ProxyUrl: "http://localhost:3128"},
+		protectedSettings{ProxyUsername: "user", ProxyPassword: newSecretRef("password")},
+	}.validate())
+
+	// certificate thumbprints with http
+	require.Equal(t, errThumbprintsRequireHttps, handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/health", CertificateThumbprints: []string{"abababababababababababababababababababababababababababababababab"}},
+		protectedSettings{},
+	}.validate())
+
+	// certificate expiry warning with http
+	require.Equal(t, errExpiryWarningRequiresHttps, handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/health", CertificateExpiryWarning: 30},
+		protectedSettings{},
+	}.validate())
+
+	// fallback port with udp
+	require.Equal(t, errFallbackPortRequiresTcpOrHttp, handlerSettings{
+		publicSettings{Protocol: "udp", Port: 53, FallbackPort: 5353},
+		protectedSettings{},
+	}.validate())
+
+	// fallback port with port discovery
+	require.Equal(t, errFallbackPortWithDiscoverPort, handlerSettings{
+		publicSettings{Protocol: "tcp", DiscoverPortOfProcess: "nginx", FallbackPort: 8081},
+		protectedSettings{},
+	}.validate())
+
+	// fallback port same as port
+	require.Equal(t, errFallbackPortSameAsPort, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 8080, FallbackPort: 8080},
+		protectedSettings{},
+	}.validate())
+
+	// loopback check with tcp
+	require.Equal(t, errLoopbackCheckRequiresHttp, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 8080, CheckLoopbackOnFailure: true},
+		protectedSettings{},
+	}.validate())
+
+	// tcp socket options with http
+	require.Equal(t, errTcpSocketOptionsRequireTcp, handlerSettings{
+		publicSettings{Protocol: "http", TcpLingerInSeconds: -1},
+		protectedSettings{},
+	}.validate())
+
+	// udp without port
+	require.Equal(t, errUdpConfigurationMustIncludePort, handlerSettings{
+		publicSettings{Protocol: "udp"},
+		protectedSettings{},
+	}.validate())
+
+	// udp includes request path
+	require.Equal(t, errUdpMustNotIncludeRequestPath, handlerSettings{
+		publicSettings{Protocol: "udp", Port: 53, RequestPath: "RequestPath"},
+		protectedSettings{},
+	}.validate())
+
+	// udp payload with tcp
+	require.Equal(t, errUdpSettingsRequireUdp, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 53, UdpPayload: "cGluZw=="},
+		protectedSettings{},
+	}.validate())
+
+	// udp payload is not base64
+	require.NotNil(t, handlerSettings{
+		publicSettings{Protocol: "udp", Port: 53, UdpPayload: "ping!"},
+		protectedSettings{},
+	}.validate())
+
+	// systemd without unit name
+	require.Equal(t, errSystemdMustIncludeUnitName, handlerSettings{
+		publicSettings{Protocol: "systemd"},
+		protectedSettings{},
+	}.validate())
+
+	// systemd includes port
+	require.Equal(t, errSystemdMustNotIncludePort, handlerSettings{
+		publicSettings{Protocol: "systemd", UnitName: "nginx.service", Port: 80},
+		protectedSettings{},
+	}.validate())
+
+	// unit name with http
+	require.Equal(t, errUnitNameRequiresSystemd, handlerSettings{
+		publicSettings{Protocol: "http", UnitName: "nginx.service"},
+		protectedSettings{},
+	}.validate())
+
+	// process without pid file or process name
+	require.Equal(t, errProcessMustIncludeOneIdentifier, handlerSettings{
+		publicSettings{Protocol: "process"},
+		protectedSettings{},
+	}.validate())
+
+	// process with both pid file and process name
+	require.Equal(t, errProcessMustIncludeOneIdentifier, handlerSettings{
+		publicSettings{Protocol: "process", PidFile: "/run/nginx.pid", ProcessName: "nginx"},
+		protectedSettings{},
+	}.validate())
+
+	// process includes port
+	require.Equal(t, errProcessMustNotIncludePort, handlerSettings{
+		publicSettings{Protocol: "process", ProcessName: "nginx", Port: 80},
+		protectedSettings{},
+	}.validate())
+
+	// process name with tcp
+	require.Equal(t, errProcessSettingsRequireProcess, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, ProcessName: "nginx"},
+		protectedSettings{},
+	}.validate())
+
+	// file without path
+	require.Equal(t, errFileMustIncludeFilePath, handlerSettings{
+		publicSettings{Protocol: "file"},
+		protectedSettings{},
+	}.validate())
+
+	// file includes port
+	require.Equal(t, errFileMustNotIncludePort, handlerSettings{
+		publicSettings{Protocol: "file", FilePath: "/tmp/healthy", Port: 80},
+		protectedSettings{},
+	}.validate())
+
+	// file settings with http
+	require.Equal(t, errFileSettingsRequireFile, handlerSettings{
+		publicSettings{Protocol: "http", MaxFileAgeInSeconds: 60},
+		protectedSettings{},
+	}.validate())
+
+	// dns without name
+	require.Equal(t, errDnsMustIncludeDnsName, handlerSettings{
+		publicSettings{Protocol: "dns"},
+		protectedSettings{},
+	}.validate())
+
+	// dns includes port
+	require.Equal(t, errDnsMustNotIncludePort, handlerSettings{
+		publicSettings{Protocol: "dns", DnsName: "contoso.com", Port: 53},
+		protectedSettings{},
+	}.validate())
+
+	// dns settings with tcp
+	require.Equal(t, errDnsSettingsRequireDns, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 53, DnsServer: "127.0.0.1"},
+		protectedSettings{},
+	}.validate())
+
+	// metrics without port
+	require.Equal(t, errMetricsMustIncludePort, handlerSettings{
+		publicSettings{Protocol: "metrics", MetricsRules: []string{"up == 1"}},
+		protectedSettings{},
+	}.validate())
+
+	// metrics without rules
+	require.Equal(t, errMetricsMustIncludeRules, handlerSettings{
+		publicSettings{Protocol: "metrics", Port: 9100},
+		protectedSettings{},
+	}.validate())
+
+	// metrics rules with another protocol
+	require.Equal(t, errMetricsRulesRequireMetrics, handlerSettings{
+		publicSettings{Protocol: "http", Port: 9100, MetricsRules: []string{"up == 1"}},
+		protectedSettings{},
+	}.validate())
+
+	// invalid metrics rule
+	require.EqualError(t, handlerSettings{
+		publicSettings{Protocol: "metrics", Port: 9100, MetricsRules: []string{"up == 1", "up = 1"}},
+		protectedSettings{},
+	}.validate(), `metrics rule 'up = 1' is not of the form 'metric{label="value"} <operator> <threshold>'`)
+
+	// log analytics workspace without key
+	require.Equal(t, errLogAnalyticsIncomplete, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80},
+		protectedSettings{LogAnalyticsWorkspaceId: "workspace"},
+	}.validate())
+
+	// log analytics key not base64
+	require.NotNil(t, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80},
+		protectedSettings{LogAnalyticsWorkspaceId: "workspace", LogAnalyticsSharedKey: newSecretRef("not base64")},
+	}.validate())
+
+	// port discovery with a protocol without port
+	require.Equal(t, errDiscoverPortRequiresTcpOrHttp, handlerSettings{
+		publicSettings{Protocol: "udp", Port: 53, DiscoverPortOfProcess: "named"},
+		protectedSettings{},
+	}.validate())
+
+	// port discovery with port
+	require.Equal(t, errDiscoverPortMustNotIncludePort, handlerSettings{
+		publicSettings{Protocol: "http", Port: 8080, DiscoverPortOfProcess: "nginx"},
+		protectedSettings{},
+	}.validate())
+
+	// failure states with a protocol without network failures
+	require.Equal(t, errFailureStatesRequireNetwork, handlerSettings{
+		publicSettings{Protocol: "process", ProcessName: "nginx", FailureStates: map[string]string{"timeout": "Unhealthy"}},
+		protectedSettings{},
+	}.validate())
+
+	// circuit breaker cooldown without timeouts
+	require.Equal(t, errCooldownRequiresCircuitBreaker, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, CircuitBreakerCooldown: seconds(30)},
+		protectedSettings{},
+	}.validate())
+
+	// rich states with a protocol without a response body
+	richStates := false
+	require.Equal(t, errRichStatesRequireHttp, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, RichStates: &richStates},
+		protectedSettings{},
+	}.validate())
+
+	// status heartbeat without writing the status on change
+	require.Equal(t, errHeartbeatRequiresOnChange, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, StatusHeartbeatIntervals: 10},
+		protectedSettings{},
+	}.validate())
+
+	// response json path with tcp, without an expected value or with rich
+	// states disabled
+	expectedStatus := "UP"
+	require.Equal(t, errJsonPathRequireHttp, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 8080, ResponseJsonPath: "$.status", ExpectedJsonPathValue: &expectedStatus},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errJsonPathRequiresExpectedValue, handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/actuator/health", ResponseJsonPath: "$.status"},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errJsonPathRequiresExpectedValue, handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/actuator/health", ExpectedJsonPathValue: &expectedStatus},
+		protectedSettings{},
+	}.validate())
+	noRichStates := false
+	require.Equal(t, errJsonPathRequiresRichStates, handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/actuator/health", ResponseJsonPath: "$.status", ExpectedJsonPathValue: &expectedStatus, RichStates: &noRichStates},
+		protectedSettings{},
+	}.validate())
+	err = handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/actuator/health", ResponseJsonPath: "$..status", ExpectedJsonPathValue: &expectedStatus},
+		protectedSettings{},
+	}.validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "JSONPath '$..status' is not valid")
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "https", RequestPath: "/actuator/health", ResponseJsonPath: "$.status", ExpectedJsonPathValue: &expectedStatus},
+		protectedSettings{},
+	}.validate())
+
+	// dependency aggregation with a protocol without a response body
+	require.Equal(t, errDependencyAggregationRequireHttp, handlerSettings{
+		publicSettings{Protocol: "file", FilePath: "/var/run/app/health", DependencyAggregation: aggregationWorstOf},
+		protectedSettings{},
+	}.validate())
+
 	// probe settle time cannot exceed 240 seconds
 	require.Equal(t, errProbeSettleTimeExceedsThreshold, handlerSettings{
-		publicSettings{Protocol: "http", IntervalInSeconds: 60, NumberOfProbes: 5},
+		publicSettings{Protocol: "http", IntervalInSeconds: seconds(60), NumberOfProbes: 5},
 		protectedSettings{},
 	}.validate())
 
@@ -27,20 +411,707 @@ func Test_handlerSettingsValidate(t *testing.T) {
 		protectedSettings{},
 	}.validate())
 
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, TcpProbeMode: "halfOpen"},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, TcpConnectTimeout: seconds(5), TcpLingerInSeconds: -1},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "udp", Port: 53, UdpPayload: "cGluZw==", UdpExpectedResponse: "cG9uZw=="},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "systemd", UnitName: "nginx.service"},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "process", PidFile: "/run/nginx.pid", MinimumUptimeInSeconds: 30},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "file", FilePath: "/tmp/healthy", MaxFileAgeInSeconds: 60, ParseFileState: true},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "dns", DnsName: "contoso.com", DnsServer: "127.0.0.1", ExpectedAddresses: []string{"10.0.0.1"}},
+		protectedSettings{},
+	}.validate())
+
 	require.Nil(t, handlerSettings{
 		publicSettings{Protocol: "http", RequestPath: "healthEndpoint"},
 		protectedSettings{},
 	}.validate())
 
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "metrics", Port: 9100, MetricsRules: []string{"up == 1", `queue_depth{queue="orders"} < 1000`}},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "fastcgi", Port: 9000},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "ssh"},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "aggregator", AggregatorSocket: "/run/health.sock", DependencyAggregation: "worstOf"},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "postgresql", DatabaseUser: "probe", DatabaseName: "app"},
+		protectedSettings{DatabasePassword: newSecretRef("secret")},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Applications: []applicationSettings{
+			{Name: "web", publicSettings: publicSettings{Protocol: "http", RequestPath: "health"}},
+			{Name: "cache", publicSettings: publicSettings{Protocol: "redis"}},
+		}},
+		protectedSettings{DatabasePassword: newSecretRef("secret")},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "fastcgi", FastcgiSocket: "/run/php/php-fpm.sock", RequestPath: "/status"},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "tcp", DiscoverPortOfProcess: "redis-server"},
+		protectedSettings{},
+	}.validate())
+
 	require.Nil(t, handlerSettings{
 		publicSettings{Protocol: "https", RequestPath: "healthEndpoint"},
 		protectedSettings{},
 	}.validate())
 
 	require.Nil(t, handlerSettings{
-		publicSettings{Protocol: "https", IntervalInSeconds: 30, NumberOfProbes: 3},
+		publicSettings{Protocol: "https", IntervalInSeconds: seconds(30), NumberOfProbes: 3},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "healthEndpoint", RichStates: &richStates},
+		protectedSettings{},
+	}.validate())
+}
+
+func Test_handlerSettingsTcpSocketOptions(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "tcp", Port: 80}, protectedSettings{}}
+	require.True(t, h.tcpNoDelay())
+	require.Equal(t, 30*time.Second, h.tcpConnectTimeout())
+	require.Equal(t, 0, h.tcpLingerInSeconds())
+
+	noDelay := false
+	h.publicSettings.TcpNoDelay = &noDelay
+	h.publicSettings.TcpConnectTimeout = seconds(5)
+	h.publicSettings.TcpLingerInSeconds = 10
+	require.False(t, h.tcpNoDelay())
+	require.Equal(t, 5*time.Second, h.tcpConnectTimeout())
+	require.Equal(t, 10, h.tcpLingerInSeconds())
+}
+
+func Test_handlerSettingsDatabaseDefaults(t *testing.T) {
+	for protocol, expected := range map[string]struct {
+		port int
+		user string
+	}{
+		"mysql":      {3306, "root"},
+		"postgresql": {5432, "postgres"},
+		"redis":      {6379, ""},
+	} {
+		h := handlerSettings{publicSettings{Protocol: protocol}, protectedSettings{}}
+		require.Equal(t, expected.port, h.databasePort(), protocol)
+		require.Equal(t, expected.user, h.databaseUser(), protocol)
+	}
+
+	h := handlerSettings{publicSettings{Protocol: "mysql", Port: 3307, DatabaseUser: "probe"}, protectedSettings{}}
+	require.Equal(t, 3307, h.databasePort())
+	require.Equal(t, "probe", h.databaseUser())
+}
+
+func Test_handlerSettingsRichStates(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "http"}, protectedSettings{}}
+	require.True(t, h.richStates())
+
+	richStates := false
+	h.publicSettings.RichStates = &richStates
+	require.False(t, h.richStates())
+}
+
+func Test_handlerSettingsDependencyAggregation(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "http"}, protectedSettings{}}
+	require.Equal(t, dependencyAggregationIgnoreOptional, h.dependencyAggregation())
+
+	h.publicSettings.DependencyAggregation = aggregationWorstOf
+	require.Equal(t, aggregationWorstOf, h.dependencyAggregation())
+}
+
+func Test_handlerSettingsValidateApplications(t *testing.T) {
+	web := applicationSettings{Name: "web", publicSettings: publicSettings{Protocol: "http", Port: 8080}}
+	db := applicationSettings{Name: "db", publicSettings: publicSettings{Protocol: "tcp", Port: 5432}}
+
+	// top level probe settings with applications
+	require.Equal(t, errApplicationsMustNotIncludeProbe, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, Applications: []applicationSettings{web}},
+		protectedSettings{},
+	}.validate())
+
+	// aggregation without applications
+	require.Equal(t, errAggregationRequiresApplications, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, Aggregation: aggregationWeighted},
+		protectedSettings{},
+	}.validate())
+
+	// requiredSubset without required applications
+	require.Equal(t, errRequiredSubsetMustIncludeRequired, handlerSettings{
+		publicSettings{Applications: []applicationSettings{web, db}, Aggregation: aggregationRequiredSubset},
+		protectedSettings{},
+	}.validate())
+
+	// unhealthy weight threshold without weighted aggregation
+	require.Equal(t, errUnhealthyWeightRequiresWeighted, handlerSettings{
+		publicSettings{Applications: []applicationSettings{web, db}, UnhealthyWeightThreshold: 0.3},
+		protectedSettings{},
+	}.validate())
+
+	// unhealthy weight threshold above the healthy one, which defaults to 0.5
+	require.Equal(t, errUnhealthyWeightAboveHealthy, handlerSettings{
+		publicSettings{Applications: []applicationSettings{web, db}, Aggregation: aggregationWeighted, UnhealthyWeightThreshold: 0.5},
+		protectedSettings{},
+	}.validate())
+	require.Nil(t, handlerSettings{
+		publicSettings{Applications: []applicationSettings{web, db}, Aggregation: aggregationWeighted, HealthyWeightThreshold: 0.9, UnhealthyWeightThreshold: 0.5},
+		protectedSettings{},
+	}.validate())
+
+	// duplicate application names
+	require.EqualError(t, handlerSettings{
+		publicSettings{Applications: []applicationSettings{web, web}},
+		protectedSettings{},
+	}.validate(), "application name 'web' is not unique")
+
+	// invalid application probe settings
+	invalid := applicationSettings{Name: "invalid", publicSettings: publicSettings{Protocol: "tcp"}}
+	require.EqualError(t, handlerSettings{
+		publicSettings{Applications: []applicationSettings{web, invalid}},
+		protectedSettings{},
+	}.validate(), "application 'invalid': "+errTcpConfigurationMustIncludePort.Error())
+
+	// valid
+	db.Required = true
+	require.Nil(t, handlerSettings{
+		publicSettings{IntervalInSeconds: seconds(10), Applications: []applicationSettings{web, db}, Aggregation: aggregationRequiredSubset},
+		protectedSettings{},
+	}.validate())
+
+	require.Nil(t, handlerSettings{
+		publicSettings{Applications: []applicationSettings{web, db}, Aggregation: aggregationWeighted, HealthyWeightThreshold: 0.6, EscalateToErrorAfterMinutes: 5},
+		protectedSettings{},
+	}.validate())
+}
+
+func Test_publicSettingsMigrateToV2(t *testing.T) {
+	// flat probe settings become a single unnamed probe
+	v1 := publicSettings{Protocol: "tcp", Port: 80, IntervalInSeconds: seconds(10), NumberOfProbes: 2, DiagnosticsPort: 6060, StatusWriteMode: statusWriteModeOnChange}
+	require.Equal(t, publicSettings{
+		SchemaVersion:     settingsSchemaVersion2,
+		IntervalInSeconds: seconds(10),
+		Probes:            []applicationSettings{{publicSettings: publicSettings{Protocol: "tcp", Port: 80, NumberOfProbes: 2}}},
+		Observability:     &observabilitySettings{DiagnosticsPort: 6060, StatusWriteMode: statusWriteModeOnChange},
+	}, v1.migrateToV2())
+
+	// applications become named probes
+	web := applicationSettings{Name: "web", publicSettings: publicSettings{Protocol: "http", Port: 8080}}
+	v1 = publicSettings{Applications: []applicationSettings{web}, Aggregation: aggregationWeighted, MirrorLogsToSyslog: true}
+	require.Equal(t, publicSettings{
+		SchemaVersion: settingsSchemaVersion2,
+		Aggregation:   aggregationWeighted,
+		Probes:        []applicationSettings{web},
+		Observability: &observabilitySettings{MirrorLogsToSyslog: true},
+	}, v1.migrateToV2())
+
+	// version 2 settings are left as is
+	v2 := publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web}}
+	require.Equal(t, v2, v2.migrateToV2())
+}
+
+func Test_observabilitySettingsMigration(t *testing.T) {
+	// each of the observability settings: its value and whether it is also a
+	// flat version 1 setting, migrated into the observability settings
+	tests := []struct {
+		name  string
+		value string
+		flat  bool
+	}{
+		{"escalateToErrorAfterMinutes", `5`, true},
+		{"mirrorLogsToSyslog", `true`, true},
+		{"diagnosticsPort", `6060`, true},
+		{"statusWriteMode", `"onChange"`, true},
+		{"statusHeartbeatIntervals", `10`, true},
+		{"applicationName", `"checkout"`, false},
+		{"environment", `"production"`, false},
+		{"otlpEndpoint", `"http://localhost:4318"`, false},
+		{"maxMemoryInMB", `64`, false},
+		{"maxGoroutines", `500`, false},
+		{"maxOpenFiles", `128`, false},
+		{"restartOnResourceLimit", `true`, false},
+		{"statusMessages", `{"healthy": "OK"}`, false},
+		{"stateFilePath", `"/run/apphealth/state"`, false},
+		{"stateFileFormat", `"line"`, false},
+		{"logDeduplication", `{"error": 300}`, false},
+		{"heartbeatSubstatus", `true`, false},
+		{"eventFilesFolder", `"/var/log/apphealth/events"`, false},
+		{"compressEventFiles", `true`, false},
+		{"telemetryFlushInterval", `10`, false},
+		{"readinessFilePath", `"/run/apphealth/ready"`, false},
+		{"eventsMaxFiles", `500`, false},
+		{"eventsMaxAge", `"72h"`, false},
+		{"eventsMaxSizeInMB", `128`, false},
+	}
+
+	var names []string
+	fields := reflect.TypeOf(observabilitySettings{})
+	for i := 0; i < fields.NumField(); i++ {
+		names = append(names, strings.Split(fields.Field(i).Tag.Get("json"), ",")[0])
+	}
+	require.Len(t, tests, len(names))
+
+	for _, tt := range tests {
+		require.Contains(t, names, tt.name)
+
+		v2JSON := `{"schemaVersion": 2, "probes": [{"protocol": "tcp", "port": 80}], "observability": {"` + tt.name + `": ` + tt.value + `}}`
+		require.Nil(t, validatePublicSettings(v2JSON), tt.name)
+		var v2 publicSettings
+		require.Nil(t, json.Unmarshal([]byte(v2JSON), &v2), tt.name)
+		require.NotEqual(t, observabilitySettings{}, *v2.Observability, tt.name)
+
+		v1JSON := `{"protocol": "tcp", "port": 80, "` + tt.name + `": ` + tt.value + `}`
+		if !tt.flat {
+			err := validatePublicSettings(v1JSON)
+			require.NotNil(t, err, tt.name)
+			require.Contains(t, err.Error(), "Additional property "+tt.name+" is not allowed")
+			continue
+		}
+		require.Nil(t, validatePublicSettings(v1JSON), tt.name)
+		var v1 publicSettings
+		require.Nil(t, json.Unmarshal([]byte(v1JSON), &v1), tt.name)
+		migrated := v1.migrateToV2()
+		require.Equal(t, v2.Observability, migrated.Observability, tt.name)
+		require.Equal(t, []applicationSettings{{publicSettings: publicSettings{Protocol: "tcp", Port: 80}}}, migrated.Probes, tt.name)
+	}
+}
+
+func Test_handlerSettingsV2(t *testing.T) {
+	web := applicationSettings{Name: "web", publicSettings: publicSettings{Protocol: "http", Port: 8080}}
+	db := applicationSettings{Name: "db", publicSettings: publicSettings{Protocol: "tcp", Port: 5432}}
+
+	h := handlerSettings{publicSettings{
+		SchemaVersion: settingsSchemaVersion2,
+		Probes:        []applicationSettings{web, db},
+		Observability: &observabilitySettings{DiagnosticsPort: 6060, StatusWriteMode: statusWriteModeOnChange, StatusHeartbeatIntervals: 10},
+	}, protectedSettings{}}
+	require.Nil(t, h.validate())
+	require.True(t, h.multipleApplications())
+	require.Equal(t, []applicationSettings{web, db}, h.applications())
+	require.Equal(t, 6060, h.diagnosticsPort())
+	require.Equal(t, 10, h.statusHeartbeatIntervals())
+	require.Empty(t, h.identity())
+
+	// application name and environment
+	h.publicSettings.Observability.ApplicationName = "checkout"
+	h.publicSettings.Observability.Environment = "production"
+	require.Nil(t, h.validate())
+	require.Equal(t, []interface{}{"applicationName", "checkout", "environment", "production"}, h.identity())
+	require.Equal(t, []interface{}{"environment", "staging"}, observabilityConfig(observabilitySettings{Environment: "staging"}).identity())
+
+	// a single unnamed probe is the top level probe
+	h = handlerSettings{publicSettings{
+		SchemaVersion: settingsSchemaVersion2,
+		Probes:        []applicationSettings{{publicSettings: web.publicSettings}},
+	}, protectedSettings{}}
+	require.Nil(t, h.validate())
+	require.False(t, h.multipleApplications())
+	require.Equal(t, statusWriteModeEveryInterval, h.statusWriteMode())
+
+	// the flat settings behave as their migration
+	v1 := handlerSettings{publicSettings{Protocol: "tcp", Port: 80, EscalateToErrorAfterMinutes: 5}, protectedSettings{}}
+	require.False(t, v1.multipleApplications())
+	require.Equal(t, 5, v1.escalateToErrorAfterMinutes())
+	v1 = handlerSettings{publicSettings{Applications: []applicationSettings{web}}, protectedSettings{}}
+	require.True(t, v1.multipleApplications())
+}
+
+func Test_handlerSettingsValidateV2(t *testing.T) {
+	web := applicationSettings{Name: "web", publicSettings: publicSettings{Protocol: "http", Port: 8080}}
+	unnamed := applicationSettings{publicSettings: publicSettings{Protocol: "tcp", Port: 5432}}
+
+	// version 2 settings without schema version
+	require.Equal(t, errSettingsV2RequireSchemaVersion2, handlerSettings{
+		publicSettings{Probes: []applicationSettings{web}},
 		protectedSettings{},
 	}.validate())
+	require.Equal(t, errSettingsV2RequireSchemaVersion2, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, Observability: &observabilitySettings{}},
+		protectedSettings{},
+	}.validate())
+
+	// flat settings with schema version 2
+	require.Equal(t, errSettingsV2MustNotIncludeFlat, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Protocol: "tcp", Port: 80},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errSettingsV2MustNotIncludeFlat, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web}, DiagnosticsPort: 6060},
+		protectedSettings{},
+	}.validate())
+
+	// no probes
+	require.Equal(t, errSettingsV2MustIncludeProbes, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2},
+		protectedSettings{},
+	}.validate())
+
+	// unnamed probe among several
+	require.Equal(t, errProbesMustBeNamed, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web, unnamed}},
+		protectedSettings{},
+	}.validate())
+
+	// aggregation of a single unnamed probe
+	require.Equal(t, errAggregationRequiresNamedProbes, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{unnamed}, Aggregation: aggregationWeighted},
+		protectedSettings{},
+	}.validate())
+
+	// invalid probe settings
+	require.Equal(t, errTcpConfigurationMustIncludePort, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{{publicSettings: publicSettings{Protocol: "tcp"}}}},
+		protectedSettings{},
+	}.validate())
+	require.EqualError(t, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web, web}},
+		protectedSettings{},
+	}.validate(), "application name 'web' is not unique")
+
+	// observability and protected settings
+	require.Equal(t, errHeartbeatRequiresOnChange, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web}, Observability: &observabilitySettings{StatusHeartbeatIntervals: 10}},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errRestartRequiresResourceLimit, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web}, Observability: &observabilitySettings{RestartOnResourceLimit: true}},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errStateFileFormatRequiresPath, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web}, Observability: &observabilitySettings{StateFileFormat: stateFileFormatJson}},
+		protectedSettings{},
+	}.validate())
+	require.Nil(t, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web}, Observability: &observabilitySettings{MaxGoroutines: 1000, RestartOnResourceLimit: true}},
+		protectedSettings{},
+	}.validate())
+	err := handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web}, Observability: &observabilitySettings{StatusMessages: map[string]string{"healthy": "{{.Uptime}}"}}},
+		protectedSettings{},
+	}.validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid 'statusMessages' template 'healthy'")
+	require.Equal(t, errDatabasePasswordRequiresDatabase, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, Probes: []applicationSettings{web}},
+		protectedSettings{DatabasePassword: newSecretRef("secret")},
+	}.validate())
+}
+
+// observabilityConfig returns version 2 settings with the observability
+// settings and a tcp probe.
+func observabilityConfig(o observabilitySettings) *handlerSettings {
+	return &handlerSettings{publicSettings{
+		SchemaVersion: settingsSchemaVersion2,
+		Probes:        []applicationSettings{{publicSettings: publicSettings{Protocol: "tcp", Port: 80}}},
+		Observability: &o,
+	}, protectedSettings{}}
+}
+
+func Test_resourceLimits(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "tcp", Port: 80}, protectedSettings{}}
+	require.Equal(t, resourceLimits{}, h.resourceLimits())
+
+	h = *observabilityConfig(observabilitySettings{MaxMemoryInMB: 64, MaxGoroutines: 500, MaxOpenFiles: 128, RestartOnResourceLimit: true})
+	require.Nil(t, h.validate())
+	require.Equal(t, resourceLimits{RssBytes: 64 * 1024 * 1024, Goroutines: 500, OpenFiles: 128}, h.resourceLimits())
+	require.True(t, h.restartOnResourceLimit())
+}
+
+func Test_heartbeatSubstatusSetting(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "tcp", Port: 80}, protectedSettings{}}
+	require.False(t, h.heartbeatSubstatus())
+
+	h = *observabilityConfig(observabilitySettings{HeartbeatSubstatus: true})
+	require.Nil(t, h.validate())
+	require.True(t, h.heartbeatSubstatus())
+}
+
+func Test_eventFiles(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "tcp", Port: 80}, protectedSettings{}}
+	require.Empty(t, h.eventFilesFolder())
+	require.Equal(t, telemetryFlushInterval, h.telemetryFlushInterval())
+
+	// compressing the files written to the events folder of the handler
+	// environment
+	h = *observabilityConfig(observabilitySettings{CompressEventFiles: true})
+	require.Nil(t, h.validate())
+
+	h.publicSettings.Observability.TelemetryFlushInterval = seconds(7200)
+	h.publicSettings.Observability.EventFilesFolder = "/var/log/apphealth/events"
+	require.Equal(t, "'telemetryFlushInterval' must be between 1s and 1h0m0s", h.validate().Error())
+
+	h.publicSettings.Observability.TelemetryFlushInterval = seconds(10)
+	require.Nil(t, h.validate())
+	require.Equal(t, "/var/log/apphealth/events", h.eventFilesFolder())
+	require.True(t, h.compressEventFiles())
+	require.Equal(t, 10*time.Second, h.telemetryFlushInterval())
+}
+
+func Test_eventsRetention(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "tcp", Port: 80}, protectedSettings{}}
+	require.Equal(t, eventsRetention{maxFiles: 100, maxAge: 7 * 24 * time.Hour, maxBytes: 64 * 1024 * 1024}, h.eventsRetention())
+
+	h = *observabilityConfig(observabilitySettings{EventsMaxFiles: 500, EventsMaxAge: durationSetting(72 * time.Hour), EventsMaxSizeInMB: 128})
+	require.Nil(t, h.validate())
+	require.Equal(t, eventsRetention{maxFiles: 500, maxAge: 72 * time.Hour, maxBytes: 128 * 1024 * 1024}, h.eventsRetention())
+
+	h.publicSettings.Observability.EventsMaxAge = seconds(30)
+	require.Equal(t, "'eventsMaxAge' must be between 1m0s and 8760h0m0s", h.validate().Error())
+}
+
+func Test_stateFile(t *testing.T) {
+	h := observabilityConfig(observabilitySettings{StateFilePath: "/run/apphealth/state"})
+	require.Nil(t, h.validate())
+	require.Equal(t, "/run/apphealth/state", h.stateFilePath())
+	require.Equal(t, stateFileFormatJson, h.stateFileFormat())
+
+	h.publicSettings.Observability.StateFileFormat = stateFileFormatLine
+	require.Nil(t, h.validate())
+	require.Equal(t, stateFileFormatLine, h.stateFileFormat())
+}
+
+func Test_probePort(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "https", RequestPath: "/health"}, protectedSettings{}}
+	require.Equal(t, 443, h.probePort())
+	h.publicSettings.Protocol = "tcp"
+	require.Equal(t, 0, h.probePort())
+
+	h.publicSettings = publicSettings{Protocol: "http", RequestPath: "/health", DefaultPorts: map[string]int{"http": 8080}}
+	require.Nil(t, h.validate())
+	require.Equal(t, 8080, h.probePort())
+	h.publicSettings.Port = 9090
+	require.Equal(t, 9090, h.probePort())
+
+	// the default ports are shared by the probes
+	h.publicSettings = publicSettings{
+		SchemaVersion: settingsSchemaVersion2,
+		DefaultPorts:  map[string]int{"http": 8080, "postgresql": 6432},
+		Probes: []applicationSettings{
+			{Name: "web", publicSettings: publicSettings{Protocol: "http", RequestPath: "/health"}},
+			{Name: "db", publicSettings: publicSettings{Protocol: "postgresql"}},
+			{Name: "ssh", publicSettings: publicSettings{Protocol: "ssh"}},
+		},
+	}
+	require.Nil(t, h.validate())
+	var ports []int
+	for _, a := range h.applications() {
+		appCfg := a.handlerSettings(&h)
+		ports = append(ports, appCfg.probePort())
+	}
+	require.Equal(t, []int{8080, 6432, 22}, ports)
+	e := h.effectivePublicSettings()
+	require.Equal(t, 8080, e.Probes[0].Port)
+	require.Nil(t, e.Probes[0].DefaultPorts)
+}
+
+func Test_healthProbeDisabled(t *testing.T) {
+	h := handlerSettings{publicSettings{DisableHealthProbe: true, DiagnosticsPort: 8765}, protectedSettings{}}
+	require.Nil(t, h.validate())
+	require.True(t, h.healthProbeDisabled())
+
+	h.publicSettings.Protocol = "tcp"
+	h.publicSettings.Port = 80
+	require.Equal(t, errDisabledProbeMustNotIncludeProbe, h.validate())
+	h.publicSettings.Protocol, h.publicSettings.Port = "", 0
+	h.publicSettings.Applications = []applicationSettings{{Name: "web", publicSettings: publicSettings{Protocol: "tcp", Port: 80}}}
+	require.Equal(t, errDisabledProbeMustNotIncludeProbe, h.validate())
+
+	// version 2 settings without probes
+	h.publicSettings = publicSettings{SchemaVersion: settingsSchemaVersion2, DisableHealthProbe: true}
+	require.Nil(t, h.validate())
+	require.True(t, h.healthProbeDisabled())
+	h.publicSettings.Probes = []applicationSettings{{publicSettings: publicSettings{Protocol: "tcp", Port: 80}}}
+	require.Equal(t, errDisabledProbeMustNotIncludeProbe, h.validate())
+	h.publicSettings.DisableHealthProbe = false
+	require.Nil(t, h.validate())
+	require.False(t, h.healthProbeDisabled())
+}
+
+func Test_readinessFile(t *testing.T) {
+	h := observabilityConfig(observabilitySettings{ReadinessFilePath: "/run/apphealth/ready"})
+	require.Nil(t, h.validate())
+	require.Equal(t, "/run/apphealth/ready", h.readinessFilePath())
+
+	h.publicSettings.Observability.StateFilePath = "/run/apphealth/ready"
+	require.Equal(t, errReadinessFileIsStateFile, h.validate())
+	h.publicSettings.Observability.StateFilePath = "/run/apphealth/state"
+	require.Nil(t, h.validate())
+}
+
+func Test_logDeduplication(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "tcp", Port: 80}, protectedSettings{}}
+	require.Nil(t, h.logDeduplication())
+
+	h = *observabilityConfig(observabilitySettings{LogDeduplication: map[string]durationSetting{logLevelError: seconds(300), logLevelWarning: durationSetting(time.Minute)}})
+	require.Nil(t, h.validate())
+	require.Equal(t, map[string]time.Duration{logLevelError: 5 * time.Minute, logLevelWarning: time.Minute}, h.logDeduplication())
+
+	h = *observabilityConfig(observabilitySettings{LogDeduplication: map[string]durationSetting{"debug": seconds(60)}})
+	require.Equal(t, errLogDeduplicationInvalidLevel, h.validate())
+	h = *observabilityConfig(observabilitySettings{LogDeduplication: map[string]durationSetting{logLevelError: durationSetting(2 * time.Hour)}})
+	err := h.validate()
+	require.NotNil(t, err)
+	require.Equal(t, "'logDeduplication.error' must be between 1s and 1h0m0s", err.Error())
+}
+
+func Test_durationSettings(t *testing.T) {
+	var h handlerSettings
+	require.Nil(t, json.Unmarshal([]byte(`{"protocol": "tcp", "port": 80, "intervalInSeconds": 10, "gracePeriod": "2m30s", "tcpConnectTimeoutInSeconds": "250ms"}`), &h.publicSettings))
+	require.Nil(t, h.validate())
+	require.Equal(t, 10*time.Second, h.interval())
+	require.Equal(t, 150*time.Second, h.gracePeriod())
+	require.Equal(t, 250*time.Millisecond, h.tcpConnectTimeout())
+	require.Equal(t, time.Minute, h.circuitBreakerCooldown())
+
+	// normalized to seconds when whole
+	b, err := json.Marshal(h.effectivePublicSettings())
+	require.Nil(t, err)
+	require.Contains(t, string(b), `"intervalInSeconds":10,`)
+	require.Contains(t, string(b), `"gracePeriod":150,`)
+	require.Contains(t, string(b), `"tcpConnectTimeoutInSeconds":"250ms",`)
+
+	// the ranges of the durations
+	for _, tc := range []struct {
+		settings publicSettings
+		err      string
+	}{
+		{publicSettings{Protocol: "tcp", Port: 80, IntervalInSeconds: durationSetting(4500 * time.Millisecond)}, "'intervalInSeconds' must be between 5s and 1m0s"},
+		{publicSettings{Protocol: "tcp", Port: 80, GracePeriod: durationSetting(5 * time.Hour)}, "'gracePeriod' must be between 5s and 4h0m0s"},
+		{publicSettings{Protocol: "tcp", Port: 80, TcpConnectTimeout: durationSetting(time.Millisecond)}, "'tcpConnectTimeoutInSeconds' must be between 10ms and 30s"},
+		{publicSettings{Protocol: "tcp", Port: 80, CircuitBreakerTimeouts: 3, CircuitBreakerCooldown: durationSetting(500 * time.Millisecond)}, "'circuitBreakerCooldownInSeconds' must be between 1s and 1h0m0s"},
+	} {
+		err := handlerSettings{tc.settings, protectedSettings{}}.validate()
+		require.NotNil(t, err, tc.err)
+		require.Equal(t, tc.err, err.Error())
+	}
+
+	// the interval of version 2 settings
+	err = handlerSettings{publicSettings{
+		SchemaVersion:     settingsSchemaVersion2,
+		IntervalInSeconds: durationSetting(90 * time.Second),
+		Probes:            []applicationSettings{{publicSettings: publicSettings{Protocol: "tcp", Port: 80}}},
+	}, protectedSettings{}}.validate()
+	require.NotNil(t, err)
+	require.Equal(t, "'intervalInSeconds' must be between 5s and 1m0s", err.Error())
+}
+
+func Test_maxInterval(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "tcp", Port: 80, IntervalInSeconds: seconds(10), MaxInterval: seconds(120)}, protectedSettings{}}
+	require.Nil(t, h.validate())
+	require.Equal(t, 2*time.Minute, h.maxInterval())
+
+	// a top level setting, migrated along with the interval
+	h.publicSettings = h.publicSettings.migrateToV2()
+	require.Nil(t, h.validate())
+	require.Equal(t, 2*time.Minute, h.maxInterval())
+	require.Equal(t, publicSettings{Protocol: "tcp", Port: 80}, h.publicSettings.Probes[0].publicSettings)
+
+	require.Equal(t, errMaxIntervalNotAboveInterval, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, IntervalInSeconds: seconds(30), MaxInterval: seconds(30)},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errMaxIntervalNotAboveInterval, handlerSettings{
+		publicSettings{SchemaVersion: settingsSchemaVersion2, MaxInterval: seconds(5), Probes: []applicationSettings{{publicSettings: publicSettings{Protocol: "tcp", Port: 80}}}},
+		protectedSettings{},
+	}.validate())
+	err := handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, MaxInterval: durationSetting(time.Hour)},
+		protectedSettings{},
+	}.validate()
+	require.NotNil(t, err)
+	require.Equal(t, "'maxIntervalInSeconds' must be between 5s and 10m0s", err.Error())
+}
+
+func Test_icmpSettings(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "icmp", IcmpAddress: "10.0.0.4"}, protectedSettings{}}
+	require.Nil(t, h.validate())
+	require.Equal(t, defaultIcmpCount, h.icmpCount())
+	require.Equal(t, defaultMaxPacketLossPercent, h.maxPacketLossPercent())
+
+	maxPacketLossPercent := 0
+	h.publicSettings.IcmpCount = 5
+	h.publicSettings.MaxPacketLossPercent = &maxPacketLossPercent
+	h.publicSettings.MaxLatencyInMilliseconds = 100
+	require.Nil(t, h.validate())
+	require.Equal(t, 5, h.icmpCount())
+	require.Equal(t, 0, h.maxPacketLossPercent())
+
+	require.Equal(t, errIcmpMustIncludeAddress, handlerSettings{
+		publicSettings{Protocol: "icmp"},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errIcmpMustNotIncludePort, handlerSettings{
+		publicSettings{Protocol: "icmp", IcmpAddress: "10.0.0.4", Port: 80},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errIcmpSettingsRequireIcmp, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, IcmpCount: 5},
+		protectedSettings{},
+	}.validate())
+	require.Equal(t, errMaxLatencyRequiresDnsOrIcmp, handlerSettings{
+		publicSettings{Protocol: "tcp", Port: 80, MaxLatencyInMilliseconds: 100},
+		protectedSettings{},
+	}.validate())
+	require.Nil(t, handlerSettings{
+		publicSettings{Protocol: "icmp", IcmpAddress: "10.0.0.4", FailureStates: map[string]string{"packetLoss": "Unknown"}},
+		protectedSettings{},
+	}.validate())
+}
+
+func Test_minimumStateDuration(t *testing.T) {
+	h := handlerSettings{publicSettings{Protocol: "tcp", Port: 80, MinimumStateDuration: 60}, protectedSettings{}}
+	require.Nil(t, h.validate())
+	require.Equal(t, 60, h.minimumStateDurationInSeconds())
+
+	// a top level setting, along with the 'applications' and in version 2
+	h.publicSettings = h.publicSettings.migrateToV2()
+	require.Nil(t, h.validate())
+	require.Equal(t, 60, h.minimumStateDurationInSeconds())
+	require.Equal(t, publicSettings{Protocol: "tcp", Port: 80}, h.publicSettings.Probes[0].publicSettings)
+	require.Nil(t, handlerSettings{publicSettings{
+		MinimumStateDuration: 60,
+		Applications:         []applicationSettings{{Name: "web", publicSettings: publicSettings{Protocol: "tcp", Port: 80}}},
+	}, protectedSettings{}}.validate())
 }
 
 func Test_toJSON_empty(t *testing.T) {
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
-	"encoding/json"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"net/url"
@@ -26,6 +31,17 @@ const (
 	Empty        HealthStatus = ""
 )
 
+// wellKnownPorts are the ports probed on localhost when 'port' is not set, for
+// the protocols which have one.
+var wellKnownPorts = map[string]int{
+	"http":       80,
+	"https":      443,
+	"ssh":        defaultSshPort,
+	"mysql":      3306,
+	"postgresql": 5432,
+	"redis":      6379,
+}
+
 func (p HealthStatus) GetStatusType() StatusType {
 	switch p {
 	case Initializing:
@@ -61,28 +77,110 @@ type HealthProbe interface {
 }
 
 type TcpHealthProbe struct {
-	Address string
+	Address        string
+	Port           int
+	HalfOpen       bool
+	ConnectTimeout time.Duration
+	NoDelay        bool
+	// Linger is the SO_LINGER of the connection in seconds, a negative value
+	// leaving the default graceful close.
+	Linger int
 }
 
 type HttpHealthProbe struct {
-	HttpClient *http.Client
-	Address    string
+	HttpClient                 *instrumentedClient
+	Address                    string
+	MaxResponseBodySizeInBytes int64
+	ExpectedHeaders            map[string]string
+	RequestHeaders             http.Header
+	// StatusCodeOnly makes any 2xx response Healthy without reading the body.
+	StatusCodeOnly        bool
+	DependencyAggregation string
+	// JsonPathRule derives the health state from a value of the response
+	// body instead of its ApplicationHealthState, when set.
+	JsonPathRule *jsonPathRule
+	// CheckLoopbackOnFailure makes the probe check the loopback networking of
+	// the VM when the endpoint could not be reached.
+	CheckLoopbackOnFailure bool
+	// checkLoopback checks the loopback networking, replaced in tests.
+	checkLoopback func() error
+	// CertificateExpiryWarning is the window before the expiry of the
+	// certificate of an https endpoint in which it is reported as a warning.
+	CertificateExpiryWarning time.Duration
+}
+
+func NewHealthProbe(ctx *log.Context, cfg *handlerSettings, seqNum int) HealthProbe {
+	if path := cfg.simulationFile(); path != "" {
+		ctx.Log("event", "creating simulated probe replaying "+path+" instead of the "+cfg.protocol()+" probe")
+		return NewSimulatedHealthProbe(path)
+	}
+	p := newHealthProbe(ctx, cfg, seqNum)
+	if threshold := cfg.circuitBreakerTimeouts(); threshold > 0 {
+		cooldown := cfg.circuitBreakerCooldown()
+		ctx.Log("event", fmt.Sprintf("Circuit breaker opens after %d consecutive probe timeouts for %v", threshold, cooldown))
+		p = NewCircuitBreakerHealthProbe(p, threshold, cooldown)
+	}
+	return p
 }
 
-func NewHealthProbe(ctx *log.Context, cfg *handlerSettings) HealthProbe {
+// newHealthProbe creates the probe of the configured protocol.
+func newHealthProbe(ctx *log.Context, cfg *handlerSettings, seqNum int) HealthProbe {
+	if processName := cfg.discoverPortOfProcess(); processName != "" {
+		ctx.Log("event", "creating "+cfg.protocol()+" probe targeting the port of process "+processName)
+		return NewPortDiscoveryHealthProbe(processName, portProbeStatusAfterGracePeriodExpires(cfg.protocol()), func(ctx *log.Context, port int) HealthProbe {
+			return newPortHealthProbe(ctx, cfg, seqNum, port)
+		})
+	}
+
 	var p HealthProbe
 	p = new(DefaultHealthProbe)
 	switch cfg.protocol() {
 	case "tcp":
-		p = &TcpHealthProbe{
-			Address: "localhost:" + strconv.Itoa(cfg.port()),
+		p = newFallbackPortHealthProbe(ctx, cfg, seqNum)
+	case "udp":
+		p = &UdpHealthProbe{
+			Address:          "localhost:" + strconv.Itoa(cfg.port()),
+			Payload:          cfg.udpPayload(),
+			ExpectedResponse: cfg.udpExpectedResponse(),
+			Timeout:          cfg.interval(),
 		}
-		ctx.Log("event", "creating tcp probe targeting "+p.address())
+		ctx.Log("event", "creating udp probe targeting "+p.address())
+	case "systemd":
+		p = NewSystemdHealthProbe(cfg.unitName(), cfg.interval())
+		ctx.Log("event", "creating systemd probe targeting unit "+p.address())
+	case "process":
+		p = NewProcessHealthProbe(cfg.pidFile(), cfg.processName(), time.Duration(cfg.minimumUptimeInSeconds())*time.Second)
+		ctx.Log("event", "creating process probe targeting "+p.address())
+	case "file":
+		fileProbe := NewFileHealthProbe(cfg.filePath(), time.Duration(cfg.maxFileAgeInSeconds())*time.Second, cfg.parseFileState())
+		fileProbe.MaxResponseBodySizeInBytes = int64(cfg.maxResponseBodySizeInBytes())
+		p = fileProbe
+		ctx.Log("event", "creating file probe targeting "+p.address())
+	case "dns":
+		p = NewDnsHealthProbe(cfg.dnsName(), cfg.dnsServer(), time.Duration(cfg.maxLatencyInMilliseconds())*time.Millisecond, cfg.expectedAddresses(), cfg.interval())
+		ctx.Log("event", "creating dns probe targeting "+p.address())
+	case "icmp":
+		p = NewIcmpHealthProbe(cfg.icmpAddress(), cfg.icmpCount(), cfg.maxPacketLossPercent(), time.Duration(cfg.maxLatencyInMilliseconds())*time.Millisecond, cfg.interval())
+		ctx.Log("event", "creating icmp probe targeting "+p.address())
+	case "metrics":
+		p = NewMetricsHealthProbe(cfg.requestPath(), cfg.port(), cfg.metricsRules())
+		ctx.Log("event", "creating metrics probe targeting "+p.address())
+	case "fastcgi":
+		p = NewFastcgiHealthProbe(cfg.fastcgiSocket(), cfg.port(), cfg.requestPath(), cfg.interval())
+		ctx.Log("event", "creating fastcgi probe targeting "+p.address())
+	case "aggregator":
+		p = NewAggregatorHealthProbe(cfg.aggregatorSocket(), cfg.port(), cfg.requestPath(), cfg.dependencyAggregation(), cfg.interval())
+		ctx.Log("event", "creating aggregator probe targeting "+p.address())
+	case "ssh":
+		p = NewSshHealthProbe(cfg.probePort(), cfg.interval())
+		ctx.Log("event", "creating ssh probe targeting "+p.address())
+	case "mysql", "postgresql", "redis":
+		p = NewDatabaseHealthProbe(cfg.protocol(), cfg.databasePort(), cfg.databaseUser(), cfg.databasePassword(), cfg.databaseName(), cfg.interval())
+		ctx.Log("event", "creating "+cfg.protocol()+" probe targeting "+p.address(), "authenticated", cfg.databasePassword() != "")
 	case "http":
 		fallthrough
 	case "https":
-		p = NewHttpHealthProbe(cfg.protocol(), cfg.requestPath(), cfg.port())
-		ctx.Log("event", "creating "+cfg.protocol()+" probe targeting "+p.address())
+		p = newFallbackPortHealthProbe(ctx, cfg, seqNum)
 	default:
 		ctx.Log("event", "default settings without probe")
 	}
@@ -90,21 +188,131 @@ func NewHealthProbe(ctx *log.Context, cfg *handlerSettings) HealthProbe {
 	return p
 }
 
+// newFallbackPortHealthProbe creates the probe of the configured port, which
+// falls back to the 'fallbackPort' when nothing listens on it.
+func newFallbackPortHealthProbe(ctx *log.Context, cfg *handlerSettings, seqNum int) HealthProbe {
+	p := newPortHealthProbe(ctx, cfg, seqNum, cfg.probePort())
+	if fallbackPort := cfg.fallbackPort(); fallbackPort != 0 {
+		fallback := newPortHealthProbe(ctx, cfg, seqNum, fallbackPort)
+		return NewFallbackHealthProbe(p, fallback)
+	}
+	return p
+}
+
+// portProbeStatusAfterGracePeriodExpires returns the state reported once the
+// grace period expired by the probes newPortHealthProbe creates for protocol.
+func portProbeStatusAfterGracePeriodExpires(protocol string) HealthStatus {
+	if protocol == "tcp" {
+		return (&TcpHealthProbe{}).healthStatusAfterGracePeriodExpires()
+	}
+	return (&HttpHealthProbe{}).healthStatusAfterGracePeriodExpires()
+}
+
+// newPortHealthProbe creates the tcp, http or https probe of the given port.
+func newPortHealthProbe(ctx *log.Context, cfg *handlerSettings, seqNum int, port int) HealthProbe {
+	var p HealthProbe
+	switch cfg.protocol() {
+	case "tcp":
+		tcpProbe := &TcpHealthProbe{
+			Address:        "localhost:" + strconv.Itoa(port),
+			Port:           port,
+			ConnectTimeout: cfg.tcpConnectTimeout(),
+			NoDelay:        cfg.tcpNoDelay(),
+			Linger:         cfg.tcpLingerInSeconds(),
+		}
+		if cfg.tcpProbeMode() == tcpProbeModeHalfOpen {
+			if canProbeHalfOpen() {
+				tcpProbe.HalfOpen = true
+			} else {
+				ctx.Log("event", "half-open tcp probe not permitted (CAP_NET_RAW required), falling back to connect")
+			}
+		}
+		p = tcpProbe
+		ctx.Log("event", "creating tcp probe targeting "+p.address(), "halfOpen", tcpProbe.HalfOpen)
+	default:
+		httpProbe := NewHttpHealthProbe(cfg.protocol(), cfg.requestPath(), port)
+		httpProbe.MaxResponseBodySizeInBytes = int64(cfg.maxResponseBodySizeInBytes())
+		httpProbe.ExpectedHeaders = cfg.expectedHeaders()
+		httpProbe.StatusCodeOnly = !cfg.richStates()
+		httpProbe.DependencyAggregation = cfg.dependencyAggregation()
+		httpProbe.JsonPathRule = cfg.jsonPathRule()
+		httpProbe.CheckLoopbackOnFailure = cfg.checkLoopbackOnFailure()
+		if cfg.httpVersion() == "2" {
+			httpProbe.forceHTTP2()
+		}
+		if proxy := cfg.proxyURL(); proxy != nil {
+			httpProbe.setProxy(newConnectProxyDialer(proxy, cfg.proxyUsername(), cfg.proxyPassword()))
+			ctx.Log("event", "probing through proxy "+proxy.Host)
+		}
+		httpProbe.RequestHeaders.Set("User-Agent", cfg.userAgent())
+		if cfg.includeIdentificationHeaders() {
+			httpProbe.HttpClient.use(headerMiddleware(identificationHeaders(seqNum)))
+		}
+		if secretHeaders := cfg.secretRequestHeaders(); len(secretHeaders) > 0 {
+			httpProbe.HttpClient.use(headerMiddleware(secretHeaders))
+		}
+		if cfg.protocol() == "https" {
+			httpProbe.CertificateExpiryWarning = time.Duration(cfg.certificateExpiryWarningInDays()) * 24 * time.Hour
+			if thumbprints := cfg.certificateThumbprints(); len(thumbprints) > 0 {
+				httpProbe.pinCertificate(thumbprints)
+			}
+			// validated with the settings
+			if cert, _ := cfg.clientCertificate(); cert != nil {
+				httpProbe.setClientCertificate(*cert)
+			}
+		}
+		p = httpProbe
+		ctx.Log("event", "creating "+cfg.protocol()+" probe targeting "+p.address())
+	}
+	return p
+}
+
 func (p *TcpHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
-	conn, err := net.DialTimeout("tcp", p.address(), 30*time.Second)
+	connectTimeout := p.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = time.Duration(defaultTcpConnectTimeoutInSeconds) * time.Second
+	}
+
+	if p.HalfOpen {
+		var probeResponse ProbeResponse
+		listening, err := halfOpenProbe(p.Port, connectTimeout)
+		if err == nil {
+			if !listening {
+				probeResponse.ApplicationHealthState = Unhealthy
+				probeResponse.ProbeDetails.Failure = probeFailureConnectionRefused
+				return probeResponse, errors.New(fmt.Sprintf("Half-open tcp probe to port %d refused", p.Port))
+			}
+			probeResponse.ApplicationHealthState = Healthy
+			return probeResponse, nil
+		}
+		if !isHalfOpenNotPermitted(err) {
+			probeResponse.ApplicationHealthState = Unhealthy
+			probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+			return probeResponse, err
+		}
+		ctx.Log("event", "half-open tcp probe no longer permitted, falling back to connect", "error", err)
+		p.HalfOpen = false
+	}
+
+	conn, err := net.DialTimeout("tcp", p.address(), connectTimeout)
 	var probeResponse ProbeResponse
 	if err != nil {
 		probeResponse.ApplicationHealthState = Unhealthy
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
 		return probeResponse, err
 	}
 
 	tcpConn, ok := conn.(*net.TCPConn)
 	if !ok {
 		probeResponse.ApplicationHealthState = Unhealthy
+		probeResponse.ProbeDetails.Failure = probeFailureConnection
 		return probeResponse, errUnableToConvertType
 	}
 
-	tcpConn.SetLinger(0)
+	tcpConn.SetNoDelay(p.NoDelay)
+	if p.Linger >= 0 {
+		tcpConn.SetLinger(p.Linger)
+	}
 	tcpConn.Close()
 
 	probeResponse.ApplicationHealthState = Healthy
@@ -120,19 +328,16 @@ func (p *TcpHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
 }
 
 // constructAddress constructs a URL string from the given protocol, port, and request path.
-// If the protocol is "http" and the port is not 0 or 80, the port number is included in the URL string.
-// If the protocol is "https" and the port is not 0 or 443, the port number is included in the URL string.
+// The port number is always included in the URL string, so that the status shows exactly
+// what was probed, a port of 0 being the well-known port of the protocol.
 func constructAddress(protocol string, port int, requestPath string) string {
-	portString := ""
-	if protocol == "http" && port != 0 && port != 80 {
-		portString = ":" + strconv.Itoa(port)
-	} else if protocol == "https" && port != 0 && port != 443 {
-		portString = ":" + strconv.Itoa(port)
+	if port == 0 {
+		port = wellKnownPorts[protocol]
 	}
 
 	u := url.URL{
 		Scheme: protocol,
-		Host:   "localhost" + portString,
+		Host:   "localhost:" + strconv.Itoa(port),
 		Path:   requestPath,
 	}
 	return u.String()
@@ -156,68 +361,192 @@ func NewHttpHealthProbe(protocol string, requestPath string, port int) *HttpHeal
 				MinVersion:         tls.VersionTLS10,
 			},
 		}
-		p.HttpClient = &http.Client{
+		p.HttpClient = newInstrumentedClient(&http.Client{
 			CheckRedirect: noRedirect,
 			Timeout:       timeout,
 			Transport:     transport,
-		}
+		})
 	} else {
-		p.HttpClient = &http.Client{
+		p.HttpClient = newInstrumentedClient(&http.Client{
 			CheckRedirect: noRedirect,
 			Timeout:       timeout,
-		}
+		})
 	}
 
 	p.Address = constructAddress(protocol, port, requestPath)
+	p.MaxResponseBodySizeInBytes = int64(defaultMaxResponseBodySizeInBytes)
+	p.RequestHeaders = http.Header{}
+	p.RequestHeaders.Set("User-Agent", defaultUserAgent)
+	p.RequestHeaders.Set("Accept-Encoding", acceptedContentEncodings)
+	p.DependencyAggregation = dependencyAggregationIgnoreOptional
+	p.checkLoopback = checkLoopback
 
 	return p
 }
 
+// setClientCertificate makes the https probe present the client certificate,
+// for applications requiring mutual TLS.
+func (p *HttpHealthProbe) setClientCertificate(cert tls.Certificate) {
+	if transport, ok := p.HttpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+}
+
+// pinCertificate makes the https probe verify that the certificate of the
+// endpoint matches one of the SHA-256 thumbprints, for self-signed
+// certificates which cannot be verified against a certificate authority.
+func (p *HttpHealthProbe) pinCertificate(thumbprints []string) {
+	if transport, ok := p.HttpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		transport.TLSClientConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("tls: no server certificate presented")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			thumbprint := hex.EncodeToString(sum[:])
+			if !containsString(thumbprints, thumbprint) {
+				return errors.New(fmt.Sprintf("tls: server certificate thumbprint %s does not match 'certificateThumbprints'", thumbprint))
+			}
+			return nil
+		}
+	}
+}
+
+// setProxy makes the probe connect to its endpoint through the tunnel of an
+// HTTP proxy, ignoring the proxy environment variables.
+func (p *HttpHealthProbe) setProxy(dialer *connectProxyDialer) {
+	transport, ok := p.HttpClient.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	p.HttpClient.Transport = transport
+}
+
+// forceHTTP2 makes the probe speak HTTP/2 only, over TLS for https addresses
+// and in cleartext (h2c) for http addresses.
+func (p *HttpHealthProbe) forceHTTP2() {
+	transport, ok := p.HttpClient.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+
+	protocols := new(http.Protocols)
+	if strings.HasPrefix(p.Address, "https://") {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	transport.Protocols = protocols
+	transport.ForceAttemptHTTP2 = true
+	p.HttpClient.Transport = transport
+}
+
 func (p *HttpHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	trace := newRequestTrace()
+	body := new(excerptWriter)
+	probeResponse, err := p.request(ctx, trace, body)
+	if err != nil && p.CheckLoopbackOnFailure && probeResponse.ProbeDetails.Failure.isUnreachable() {
+		if loopbackErr := p.checkLoopback(); loopbackErr != nil {
+			probeResponse.ProbeDetails.Failure = probeFailureLoopback
+			err = errors.Wrapf(err, "loopback networking of the VM is broken (%v)", loopbackErr)
+		}
+	}
+	// the timing tells where the latency of any probe comes from
+	probeResponse.ProbeDetails.Timing = trace.timing()
+	if probeResponse.ApplicationHealthState == Healthy {
+		// the response is only described to diagnose an unhealthy application
+		probeResponse.ProbeDetails.StatusLine = ""
+	} else {
+		probeResponse.ProbeDetails.BodyExcerpt = body.excerpt()
+	}
+	return probeResponse, err
+}
+
+// request sends the probe request, recording its phases in trace and the start
+// of the response body in body.
+func (p *HttpHealthProbe) request(ctx *log.Context, trace *requestTrace, body *excerptWriter) (ProbeResponse, error) {
 	req, err := http.NewRequest("GET", p.address(), nil)
 	var probeResponse ProbeResponse
 	if err != nil {
-		probeResponse.ApplicationHealthState = Unknown
-		return probeResponse, err
+		return httpFailure(probeResponse, probeFailureConnection, err)
 	}
 
-	req.Header.Set("User-Agent", "ApplicationHealthExtension/1.0")
-	resp, err := p.HttpClient.Do(req)
+	for name, values := range p.RequestHeaders {
+		req.Header[name] = values
+	}
+	resp, err := p.HttpClient.do(req, trace)
 	// non-2xx status code doesn't return err
-	// err is returned if a timeout occurred
+	// err is returned if a timeout occurred, or with the response of a redirect
 	if err != nil {
-		probeResponse.ApplicationHealthState = Unknown
-		return probeResponse, err
+		if resp != nil {
+			probeResponse.ProbeDetails.StatusCode = resp.StatusCode
+			probeResponse.ProbeDetails.StatusLine = resp.Proto + " " + resp.Status
+		}
+		return httpFailure(probeResponse, classifyRequestError(err), err)
 	}
 
 	defer resp.Body.Close()
+	probeResponse.ProbeDetails.Protocol = resp.Proto
+	probeResponse.ProbeDetails.StatusCode = resp.StatusCode
+	probeResponse.ProbeDetails.StatusLine = resp.Proto + " " + resp.Status
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		probeResponse.ProbeDetails.Certificate = newCertificateExpiry(resp.TLS.PeerCertificates[0].NotAfter, time.Now(), p.CertificateExpiryWarning)
+	}
 
 	// non 2xx status code
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		probeResponse.ApplicationHealthState = Unknown
-		return probeResponse, errors.New(fmt.Sprintf("Unsuccessful response status code %v", resp.StatusCode))
+		readExcerpt(resp, body)
+		return httpFailure(probeResponse, probeFailureBadStatus, errors.New(fmt.Sprintf("Unsuccessful response status code %v", resp.StatusCode)))
 	}
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		probeResponse.ApplicationHealthState = Unknown
-		return probeResponse, err
+
+	if err := validateResponseHeaders(resp.Header, p.ExpectedHeaders); err != nil {
+		readExcerpt(resp, body)
+		return httpFailure(probeResponse, probeFailureBadHeaders, err)
 	}
 
-	if err := json.Unmarshal(bodyBytes, &probeResponse); err != nil {
-		probeResponse.ApplicationHealthState = Unknown
-		return probeResponse, err
+	if p.StatusCodeOnly {
+		probeResponse.ApplicationHealthState = Healthy
+		return probeResponse, nil
+	}
+
+	decoded, err := decodedBody(resp)
+	if err != nil {
+		return httpFailure(probeResponse, probeFailureBadBody, err)
+	}
+	details := probeResponse.ProbeDetails
+	limited := io.TeeReader(newSizeLimitedReader(decoded, p.MaxResponseBodySizeInBytes), body)
+	if p.JsonPathRule != nil {
+		probeResponse, err = p.JsonPathRule.evaluate(limited)
+	} else {
+		probeResponse, err = parseProbeResponse(limited, p.DependencyAggregation)
+	}
+	probeResponse.ProbeDetails = details
+	if err != nil {
+		return httpFailure(probeResponse, probeFailureBadBody, err)
 	}
 
 	if err := probeResponse.validateCustomMetrics(); err != nil {
 		ctx.Log("error", err)
 	}
 
-	if err := probeResponse.validateApplicationHealthState(); err != nil {
-		probeResponse.ApplicationHealthState = Unknown
-		return probeResponse, err
+	return probeResponse, nil
+}
+
+// readExcerpt reads the start of the response body into body, for a response
+// whose body isn't otherwise read.
+func readExcerpt(resp *http.Response, body *excerptWriter) {
+	if decoded, err := decodedBody(resp); err == nil {
+		io.Copy(body, io.LimitReader(decoded, maxBodyExcerptReadLength))
 	}
+}
 
-	return probeResponse, nil
+// httpFailure returns the response of a failed http probe: Unknown, unless
+// the failure is mapped to another state with 'failureStates'.
+func httpFailure(probeResponse ProbeResponse, failure probeFailure, err error) (ProbeResponse, error) {
+	probeResponse.ApplicationHealthState = Unknown
+	probeResponse.ProbeDetails.Failure = failure
+	return probeResponse, err
 }
 
 func (p *HttpHealthProbe) address() string {
@@ -231,8 +560,76 @@ func (p *HttpHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
 var (
 	errNoRedirect          = errors.New("No redirect allowed")
 	errUnableToConvertType = errors.New("Unable to convert type")
+	errEmptyResponseBody   = errors.New("Response body is empty")
 )
 
+// identificationHeaders returns the headers identifying this extension
+// instance to the probed application: the extension version (set at build
+// time), the VM name and the sequence number of the applied settings.
+func identificationHeaders(seqNum int) http.Header {
+	h := http.Header{}
+	if Version != "" {
+		h.Set(IdentificationHeaderExtensionVersion, Version)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		h.Set(IdentificationHeaderVMName, hostname)
+	}
+	h.Set(IdentificationHeaderSequenceNumber, strconv.Itoa(seqNum))
+	return h
+}
+
+// validateResponseHeaders checks the response headers against the expected
+// ones. An empty expected value only requires the header to be present with a
+// non-empty value; otherwise the value must match ignoring case, either as a
+// whole or without its ';' separated parameters (e.g. Content-Type charset).
+func validateResponseHeaders(header http.Header, expected map[string]string) error {
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		want := expected[name]
+		got := header.Get(name)
+		if got == "" {
+			return errors.New(fmt.Sprintf("Response header '%s' is missing", name))
+		}
+		if want == "" {
+			continue
+		}
+		mediaType := strings.TrimSpace(strings.SplitN(got, ";", 2)[0])
+		if !strings.EqualFold(got, want) && !strings.EqualFold(mediaType, want) {
+			return errors.New(fmt.Sprintf("Response header '%s' has value '%s', expected '%s'", name, got, want))
+		}
+	}
+	return nil
+}
+
+// sizeLimitedReader reads from the underlying reader until more than limit
+// bytes are consumed, at which point it fails with an error rather than
+// silently truncating the content the way io.LimitReader does.
+type sizeLimitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func newSizeLimitedReader(r io.Reader, limit int64) *sizeLimitedReader {
+	// read one byte past the limit so an over-limit body can be told apart
+	// from a body of exactly limit bytes
+	return &sizeLimitedReader{r: io.LimitReader(r, limit+1), limit: limit}
+}
+
+func (l *sizeLimitedReader) Read(b []byte) (int, error) {
+	n, err := l.r.Read(b)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, fmt.Errorf("Response body exceeds the maximum allowed size of %d bytes", l.limit)
+	}
+	return n, err
+}
+
 func noRedirect(req *http.Request, via []*http.Request) error {
 	return errNoRedirect
 }
@@ -1,8 +1,26 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,7 +33,7 @@ func TestNewHttpHealthProbe_DefaultHttpPort(t *testing.T) {
 
 	require.NotNil(t, probe, "Expected HttpHealthProbe, got nil")
 	require.NotNil(t, probe.HttpClient, "Expected HttpClient, got nil")
-	require.Equal(t, "http://localhost/test", probe.Address, "Expected address to be http://localhost/test")
+	require.Equal(t, "http://localhost:80/test", probe.Address, "Expected address to be http://localhost:80/test")
 }
 
 func TestNewHttpHealthProbe_DefaultHttpsPort(t *testing.T) {
@@ -27,7 +45,7 @@ func TestNewHttpHealthProbe_DefaultHttpsPort(t *testing.T) {
 
 	require.NotNil(t, probe, "Expected HttpHealthProbe, got nil")
 	require.NotNil(t, probe.HttpClient, "Expected HttpClient, got nil")
-	require.Equal(t, "https://localhost/test", probe.Address, "Expected address to be https://localhost/test")
+	require.Equal(t, "https://localhost:443/test", probe.Address, "Expected address to be https://localhost:443/test")
 }
 
 func TestNewHttpHealthProbe_NonDefaultPort(t *testing.T) {
@@ -59,7 +77,21 @@ func TestConstructAddress_RequestPath(t *testing.T) {
 	port = 80
 
 	address = constructAddress(protocol, port, requestPath)
-	require.Equal(t, "http://localhost/test", address, "Expected address to be http://localhost/test")
+	require.Equal(t, "http://localhost:80/test", address, "Expected address to be http://localhost:80/test")
+
+	// Testing the default port
+	address = constructAddress("https", 0, "/test")
+	require.Equal(t, "https://localhost:443/test", address, "Expected address to be https://localhost:443/test")
+}
+
+func TestNewHealthProbe_defaultPorts(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	cfg := &handlerSettings{publicSettings: publicSettings{Protocol: "https", RequestPath: "/health", DefaultPorts: map[string]int{"https": 8443}}}
+	require.Equal(t, "https://localhost:8443/health", NewHealthProbe(ctx, cfg, 0).address())
+
+	cfg.publicSettings.Protocol = "ssh"
+	cfg.publicSettings.RequestPath = ""
+	require.Equal(t, "localhost:22", NewHealthProbe(ctx, cfg, 0).address())
 }
 
 func TestNewHttpHealthProbe_RequestPath(t *testing.T) {
@@ -73,7 +105,7 @@ func TestNewHttpHealthProbe_RequestPath(t *testing.T) {
 
 	require.NotNil(t, probe, "Expected HttpHealthProbe, got nil")
 	require.NotNil(t, probe.HttpClient, "Expected HttpClient, got nil")
-	require.Equal(t, "http://localhost/test", probe.Address, "Expected address to be http://localhost/test")
+	require.Equal(t, "http://localhost:80/test", probe.Address, "Expected address to be http://localhost:80/test")
 
 	// Testing non-leading slash
 	protocol = "http"
@@ -85,3 +117,392 @@ func TestNewHttpHealthProbe_RequestPath(t *testing.T) {
 	require.NotNil(t, probe.HttpClient, "Expected HttpClient, got nil")
 	require.Equal(t, "http://localhost:10400/test", probe.Address, "Expected address to be http://localhost:10400/test")
 }
+
+func TestHttpHealthProbe_evaluate_ResponseBodySizeLimit(t *testing.T) {
+	body := `{"ApplicationHealthState": "Healthy"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	probe := NewHttpHealthProbe("http", "/health", 80)
+	probe.Address = server.URL + "/health"
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// body within the limit is decoded
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// body of exactly the limit is decoded
+	probe.MaxResponseBodySizeInBytes = int64(len(body))
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// body over the limit results in unknown
+	probe.MaxResponseBodySizeInBytes = int64(len(body) - 1)
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "exceeds the maximum allowed size")
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+
+	// trailing content past the limit results in unknown
+	body = `{"ApplicationHealthState": "Healthy"}` + strings.Repeat(" ", 8192)
+	probe.MaxResponseBodySizeInBytes = int64(defaultMaxResponseBodySizeInBytes)
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+
+	// empty body results in unknown
+	body = ""
+	probeResponse, err = probe.evaluate(ctx)
+	require.Equal(t, errEmptyResponseBody, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+}
+
+func TestValidateResponseHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	header.Set("X-Build-Version", "1.2.3")
+
+	require.Nil(t, validateResponseHeaders(header, nil))
+	require.Nil(t, validateResponseHeaders(header, map[string]string{
+		"content-type":    "Application/JSON",
+		"X-Build-Version": "",
+	}))
+
+	err := validateResponseHeaders(header, map[string]string{"X-Missing": ""})
+	require.NotNil(t, err)
+	require.Equal(t, "Response header 'X-Missing' is missing", err.Error())
+
+	err = validateResponseHeaders(header, map[string]string{"Content-Type": "text/html"})
+	require.NotNil(t, err)
+	require.Equal(t, "Response header 'Content-Type' has value 'application/json; charset=utf-8', expected 'text/html'", err.Error())
+}
+
+func TestHttpHealthProbe_evaluate_ExpectedHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	}))
+	defer server.Close()
+
+	probe := NewHttpHealthProbe("http", "/health", 80)
+	probe.Address = server.URL + "/health"
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe.ExpectedHeaders = map[string]string{"Content-Type": "application/json"}
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probe.ExpectedHeaders = map[string]string{"X-Build-Version": ""}
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "X-Build-Version")
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+}
+
+func TestTcpHealthProbe_evaluate_Linger(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// closeError probes the listener and returns the error reading from the
+	// accepted connection once the probe closed it
+	closeError := func(probe *TcpHealthProbe) error {
+		probe.Address = l.Addr().String()
+		probeResponse, err := probe.evaluate(ctx)
+		require.Nil(t, err)
+		require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+		conn, err := l.Accept()
+		require.Nil(t, err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	// the connection is reset by default
+	probe := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{Protocol: "tcp", Port: port}}, 0).(*TcpHealthProbe)
+	require.Equal(t, 30*time.Second, probe.ConnectTimeout)
+	require.True(t, probe.NoDelay)
+	err = closeError(probe)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "connection reset by peer")
+
+	// or closed gracefully
+	probe = NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{Protocol: "tcp", Port: port, TcpConnectTimeout: seconds(5), TcpLingerInSeconds: -1}}, 0).(*TcpHealthProbe)
+	require.Equal(t, 5*time.Second, probe.ConnectTimeout)
+	require.Equal(t, io.EOF, closeError(probe))
+}
+
+func TestHttpHealthProbe_evaluate_RichStates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body>OK</body></html>`))
+	}))
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// a 2xx response without a valid state is Unknown with rich states
+	probe := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{Protocol: "http", RequestPath: "/health"}}, 0).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+
+	// any 2xx response is Healthy without rich states
+	richStates := false
+	probe = NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{Protocol: "http", RequestPath: "/health", RichStates: &richStates}}, 0).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// but other responses are still not
+	probe.Address = server.URL + "/missing"
+	server.Config.Handler = http.NotFoundHandler()
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+}
+
+func TestHttpHealthProbe_evaluate_ResponseJsonPath(t *testing.T) {
+	status := "UP"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.spring-boot.actuator.v3+json")
+		w.Write([]byte(`{"status": "` + status + `"}`))
+	}))
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	expected := "UP"
+	probe := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{
+		Protocol:              "http",
+		RequestPath:           "/actuator/health",
+		ResponseJsonPath:      "$.status",
+		ExpectedJsonPathValue: &expected,
+	}}, 0).(*HttpHealthProbe)
+	probe.Address = server.URL + "/actuator/health"
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	status = "DOWN"
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, `{"status": "DOWN"}`, probeResponse.ProbeDetails.BodyExcerpt)
+}
+
+func TestNewHealthProbe_RequestHeaders(t *testing.T) {
+	defer resetStrings()
+	Version = "2.0.9"
+
+	var receivedHeaders http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	}))
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// default user agent and no identification headers
+	probe := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{Protocol: "http", RequestPath: "/health"}}, 3).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	_, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, "ApplicationHealthExtension/1.0", receivedHeaders.Get("User-Agent"))
+	require.Empty(t, receivedHeaders.Get(IdentificationHeaderSequenceNumber))
+
+	// custom user agent and identification headers
+	probe = NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{
+		Protocol:                     "http",
+		RequestPath:                  "/health",
+		UserAgent:                    "contoso-health/2.0",
+		IncludeIdentificationHeaders: true,
+	}}, 3).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	_, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	hostname, _ := os.Hostname()
+	require.Equal(t, "contoso-health/2.0", receivedHeaders.Get("User-Agent"))
+	require.Equal(t, "2.0.9", receivedHeaders.Get(IdentificationHeaderExtensionVersion))
+	require.Equal(t, hostname, receivedHeaders.Get(IdentificationHeaderVMName))
+	require.Equal(t, "3", receivedHeaders.Get(IdentificationHeaderSequenceNumber))
+
+	// secret headers of the protected settings
+	probe = NewHealthProbe(ctx, &handlerSettings{
+		publicSettings{Protocol: "http", RequestPath: "/health"},
+		protectedSettings{RequestHeaders: map[string]secretRef{"x-api-key": newSecretRef("k3y")}},
+	}, 3).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	_, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, "k3y", receivedHeaders.Get("X-Api-Key"))
+}
+
+func TestNewHealthProbe_ClientCertificate(t *testing.T) {
+	certPEM, keyPEM := testClientCertificate(t)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(certPEM))
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// without client certificate
+	probe := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{Protocol: "https", RequestPath: "/health"}}, 0).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	_, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+
+	probe = NewHealthProbe(ctx, &handlerSettings{
+		publicSettings{Protocol: "https", RequestPath: "/health"},
+		protectedSettings{ClientCertificate: certPEM, ClientKey: newSecretRef(keyPEM)},
+	}, 0).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+}
+
+func TestNewHealthProbe_CertificateThumbprints(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	}))
+	defer server.Close()
+	sum := sha256.Sum256(server.Certificate().Raw)
+	thumbprint := strings.ToUpper(hex.EncodeToString(sum[:]))
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// matching thumbprint, in any case
+	probe := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{
+		Protocol:               "https",
+		RequestPath:            "/health",
+		CertificateThumbprints: []string{strings.Repeat("00", 32), thumbprint},
+	}}, 0).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// mismatching thumbprint
+	probe = NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{
+		Protocol:               "https",
+		RequestPath:            "/health",
+		CertificateThumbprints: []string{strings.Repeat("00:", 31) + "00"},
+	}}, 0).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not match 'certificateThumbprints'")
+	require.Equal(t, probeFailureTls, probeResponse.ProbeDetails.Failure)
+}
+
+func TestNewHealthProbe_CertificateExpiry(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	}))
+	defer server.Close()
+	notAfter := server.Certificate().NotAfter
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{
+		Protocol:                 "https",
+		RequestPath:              "/health",
+		CertificateExpiryWarning: 365,
+	}}, 0).(*HttpHealthProbe)
+	require.Equal(t, 365*24*time.Hour, probe.CertificateExpiryWarning)
+	probe.Address = server.URL + "/health"
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.NotNil(t, probeResponse.ProbeDetails.Certificate)
+	require.Equal(t, notAfter.UTC().Format(time.RFC3339), probeResponse.ProbeDetails.Certificate.NotAfter)
+
+	// no certificate over http
+	server = httptest.NewServer(server.Config.Handler)
+	defer server.Close()
+	httpProbe := NewHttpHealthProbe("http", "/health", 80)
+	httpProbe.Address = server.URL + "/health"
+	probeResponse, err = httpProbe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Nil(t, probeResponse.ProbeDetails.Certificate)
+}
+
+// testClientCertificate returns a PEM encoded self-signed client certificate
+// and its key.
+func testClientCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "probe"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestHttpHealthProbe_evaluate_HTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	})
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// HTTP/2 over TLS
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	probe := NewHttpHealthProbe("https", "/health", 443)
+	probe.Address = tlsServer.URL + "/health"
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, "HTTP/1.1", probeResponse.ProbeDetails.Protocol)
+
+	probe = NewHttpHealthProbe("https", "/health", 443)
+	probe.Address = tlsServer.URL + "/health"
+	probe.forceHTTP2()
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, "HTTP/2.0", probeResponse.ProbeDetails.Protocol)
+
+	// cleartext HTTP/2 (h2c)
+	h2cServer := httptest.NewUnstartedServer(handler)
+	h2cServer.Config.Protocols = new(http.Protocols)
+	h2cServer.Config.Protocols.SetHTTP1(true)
+	h2cServer.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2cServer.Start()
+	defer h2cServer.Close()
+
+	probe = NewHttpHealthProbe("http", "/health", 80)
+	probe.Address = h2cServer.URL + "/health"
+	probe.forceHTTP2()
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, "HTTP/2.0", probeResponse.ProbeDetails.Protocol)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// heartbeat proves the prober loop of the extension is alive: its message
+// changes every probe cycle, even when the health state hasn't changed for
+// days.
+type heartbeat struct {
+	LastProbeTime time.Time `json:"lastProbeTime"`
+	Iterations    int       `json:"iterations"`
+	Pid           int       `json:"pid"`
+}
+
+// heartbeatSubstatus returns the substatus of the heartbeat of the probe cycle
+// started at lastProbeTime, the iterations-th since the extension started.
+func heartbeatSubstatus(lastProbeTime time.Time, iterations int) (SubstatusItem, error) {
+	b, err := json.Marshal(heartbeat{LastProbeTime: lastProbeTime.UTC(), Iterations: iterations, Pid: os.Getpid()})
+	if err != nil {
+		return SubstatusItem{}, err
+	}
+	return NewSubstatus(SubstatusKeyNameHeartbeat, StatusSuccess, string(b)), nil
+}
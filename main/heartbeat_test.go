@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_heartbeatSubstatus(t *testing.T) {
+	lastProbeTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	substatus, err := heartbeatSubstatus(lastProbeTime, 42)
+	require.Nil(t, err)
+	require.Equal(t, SubstatusKeyNameHeartbeat, substatus.Name)
+	require.Equal(t, StatusSuccess, substatus.Status)
+
+	var h heartbeat
+	require.Nil(t, json.Unmarshal([]byte(substatus.FormattedMessage.Message), &h))
+	require.Equal(t, heartbeat{LastProbeTime: lastProbeTime.UTC(), Iterations: 42, Pid: os.Getpid()}, h)
+}
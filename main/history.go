@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// transitionHistoryFile is the file in the data dir where the recent
+	// transitions of the committed health state are persisted.
+	transitionHistoryFile = "transitions.json"
+	maxTransitionHistory  = 20
+)
+
+// stateTransition is a change of the committed health state.
+type stateTransition struct {
+	Time time.Time    `json:"time"`
+	From HealthStatus `json:"from"`
+	To   HealthStatus `json:"to"`
+}
+
+// readTransitions returns the persisted transitions, oldest first. A missing
+// history file is not an error.
+func readTransitions(dir string) ([]stateTransition, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, transitionHistoryFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read transition history")
+	}
+	var transitions []stateTransition
+	if err := json.Unmarshal(b, &transitions); err != nil {
+		return nil, errors.Wrap(err, "failed to parse transition history")
+	}
+	return transitions, nil
+}
+
+// appendTransition persists a transition, keeping the last
+// maxTransitionHistory ones. The file is replaced atomically.
+func appendTransition(dir string, t stateTransition) error {
+	transitions, err := readTransitions(dir)
+	if err != nil {
+		// start over rather than failing forever on a corrupted file
+		transitions = nil
+	}
+	transitions = append(transitions, t)
+	if len(transitions) > maxTransitionHistory {
+		transitions = transitions[len(transitions)-maxTransitionHistory:]
+	}
+
+	b, err := json.MarshalIndent(transitions, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal transition history")
+	}
+	tmpFile, err := ioutil.TempFile(dir, transitionHistoryFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	tmpFile.Close()
+	if err := ioutil.WriteFile(tmpFile.Name(), b, 0644); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "failed to write transition history")
+	}
+	if err := os.Rename(tmpFile.Name(), filepath.Join(dir, transitionHistoryFile)); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "failed to move transition history")
+	}
+	return nil
+}
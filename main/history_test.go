@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendTransition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	transitions, err := readTransitions(dir)
+	require.Nil(t, err)
+	require.Empty(t, transitions)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < maxTransitionHistory+5; i++ {
+		from, to := Healthy, Unhealthy
+		if i%2 == 1 {
+			from, to = Unhealthy, Healthy
+		}
+		require.Nil(t, appendTransition(dir, stateTransition{Time: start.Add(time.Duration(i) * time.Minute), From: from, To: to}))
+	}
+
+	transitions, err = readTransitions(dir)
+	require.Nil(t, err)
+	require.Len(t, transitions, maxTransitionHistory)
+	require.Equal(t, start.Add(5*time.Minute), transitions[0].Time)
+	require.Equal(t, Unhealthy, transitions[0].From)
+	require.Equal(t, start.Add(time.Duration(maxTransitionHistory+4)*time.Minute), transitions[maxTransitionHistory-1].Time)
+}
+
+func TestAppendTransition_corruptedHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, ioutil.WriteFile(dir+"/"+transitionHistoryFile, []byte("not json"), 0644))
+	_, err = readTransitions(dir)
+	require.NotNil(t, err)
+
+	require.Nil(t, appendTransition(dir, stateTransition{Time: time.Now().UTC(), To: Healthy}))
+	transitions, err := readTransitions(dir)
+	require.Nil(t, err)
+	require.Len(t, transitions, 1)
+}
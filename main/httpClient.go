@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// clientMiddleware wraps the transport of an instrumentedClient, such as to
+// inject authentication or trace headers into its requests.
+type clientMiddleware func(next http.RoundTripper) http.RoundTripper
+
+// roundTripperFunc adapts a function to an http.RoundTripper.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// headerMiddleware sets the headers on the requests, replacing the values set
+// by the caller.
+func headerMiddleware(h http.Header) clientMiddleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// a round tripper must not modify the request of the caller
+			req = req.Clone(req.Context())
+			for name, values := range h {
+				req.Header[name] = values
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// retryPolicy decides how many attempts a request gets and which failures
+// are retried, backing off between the attempts.
+type retryPolicy struct {
+	Attempts int
+	// Backoff is the wait before the first retry, doubled after each retry.
+	Backoff time.Duration
+	// Retryable reports whether the failed attempt is retried.
+	Retryable func(resp *http.Response, err error) bool
+}
+
+// noRetries sends each request once.
+var noRetries = retryPolicy{Attempts: 1}
+
+// retryTransientFailures retries the requests which failed to get a response,
+// were throttled or met a server error.
+func retryTransientFailures(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// attemptHook is notified of each attempt of a request, with its response or
+// error and how long it took.
+type attemptHook func(req *http.Request, attempt int, resp *http.Response, err error, elapsed time.Duration)
+
+// instrumentedClient is the http client of the probes and of the telemetry
+// sinks. It bounds each attempt of a request with its own timeout, retries the
+// failures allowed by its retry policy, sends the requests through its
+// middleware and notifies its hook of each attempt. The embedded http.Client
+// configures the transport and the timeout of the whole attempt.
+type instrumentedClient struct {
+	*http.Client
+	// AttemptTimeout bounds each attempt, including reading the response
+	// body, when set.
+	AttemptTimeout time.Duration
+	Retry          retryPolicy
+	Middleware     []clientMiddleware
+	OnAttempt      attemptHook
+
+	// sleep waits between the attempts, replaced in tests.
+	sleep func(time.Duration)
+}
+
+func newInstrumentedClient(client *http.Client) *instrumentedClient {
+	return &instrumentedClient{Client: client, Retry: noRetries, sleep: time.Sleep}
+}
+
+// use appends middleware, the first one added seeing the requests first.
+func (c *instrumentedClient) use(m ...clientMiddleware) {
+	c.Middleware = append(c.Middleware, m...)
+}
+
+// Do sends the request with the retries of the retry policy.
+func (c *instrumentedClient) Do(req *http.Request) (*http.Response, error) {
+	return c.do(req, nil)
+}
+
+// do sends the request, recording the phases of its attempts in trace when it
+// is not nil. Only requests without a body, or whose body can be replayed, are
+// retried. The response of the last attempt is returned.
+func (c *instrumentedClient) do(req *http.Request, trace *requestTrace) (*http.Response, error) {
+	client := c.client()
+	if trace != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+	}
+
+	backoff := c.Retry.Backoff
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		start := time.Now()
+		resp, err := c.attempt(client, req)
+		if c.OnAttempt != nil {
+			c.OnAttempt(req, attempt, resp, err, time.Since(start))
+		}
+		if attempt >= c.Retry.Attempts || c.Retry.Retryable == nil || !c.Retry.Retryable(resp, err) ||
+			(req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			// drained so that the connection can be reused
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodyExcerptReadLength))
+			resp.Body.Close()
+		}
+		c.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// attempt sends the request once, within the attempt timeout.
+func (c *instrumentedClient) attempt(client *http.Client, req *http.Request) (*http.Response, error) {
+	if c.AttemptTimeout <= 0 {
+		return client.Do(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), c.AttemptTimeout)
+	resp, err := client.Do(req.WithContext(ctx))
+	if resp == nil {
+		cancel()
+		return resp, err
+	}
+	// the attempt lasts until the body is closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, err
+}
+
+// client returns the http client sending the requests through the middleware.
+func (c *instrumentedClient) client() *http.Client {
+	if len(c.Middleware) == 0 {
+		return c.Client
+	}
+	transport := c.Client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	for i := len(c.Middleware) - 1; i >= 0; i-- {
+		transport = c.Middleware[i](transport)
+	}
+	client := *c.Client
+	client.Transport = transport
+	return &client
+}
+
+// cancelOnClose cancels the context of a request once its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
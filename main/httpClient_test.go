@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentedClient_retries(t *testing.T) {
+	var bodies []string
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(statuses[len(bodies)-1])
+	}))
+	defer server.Close()
+
+	c := newInstrumentedClient(server.Client())
+	c.Retry = retryPolicy{Attempts: 3, Backoff: time.Second, Retryable: retryTransientFailures}
+	var sleeps []time.Duration
+	c.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	var attempts []int
+	c.OnAttempt = func(req *http.Request, attempt int, resp *http.Response, err error, elapsed time.Duration) {
+		require.Nil(t, err)
+		attempts = append(attempts, resp.StatusCode)
+	}
+
+	req, err := http.NewRequest("POST", server.URL, bytes.NewReader([]byte("events")))
+	require.Nil(t, err)
+	resp, err := c.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// the body is replayed on each attempt
+	require.Equal(t, []string{"events", "events", "events"}, bodies)
+	require.Equal(t, []int{503, 429, 200}, attempts)
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second}, sleeps)
+
+	// the last response is returned once the attempts are exhausted
+	bodies, attempts = nil, nil
+	statuses = []int{http.StatusBadGateway, http.StatusBadGateway}
+	c.Retry.Attempts = 2
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	resp, err = c.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	require.Len(t, attempts, 2)
+
+	// client errors are not retried
+	bodies, attempts = nil, nil
+	statuses = []int{http.StatusNotFound}
+	resp, err = c.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Len(t, attempts, 1)
+}
+
+func TestInstrumentedClient_attemptTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := newInstrumentedClient(server.Client())
+	c.AttemptTimeout = 50 * time.Millisecond
+	c.Retry = retryPolicy{Attempts: 2, Retryable: retryTransientFailures}
+	c.sleep = func(time.Duration) {}
+	var errs []error
+	c.OnAttempt = func(req *http.Request, attempt int, resp *http.Response, err error, elapsed time.Duration) {
+		errs = append(errs, err)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := c.Do(req)
+	require.NotNil(t, err)
+	require.Equal(t, probeFailureTimeout, classifyRequestError(err))
+	require.Len(t, errs, 2)
+}
+
+func TestInstrumentedClient_middleware(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer server.Close()
+
+	c := newInstrumentedClient(server.Client())
+	c.use(headerMiddleware(http.Header{"Authorization": {"Bearer token"}}))
+	c.use(func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			// the headers of the previous middleware are visible
+			req = req.Clone(req.Context())
+			req.Header.Set("Traceparent", strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+			return next.RoundTrip(req)
+		})
+	})
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	trace := newRequestTrace()
+	resp, err := c.do(req, trace)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, "Bearer token", received.Get("Authorization"))
+	require.Equal(t, "token", received.Get("Traceparent"))
+	// the request of the caller is left unchanged
+	require.Empty(t, req.Header.Get("Authorization"))
+	require.NotEmpty(t, trace.timing().TimeToFirstByte)
+}
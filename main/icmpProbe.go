@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	icmpTypeEchoReply   = 0
+	icmpTypeEchoRequest = 8
+
+	// icmpEchoPayloadSize is the size of the payload of the echo requests,
+	// the usual 56 bytes of ping.
+	icmpEchoPayloadSize = 56
+)
+
+// IcmpHealthProbe sends Count echo requests to Address, one after the other,
+// for network appliances without listening services. The target is healthy
+// when the packet loss is at most MaxPacketLossPercent and the average round
+// trip time at most MaxLatency (if set).
+type IcmpHealthProbe struct {
+	Address              string
+	Count                int
+	MaxPacketLossPercent int
+	MaxLatency           time.Duration
+	// Timeout is shared by the echo requests of a probe.
+	Timeout time.Duration
+
+	// listen opens the ICMP socket, replaced in tests.
+	listen func() (*icmpSocket, error)
+}
+
+func NewIcmpHealthProbe(address string, count, maxPacketLossPercent int, maxLatency, timeout time.Duration) *IcmpHealthProbe {
+	return &IcmpHealthProbe{
+		Address:              address,
+		Count:                count,
+		MaxPacketLossPercent: maxPacketLossPercent,
+		MaxLatency:           maxLatency,
+		Timeout:              timeout,
+		listen:               listenIcmp,
+	}
+}
+
+func (p *IcmpHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unhealthy
+
+	socket, err := p.listen()
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureConnection
+		return probeResponse, err
+	}
+	defer socket.conn.Close()
+
+	ip := net.ParseIP(p.Address)
+	id, seq := uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16))
+	var received int
+	var totalRtt time.Duration
+	for i := 0; i < p.Count; i++ {
+		rtt, ok, err := socket.echo(ip, id, seq+uint16(i), p.Timeout/time.Duration(p.Count))
+		if err != nil {
+			probeResponse.ProbeDetails.Failure = probeFailureConnection
+			return probeResponse, errors.Wrapf(err, "failed to ping %s", p.Address)
+		}
+		if ok {
+			received++
+			totalRtt += rtt
+		}
+	}
+
+	if received == 0 {
+		probeResponse.ProbeDetails.Failure = probeFailureTimeout
+		return probeResponse, errors.New(fmt.Sprintf("No reply to %d echo requests to %s", p.Count, p.Address))
+	}
+	if loss := (p.Count - received) * 100 / p.Count; loss > p.MaxPacketLossPercent {
+		probeResponse.ProbeDetails.Failure = probeFailurePacketLoss
+		return probeResponse, errors.New(fmt.Sprintf("%d%% packet loss to %s, exceeding %d%%", loss, p.Address, p.MaxPacketLossPercent))
+	}
+	if latency := totalRtt / time.Duration(received); p.MaxLatency > 0 && latency > p.MaxLatency {
+		probeResponse.ProbeDetails.Failure = probeFailureLatency
+		return probeResponse, errors.New(fmt.Sprintf("Average round trip time to %s is %v, exceeding %v", p.Address, latency, p.MaxLatency))
+	}
+
+	probeResponse.ApplicationHealthState = Healthy
+	return probeResponse, nil
+}
+
+func (p *IcmpHealthProbe) address() string {
+	return p.Address
+}
+
+func (p *IcmpHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
+
+// icmpSocket is a socket sending ICMP echo requests, either a raw socket or
+// an unprivileged ICMP datagram socket.
+type icmpSocket struct {
+	conn net.PacketConn
+	// privileged is set for a raw socket, which receives the replies to the
+	// requests of all the processes, matched on their identifier. The kernel
+	// sets the identifier of the requests of datagram sockets and only
+	// delivers their replies.
+	privileged bool
+}
+
+// listenIcmp opens a raw ICMP socket when the process is allowed to
+// (CAP_NET_RAW), and an unprivileged ICMP datagram socket otherwise, which the
+// group of the process must be allowed to open by net.ipv4.ping_group_range.
+func listenIcmp() (*icmpSocket, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err == nil {
+		return &icmpSocket{conn: conn, privileged: true}, nil
+	}
+	if opErr, ok := err.(*net.OpError); !ok || !os.IsPermission(opErr.Err) {
+		return nil, errors.Wrap(err, "failed to open raw ICMP socket")
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_ICMP)
+	if err != nil {
+		return nil, errors.Wrap(os.NewSyscallError("socket", err), "failed to open ICMP socket, either CAP_NET_RAW or a group within net.ipv4.ping_group_range is required")
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{}); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(os.NewSyscallError("bind", err), "failed to bind ICMP socket")
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	conn, err = net.FilePacketConn(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open ICMP socket")
+	}
+	return &icmpSocket{conn: conn}, nil
+}
+
+// echo sends an echo request to ip and waits for its reply until timeout,
+// returning the round trip time and whether the reply was received.
+func (s *icmpSocket) echo(ip net.IP, id, seq uint16, timeout time.Duration) (time.Duration, bool, error) {
+	var addr net.Addr = &net.IPAddr{IP: ip}
+	if !s.privileged {
+		addr = &net.UDPAddr{IP: ip}
+	}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	if _, err := s.conn.WriteTo(icmpEchoRequest(id, seq), addr); err != nil {
+		return 0, false, err
+	}
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return 0, false, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return 0, false, nil
+			}
+			return 0, false, err
+		}
+		if isIcmpEchoReply(buf[:n], id, seq, s.privileged) {
+			return time.Since(start), true, nil
+		}
+	}
+}
+
+// icmpEchoRequest returns an ICMP echo request message.
+func icmpEchoRequest(id, seq uint16) []byte {
+	b := make([]byte, 8+icmpEchoPayloadSize)
+	b[0] = icmpTypeEchoRequest
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], seq)
+	for i := 8; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+	binary.BigEndian.PutUint16(b[2:4], internetChecksum(b))
+	return b
+}
+
+// isIcmpEchoReply reports whether the ICMP message is the reply to the echo
+// request of id and seq, the identifier being only matched when it was not
+// set by the kernel.
+func isIcmpEchoReply(b []byte, id, seq uint16, matchId bool) bool {
+	if len(b) < 8 || b[0] != icmpTypeEchoReply || b[1] != 0 {
+		return false
+	}
+	if matchId && binary.BigEndian.Uint16(b[4:6]) != id {
+		return false
+	}
+	return binary.BigEndian.Uint16(b[6:8]) == seq
+}
+
+// internetChecksum computes the checksum of RFC 1071 used by IP, ICMP and
+// TCP.
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
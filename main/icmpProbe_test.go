@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIcmpConn replies to the echo requests whose index is in replies, after
+// rtt, and times out the others.
+type fakeIcmpConn struct {
+	net.PacketConn
+	replies map[int]bool
+	rtt     time.Duration
+
+	requests int
+	pending  []byte
+}
+
+func (c *fakeIcmpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.pending = nil
+	if c.replies[c.requests] {
+		c.pending = append([]byte{}, b...)
+		c.pending[0] = icmpTypeEchoReply
+	}
+	c.requests++
+	return len(b), nil
+}
+
+func (c *fakeIcmpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.pending == nil {
+		return 0, nil, &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}
+	}
+	time.Sleep(c.rtt)
+	n := copy(b, c.pending)
+	c.pending = nil
+	return n, &net.UDPAddr{}, nil
+}
+
+func (c *fakeIcmpConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *fakeIcmpConn) Close() error {
+	return nil
+}
+
+func newFakeIcmpProbe(conn *fakeIcmpConn, maxPacketLossPercent int, maxLatency time.Duration) *IcmpHealthProbe {
+	p := NewIcmpHealthProbe("10.0.0.4", 4, maxPacketLossPercent, maxLatency, time.Second)
+	p.listen = func() (*icmpSocket, error) {
+		return &icmpSocket{conn: conn}, nil
+	}
+	return p
+}
+
+func TestIcmpHealthProbe_evaluate(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+
+	conn := &fakeIcmpConn{replies: map[int]bool{0: true, 1: true, 2: true, 3: true}}
+	probeResponse, err := newFakeIcmpProbe(conn, 0, 0).evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, 4, conn.requests)
+
+	// half of the requests lost
+	conn = &fakeIcmpConn{replies: map[int]bool{0: true, 2: true}}
+	probeResponse, err = newFakeIcmpProbe(conn, 50, 0).evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	conn = &fakeIcmpConn{replies: map[int]bool{0: true, 2: true}}
+	probeResponse, err = newFakeIcmpProbe(conn, 25, 0).evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, "50% packet loss to 10.0.0.4, exceeding 25%", err.Error())
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailurePacketLoss, probeResponse.ProbeDetails.Failure)
+
+	// no reply
+	conn = &fakeIcmpConn{}
+	probeResponse, err = newFakeIcmpProbe(conn, 50, 0).evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureTimeout, probeResponse.ProbeDetails.Failure)
+
+	// slow replies
+	conn = &fakeIcmpConn{replies: map[int]bool{0: true, 1: true, 2: true, 3: true}, rtt: 10 * time.Millisecond}
+	probeResponse, err = newFakeIcmpProbe(conn, 0, time.Millisecond).evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureLatency, probeResponse.ProbeDetails.Failure)
+}
+
+func TestIcmpHealthProbe_evaluateLoopback(t *testing.T) {
+	socket, err := listenIcmp()
+	if err != nil {
+		t.Skipf("ICMP sockets are not allowed: %v", err)
+	}
+	socket.conn.Close()
+
+	probe := NewIcmpHealthProbe("127.0.0.1", 2, 0, 0, 2*time.Second)
+	probeResponse, err := probe.evaluate(log.NewContext(log.NewNopLogger()))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+}
+
+func Test_isIcmpEchoReply(t *testing.T) {
+	reply := icmpEchoRequest(7, 42)
+	require.False(t, isIcmpEchoReply(reply, 7, 42, true))
+
+	reply[0] = icmpTypeEchoReply
+	require.True(t, isIcmpEchoReply(reply, 7, 42, true))
+	require.False(t, isIcmpEchoReply(reply, 7, 43, true))
+	require.False(t, isIcmpEchoReply(reply, 8, 42, true))
+	// the kernel sets the identifier of unprivileged sockets
+	require.True(t, isIcmpEchoReply(reply, 8, 42, false))
+	require.False(t, isIcmpEchoReply(reply[:4], 7, 42, true))
+}
+
+func Test_internetChecksum(t *testing.T) {
+	// a message including its checksum sums to zero
+	require.Equal(t, uint16(0), internetChecksum(icmpEchoRequest(7, 42)))
+	require.Equal(t, uint16(0xffff), internetChecksum(nil))
+	require.Equal(t, ^uint16(0x0100), internetChecksum([]byte{1}))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// jsonPathStep is a member or array index access of a JSONPath expression.
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// jsonPathRule derives the health state of an http/https probe from the value
+// at a JSONPath of the response body, for applications whose health endpoint
+// doesn't follow the ApplicationHealthState schema, such as the '$.status' of
+// the Spring Boot actuator. The application is Healthy when the value equals
+// the expected one and Unhealthy otherwise.
+type jsonPathRule struct {
+	expression string
+	steps      []jsonPathStep
+	expected   string
+}
+
+// parseJsonPath parses the subset of JSONPath selecting a single value, made of
+// member accesses such as '$.status' or "$['status']" and array indexes such
+// as '$.checks[0].state'.
+func parseJsonPath(expression string) ([]jsonPathStep, error) {
+	invalid := func(reason string) error {
+		return errors.New(fmt.Sprintf("JSONPath '%s' is not valid: %s", expression, reason))
+	}
+	if !strings.HasPrefix(expression, "$") {
+		return nil, invalid("it must start with '$'")
+	}
+
+	var steps []jsonPathStep
+	rest := expression[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, invalid("empty member name")
+			}
+			steps = append(steps, jsonPathStep{key: key})
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, invalid("unterminated member name")
+			}
+			steps = append(steps, jsonPathStep{key: rest[2:end]})
+			rest = rest[end+2:]
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, invalid("unterminated array index")
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, invalid(fmt.Sprintf("'%s' is not an array index", rest[1:end]))
+			}
+			steps = append(steps, jsonPathStep{index: index, isIndex: true})
+			rest = rest[end+1:]
+		default:
+			return nil, invalid(fmt.Sprintf("unexpected '%c'", rest[0]))
+		}
+	}
+	return steps, nil
+}
+
+func newJsonPathRule(expression, expected string) (*jsonPathRule, error) {
+	steps, err := parseJsonPath(expression)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonPathRule{expression: expression, steps: steps, expected: expected}, nil
+}
+
+// evaluate returns the health state of the response body read from r, which
+// is expected to be size limited. A body which isn't json, or without a value
+// at the path, is an error.
+func (r *jsonPathRule) evaluate(body io.Reader) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return probeResponse, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return probeResponse, errEmptyResponseBody
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return probeResponse, withBodyExcerpt(errors.Wrap(err, "Response body is not valid json"), b)
+	}
+	value, ok := r.lookup(document)
+	if !ok {
+		return probeResponse, withBodyExcerpt(errors.New(fmt.Sprintf("Response body has no value at '%s'", r.expression)), b)
+	}
+
+	actual := jsonValueString(value)
+	if actual == r.expected {
+		probeResponse.ApplicationHealthState = Healthy
+	} else {
+		probeResponse.ApplicationHealthState = Unhealthy
+		probeResponse.Description = truncate(fmt.Sprintf("'%s' is '%s', expected '%s'", r.expression, actual, r.expected), maxDescriptionLength)
+	}
+	return probeResponse, nil
+}
+
+// lookup returns the value at the path of the document.
+func (r *jsonPathRule) lookup(document interface{}) (interface{}, bool) {
+	value := document
+	for _, step := range r.steps {
+		if step.isIndex {
+			array, ok := value.([]interface{})
+			if !ok || step.index >= len(array) {
+				return nil, false
+			}
+			value = array[step.index]
+		} else {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = object[step.key]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return value, true
+}
+
+// jsonValueString returns the value compared to the expected one: strings
+// unquoted, and other values as their json text.
+func jsonValueString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseJsonPath(t *testing.T) {
+	steps, err := parseJsonPath("$")
+	require.Nil(t, err)
+	require.Empty(t, steps)
+
+	steps, err = parseJsonPath("$.components['db'].details[1].status")
+	require.Nil(t, err)
+	require.Equal(t, []jsonPathStep{
+		{key: "components"},
+		{key: "db"},
+		{key: "details"},
+		{index: 1, isIndex: true},
+		{key: "status"},
+	}, steps)
+
+	for _, expression := range []string{"status", "$..status", "$.status[", "$['status'", "$[-1]", "$[a]", "$status"} {
+		_, err := parseJsonPath(expression)
+		require.NotNil(t, err, expression)
+		require.Contains(t, err.Error(), "JSONPath '"+expression+"' is not valid")
+	}
+}
+
+func TestJsonPathRule_evaluate(t *testing.T) {
+	rule, err := newJsonPathRule("$.status", "UP")
+	require.Nil(t, err)
+
+	probeResponse, err := rule.evaluate(strings.NewReader(`{"status": "UP", "components": {"db": {"status": "UP"}}}`))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probeResponse, err = rule.evaluate(strings.NewReader(`{"status": "DOWN"}`))
+	require.Nil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, "'$.status' is 'DOWN', expected 'UP'", probeResponse.Description)
+
+	_, err = rule.evaluate(strings.NewReader(`{"state": "UP"}`))
+	require.NotNil(t, err)
+	require.Equal(t, `Response body has no value at '$.status' (response body: '{"state": "UP"}')`, err.Error())
+
+	_, err = rule.evaluate(strings.NewReader(`UP`))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Response body is not valid json")
+
+	_, err = rule.evaluate(strings.NewReader(` `))
+	require.Equal(t, errEmptyResponseBody, err)
+
+	// other values are compared as their json text
+	rule, err = newJsonPathRule("$.checks[1].ok", "true")
+	require.Nil(t, err)
+	probeResponse, err = rule.evaluate(strings.NewReader(`{"checks": [{"ok": false}, {"ok": true}]}`))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	rule, err = newJsonPathRule("$['replicas']", "3")
+	require.Nil(t, err)
+	probeResponse, err = rule.evaluate(strings.NewReader(`{"replicas": 3}`))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+}
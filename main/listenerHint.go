@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// noListenerHintFormat is the hint reported while the application is
+// Initializing when nothing listens on its port yet, the most common reason an
+// application never becomes healthy.
+const noListenerHintFormat = "no listener on port %d yet"
+
+// noListenerHint returns the hint naming the ports of the applications nothing
+// listens on, empty when something listens on all of them or when the
+// listening sockets can't be read from the tcp tables under procRoot.
+func noListenerHint(procRoot string, cfg *handlerSettings) string {
+	listening, ok := listeningTcpPorts(procRoot)
+	if !ok {
+		return ""
+	}
+	var hints []string
+	for _, a := range cfg.applications() {
+		appCfg := a.handlerSettings(cfg)
+		if appCfg.discoverPortOfProcess() != "" {
+			continue
+		}
+		if port := selfTestPort(&appCfg); port != 0 && !listening[port] {
+			hints = append(hints, fmt.Sprintf(noListenerHintFormat, port))
+		}
+	}
+	return strings.Join(hints, "; ")
+}
+
+// listeningTcpPorts returns the ports of the listening tcp sockets of the
+// network namespace, false when none of the tcp tables can be read.
+func listeningTcpPorts(procRoot string) (map[int]bool, bool) {
+	ports := make(map[int]bool)
+	read := false
+	for _, table := range []string{"tcp", "tcp6"} {
+		content, err := ioutil.ReadFile(filepath.Join(procRoot, "net", table))
+		if err != nil {
+			continue
+		}
+		read = true
+		for _, port := range listeningPorts(string(content), nil) {
+			ports[port] = true
+		}
+	}
+	return ports, read
+}
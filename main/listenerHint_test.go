@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_noListenerHint(t *testing.T) {
+	procRoot, err := ioutil.TempDir("", "proc")
+	require.Nil(t, err)
+	defer os.RemoveAll(procRoot)
+
+	cfg := &handlerSettings{publicSettings: publicSettings{Protocol: "http", Port: 8080, RequestPath: "/health"}}
+	// the tcp tables can't be read
+	require.Empty(t, noListenerHint(procRoot, cfg))
+
+	require.Nil(t, os.MkdirAll(filepath.Join(procRoot, "net"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(procRoot, "net", "tcp"), []byte(testTcpTable), 0644))
+	require.Empty(t, noListenerHint(procRoot, cfg))
+
+	cfg.publicSettings.Port = 8081
+	require.Equal(t, "no listener on port 8081 yet", noListenerHint(procRoot, cfg))
+
+	// the default port of http probes
+	cfg.publicSettings.Port = 0
+	require.Equal(t, "no listener on port 80 yet", noListenerHint(procRoot, cfg))
+
+	// probes without a port
+	cfg.publicSettings = publicSettings{Protocol: "systemd", UnitName: "nginx.service"}
+	require.Empty(t, noListenerHint(procRoot, cfg))
+
+	cfg.publicSettings = publicSettings{Applications: []applicationSettings{
+		{Name: "web", publicSettings: publicSettings{Protocol: "tcp", Port: 8080}},
+		{Name: "api", publicSettings: publicSettings{Protocol: "tcp", Port: 9000}},
+		{Name: "cache", publicSettings: publicSettings{Protocol: "redis"}},
+	}}
+	require.Equal(t, "no listener on port 9000 yet; no listener on port 6379 yet", noListenerHint(procRoot, cfg))
+}
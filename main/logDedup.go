@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	logLevelError   = "error"
+	logLevelWarning = "warning"
+	logLevelInfo    = "info"
+)
+
+// dedupEntry tracks the repeats of an event since it was last logged.
+type dedupEntry struct {
+	keyvals  []interface{}
+	level    string
+	loggedAt time.Time
+	repeats  int
+}
+
+// dedupLogger collapses the repeats of identical events, such as the errors of
+// a flapping endpoint logged every probe cycle. Once configured, an event of a
+// deduplicated level is logged once per interval of its level, the repeats in
+// between being summarized by a single 'last message repeated N times' event
+// when the interval expires. Events are identical when their values, but their
+// time, are.
+type dedupLogger struct {
+	logger log.Logger
+	now    func() time.Time
+
+	mu        sync.Mutex
+	intervals map[string]time.Duration
+	entries   map[string]*dedupEntry
+}
+
+func newDedupLogger(logger log.Logger) *dedupLogger {
+	return &dedupLogger{logger: logger, now: time.Now, entries: make(map[string]*dedupEntry)}
+}
+
+// configure sets the summary interval of the deduplicated levels, the events
+// of the other levels being logged as is.
+func (l *dedupLogger) configure(intervals map[string]time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.intervals = intervals
+}
+
+func (l *dedupLogger) Log(keyvals ...interface{}) error {
+	now := l.now()
+	l.mu.Lock()
+	summaries := l.expire(now)
+	level := eventLogLevel(keyvals)
+	_, dedup := l.intervals[level]
+	var suppressed bool
+	if dedup {
+		key := dedupKey(keyvals)
+		if entry, ok := l.entries[key]; ok {
+			entry.repeats++
+			suppressed = true
+		} else {
+			// keyvals may share its backing array with the keyvals of a
+			// log.Context
+			kvs := make([]interface{}, len(keyvals))
+			copy(kvs, keyvals)
+			l.entries[key] = &dedupEntry{keyvals: kvs, level: level, loggedAt: now}
+		}
+	}
+	l.mu.Unlock()
+
+	for _, summary := range summaries {
+		l.logger.Log(summary...)
+	}
+	if suppressed {
+		return nil
+	}
+	return l.logger.Log(keyvals...)
+}
+
+// flush logs the summaries of the repeats which weren't summarized yet.
+func (l *dedupLogger) flush() {
+	l.mu.Lock()
+	var summaries [][]interface{}
+	for key, entry := range l.entries {
+		if entry.repeats > 0 {
+			summaries = append(summaries, entry.summary())
+		}
+		delete(l.entries, key)
+	}
+	l.mu.Unlock()
+
+	for _, summary := range summaries {
+		l.logger.Log(summary...)
+	}
+}
+
+// expire forgets the events whose interval expired, returning the summaries
+// of their repeats. It must be called with the lock held.
+func (l *dedupLogger) expire(now time.Time) [][]interface{} {
+	var summaries [][]interface{}
+	for key, entry := range l.entries {
+		if now.Sub(entry.loggedAt) < l.intervals[entry.level] {
+			continue
+		}
+		if entry.repeats > 0 {
+			summaries = append(summaries, entry.summary())
+		}
+		delete(l.entries, key)
+	}
+	return summaries
+}
+
+func (e *dedupEntry) summary() []interface{} {
+	kvs := make([]interface{}, len(e.keyvals), len(e.keyvals)+2)
+	copy(kvs, e.keyvals)
+	return append(kvs, "dedup", fmt.Sprintf("last message repeated %d times", e.repeats))
+}
+
+// dedupKey returns the identity of an event, its values but its time.
+func dedupKey(keyvals []interface{}) string {
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == "time" {
+			continue
+		}
+		fmt.Fprintf(&buf, "%v=%v\x00", keyvals[i], keyvals[i+1])
+	}
+	return buf.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupLogger(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newDedupLogger(log.NewLogfmtLogger(&buf))
+	l.now = func() time.Time { return now }
+	lines := func() []string {
+		defer buf.Reset()
+		return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	}
+
+	// not deduplicated until configured
+	l.Log("error", "probe failed")
+	l.Log("error", "probe failed")
+	require.Equal(t, []string{`error="probe failed"`, `error="probe failed"`}, lines())
+
+	l.configure(map[string]time.Duration{logLevelError: time.Minute})
+	for i := 0; i < 3; i++ {
+		now = now.Add(10 * time.Second)
+		l.Log("time", now, "error", "probe failed")
+		l.Log("event", "polling")
+	}
+	require.Equal(t, []string{
+		`time=2024-01-01T00:00:10Z error="probe failed"`,
+		`event=polling`,
+		`event=polling`,
+		`event=polling`,
+	}, lines())
+
+	// the repeats are summarized once the interval expires, and the event is
+	// logged again
+	now = now.Add(time.Minute)
+	l.Log("time", now, "error", "probe failed")
+	require.Equal(t, []string{
+		`time=2024-01-01T00:00:10Z error="probe failed" dedup="last message repeated 2 times"`,
+		`time=2024-01-01T00:01:30Z error="probe failed"`,
+	}, lines())
+
+	// other events are deduplicated independently
+	l.Log("error", "connection refused")
+	l.Log("error", "connection refused")
+	l.Log("error", "probe failed")
+	require.Equal(t, []string{`error="connection refused"`}, lines())
+
+	l.flush()
+	flushed := lines()
+	sort.Strings(flushed)
+	require.Equal(t, []string{
+		`error="connection refused" dedup="last message repeated 1 times"`,
+		`time=2024-01-01T00:01:30Z error="probe failed" dedup="last message repeated 1 times"`,
+	}, flushed)
+	require.Empty(t, l.entries)
+}
+
+func Test_eventLogLevel(t *testing.T) {
+	require.Equal(t, logLevelInfo, eventLogLevel([]interface{}{"event", "Committed health state is healthy"}))
+	require.Equal(t, logLevelWarning, eventLogLevel([]interface{}{"event", "Committed health state is unhealthy"}))
+	require.Equal(t, logLevelError, eventLogLevel([]interface{}{"seq", 1, "error", "failed"}))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// loopbackCheckTimeout bounds the loopback sanity check.
+const loopbackCheckTimeout = time.Second
+
+// checkLoopback checks that the networking stack of the VM works by accepting
+// a connection on an ephemeral loopback port. A probe which could not reach
+// the application while this check fails is not evidence that the
+// application is down.
+func checkLoopback() error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return errors.Wrap(err, "failed to bind a loopback port")
+	}
+	defer l.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), loopbackCheckTimeout)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to a loopback port")
+	}
+	conn.Close()
+
+	select {
+	case err := <-accepted:
+		return errors.Wrap(err, "failed to accept a loopback connection")
+	case <-time.After(loopbackCheckTimeout):
+		return errors.New("timed out accepting a loopback connection")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckLoopback(t *testing.T) {
+	require.Nil(t, checkLoopback())
+}
+
+func TestHttpHealthProbe_evaluate_CheckLoopbackOnFailure(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	probe := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{Protocol: "http", Port: port, CheckLoopbackOnFailure: true}}, 0).(*HttpHealthProbe)
+	require.True(t, probe.CheckLoopbackOnFailure)
+
+	// the loopback networking works, the application is unreachable
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, probeFailureConnectionRefused, probeResponse.ProbeDetails.Failure)
+
+	// the loopback networking is broken
+	probe.checkLoopback = func() error { return errors.New("network is unreachable") }
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "loopback networking of the VM is broken (network is unreachable)")
+	require.Equal(t, probeFailureLoopback, probeResponse.ProbeDetails.Failure)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+
+	// without the check
+	probe.CheckLoopbackOnFailure = false
+	probeResponse, _ = probe.evaluate(ctx)
+	require.Equal(t, probeFailureConnectionRefused, probeResponse.ProbeDetails.Failure)
+}
@@ -12,15 +12,30 @@ import (
 )
 
 var (
-	// dataDir is where we store the logs and state for the extension handler
+	// dataDir is where we store the logs and state for the extension handler,
+	// unless overridden (see handlerPaths)
 	dataDir = "/var/lib/waagent/apphealth"
 
-	shutdown = false
+	// shutdown is closed once the extension is asked to terminate
+	shutdown = make(chan struct{})
+
+	// eventLogger logs the extension events, it can mirror them to another sink
+	eventLogger = newMirrorLogger(log.NewLogfmtLogger(os.Stdout))
+
+	// logDeduplicator collapses the repeated events, once the settings
+	// enabling it are known
+	logDeduplicator = newDedupLogger(eventLogger)
 )
 
 func main() {
-	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(
-		os.Stdout))).With("time", log.DefaultTimestamp).With("version", VersionString())
+	// tool subcommands run without a handler environment
+	if len(os.Args) >= 2 {
+		if f, ok := toolCmds[os.Args[1]]; ok {
+			os.Exit(f(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	ctx := log.NewContext(log.NewSyncLogger(newRedactingLogger(logDeduplicator, secrets))).With("time", log.DefaultTimestamp).With("version", VersionString())
 
 	// parse command line arguments
 	cmd := parseCmd(os.Args)
@@ -31,16 +46,16 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigs
-		shutdown = true
+		close(shutdown)
 	}()
 
-	// parse extension environment
-	hEnv, err := vmextension.GetHandlerEnv()
-	if err != nil {
-		ctx.Log("message", "failed to parse handlerenv", "error", err)
-		os.Exit(cmd.failExitCode)
+	// parse extension environment, running degraded when it is invalid
+	paths, reasons := loadHandlerPaths()
+	for _, reason := range reasons {
+		ctx.Log("message", "handler environment degraded", "reason", reason)
 	}
-	seqNum, err := vmextension.FindSeqNum(hEnv.HandlerEnvironment.ConfigFolder)
+	handlerEnvDegradation = reasons
+	seqNum, err := vmextension.FindSeqNum(paths.configFolder())
 	if err != nil {
 		ctx.Log("messsage", "failed to find sequence number", "error", err)
 	}
@@ -56,14 +71,14 @@ func main() {
 		}
 	}
 	// execute the subcommand
-	reportStatus(ctx, hEnv, seqNum, StatusTransitioning, cmd, "")
-	msg, err := cmd.f(ctx, hEnv, seqNum)
+	reportStatus(ctx, paths, seqNum, StatusTransitioning, cmd, "")
+	msg, err := cmd.f(ctx, paths, seqNum)
 	if err != nil {
 		ctx.Log("event", "failed to handle", "error", err)
-		reportStatus(ctx, hEnv, seqNum, StatusError, cmd, err.Error()+msg)
+		reportStatus(ctx, paths, seqNum, StatusError, cmd, err.Error()+msg)
 		os.Exit(cmd.failExitCode)
 	}
-	reportStatus(ctx, hEnv, seqNum, StatusSuccess, cmd, msg)
+	reportStatus(ctx, paths, seqNum, StatusSuccess, cmd, msg)
 	ctx.Log("event", "end")
 }
 
@@ -91,12 +106,25 @@ func printUsage(args []string) {
 	fmt.Printf("Usage: %s ", os.Args[0])
 	i := 0
 	for k := range cmds {
-		fmt.Printf(k)
+		fmt.Print(k)
 		if i != len(cmds)-1 {
 			fmt.Printf("|")
 		}
 		i++
 	}
 	fmt.Println()
+	for k := range toolCmds {
+		fmt.Printf("       %s %s [flags]\n", os.Args[0], k)
+	}
 	fmt.Println(DetailedVersionString())
 }
+
+// shuttingDown reports whether the extension is asked to terminate.
+func shuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMetricsRequestPath     = "/metrics"
+	maxMetricsResponseSizeInBytes = 4 * 1024 * 1024
+)
+
+// metricsRuleRegexp matches rules such as `up == 1` or
+// `queue_depth{queue="orders"} < 1000`.
+var metricsRuleRegexp = regexp.MustCompile(`^\s*([a-zA-Z_:][a-zA-Z0-9_:]*)\s*(\{[^}]*\})?\s*(<=|>=|==|!=|<|>)\s*(\S+)\s*$`)
+
+// metricsRule is a threshold rule on the samples of a metric.
+type metricsRule struct {
+	expression string
+	metric     string
+	labels     map[string]string
+	operator   string
+	threshold  float64
+}
+
+// metricSample is a sample parsed from the Prometheus text exposition format.
+type metricSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// MetricsHealthProbe scrapes a Prometheus/OpenMetrics endpoint and considers
+// the application healthy when all the samples matching each rule satisfy it.
+// A rule not matching any sample leaves the health state Unknown.
+type MetricsHealthProbe struct {
+	HttpClient *http.Client
+	Address    string
+	Rules      []metricsRule
+}
+
+func NewMetricsHealthProbe(requestPath string, port int, rules []metricsRule) *MetricsHealthProbe {
+	if requestPath == "" {
+		requestPath = defaultMetricsRequestPath
+	}
+	return &MetricsHealthProbe{
+		HttpClient: &http.Client{
+			CheckRedirect: noRedirect,
+			Timeout:       30 * time.Second,
+		},
+		Address: constructAddress("http", port, requestPath),
+		Rules:   rules,
+	}
+}
+
+func (p *MetricsHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unknown
+
+	req, err := http.NewRequest("GET", p.address(), nil)
+	if err != nil {
+		return probeResponse, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4;q=0.9,*/*;q=0.1")
+	req.Header.Set("User-Agent", defaultUserAgent)
+	req.Header.Set("Accept-Encoding", acceptedContentEncodings)
+	resp, err := p.HttpClient.Do(req)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, err
+	}
+	defer resp.Body.Close()
+	probeResponse.ProbeDetails.StatusCode = resp.StatusCode
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		probeResponse.ProbeDetails.Failure = probeFailureBadStatus
+		return probeResponse, errors.New(fmt.Sprintf("Unsuccessful response status code %v", resp.StatusCode))
+	}
+
+	decoded, err := decodedBody(resp)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureBadBody
+		return probeResponse, err
+	}
+	samples, err := parseMetrics(newSizeLimitedReader(decoded, maxMetricsResponseSizeInBytes))
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureBadBody
+		return probeResponse, err
+	}
+
+	var failed []string
+	for _, rule := range p.Rules {
+		ok, err := rule.evaluate(samples)
+		if err != nil {
+			probeResponse.ProbeDetails.Failure = probeFailureBadBody
+			return probeResponse, err
+		}
+		if !ok {
+			failed = append(failed, rule.expression)
+		}
+	}
+	if len(failed) > 0 {
+		probeResponse.ApplicationHealthState = Unhealthy
+		return probeResponse, errors.New(fmt.Sprintf("Metrics rules not satisfied: %s", strings.Join(failed, ", ")))
+	}
+
+	probeResponse.ApplicationHealthState = Healthy
+	return probeResponse, nil
+}
+
+func (p *MetricsHealthProbe) address() string {
+	return p.Address
+}
+
+func (p *MetricsHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unknown
+}
+
+// parseMetricsRule parses a rule made of a metric name, optional label
+// matchers, a comparison operator and a threshold.
+func parseMetricsRule(expression string) (metricsRule, error) {
+	m := metricsRuleRegexp.FindStringSubmatch(expression)
+	if m == nil {
+		return metricsRule{}, errors.New(fmt.Sprintf("metrics rule '%s' is not of the form 'metric{label=\"value\"} <operator> <threshold>'", expression))
+	}
+
+	threshold, err := strconv.ParseFloat(m[4], 64)
+	if err != nil {
+		return metricsRule{}, errors.New(fmt.Sprintf("metrics rule '%s' threshold is not a number", expression))
+	}
+
+	rule := metricsRule{expression: strings.TrimSpace(expression), metric: m[1], operator: m[3], threshold: threshold}
+	if m[2] != "" {
+		labels, rest, err := parseLabels(m[2])
+		if err != nil || strings.TrimSpace(rest) != "" {
+			return metricsRule{}, errors.New(fmt.Sprintf("metrics rule '%s' has invalid labels", expression))
+		}
+		rule.labels = labels
+	}
+	return rule, nil
+}
+
+// evaluate reports whether all the samples matching the rule satisfy it.
+func (r metricsRule) evaluate(samples []metricSample) (bool, error) {
+	matched := false
+	for _, s := range samples {
+		if s.name != r.metric || !labelsMatch(s.labels, r.labels) {
+			continue
+		}
+		matched = true
+		if !compare(s.value, r.operator, r.threshold) {
+			return false, nil
+		}
+	}
+	if !matched {
+		return false, errors.New(fmt.Sprintf("No sample matches metrics rule '%s'", r.expression))
+	}
+	return true, nil
+}
+
+func labelsMatch(labels, matchers map[string]string) bool {
+	for name, value := range matchers {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func compare(value float64, operator string, threshold float64) bool {
+	switch operator {
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "==":
+		return value == threshold
+	default:
+		return value != threshold
+	}
+}
+
+// parseMetrics parses samples in the Prometheus text exposition format, which
+// OpenMetrics text is compatible with for the purpose of reading samples.
+func parseMetrics(r io.Reader) ([]metricSample, error) {
+	var samples []metricSample
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxMetricsResponseSizeInBytes)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var s metricSample
+		i := strings.IndexAny(line, "{ \t")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid metrics line '%s'", line))
+		}
+		s.name, line = line[:i], line[i:]
+		if strings.HasPrefix(line, "{") {
+			labels, rest, err := parseLabels(line)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid metrics line '%s'", scanner.Text())
+			}
+			s.labels, line = labels, rest
+		}
+
+		// the value may be followed by a timestamp
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid metrics line '%s'", scanner.Text()))
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid metrics value in line '%s'", scanner.Text())
+		}
+		s.value = value
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read metrics")
+	}
+	return samples, nil
+}
+
+// parseLabels parses a `{name="value",...}` label set at the start of s and
+// returns the labels and the remainder of s.
+func parseLabels(s string) (map[string]string, string, error) {
+	labels := make(map[string]string)
+	s = strings.TrimPrefix(s, "{")
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+
+		eq := strings.Index(s, "=")
+		if eq <= 0 {
+			return nil, "", errors.New("invalid label")
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return nil, "", errors.New("label value is not quoted")
+		}
+
+		var value strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return nil, "", errors.New("unterminated label value")
+		}
+		labels[name] = value.String()
+		s = s[i+1:]
+	}
+}
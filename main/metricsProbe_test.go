@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+const testMetrics = `# HELP up Whether the application is up.
+# TYPE up gauge
+up 1
+# TYPE queue_depth gauge
+queue_depth{queue="orders"} 250 1700000000000
+queue_depth{queue="invoices",region="west \"1\""} 1500
+http_requests_total{code="200"} 1.5e+06
+`
+
+func TestParseMetrics(t *testing.T) {
+	samples, err := parseMetrics(strings.NewReader(testMetrics))
+	require.Nil(t, err)
+	require.Len(t, samples, 4)
+	require.Equal(t, metricSample{name: "up", value: 1}, samples[0])
+	require.Equal(t, metricSample{name: "queue_depth", labels: map[string]string{"queue": "orders"}, value: 250}, samples[1])
+	require.Equal(t, map[string]string{"queue": "invoices", "region": `west "1"`}, samples[2].labels)
+	require.Equal(t, 1.5e+06, samples[3].value)
+
+	_, err = parseMetrics(strings.NewReader("up one\n"))
+	require.NotNil(t, err)
+	_, err = parseMetrics(strings.NewReader(`up{code="200} 1` + "\n"))
+	require.NotNil(t, err)
+}
+
+func TestParseMetricsRule(t *testing.T) {
+	rule, err := parseMetricsRule("up == 1")
+	require.Nil(t, err)
+	require.Equal(t, metricsRule{expression: "up == 1", metric: "up", operator: "==", threshold: 1}, rule)
+
+	rule, err = parseMetricsRule(`queue_depth{queue="orders"}<1000`)
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"queue": "orders"}, rule.labels)
+	require.Equal(t, "<", rule.operator)
+	require.Equal(t, float64(1000), rule.threshold)
+
+	_, err = parseMetricsRule("up = 1")
+	require.NotNil(t, err)
+	_, err = parseMetricsRule("up == one")
+	require.EqualError(t, err, "metrics rule 'up == one' threshold is not a number")
+	_, err = parseMetricsRule(`up{code=200} == 1`)
+	require.EqualError(t, err, "metrics rule 'up{code=200} == 1' has invalid labels")
+}
+
+func TestMetricsRule_evaluate(t *testing.T) {
+	samples, err := parseMetrics(strings.NewReader(testMetrics))
+	require.Nil(t, err)
+
+	for expression, expected := range map[string]bool{
+		"up == 1":                            true,
+		"up != 1":                            false,
+		`queue_depth{queue="orders"} < 1000`: true,
+		"queue_depth < 1000":                 false,
+		"queue_depth >= 250":                 true,
+		`http_requests_total > 1000000`:      true,
+	} {
+		rule, err := parseMetricsRule(expression)
+		require.Nil(t, err)
+		ok, err := rule.evaluate(samples)
+		require.Nil(t, err, expression)
+		require.Equal(t, expected, ok, expression)
+	}
+
+	rule, err := parseMetricsRule(`queue_depth{queue="shipping"} < 1000`)
+	require.Nil(t, err)
+	_, err = rule.evaluate(samples)
+	require.EqualError(t, err, `No sample matches metrics rule 'queue_depth{queue="shipping"} < 1000'`)
+}
+
+func TestMetricsHealthProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/metrics", r.URL.Path)
+		fmt.Fprint(w, testMetrics)
+	}))
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewMetricsHealthProbe("", 0, nil)
+	probe.Address = server.URL + "/metrics"
+	for _, expression := range []string{"up == 1", `queue_depth{queue="orders"} < 1000`} {
+		rule, err := parseMetricsRule(expression)
+		require.Nil(t, err)
+		probe.Rules = append(probe.Rules, rule)
+	}
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	rule, err := parseMetricsRule("queue_depth < 1000")
+	require.Nil(t, err)
+	probe.Rules = append(probe.Rules, rule)
+	probeResponse, err = probe.evaluate(ctx)
+	require.EqualError(t, err, "Metrics rules not satisfied: queue_depth < 1000")
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	rule, err = parseMetricsRule("missing == 1")
+	require.Nil(t, err)
+	probe.Rules = []metricsRule{rule}
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+}
+
+func TestNewMetricsHealthProbe(t *testing.T) {
+	probe := NewMetricsHealthProbe("", 9100, nil)
+	require.Equal(t, "http://localhost:9100/metrics", probe.address())
+	require.Equal(t, Unknown, probe.healthStatusAfterGracePeriodExpires())
+
+	probe = NewMetricsHealthProbe("stats", 9100, nil)
+	require.Equal(t, "http://localhost:9100/stats", probe.address())
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mysqlProtocolVersion = 10
+
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientConnectWithDB    = 0x00000008
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSecureConnection = 0x00008000
+	mysqlClientPluginAuth       = 0x00080000
+
+	mysqlPacketOK         = 0x00
+	mysqlPacketAuthMore   = 0x01
+	mysqlPacketAuthSwitch = 0xfe
+	mysqlPacketError      = 0xff
+
+	mysqlNativePassword         = "mysql_native_password"
+	mysqlCachingSha2Password    = "caching_sha2_password"
+	mysqlFastAuthSuccess        = 0x03
+	mysqlPerformFullAuth        = 0x04
+	mysqlRequestPublicKey       = 0x02
+	mysqlMaxPacketSize          = 1 << 24
+	mysqlCharsetUtf8mb4         = 45
+	mysqlHandshakeReservedBytes = 23
+)
+
+// mysqlHandshake reads the initial handshake of the server and, when a
+// password is set, logs in with the mysql_native_password or
+// caching_sha2_password authentication.
+func mysqlHandshake(conn net.Conn, user, password, database string) error {
+	seq, greeting, err := readMysqlPacket(conn)
+	if err != nil {
+		return err
+	}
+	if len(greeting) > 0 && greeting[0] == mysqlPacketError {
+		return mysqlError(greeting)
+	}
+	nonce, plugin, err := parseMysqlGreeting(greeting)
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return nil
+	}
+
+	if plugin != mysqlCachingSha2Password {
+		plugin = mysqlNativePassword
+	}
+	capabilities := uint32(mysqlClientLongPassword | mysqlClientProtocol41 | mysqlClientSecureConnection | mysqlClientPluginAuth)
+	if database != "" {
+		capabilities |= mysqlClientConnectWithDB
+	}
+	var response bytes.Buffer
+	binary.Write(&response, binary.LittleEndian, capabilities)
+	binary.Write(&response, binary.LittleEndian, uint32(mysqlMaxPacketSize))
+	response.WriteByte(mysqlCharsetUtf8mb4)
+	response.Write(make([]byte, mysqlHandshakeReservedBytes))
+	response.WriteString(user + "\x00")
+	authResponse := mysqlScramble(plugin, password, nonce)
+	response.WriteByte(byte(len(authResponse)))
+	response.Write(authResponse)
+	if database != "" {
+		response.WriteString(database + "\x00")
+	}
+	response.WriteString(plugin + "\x00")
+	if err := writeMysqlPacket(conn, seq+1, response.Bytes()); err != nil {
+		return err
+	}
+
+	for {
+		seq, packet, err := readMysqlPacket(conn)
+		if err != nil {
+			return err
+		}
+		if len(packet) == 0 {
+			return &databaseError{probeFailureBadBody, "Empty MySQL packet"}
+		}
+
+		var reply []byte
+		switch packet[0] {
+		case mysqlPacketOK:
+			return nil
+		case mysqlPacketError:
+			return mysqlError(packet)
+		case mysqlPacketAuthSwitch:
+			// plugin name and nonce, both null terminated
+			fields := bytes.SplitN(packet[1:], []byte{0}, 2)
+			if len(fields) != 2 {
+				return &databaseError{probeFailureBadBody, "Invalid MySQL authentication switch request"}
+			}
+			plugin, nonce = string(fields[0]), bytes.TrimRight(fields[1], "\x00")
+			if plugin != mysqlNativePassword && plugin != mysqlCachingSha2Password {
+				return &databaseError{probeFailureBadStatus, fmt.Sprintf("Unsupported MySQL authentication plugin '%s'", plugin)}
+			}
+			reply = mysqlScramble(plugin, password, nonce)
+		case mysqlPacketAuthMore:
+			switch {
+			case len(packet) == 2 && packet[1] == mysqlFastAuthSuccess:
+				continue
+			case len(packet) == 2 && packet[1] == mysqlPerformFullAuth:
+				reply = []byte{mysqlRequestPublicKey}
+			case plugin == mysqlCachingSha2Password && len(packet) > 2:
+				// the public key of the server to encrypt the password with
+				if reply, err = mysqlEncryptPassword(packet[1:], password, nonce); err != nil {
+					return err
+				}
+			default:
+				return &databaseError{probeFailureBadBody, "Unexpected MySQL authentication data"}
+			}
+		default:
+			return &databaseError{probeFailureBadBody, fmt.Sprintf("Unexpected MySQL packet 0x%02x during authentication", packet[0])}
+		}
+		if err := writeMysqlPacket(conn, seq+1, reply); err != nil {
+			return err
+		}
+	}
+}
+
+// parseMysqlGreeting returns the authentication nonce and plugin of the
+// initial handshake packet (protocol version 10).
+func parseMysqlGreeting(greeting []byte) ([]byte, string, error) {
+	errInvalid := &databaseError{probeFailureBadBody, "Invalid MySQL initial handshake"}
+	if len(greeting) == 0 || greeting[0] != mysqlProtocolVersion {
+		return nil, "", errInvalid
+	}
+	// server version
+	i := bytes.IndexByte(greeting[1:], 0)
+	if i < 0 {
+		return nil, "", errInvalid
+	}
+	b := greeting[1+i+1:]
+	// connection id, first part of the nonce and a filler byte
+	if len(b) < 4+8+1 {
+		return nil, "", errInvalid
+	}
+	nonce := append([]byte{}, b[4:12]...)
+	b = b[13:]
+	// capabilities, character set, status, upper capabilities, nonce length
+	// and reserved bytes
+	if len(b) < 2+1+2+2+1+10 {
+		return nonce, mysqlNativePassword, nil
+	}
+	b = b[18:]
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		nonce = append(nonce, b[:i]...)
+		b = b[i+1:]
+	} else {
+		return nil, "", errInvalid
+	}
+	plugin := string(bytes.TrimRight(b, "\x00"))
+	return nonce, plugin, nil
+}
+
+// mysqlScramble computes the authentication response of a password:
+//   - mysql_native_password: SHA1(password) XOR SHA1(nonce + SHA1(SHA1(password)))
+//   - caching_sha2_password: SHA256(password) XOR SHA256(SHA256(SHA256(password)) + nonce)
+func mysqlScramble(plugin, password string, nonce []byte) []byte {
+	if plugin == mysqlCachingSha2Password {
+		h1 := sha256.Sum256([]byte(password))
+		h2 := sha256.Sum256(h1[:])
+		h3 := sha256.Sum256(append(h2[:], nonce...))
+		return xorBytes(h1[:], h3[:])
+	}
+	h1 := sha1.Sum([]byte(password))
+	h2 := sha1.Sum(h1[:])
+	h3 := sha1.Sum(append(append([]byte{}, nonce...), h2[:]...))
+	return xorBytes(h1[:], h3[:])
+}
+
+// mysqlEncryptPassword encrypts the null terminated password, XORed with the
+// nonce, with the RSA public key of the server for caching_sha2_password full
+// authentication over an unencrypted connection.
+func mysqlEncryptPassword(publicKeyPEM []byte, password string, nonce []byte) ([]byte, error) {
+	if len(nonce) == 0 {
+		return nil, &databaseError{probeFailureBadBody, "Empty MySQL authentication nonce"}
+	}
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return nil, &databaseError{probeFailureBadBody, "Invalid MySQL server public key"}
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, &databaseError{probeFailureBadBody, "Invalid MySQL server public key: " + err.Error()}
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, &databaseError{probeFailureBadBody, "MySQL server public key is not an RSA key"}
+	}
+
+	plain := []byte(password + "\x00")
+	for i := range plain {
+		plain[i] ^= nonce[i%len(nonce)]
+	}
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, plain, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encrypt the MySQL password")
+	}
+	return encrypted, nil
+}
+
+// mysqlError returns the error of an ERR packet.
+func mysqlError(packet []byte) error {
+	if len(packet) < 3 {
+		return &databaseError{probeFailureBadBody, "Invalid MySQL error packet"}
+	}
+	code := binary.LittleEndian.Uint16(packet[1:3])
+	message := packet[3:]
+	if len(message) >= 6 && message[0] == '#' {
+		// SQL state
+		message = message[6:]
+	}
+	return &databaseError{probeFailureBadStatus, fmt.Sprintf("MySQL error %d: %s", code, bodyExcerpt(message))}
+}
+
+func readMysqlPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length > maxDatabaseMessageSize {
+		return 0, nil, &databaseError{probeFailureBadBody, fmt.Sprintf("MySQL packet of %d bytes exceeds the maximum allowed size", length)}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+func writeMysqlPacket(w io.Writer, seq byte, payload []byte) error {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func xorBytes(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
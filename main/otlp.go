@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	otlpRequestTimeout = 5 * time.Second
+	otlpScopeName      = "ApplicationHealthExtension"
+
+	otlpSpanKindInternal = 1
+	otlpStatusCodeOk     = 1
+	otlpStatusCodeError  = 2
+
+	otlpAggregationTemporalityCumulative = 2
+
+	otlpMetricHealthState   = "apphealth.health_state"
+	otlpMetricProbeDuration = "apphealth.probe.duration"
+	otlpMetricProbeResults  = "apphealth.probe.results"
+	otlpMetricProbeLatency  = "apphealth.probe.latency"
+	otlpMetricProbePhase    = "apphealth.probe.phase"
+)
+
+// probeCycle is the outcome of a probe cycle exported to OpenTelemetry.
+type probeCycle struct {
+	start, end time.Time
+	state      HealthStatus
+	probes     []cycleProbe
+}
+
+// cycleProbe is the outcome of the probe of an application in a cycle.
+type cycleProbe struct {
+	application    string
+	target         string
+	start          time.Time
+	duration       time.Duration
+	healthState    HealthStatus
+	committedState HealthStatus
+	failure        probeFailure
+	timing         *requestTiming
+}
+
+// newProbeCycle records the outcome of the probes of the applications.
+func newProbeCycle(start, end time.Time, state HealthStatus, apps []*application) probeCycle {
+	cycle := probeCycle{start: start, end: end, state: state}
+	for _, a := range apps {
+		cycle.probes = append(cycle.probes, cycleProbe{
+			application:    a.name,
+			target:         a.probe.address(),
+			start:          a.lastProbeStart,
+			duration:       a.lastProbeDuration,
+			healthState:    a.lastResponse.ApplicationHealthState,
+			committedState: a.committedState,
+			failure:        a.lastResponse.ProbeDetails.Failure,
+			timing:         a.lastResponse.ProbeDetails.Timing,
+		})
+	}
+	return cycle
+}
+
+// otlpExporter exports a span per probe cycle, with a child span per probe,
+// the health state and probe duration gauges and the probe metrics to an
+// OpenTelemetry collector, using OTLP/HTTP with JSON encoding. Cycles are
+// exported in the background; a cycle ending while the previous one is still
+// being exported is dropped.
+type otlpExporter struct {
+	endpoint string
+	client   *instrumentedClient
+	resource otlpResource
+	stats    *probeMetrics
+
+	busy chan struct{}
+	// failing records whether the last export failed, to log the failures
+	// only once until an export succeeds again, and report the service
+	// unhealthy.
+	mu      sync.Mutex
+	failing bool
+}
+
+// newOtlpExporter creates the exporter of the configured endpoint, or returns
+// nil when there is none.
+func newOtlpExporter(cfg *handlerSettings) *otlpExporter {
+	endpoint := cfg.otlpEndpoint()
+	if endpoint == "" {
+		return nil
+	}
+	attributes := []otlpAttribute{
+		stringAttribute("service.name", otlpScopeName),
+		stringAttribute("service.version", VersionString()),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		attributes = append(attributes, stringAttribute("host.name", hostname))
+	}
+	if name := cfg.applicationName(); name != "" {
+		attributes = append(attributes, stringAttribute("service.namespace", name))
+	}
+	if environment := cfg.environment(); environment != "" {
+		attributes = append(attributes, stringAttribute("deployment.environment", environment))
+	}
+	// the cycles are exported in the background, the retries don't delay
+	// the probes
+	client := newInstrumentedClient(&http.Client{Timeout: otlpRequestTimeout})
+	client.Retry = retryPolicy{Attempts: 3, Backoff: telemetryRetryBackoff, Retryable: retryTransientFailures}
+	return &otlpExporter{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   client,
+		resource: otlpResource{Attributes: attributes},
+		stats:    probeStats,
+		busy:     make(chan struct{}, 1),
+	}
+}
+
+// subscribe exports the probe cycles published on the bus.
+func (e *otlpExporter) subscribe(bus *eventBus) {
+	bus.subscribe(busEventProbeCycle, func(ctx *log.Context, ev busEvent) {
+		e.exportAsync(ctx, newProbeCycle(ev.Start, ev.End, ev.CommittedState, ev.Apps))
+	})
+}
+
+// exportAsync exports the cycle in the background, unless the previous cycle
+// is still being exported.
+func (e *otlpExporter) exportAsync(ctx *log.Context, cycle probeCycle) {
+	select {
+	case e.busy <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-e.busy }()
+		e.export(ctx, cycle)
+	}()
+}
+
+// export sends the span and the metrics of the cycle.
+func (e *otlpExporter) export(ctx *log.Context, cycle probeCycle) {
+	err := e.post("/v1/traces", e.traces(cycle))
+	if err == nil {
+		err = e.post("/v1/metrics", e.metrics(cycle))
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil && !e.failing {
+		ctx.Log("error", errors.Wrapf(err, "failed to export to OpenTelemetry collector %s", e.endpoint))
+	} else if err == nil && e.failing {
+		ctx.Log("event", "exporting to OpenTelemetry collector "+e.endpoint+" again")
+	}
+	e.failing = err != nil
+}
+
+// The exporter is a service of the extension, which waits for the export in
+// progress when it is stopped.
+
+func (e *otlpExporter) name() string {
+	return "OpenTelemetry exporter"
+}
+
+func (e *otlpExporter) start(ctx *log.Context) error {
+	return nil
+}
+
+func (e *otlpExporter) stop() {
+	// cycles ending once stopped are dropped
+	e.busy <- struct{}{}
+}
+
+func (e *otlpExporter) health() serviceHealth {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h := serviceHealth{Name: e.name(), Running: true}
+	if e.failing {
+		h.Error = "failed to export to " + e.endpoint
+	}
+	return h
+}
+
+func (e *otlpExporter) post(path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doTelemetryRequest(e.client, req)
+}
+
+// traces returns the span of the cycle and the child spans of its probes.
+func (e *otlpExporter) traces(cycle probeCycle) otlpTraces {
+	traceID, rootID := randomHex(16), randomHex(8)
+	spans := []otlpSpan{{
+		TraceID:           traceID,
+		SpanID:            rootID,
+		Name:              "ProbeCycle",
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: unixNano(cycle.start),
+		EndTimeUnixNano:   unixNano(cycle.end),
+		Attributes:        []otlpAttribute{stringAttribute("apphealth.health_state", string(cycle.state))},
+		Status:            otlpStatus{Code: otlpStatusCodeOk},
+	}}
+	for _, p := range cycle.probes {
+		attributes := []otlpAttribute{
+			stringAttribute("apphealth.probe.target", p.target),
+			stringAttribute("apphealth.probe.health_state", string(p.healthState)),
+			stringAttribute("apphealth.committed_state", string(p.committedState)),
+		}
+		if p.application != "" {
+			attributes = append(attributes, stringAttribute("apphealth.application", p.application))
+		}
+		status := otlpStatus{Code: otlpStatusCodeOk}
+		if p.failure != "" {
+			attributes = append(attributes, stringAttribute("apphealth.probe.failure", string(p.failure)))
+			status = otlpStatus{Code: otlpStatusCodeError, Message: string(p.failure)}
+		}
+		if t := p.timing; t != nil {
+			for key, value := range map[string]string{
+				"dns_lookup":         t.DnsLookup,
+				"connect":            t.Connect,
+				"tls_handshake":      t.TlsHandshake,
+				"time_to_first_byte": t.TimeToFirstByte,
+			} {
+				if value != "" {
+					attributes = append(attributes, stringAttribute("apphealth.probe.timing."+key, value))
+				}
+			}
+		}
+		spans = append(spans, otlpSpan{
+			TraceID:           traceID,
+			SpanID:            randomHex(8),
+			ParentSpanID:      rootID,
+			Name:              "Probe",
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: unixNano(p.start),
+			EndTimeUnixNano:   unixNano(p.start.Add(p.duration)),
+			Attributes:        attributes,
+			Status:            status,
+		})
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   e.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: e.scope(), Spans: spans}},
+	}}}
+}
+
+// metrics returns the health state gauge, of the VM and of each application,
+// the probe duration gauge of each application and the probe metrics: the
+// counter of the probe results and the latency histograms.
+func (e *otlpExporter) metrics(cycle probeCycle) otlpMetrics {
+	t := unixNano(cycle.end)
+	one := "1"
+	states := []otlpDataPoint{{
+		Attributes:   []otlpAttribute{stringAttribute("state", string(cycle.state))},
+		TimeUnixNano: t,
+		AsInt:        &one,
+	}}
+	var durations []otlpDataPoint
+	for _, p := range cycle.probes {
+		var attributes []otlpAttribute
+		if p.application != "" {
+			attributes = append(attributes, stringAttribute("application", p.application))
+		}
+		states = append(states, otlpDataPoint{
+			Attributes:   append([]otlpAttribute{stringAttribute("state", string(p.committedState))}, attributes...),
+			TimeUnixNano: t,
+			AsInt:        &one,
+		})
+		seconds := p.duration.Seconds()
+		durations = append(durations, otlpDataPoint{Attributes: attributes, TimeUnixNano: t, AsDouble: &seconds})
+	}
+
+	start := unixNano(e.stats.start)
+	results, latencies := e.stats.snapshot()
+	var counts []otlpDataPoint
+	for _, r := range results {
+		count := strconv.FormatInt(r.count, 10)
+		attributes := []otlpAttribute{stringAttribute("probe", r.probe), stringAttribute("outcome", r.outcome)}
+		if r.statusClass != "" {
+			attributes = append(attributes, stringAttribute("status_class", r.statusClass))
+		}
+		counts = append(counts, otlpDataPoint{Attributes: attributes, StartTimeUnixNano: start, TimeUnixNano: t, AsInt: &count})
+	}
+	var histograms []otlpHistogramDataPoint
+	for _, l := range latencies {
+		histograms = append(histograms, histogramDataPoint([]otlpAttribute{stringAttribute("probe", l.probe)}, l.latencyHistogram, start, t))
+	}
+	var phases []otlpHistogramDataPoint
+	for _, p := range e.stats.phaseSnapshot() {
+		attributes := []otlpAttribute{stringAttribute("probe", p.probe), stringAttribute("phase", p.phase)}
+		phases = append(phases, histogramDataPoint(attributes, p.latencyHistogram, start, t))
+	}
+
+	return otlpMetrics{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: e.resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: e.scope(), Metrics: []otlpMetric{
+			{Name: otlpMetricHealthState, Description: "The committed health state, as the 'state' attribute of a point valued 1.", Unit: "1", Gauge: &otlpGauge{DataPoints: states}},
+			{Name: otlpMetricProbeDuration, Description: "The duration of the last probe.", Unit: "s", Gauge: &otlpGauge{DataPoints: durations}},
+			{Name: otlpMetricProbeResults, Description: "Probe results by probe, outcome and http status class.", Unit: "1", Sum: &otlpSum{
+				DataPoints:             counts,
+				AggregationTemporality: otlpAggregationTemporalityCumulative,
+				IsMonotonic:            true,
+			}},
+			{Name: otlpMetricProbeLatency, Description: "Probe latency by probe.", Unit: "s", Histogram: &otlpHistogram{
+				DataPoints:             histograms,
+				AggregationTemporality: otlpAggregationTemporalityCumulative,
+			}},
+			{Name: otlpMetricProbePhase, Description: "Duration of the phases of the http requests of the probes, by probe and phase.", Unit: "s", Histogram: &otlpHistogram{
+				DataPoints:             phases,
+				AggregationTemporality: otlpAggregationTemporalityCumulative,
+			}},
+		}}},
+	}}}
+}
+
+// histogramDataPoint returns the cumulative data point of a latency histogram
+// since start.
+func histogramDataPoint(attributes []otlpAttribute, h latencyHistogram, start, t string) otlpHistogramDataPoint {
+	bucketCounts := make([]string, 0, len(h.counts))
+	for _, c := range h.counts {
+		bucketCounts = append(bucketCounts, strconv.FormatInt(c, 10))
+	}
+	return otlpHistogramDataPoint{
+		Attributes:        attributes,
+		StartTimeUnixNano: start,
+		TimeUnixNano:      t,
+		Count:             strconv.FormatInt(h.count, 10),
+		Sum:               h.sum,
+		BucketCounts:      bucketCounts,
+		ExplicitBounds:    probeLatencyBucketsInSeconds,
+	}
+}
+
+func (e *otlpExporter) scope() otlpScope {
+	return otlpScope{Name: otlpScopeName, Version: VersionString()}
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+// unixNano formats a time as OTLP JSON encodes 64 bit integers.
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The OTLP JSON encoding of the exported traces and metrics.
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpMetrics struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsInt             *string         `json:"asInt,omitempty"`
+	AsDouble          *float64        `json:"asDouble,omitempty"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	BucketCounts      []string        `json:"bucketCounts"`
+	ExplicitBounds    []float64       `json:"explicitBounds"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOtlpCollector records the payloads it is sent, by path.
+type fakeOtlpCollector struct {
+	mu       sync.Mutex
+	payloads map[string][]byte
+	status   int
+}
+
+func (c *fakeOtlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.payloads[r.URL.Path] = body
+	w.WriteHeader(c.status)
+}
+
+func TestNewOtlpExporter(t *testing.T) {
+	require.Nil(t, newOtlpExporter(&handlerSettings{}))
+
+	e := newOtlpExporter(observabilityConfig(observabilitySettings{OtlpEndpoint: "http://localhost:4318/", ApplicationName: "checkout"}))
+	require.NotNil(t, e)
+	require.Equal(t, "http://localhost:4318", e.endpoint)
+	require.Contains(t, e.resource.Attributes, stringAttribute("service.namespace", "checkout"))
+}
+
+func TestOtlpExporter_export(t *testing.T) {
+	collector := &fakeOtlpCollector{payloads: make(map[string][]byte), status: http.StatusOK}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	e := newOtlpExporter(observabilityConfig(observabilitySettings{OtlpEndpoint: server.URL}))
+	e.client.sleep = func(time.Duration) {}
+	e.stats = newProbeMetrics()
+	e.stats.record("api", ProbeDetails{Failure: probeFailureBadStatus, StatusCode: 503, Timing: &requestTiming{phases: map[string]time.Duration{requestPhaseConnect: time.Millisecond}}}, 300*time.Millisecond)
+
+	start := time.Unix(100, 0)
+	cycle := probeCycle{start: start, end: start.Add(2 * time.Second), state: Unhealthy, probes: []cycleProbe{
+		{application: "web", target: "http://localhost/health", start: start, duration: time.Second, healthState: Healthy, committedState: Healthy},
+		{application: "api", target: "localhost:8080", start: start, duration: 1500 * time.Millisecond, healthState: Unhealthy, committedState: Unhealthy, failure: probeFailureConnectionRefused},
+	}}
+	e.export(log.NewContext(log.NewNopLogger()), cycle)
+	require.False(t, e.failing)
+
+	var traces otlpTraces
+	require.Nil(t, json.Unmarshal(collector.payloads["/v1/traces"], &traces))
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 3)
+	require.Equal(t, "ProbeCycle", spans[0].Name)
+	require.Equal(t, "100000000000", spans[0].StartTimeUnixNano)
+	require.Equal(t, "102000000000", spans[0].EndTimeUnixNano)
+	require.Len(t, spans[0].TraceID, 32)
+	for _, span := range spans[1:] {
+		require.Equal(t, spans[0].TraceID, span.TraceID)
+		require.Equal(t, spans[0].SpanID, span.ParentSpanID)
+	}
+	require.Equal(t, "101000000000", spans[1].EndTimeUnixNano)
+	require.Equal(t, otlpStatusCodeOk, spans[1].Status.Code)
+	require.Equal(t, otlpStatus{Code: otlpStatusCodeError, Message: "connectionRefused"}, spans[2].Status)
+	require.Contains(t, spans[2].Attributes, stringAttribute("apphealth.application", "api"))
+
+	var metrics otlpMetrics
+	require.Nil(t, json.Unmarshal(collector.payloads["/v1/metrics"], &metrics))
+	gauges := metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	require.Len(t, gauges, 5)
+	require.Equal(t, otlpMetricHealthState, gauges[0].Name)
+	require.Len(t, gauges[0].Gauge.DataPoints, 3)
+	require.Equal(t, []otlpAttribute{stringAttribute("state", "Unhealthy")}, gauges[0].Gauge.DataPoints[0].Attributes)
+	require.Equal(t, []otlpAttribute{stringAttribute("state", "Unhealthy"), stringAttribute("application", "api")}, gauges[0].Gauge.DataPoints[2].Attributes)
+	require.Equal(t, otlpMetricProbeDuration, gauges[1].Name)
+	require.Equal(t, 1.5, *gauges[1].Gauge.DataPoints[1].AsDouble)
+	require.Equal(t, otlpMetricProbeResults, gauges[2].Name)
+	require.True(t, gauges[2].Sum.IsMonotonic)
+	require.Equal(t, "1", *gauges[2].Sum.DataPoints[0].AsInt)
+	require.Contains(t, gauges[2].Sum.DataPoints[0].Attributes, stringAttribute("status_class", "5xx"))
+	require.Equal(t, otlpMetricProbeLatency, gauges[3].Name)
+	histogram := gauges[3].Histogram.DataPoints[0]
+	require.Equal(t, "1", histogram.Count)
+	require.Len(t, histogram.BucketCounts, len(histogram.ExplicitBounds)+1)
+	require.Equal(t, "1", histogram.BucketCounts[6])
+	require.Equal(t, otlpMetricProbePhase, gauges[4].Name)
+	phase := gauges[4].Histogram.DataPoints[0]
+	require.Equal(t, []otlpAttribute{stringAttribute("probe", "api"), stringAttribute("phase", "connect")}, phase.Attributes)
+	require.Equal(t, "1", phase.BucketCounts[0])
+
+	// a failed export is logged once, until an export succeeds again
+	collector.status = http.StatusServiceUnavailable
+	e.export(log.NewContext(log.NewNopLogger()), cycle)
+	require.True(t, e.failing)
+	require.Equal(t, serviceHealth{Name: "OpenTelemetry exporter", Running: true, Error: "failed to export to " + server.URL}, e.health())
+	collector.status = http.StatusOK
+	e.export(log.NewContext(log.NewNopLogger()), cycle)
+	require.False(t, e.failing)
+}
+
+func TestOtlpExporter_exportAsyncDropsWhileBusy(t *testing.T) {
+	e := newOtlpExporter(observabilityConfig(observabilitySettings{OtlpEndpoint: "http://localhost:4318"}))
+	e.busy <- struct{}{}
+	// the previous cycle is still being exported, the cycle is dropped
+	e.exportAsync(log.NewContext(log.NewNopLogger()), probeCycle{})
+	require.Len(t, e.busy, 1)
+}
+
+func TestOtlpExporter_stopWaitsForExport(t *testing.T) {
+	e := newOtlpExporter(observabilityConfig(observabilitySettings{OtlpEndpoint: "http://localhost:4318"}))
+	e.busy <- struct{}{}
+	stopped := make(chan struct{})
+	go func() {
+		e.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stopped while exporting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the export completes
+	<-e.busy
+	<-stopped
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// tcpStateListen is the state of listening sockets in /proc/net/tcp.
+const tcpStateListen = "0A"
+
+// PortDiscoveryHealthProbe probes an application that listens on a port not
+// known in advance. On each evaluation, the port the process named
+// ProcessName listens on is discovered from the proc filesystem, and the probe
+// created by newProbe for that port is evaluated.
+type PortDiscoveryHealthProbe struct {
+	ProcessName string
+
+	// ProcRoot is where the proc filesystem is mounted, replaced in tests.
+	ProcRoot string
+
+	newProbe func(ctx *log.Context, port int) HealthProbe
+	port     int
+	probe    HealthProbe
+
+	statusAfterGracePeriodExpires HealthStatus
+}
+
+// NewPortDiscoveryHealthProbe creates the probe discovering the port of the
+// process, which reports statusAfterGracePeriodExpires, the state the probes
+// created by newProbe report, while no port is discovered.
+func NewPortDiscoveryHealthProbe(processName string, statusAfterGracePeriodExpires HealthStatus, newProbe func(ctx *log.Context, port int) HealthProbe) *PortDiscoveryHealthProbe {
+	return &PortDiscoveryHealthProbe{
+		ProcessName:                   processName,
+		ProcRoot:                      "/proc",
+		newProbe:                      newProbe,
+		statusAfterGracePeriodExpires: statusAfterGracePeriodExpires,
+	}
+}
+
+func (p *PortDiscoveryHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	port, err := p.discoverPort()
+	if err != nil {
+		var probeResponse ProbeResponse
+		probeResponse.ApplicationHealthState = p.statusAfterGracePeriodExpires
+		return probeResponse, err
+	}
+
+	if port != p.port {
+		ctx.Log("event", fmt.Sprintf("Discovered port %d of process '%s'", port, p.ProcessName))
+		p.port = port
+		p.probe = p.newProbe(ctx, port)
+	}
+	return p.probe.evaluate(ctx)
+}
+
+func (p *PortDiscoveryHealthProbe) address() string {
+	if p.probe != nil {
+		return p.probe.address()
+	}
+	return "port of process " + p.ProcessName
+}
+
+func (p *PortDiscoveryHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return p.statusAfterGracePeriodExpires
+}
+
+// discoverPort returns the lowest tcp port a process named ProcessName listens
+// on. Listening sockets are found in the tcp tables of the network namespace
+// of each matching process, and matched to the process by the inodes of its
+// open sockets.
+func (p *PortDiscoveryHealthProbe) discoverPort() (int, error) {
+	pids, err := pidsByName(p.ProcRoot, p.ProcessName)
+	if err != nil {
+		return 0, err
+	}
+	if len(pids) == 0 {
+		return 0, errors.New(fmt.Sprintf("No process named '%s' is running", p.ProcessName))
+	}
+
+	found := 0
+	for _, pid := range pids {
+		inodes := p.socketInodes(pid)
+		if len(inodes) == 0 {
+			continue
+		}
+		for _, table := range []string{"tcp", "tcp6"} {
+			content, err := ioutil.ReadFile(filepath.Join(p.ProcRoot, strconv.Itoa(pid), "net", table))
+			if err != nil {
+				continue
+			}
+			for _, port := range listeningPorts(string(content), inodes) {
+				if found == 0 || port < found {
+					found = port
+				}
+			}
+		}
+	}
+	if found == 0 {
+		return 0, errors.New(fmt.Sprintf("No listening tcp port found for process '%s'", p.ProcessName))
+	}
+	return found, nil
+}
+
+// socketInodes returns the inodes of the sockets opened by the process.
+func (p *PortDiscoveryHealthProbe) socketInodes(pid int) map[string]bool {
+	fdDir := filepath.Join(p.ProcRoot, strconv.Itoa(pid), "fd")
+	entries, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return nil
+	}
+
+	inodes := make(map[string]bool)
+	for _, e := range entries {
+		link, err := os.Readlink(filepath.Join(fdDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(link, "socket:[") && strings.HasSuffix(link, "]") {
+			inodes[link[len("socket:["):len(link)-1]] = true
+		}
+	}
+	return inodes
+}
+
+// listeningPorts parses a /proc/net/tcp or /proc/net/tcp6 table and returns
+// the local ports of the listening sockets with one of the given inodes, or of
+// all the listening sockets when inodes is nil.
+func listeningPorts(table string, inodes map[string]bool) []int {
+	var ports []int
+	lines := strings.Split(table, "\n")
+	for _, line := range lines[1:] {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[3] != tcpStateListen || (inodes != nil && !inodes[fields[9]]) {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			continue
+		}
+		ports = append(ports, int(port))
+	}
+	return ports
+}
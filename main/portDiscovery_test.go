@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+const testTcpTable = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 20 4 30 10 -1
+`
+
+func TestListeningPorts(t *testing.T) {
+	require.Equal(t, []int{8080}, listeningPorts(testTcpTable, map[string]bool{"1001": true, "1003": true}))
+	require.Equal(t, []int{8080, 22}, listeningPorts(testTcpTable, map[string]bool{"1001": true, "1002": true}))
+	require.Empty(t, listeningPorts(testTcpTable, map[string]bool{"1003": true}))
+	require.Equal(t, []int{8080, 22}, listeningPorts(testTcpTable, nil))
+}
+
+func TestPortDiscoveryHealthProbe(t *testing.T) {
+	comm, err := ioutil.ReadFile("/proc/self/comm")
+	require.Nil(t, err)
+	ctx := log.NewContext(log.NewNopLogger())
+	cfg := handlerSettings{publicSettings: publicSettings{Protocol: "tcp", DiscoverPortOfProcess: strings.TrimSpace(string(comm))}}
+
+	probe, ok := NewHealthProbe(ctx, &cfg, 0).(*PortDiscoveryHealthProbe)
+	require.True(t, ok)
+	require.Equal(t, Unhealthy, probe.healthStatusAfterGracePeriodExpires())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+
+	port, err := probe.discoverPort()
+	require.Nil(t, err)
+	require.True(t, port <= listener.Addr().(*net.TCPAddr).Port)
+
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, "localhost:"+strings.TrimPrefix(listener.Addr().String(), "127.0.0.1:"), probe.address())
+}
+
+func TestPortDiscoveryHealthProbe_noProcess(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	cfg := handlerSettings{publicSettings: publicSettings{Protocol: "http", DiscoverPortOfProcess: "no-such-process"}}
+
+	probe := NewHealthProbe(ctx, &cfg, 0)
+	require.Equal(t, Unknown, probe.healthStatusAfterGracePeriodExpires())
+	probeResponse, err := probe.evaluate(ctx)
+	require.EqualError(t, err, "No process named 'no-such-process' is running")
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+}
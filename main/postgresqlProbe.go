@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	postgresqlProtocolVersion = 3 << 16
+
+	postgresqlAuthOk                = 0
+	postgresqlAuthCleartextPassword = 3
+	postgresqlAuthMD5Password       = 5
+	postgresqlAuthSASL              = 10
+	postgresqlAuthSASLContinue      = 11
+	postgresqlAuthSASLFinal         = 12
+
+	scramSha256 = "SCRAM-SHA-256"
+)
+
+// postgresqlHandshake sends the startup message and, when a password is set,
+// authenticates with the cleartext, md5 or SCRAM-SHA-256 method until the
+// server is ready for queries. Without a password, a server asking for
+// authentication or rejecting the role is considered to accept connections.
+func postgresqlHandshake(conn net.Conn, user, password, database string) error {
+	var startup bytes.Buffer
+	binary.Write(&startup, binary.BigEndian, int32(0))
+	binary.Write(&startup, binary.BigEndian, int32(postgresqlProtocolVersion))
+	startup.WriteString("user\x00" + user + "\x00")
+	if database != "" {
+		startup.WriteString("database\x00" + database + "\x00")
+	}
+	startup.WriteString("application_name\x00" + syslogTag + "\x00\x00")
+	b := startup.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+	for {
+		messageType, message, err := readPostgresqlMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		switch messageType {
+		case 'E':
+			code, text := postgresqlErrorFields(message)
+			// class 28 is invalid authorization, such as an unknown role
+			if password == "" && strings.HasPrefix(code, "28") {
+				return nil
+			}
+			return &databaseError{probeFailureBadStatus, fmt.Sprintf("PostgreSQL error %s: %s", code, text)}
+		case 'Z':
+			// ready for query, terminate the session
+			conn.Write([]byte{'X', 0, 0, 0, 4})
+			return nil
+		case 'R':
+			if len(message) < 4 {
+				return &databaseError{probeFailureBadBody, "Invalid PostgreSQL authentication request"}
+			}
+			method, data := binary.BigEndian.Uint32(message), message[4:]
+			if method == postgresqlAuthOk {
+				continue
+			}
+			if password == "" {
+				return nil
+			}
+
+			var response []byte
+			switch method {
+			case postgresqlAuthCleartextPassword:
+				response = []byte(password + "\x00")
+			case postgresqlAuthMD5Password:
+				if len(data) < 4 {
+					return &databaseError{probeFailureBadBody, "Invalid PostgreSQL md5 authentication request"}
+				}
+				response = []byte(postgresqlMD5Password(user, password, data[:4]) + "\x00")
+			case postgresqlAuthSASL:
+				if !containsString(strings.Split(string(data), "\x00"), scramSha256) {
+					return &databaseError{probeFailureBadStatus, "PostgreSQL server doesn't offer SCRAM-SHA-256 authentication"}
+				}
+				if scram, err = newScramClient("", password); err != nil {
+					return err
+				}
+				clientFirst := scram.clientFirst()
+				var initial bytes.Buffer
+				initial.WriteString(scramSha256 + "\x00")
+				binary.Write(&initial, binary.BigEndian, int32(len(clientFirst)))
+				initial.WriteString(clientFirst)
+				response = initial.Bytes()
+			case postgresqlAuthSASLContinue:
+				if scram == nil {
+					return &databaseError{probeFailureBadBody, "Unexpected PostgreSQL SASL continuation"}
+				}
+				clientFinal, err := scram.clientFinal(string(data))
+				if err != nil {
+					return err
+				}
+				response = []byte(clientFinal)
+			case postgresqlAuthSASLFinal:
+				if scram == nil {
+					return &databaseError{probeFailureBadBody, "Unexpected PostgreSQL SASL completion"}
+				}
+				if err := scram.verifyServerFinal(string(data)); err != nil {
+					return err
+				}
+				continue
+			default:
+				return &databaseError{probeFailureBadStatus, fmt.Sprintf("Unsupported PostgreSQL authentication method %d", method)}
+			}
+			if err := writePostgresqlMessage(conn, 'p', response); err != nil {
+				return err
+			}
+		}
+		// other messages, such as parameter statuses, are ignored
+	}
+}
+
+// postgresqlMD5Password returns "md5" + md5(md5(password + user) + salt).
+func postgresqlMD5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// postgresqlErrorFields returns the SQLSTATE code and the message of an
+// ErrorResponse.
+func postgresqlErrorFields(message []byte) (string, string) {
+	var code, text string
+	for _, field := range bytes.Split(message, []byte{0}) {
+		if len(field) == 0 {
+			continue
+		}
+		switch field[0] {
+		case 'C':
+			code = string(field[1:])
+		case 'M':
+			text = bodyExcerpt(field[1:])
+		}
+	}
+	return code, text
+}
+
+func readPostgresqlMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length > maxDatabaseMessageSize {
+		return 0, nil, &databaseError{probeFailureBadBody, fmt.Sprintf("Invalid PostgreSQL message length %d", length)}
+	}
+	message := make([]byte, length-4)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return 0, nil, err
+	}
+	return header[0], message, nil
+}
+
+func writePostgresqlMessage(w io.Writer, messageType byte, message []byte) error {
+	header := []byte{messageType, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(message)+4))
+	_, err := w.Write(append(header, message...))
+	return err
+}
+
+// scramClient is the client side of a SCRAM-SHA-256 exchange (RFC 7677)
+// without channel binding.
+type scramClient struct {
+	user            string
+	password        string
+	nonce           string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func newScramClient(user, password string) (*scramClient, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &scramClient{user: user, password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}, nil
+}
+
+func (c *scramClient) clientFirst() string {
+	c.clientFirstBare = "n=" + c.user + ",r=" + c.nonce
+	return "n,," + c.clientFirstBare
+}
+
+// clientFinal returns the final message of the client, proving it knows the
+// password, in response to the first message of the server.
+func (c *scramClient) clientFinal(serverFirst string) (string, error) {
+	attributes := scramAttributes(serverFirst)
+	nonce, salt, iterations := attributes["r"], attributes["s"], attributes["i"]
+	if !strings.HasPrefix(nonce, c.nonce) {
+		return "", &databaseError{probeFailureBadBody, "Invalid SCRAM server nonce"}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", &databaseError{probeFailureBadBody, "Invalid SCRAM salt"}
+	}
+	n, err := strconv.Atoi(iterations)
+	if err != nil || n < 1 {
+		return "", &databaseError{probeFailureBadBody, "Invalid SCRAM iteration count"}
+	}
+
+	c.saltedPassword = pbkdf2Sha256([]byte(c.password), saltBytes, n)
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	c.authMessage = c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	clientKey := hmacSha256(c.saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSha256(storedKey[:], []byte(c.authMessage))
+	proof := xorBytes(clientKey, clientSignature)
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal checks that the server knows the password as well.
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+	attributes := scramAttributes(serverFinal)
+	if e, ok := attributes["e"]; ok {
+		return &databaseError{probeFailureBadStatus, "SCRAM authentication failed: " + e}
+	}
+	serverKey := hmacSha256(c.saltedPassword, []byte("Server Key"))
+	expected := base64.StdEncoding.EncodeToString(hmacSha256(serverKey, []byte(c.authMessage)))
+	if !hmac.Equal([]byte(attributes["v"]), []byte(expected)) {
+		return &databaseError{probeFailureBadStatus, "Invalid SCRAM server signature"}
+	}
+	return nil
+}
+
+// scramAttributes parses the comma separated 'name=value' attributes of a
+// SCRAM message.
+func scramAttributes(message string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(message, ",") {
+		if i := strings.Index(attribute, "="); i > 0 {
+			attributes[attribute[:i]] = attribute[i+1:]
+		}
+	}
+	return attributes
+}
+
+func hmacSha256(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// pbkdf2Sha256 derives a key of the size of a SHA-256 digest, the only block
+// SCRAM-SHA-256 needs.
+func pbkdf2Sha256(password, salt []byte, iterations int) []byte {
+	u := hmacSha256(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacSha256(password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
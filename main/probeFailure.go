@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// probeFailure classifies why a probe failed. It is reported in the probe
+// details and can be mapped to a health state with 'failureStates'.
+type probeFailure string
+
+const (
+	probeFailureDnsResolution     probeFailure = "dnsResolution"
+	probeFailureConnectionRefused probeFailure = "connectionRefused"
+	probeFailureConnection        probeFailure = "connection"
+	probeFailureTls               probeFailure = "tls"
+	probeFailureTimeout           probeFailure = "timeout"
+	probeFailureRedirect          probeFailure = "redirect"
+	probeFailureProxy             probeFailure = "proxy"
+	probeFailureBadStatus         probeFailure = "badStatus"
+	probeFailureBadHeaders        probeFailure = "badHeaders"
+	probeFailureBadBody           probeFailure = "badBody"
+	probeFailurePacketLoss        probeFailure = "packetLoss"
+	probeFailureLatency           probeFailure = "latency"
+	// probeFailureLoopback replaces the classes of failures where the endpoint
+	// could not be reached when the loopback sanity check fails too: the
+	// networking stack of the VM is broken, rather than the application down.
+	probeFailureLoopback probeFailure = "loopback"
+
+	// probeFailureUnreachable is not reported, it groups the classes of
+	// failures where the endpoint could not be reached, so that they can be
+	// mapped to a state at once.
+	probeFailureUnreachable probeFailure = "unreachable"
+)
+
+func (f probeFailure) isUnreachable() bool {
+	switch f {
+	case probeFailureDnsResolution, probeFailureConnectionRefused, probeFailureConnection, probeFailureTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// mapFailureState returns the health state of a probe response once mapped by
+// failureStates. A class of failure takes precedence over its group.
+func mapFailureState(failureStates map[probeFailure]HealthStatus, probeResponse ProbeResponse) HealthStatus {
+	failure := probeResponse.ProbeDetails.Failure
+	if failure == "" {
+		return probeResponse.ApplicationHealthState
+	}
+	if state, ok := failureStates[failure]; ok {
+		return state
+	}
+	if state, ok := failureStates[probeFailureUnreachable]; ok && failure.isUnreachable() {
+		return state
+	}
+	return probeResponse.ApplicationHealthState
+}
+
+// classifyRequestError classifies the error of a request which didn't get a
+// response.
+func classifyRequestError(err error) probeFailure {
+	var dnsErr *net.DNSError
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var netErr net.Error
+	var proxyErr *proxyConnectError
+
+	switch {
+	case errors.Is(err, errNoRedirect):
+		return probeFailureRedirect
+	case errors.As(err, &proxyErr):
+		return probeFailureProxy
+	case errors.As(err, &dnsErr):
+		return probeFailureDnsResolution
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return probeFailureTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return probeFailureConnectionRefused
+	case errors.As(err, &recordHeaderErr), errors.As(err, &unknownAuthorityErr),
+		errors.As(err, &certificateInvalidErr), errors.As(err, &hostnameErr),
+		strings.Contains(err.Error(), "tls: "):
+		return probeFailureTls
+	default:
+		return probeFailureConnection
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHttpHealthProbe_evaluate_failures(t *testing.T) {
+	status := http.StatusOK
+	body := `{"ApplicationHealthState": "Healthy"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status/100 == 3 {
+			w.Header().Set("Location", "/moved")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	probe := NewHttpHealthProbe("http", "/health", 80)
+	probe.Address = server.URL + "/health"
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, probeFailure(""), probeResponse.ProbeDetails.Failure)
+
+	status = http.StatusServiceUnavailable
+	probeResponse, _ = probe.evaluate(ctx)
+	require.Equal(t, probeFailureBadStatus, probeResponse.ProbeDetails.Failure)
+	require.Equal(t, http.StatusServiceUnavailable, probeResponse.ProbeDetails.StatusCode)
+
+	status = http.StatusFound
+	probeResponse, _ = probe.evaluate(ctx)
+	require.Equal(t, probeFailureRedirect, probeResponse.ProbeDetails.Failure)
+	require.Equal(t, http.StatusFound, probeResponse.ProbeDetails.StatusCode)
+
+	status, body = http.StatusOK, `{"ApplicationHealthState": "Great"}`
+	probeResponse, _ = probe.evaluate(ctx)
+	require.Equal(t, probeFailureBadBody, probeResponse.ProbeDetails.Failure)
+
+	body = `{"ApplicationHealthState": "Healthy"}`
+	probe.ExpectedHeaders = map[string]string{"X-Build-Version": ""}
+	probeResponse, _ = probe.evaluate(ctx)
+	require.Equal(t, probeFailureBadHeaders, probeResponse.ProbeDetails.Failure)
+}
+
+func TestClassifyRequestError(t *testing.T) {
+	// only the timeout case depends on the client deadline, the others
+	// get a generous one so that they don't time out on a loaded machine
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	// nothing listening
+	l, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	_, err = client.Get("http://" + addr)
+	require.NotNil(t, err)
+	require.Equal(t, probeFailureConnectionRefused, classifyRequestError(err))
+
+	// no response in time
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	_, err = (&http.Client{Timeout: 100 * time.Millisecond}).Get(slow.URL)
+	require.NotNil(t, err)
+	require.Equal(t, probeFailureTimeout, classifyRequestError(err))
+
+	// untrusted certificate
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	_, err = client.Get(tlsServer.URL)
+	require.NotNil(t, err)
+	require.Equal(t, probeFailureTls, classifyRequestError(err))
+
+	require.Equal(t, probeFailureDnsResolution, classifyRequestError(&net.DNSError{Err: "no such host", Name: "invalid"}))
+	require.Equal(t, probeFailureConnection, classifyRequestError(&net.OpError{Op: "read", Err: net.UnknownNetworkError("eof")}))
+}
+
+func TestApplicationEvaluate_failureStates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx := log.NewContext(log.NewNopLogger())
+	probe := NewHttpHealthProbe("http", "/health", 80)
+	probe.Address = server.URL + "/health"
+	app := &application{ctx: ctx, probe: probe, evaluator: newHealthEvaluator(ctx, probe, 1, 0)}
+
+	app.evaluate(0)
+	require.Equal(t, Unknown, app.committedState)
+
+	app.failureStates = map[probeFailure]HealthStatus{probeFailureBadStatus: Unhealthy}
+	app.evaluate(0)
+	require.Equal(t, Unhealthy, app.committedState)
+	require.Equal(t, probeFailureBadStatus, app.lastResponse.ProbeDetails.Failure)
+}
+
+func TestMapFailureState(t *testing.T) {
+	failed := func(state HealthStatus, failure probeFailure) ProbeResponse {
+		var r ProbeResponse
+		r.ApplicationHealthState, r.ProbeDetails.Failure = state, failure
+		return r
+	}
+	states := map[probeFailure]HealthStatus{
+		probeFailureUnreachable: Unhealthy,
+		probeFailureTimeout:     Unknown,
+	}
+
+	require.Equal(t, Healthy, mapFailureState(states, failed(Healthy, "")))
+	require.Equal(t, Unhealthy, mapFailureState(states, failed(Unknown, probeFailureConnectionRefused)))
+	require.Equal(t, Unhealthy, mapFailureState(states, failed(Unknown, probeFailureDnsResolution)))
+	// a class takes precedence over its group
+	require.Equal(t, Unknown, mapFailureState(states, failed(Unhealthy, probeFailureTimeout)))
+	// failures outside of the group keep the state of the probe
+	require.Equal(t, Unknown, mapFailureState(states, failed(Unknown, probeFailureBadStatus)))
+	require.Equal(t, Unknown, mapFailureState(nil, failed(Unknown, probeFailureConnectionRefused)))
+}
+
+func TestTcpHealthProbe_evaluate_failure(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	probe := &TcpHealthProbe{Address: addr}
+	probeResponse, err := probe.evaluate(log.NewContext(log.NewNopLogger()))
+	require.NotNil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureConnectionRefused, probeResponse.ProbeDetails.Failure)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const probeOutcomeSuccess = "success"
+
+// probeLatencyBucketsInSeconds are the upper bounds of the buckets of the
+// probe latency histograms.
+var probeLatencyBucketsInSeconds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// probeStats are the metrics of the probes of the extension, served by the
+// diagnostics endpoint and exported to the OpenTelemetry collector.
+var probeStats = newProbeMetrics()
+
+// probeResultKey labels the counter of the probe results: the probe name (the
+// application, "" for a single probe), the outcome (success or the class of
+// failure) and the class of the http status code, such as "5xx", when the
+// probe got a response.
+type probeResultKey struct {
+	probe       string
+	outcome     string
+	statusClass string
+}
+
+// probePhaseKey labels the histogram of the duration of a phase of the http
+// requests of a probe, such as "connect" or "timeToFirstByte".
+type probePhaseKey struct {
+	probe string
+	phase string
+}
+
+// latencyHistogram counts the probe latencies per bucket of
+// probeLatencyBucketsInSeconds, the last count being the +Inf bucket.
+type latencyHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int64, len(probeLatencyBucketsInSeconds)+1)}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.counts[sort.SearchFloat64s(probeLatencyBucketsInSeconds, seconds)]++
+	h.count++
+	h.sum += seconds
+}
+
+func (h *latencyHistogram) copy() latencyHistogram {
+	return latencyHistogram{counts: append([]int64(nil), h.counts...), count: h.count, sum: h.sum}
+}
+
+// probeMetrics counts the probe results by probe, outcome and status class,
+// so that alerting rules can tell a slow application from one responding
+// with server errors, and records the histogram of the latency of each
+// probe and of the phases of its http requests, which tell whether the
+// latency comes from name resolution, connection, TLS or the application.
+// Counters are cumulative since start.
+type probeMetrics struct {
+	mu        sync.Mutex
+	start     time.Time
+	results   map[probeResultKey]int64
+	latencies map[string]*latencyHistogram
+	phases    map[probePhaseKey]*latencyHistogram
+}
+
+func newProbeMetrics() *probeMetrics {
+	return &probeMetrics{
+		start:     time.Now(),
+		results:   make(map[probeResultKey]int64),
+		latencies: make(map[string]*latencyHistogram),
+		phases:    make(map[probePhaseKey]*latencyHistogram),
+	}
+}
+
+// record counts the result of a probe run which took latency.
+func (m *probeMetrics) record(probe string, details ProbeDetails, latency time.Duration) {
+	key := probeResultKey{probe: probe, outcome: probeOutcomeSuccess, statusClass: statusClass(details.StatusCode)}
+	if details.Failure != "" {
+		key.outcome = string(details.Failure)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[key]++
+	h, ok := m.latencies[probe]
+	if !ok {
+		h = newLatencyHistogram()
+		m.latencies[probe] = h
+	}
+	h.observe(latency)
+
+	if details.Timing == nil {
+		return
+	}
+	for phase, d := range details.Timing.phases {
+		key := probePhaseKey{probe: probe, phase: phase}
+		h, ok := m.phases[key]
+		if !ok {
+			h = newLatencyHistogram()
+			m.phases[key] = h
+		}
+		h.observe(d)
+	}
+}
+
+// statusClass returns the class of an http status code, such as "5xx", or ""
+// without a status code.
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return ""
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// probeResultCount is the value of a counter of the probe results.
+type probeResultCount struct {
+	probeResultKey
+	count int64
+}
+
+// probeLatency is the latency histogram of a probe.
+type probeLatency struct {
+	probe string
+	latencyHistogram
+}
+
+// snapshot returns the counters and the histograms, sorted by labels.
+func (m *probeMetrics) snapshot() ([]probeResultCount, []probeLatency) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]probeResultCount, 0, len(m.results))
+	for key, count := range m.results {
+		results = append(results, probeResultCount{key, count})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.probe != b.probe {
+			return a.probe < b.probe
+		}
+		if a.outcome != b.outcome {
+			return a.outcome < b.outcome
+		}
+		return a.statusClass < b.statusClass
+	})
+
+	latencies := make([]probeLatency, 0, len(m.latencies))
+	for probe, h := range m.latencies {
+		latencies = append(latencies, probeLatency{probe, h.copy()})
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i].probe < latencies[j].probe })
+	return results, latencies
+}
+
+// probePhaseLatency is the histogram of the duration of a phase of the http
+// requests of a probe.
+type probePhaseLatency struct {
+	probePhaseKey
+	latencyHistogram
+}
+
+// phaseSnapshot returns the histograms of the request phases, sorted by
+// labels.
+func (m *probeMetrics) phaseSnapshot() []probePhaseLatency {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	phases := make([]probePhaseLatency, 0, len(m.phases))
+	for key, h := range m.phases {
+		phases = append(phases, probePhaseLatency{key, h.copy()})
+	}
+	sort.Slice(phases, func(i, j int) bool {
+		a, b := phases[i], phases[j]
+		if a.probe != b.probe {
+			return a.probe < b.probe
+		}
+		return a.phase < b.phase
+	})
+	return phases
+}
+
+// writePrometheus writes the metrics in the Prometheus text exposition format.
+func (m *probeMetrics) writePrometheus(w io.Writer) {
+	results, latencies := m.snapshot()
+
+	fmt.Fprintln(w, "# HELP apphealth_probe_results_total Probe results by probe, outcome and http status class.")
+	fmt.Fprintln(w, "# TYPE apphealth_probe_results_total counter")
+	for _, r := range results {
+		fmt.Fprintf(w, "apphealth_probe_results_total{probe=%s,outcome=%s,status_class=%s} %d\n",
+			quoteLabel(r.probe), quoteLabel(r.outcome), quoteLabel(r.statusClass), r.count)
+	}
+
+	fmt.Fprintln(w, "# HELP apphealth_probe_latency_seconds Probe latency by probe.")
+	fmt.Fprintln(w, "# TYPE apphealth_probe_latency_seconds histogram")
+	for _, l := range latencies {
+		writePrometheusHistogram(w, "apphealth_probe_latency_seconds", "probe="+quoteLabel(l.probe), l.latencyHistogram)
+	}
+
+	fmt.Fprintln(w, "# HELP apphealth_probe_phase_seconds Duration of the phases of the http requests of the probes, by probe and phase.")
+	fmt.Fprintln(w, "# TYPE apphealth_probe_phase_seconds histogram")
+	for _, p := range m.phaseSnapshot() {
+		writePrometheusHistogram(w, "apphealth_probe_phase_seconds", "probe="+quoteLabel(p.probe)+",phase="+quoteLabel(p.phase), p.latencyHistogram)
+	}
+}
+
+// writePrometheusHistogram writes the samples of a histogram with the labels.
+func writePrometheusHistogram(w io.Writer, name, labels string, h latencyHistogram) {
+	var cumulative int64
+	for i, bound := range probeLatencyBucketsInSeconds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// quoteLabel quotes a label value as the Prometheus text format escapes it.
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
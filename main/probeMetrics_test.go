@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusClass(t *testing.T) {
+	require.Equal(t, "", statusClass(0))
+	require.Equal(t, "2xx", statusClass(200))
+	require.Equal(t, "3xx", statusClass(302))
+	require.Equal(t, "5xx", statusClass(503))
+}
+
+func TestProbeMetrics_record(t *testing.T) {
+	m := newProbeMetrics()
+	m.record("web", ProbeDetails{StatusCode: 200}, 20*time.Millisecond)
+	m.record("web", ProbeDetails{StatusCode: 200}, 40*time.Millisecond)
+	m.record("web", ProbeDetails{Failure: probeFailureBadStatus, StatusCode: 500}, 2*time.Second)
+	m.record("api", ProbeDetails{Failure: probeFailureTimeout}, time.Minute)
+
+	results, latencies := m.snapshot()
+	require.Equal(t, []probeResultCount{
+		{probeResultKey{"api", "timeout", ""}, 1},
+		{probeResultKey{"web", "badStatus", "5xx"}, 1},
+		{probeResultKey{"web", "success", "2xx"}, 2},
+	}, results)
+
+	require.Len(t, latencies, 2)
+	require.Equal(t, "api", latencies[0].probe)
+	// beyond the last bucket
+	require.Equal(t, int64(1), latencies[0].counts[len(probeLatencyBucketsInSeconds)])
+	web := latencies[1]
+	require.Equal(t, int64(3), web.count)
+	require.InDelta(t, 2.06, web.sum, 1e-9)
+	require.Equal(t, []int64{0, 0, 1, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0}, web.counts)
+}
+
+func TestProbeMetrics_phases(t *testing.T) {
+	m := newProbeMetrics()
+	m.record("web", ProbeDetails{Timing: &requestTiming{phases: map[string]time.Duration{
+		requestPhaseConnect:         time.Millisecond,
+		requestPhaseTimeToFirstByte: 300 * time.Millisecond,
+	}}}, 300*time.Millisecond)
+	m.record("web", ProbeDetails{Timing: &requestTiming{phases: map[string]time.Duration{
+		requestPhaseConnect: 2 * time.Millisecond,
+	}}}, 3*time.Second)
+	m.record("api", ProbeDetails{}, time.Second)
+
+	phases := m.phaseSnapshot()
+	require.Len(t, phases, 2)
+	require.Equal(t, probePhaseKey{"web", requestPhaseConnect}, phases[0].probePhaseKey)
+	require.Equal(t, int64(2), phases[0].count)
+	require.InDelta(t, 0.003, phases[0].sum, 1e-9)
+	require.Equal(t, probePhaseKey{"web", requestPhaseTimeToFirstByte}, phases[1].probePhaseKey)
+	require.Equal(t, int64(1), phases[1].counts[6])
+
+	var b bytes.Buffer
+	m.writePrometheus(&b)
+	require.Contains(t, b.String(), `apphealth_probe_phase_seconds_bucket{probe="web",phase="connect",le="0.005"} 2`)
+	require.Contains(t, b.String(), `apphealth_probe_phase_seconds_count{probe="web",phase="timeToFirstByte"} 1`)
+}
+
+func TestProbeMetrics_writePrometheus(t *testing.T) {
+	m := newProbeMetrics()
+	m.record("web", ProbeDetails{Failure: probeFailureRedirect, StatusCode: 301}, 20*time.Millisecond)
+	m.record("", ProbeDetails{}, 3*time.Second)
+
+	var b bytes.Buffer
+	m.writePrometheus(&b)
+	require.Contains(t, b.String(), `apphealth_probe_results_total{probe="web",outcome="redirect",status_class="3xx"} 1`)
+	require.Contains(t, b.String(), `apphealth_probe_latency_seconds_bucket{probe="web",le="0.025"} 1`)
+	require.Contains(t, b.String(), `apphealth_probe_latency_seconds_bucket{probe="",le="2.5"} 0`)
+	require.Contains(t, b.String(), `apphealth_probe_latency_seconds_bucket{probe="",le="+Inf"} 1`)
+
+	// the output can be scraped, as by the metrics probe
+	samples, err := parseMetrics(&b)
+	require.Nil(t, err)
+	rule, err := parseMetricsRule(`apphealth_probe_results_total{outcome="redirect"} == 1`)
+	require.Nil(t, err)
+	ok, err := rule.evaluate(samples)
+	require.Nil(t, err)
+	require.True(t, ok)
+}
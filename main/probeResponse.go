@@ -1,8 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
 	"github.com/pkg/errors"
 )
 
@@ -13,9 +24,245 @@ var (
 	}
 )
 
+const (
+	maxDescriptionLength     = 256
+	maxAnnotations           = 16
+	maxAnnotationKeyLength   = 64
+	maxAnnotationValueLength = 256
+	minReadinessScore        = 0
+	maxReadinessScore        = 100
+	truncatedSuffix          = "..."
+	maxBodyExcerptLength     = 128
+	// maxBodyExcerptReadLength is how much of the body is kept to build an
+	// excerpt, whitespace being collapsed in the excerpt.
+	maxBodyExcerptReadLength = 4 * maxBodyExcerptLength
+	maxDependencies          = 32
+
+	// dependencyAggregationIgnoreOptional computes the health state from the
+	// dependencies which are not optional, aggregationWorstOf from all of them.
+	dependencyAggregationIgnoreOptional = "ignoreOptional"
+)
+
 type ProbeResponse struct {
-	ApplicationHealthState HealthStatus `json:"applicationHealthState"`
-	CustomMetrics          string       `json:"customMetrics,omitempty"`
+	ApplicationHealthState HealthStatus           `json:"applicationHealthState"`
+	CustomMetrics          string                 `json:"customMetrics,omitempty"`
+	Description            string                 `json:"description,omitempty"`
+	ReadinessScore         *float64               `json:"readinessScore,omitempty"`
+	Annotations            map[string]interface{} `json:"annotations,omitempty"`
+	Dependencies           []ProbeDependency      `json:"dependencies,omitempty"`
+
+	// ProbeDetails is filled in by the probe, it is not part of the response body.
+	ProbeDetails ProbeDetails `json:"-"`
+}
+
+// ProbeDetails describes how a probe was carried out, as opposed to what the
+// application responded. It is reported in its own substatus.
+type ProbeDetails struct {
+	Protocol  string       `json:"protocol,omitempty"`
+	UnitState string       `json:"unitState,omitempty"`
+	Failure   probeFailure `json:"failure,omitempty"`
+	// Target is the address of the target which produced the response, when
+	// a fallback target is configured.
+	Target string `json:"target,omitempty"`
+	// Simulated reports that the state was scripted by a simulation file
+	// rather than probed.
+	Simulated bool `json:"simulated,omitempty"`
+
+	// StatusLine and BodyExcerpt describe the http request of a probe which
+	// didn't find the application healthy. Timing is the time spent in the
+	// phases of the request of any http probe.
+	StatusLine  string         `json:"statusLine,omitempty"`
+	BodyExcerpt string         `json:"bodyExcerpt,omitempty"`
+	Timing      *requestTiming `json:"timing,omitempty"`
+	// StatusCode is the status code of the http response, counted by class
+	// in the probe metrics.
+	StatusCode int `json:"-"`
+
+	// Certificate describes the certificate of an https endpoint, it is
+	// reported in its own substatus.
+	Certificate *certificateExpiry `json:"-"`
+}
+
+// certificateExpiry is the expiry of the certificate of an https endpoint.
+type certificateExpiry struct {
+	NotAfter      string `json:"notAfter"`
+	ExpiresInDays int    `json:"expiresInDays"`
+
+	// expiringSoon reports that the certificate expires within the warning
+	// window of the settings.
+	expiringSoon bool
+}
+
+func newCertificateExpiry(notAfter, now time.Time, warningWindow time.Duration) *certificateExpiry {
+	remaining := notAfter.Sub(now)
+	return &certificateExpiry{
+		NotAfter:      notAfter.UTC().Format(time.RFC3339),
+		ExpiresInDays: int(math.Floor(remaining.Hours() / 24)),
+		expiringSoon:  warningWindow > 0 && remaining < warningWindow,
+	}
+}
+
+// substatus returns the substatus reporting the certificate expiry, a warning
+// when the certificate expires soon.
+func (c certificateExpiry) substatus() (SubstatusItem, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return SubstatusItem{}, err
+	}
+	statusType := StatusSuccess
+	if c.expiringSoon {
+		statusType = StatusWarning
+	}
+	return NewSubstatus(SubstatusKeyNameCertificate, statusType, string(b)), nil
+}
+
+func (d ProbeDetails) isEmpty() bool {
+	return d == ProbeDetails{}
+}
+
+// ProbeResponseDetails holds the optional details an application can return
+// alongside its health state to explain it. It is forwarded to the platform in
+// the extension substatus.
+type ProbeResponseDetails struct {
+	Description    string            `json:"description,omitempty"`
+	ReadinessScore *float64          `json:"readinessScore,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+}
+
+// ProbeDependency is the check of a dependency of the application, reported in
+// the probe response by applications which don't aggregate their health state.
+type ProbeDependency struct {
+	Name     string       `json:"name"`
+	State    HealthStatus `json:"state"`
+	Detail   string       `json:"detail,omitempty"`
+	Optional bool         `json:"optional,omitempty"`
+}
+
+// parseProbeResponse parses a probe response from r, which is expected to be
+// size limited. Keys unknown to the extension are ignored and the health state
+// is matched case-insensitively. A response without a health state but with
+// dependencies gets the state computed from them with dependencyAggregation.
+// Parsing and validation errors include an excerpt of the body so that the
+// endpoint can be fixed from the status alone.
+func parseProbeResponse(r io.Reader, dependencyAggregation string) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return probeResponse, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return probeResponse, errEmptyResponseBody
+	}
+
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&probeResponse); err != nil {
+		return probeResponse, withBodyExcerpt(errors.Wrap(err, "Response body is not a valid json object"), b)
+	}
+	probeResponse.ApplicationHealthState = normalizeHealthStatus(probeResponse.ApplicationHealthState)
+	probeResponse.normalizeDependencies()
+	if probeResponse.ApplicationHealthState == "" && len(probeResponse.Dependencies) > 0 {
+		// a dependency without a valid state makes the application Unknown,
+		// which the dependency substatuses explain
+		probeResponse.ApplicationHealthState = probeResponse.dependenciesState(dependencyAggregation)
+		return probeResponse, nil
+	}
+	if err := probeResponse.validateApplicationHealthState(); err != nil {
+		return probeResponse, withBodyExcerpt(err, b)
+	}
+	return probeResponse, nil
+}
+
+// normalizeDependencies keeps the first maxDependencies dependencies, names
+// the unnamed ones after their position and makes the states which are
+// neither Healthy nor Unhealthy Unknown.
+func (p *ProbeResponse) normalizeDependencies() {
+	if len(p.Dependencies) > maxDependencies {
+		p.Dependencies = p.Dependencies[:maxDependencies]
+	}
+	for i := range p.Dependencies {
+		d := &p.Dependencies[i]
+		if d.Name = truncate(strings.TrimSpace(d.Name), maxAnnotationKeyLength); d.Name == "" {
+			d.Name = strconv.Itoa(i + 1)
+		}
+		if d.State = normalizeHealthStatus(d.State); !allowedHealthStatuses[d.State] {
+			d.State = Unknown
+		}
+		d.Detail = truncate(d.Detail, maxDescriptionLength)
+	}
+}
+
+// substatus reports the state of the dependency, followed by its detail.
+func (d ProbeDependency) substatus() SubstatusItem {
+	message := string(d.State)
+	if d.Detail != "" {
+		message += ": " + d.Detail
+	}
+	return NewSubstatus(fmt.Sprintf("%s/%s", SubstatusKeyNameDependency, d.Name), d.State.GetStatusTypeForAppHealthStatus(), message)
+}
+
+// dependenciesState returns the worst state of the dependencies considered by
+// the aggregation, Healthy when none is.
+func (p ProbeResponse) dependenciesState(aggregation string) HealthStatus {
+	worst := Healthy
+	for _, d := range p.Dependencies {
+		if d.Optional && aggregation == dependencyAggregationIgnoreOptional {
+			continue
+		}
+		if healthStatusSeverity[d.State] > healthStatusSeverity[worst] {
+			worst = d.State
+		}
+	}
+	return worst
+}
+
+// normalizeHealthStatus returns the allowed health status matching s
+// case-insensitively and ignoring surrounding whitespace, or s unchanged.
+func normalizeHealthStatus(s HealthStatus) HealthStatus {
+	trimmed := strings.TrimSpace(string(s))
+	for status := range allowedHealthStatuses {
+		if strings.EqualFold(trimmed, string(status)) {
+			return status
+		}
+	}
+	return s
+}
+
+// withBodyExcerpt appends an excerpt of the response body to err.
+func withBodyExcerpt(err error, body []byte) error {
+	return errors.New(fmt.Sprintf("%v (response body: '%s')", err, bodyExcerpt(body)))
+}
+
+// bodyExcerpt returns a printable excerpt of the response body. Whitespace is
+// collapsed and invalid or non-printable characters are replaced.
+func bodyExcerpt(body []byte) string {
+	printable := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		} else if !unicode.IsPrint(r) {
+			return '?'
+		}
+		return r
+	}, strings.ToValidUTF8(string(body), "?"))
+	return truncate(strings.Join(strings.Fields(printable), " "), maxBodyExcerptLength)
+}
+
+// excerptWriter keeps the start of what is written to it, up to
+// maxBodyExcerptReadLength bytes.
+type excerptWriter struct {
+	b []byte
+}
+
+func (w *excerptWriter) Write(p []byte) (int, error) {
+	if n := maxBodyExcerptReadLength - len(w.b); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.b = append(w.b, p[:n]...)
+	}
+	return len(p), nil
+}
+
+func (w *excerptWriter) excerpt() string {
+	return bodyExcerpt(w.b)
 }
 
 func (p ProbeResponse) validateApplicationHealthState() error {
@@ -37,3 +284,76 @@ func (p ProbeResponse) validateCustomMetrics() error {
 	}
 	return nil
 }
+
+func (p ProbeResponse) hasDetails() bool {
+	return p.Description != "" || p.ReadinessScore != nil || len(p.Annotations) > 0
+}
+
+// details returns the validated and truncated details of the probe response.
+// Invalid values are dropped from the result and reported in the returned error,
+// the remaining details are still returned.
+func (p ProbeResponse) details() (ProbeResponseDetails, error) {
+	var (
+		d    ProbeResponseDetails
+		errs []string
+	)
+
+	d.Description = truncate(p.Description, maxDescriptionLength)
+
+	if p.ReadinessScore != nil {
+		if *p.ReadinessScore < minReadinessScore || *p.ReadinessScore > maxReadinessScore {
+			errs = append(errs, fmt.Sprintf("Response body key '%s' value must be between %d and %d: '%v'", ProbeResponseKeyNameReadinessScore, minReadinessScore, maxReadinessScore, *p.ReadinessScore))
+		} else {
+			score := *p.ReadinessScore
+			d.ReadinessScore = &score
+		}
+	}
+
+	if len(p.Annotations) > 0 {
+		keys := make([]string, 0, len(p.Annotations))
+		for k := range p.Annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if len(keys) > maxAnnotations {
+			errs = append(errs, fmt.Sprintf("Response body key '%s' has %d entries, only the first %d are reported", ProbeResponseKeyNameAnnotations, len(keys), maxAnnotations))
+			keys = keys[:maxAnnotations]
+		}
+
+		d.Annotations = make(map[string]string, len(keys))
+		for _, k := range keys {
+			var value string
+			switch v := p.Annotations[k].(type) {
+			case string:
+				value = v
+			case float64, bool:
+				value = fmt.Sprint(v)
+			default:
+				errs = append(errs, fmt.Sprintf("Response body key '%s' entry '%s' must be a string, number or boolean", ProbeResponseKeyNameAnnotations, k))
+				continue
+			}
+			d.Annotations[truncate(k, maxAnnotationKeyLength)] = truncate(value, maxAnnotationValueLength)
+		}
+		if len(d.Annotations) == 0 {
+			d.Annotations = nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return d, errors.New(strings.Join(errs, "; "))
+	}
+	return d, nil
+}
+
+// truncate shortens s to at most max bytes, marking it with a trailing
+// ellipsis when it was cut. Multi-byte characters are never split.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	cut := max - len(truncatedSuffix)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + truncatedSuffix
+}
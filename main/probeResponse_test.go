@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeResponse_details(t *testing.T) {
+	var p ProbeResponse
+	require.False(t, p.hasDetails())
+
+	err := json.Unmarshal([]byte(`{
+		"ApplicationHealthState": "Unhealthy",
+		"Description": "database connection pool exhausted",
+		"ReadinessScore": 42.5,
+		"Annotations": {"region": "westus", "pool": 10, "degraded": true}
+	}`), &p)
+	require.Nil(t, err)
+	require.True(t, p.hasDetails())
+
+	d, err := p.details()
+	require.Nil(t, err)
+	require.Equal(t, "database connection pool exhausted", d.Description)
+	require.Equal(t, 42.5, *d.ReadinessScore)
+	require.Equal(t, map[string]string{"region": "westus", "pool": "10", "degraded": "true"}, d.Annotations)
+}
+
+func TestProbeResponse_details_invalidValuesDropped(t *testing.T) {
+	var p ProbeResponse
+	err := json.Unmarshal([]byte(`{
+		"ApplicationHealthState": "Healthy",
+		"ReadinessScore": 101,
+		"Annotations": {"nested": {"a": 1}, "ok": "yes"}
+	}`), &p)
+	require.Nil(t, err)
+
+	d, err := p.details()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "'ReadinessScore' value must be between 0 and 100")
+	require.Contains(t, err.Error(), "'Annotations' entry 'nested' must be a string, number or boolean")
+	require.Nil(t, d.ReadinessScore)
+	require.Equal(t, map[string]string{"ok": "yes"}, d.Annotations)
+}
+
+func TestProbeResponse_details_truncated(t *testing.T) {
+	p := ProbeResponse{
+		Description: strings.Repeat("a", maxDescriptionLength+1),
+		Annotations: map[string]interface{}{},
+	}
+	for i := 0; i < maxAnnotations+1; i++ {
+		p.Annotations[strings.Repeat("k", i+1)] = strings.Repeat("v", maxAnnotationValueLength+1)
+	}
+
+	d, err := p.details()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "only the first 16 are reported")
+	require.Len(t, d.Description, maxDescriptionLength)
+	require.True(t, strings.HasSuffix(d.Description, truncatedSuffix))
+	require.Len(t, d.Annotations, maxAnnotations)
+	for _, v := range d.Annotations {
+		require.Len(t, v, maxAnnotationValueLength)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	require.Equal(t, "abc", truncate("abc", 3))
+	require.Equal(t, "a...", truncate("abcde", 4))
+	// multi-byte characters are not split
+	require.Equal(t, "...", truncate("ééé", 4))
+	require.Equal(t, "é...", truncate("ééé", 5))
+}
+
+func TestParseProbeResponse(t *testing.T) {
+	for _, body := range []string{
+		`{"ApplicationHealthState": "Healthy"}`,
+		`{"applicationHealthState": "healthy"}`,
+		`{"APPLICATIONHEALTHSTATE": " HEALTHY "}`,
+		`{"ApplicationHealthState": "Healthy", "version": "1.2.3", "checks": [{"db": "ok"}]}`,
+	} {
+		p, err := parseProbeResponse(strings.NewReader(body), dependencyAggregationIgnoreOptional)
+		require.Nil(t, err, body)
+		require.Equal(t, Healthy, p.ApplicationHealthState, body)
+	}
+
+	p, err := parseProbeResponse(strings.NewReader(`{"ApplicationHealthState": "unHealthy"}`), dependencyAggregationIgnoreOptional)
+	require.Nil(t, err)
+	require.Equal(t, Unhealthy, p.ApplicationHealthState)
+}
+
+func TestParseProbeResponse_dependencies(t *testing.T) {
+	body := `{"dependencies": [
+		{"name": "db", "state": "healthy"},
+		{"name": "cache", "state": "Unhealthy", "detail": "connection refused", "optional": true},
+		{"state": "degraded", "optional": true}
+	]}`
+	p, err := parseProbeResponse(strings.NewReader(body), dependencyAggregationIgnoreOptional)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, p.ApplicationHealthState)
+	require.Equal(t, []ProbeDependency{
+		{Name: "db", State: Healthy},
+		{Name: "cache", State: Unhealthy, Detail: "connection refused", Optional: true},
+		{Name: "3", State: Unknown, Optional: true},
+	}, p.Dependencies)
+
+	p, err = parseProbeResponse(strings.NewReader(body), aggregationWorstOf)
+	require.Nil(t, err)
+	require.Equal(t, Unhealthy, p.ApplicationHealthState)
+
+	p, err = parseProbeResponse(strings.NewReader(`{"dependencies": [{"name": "db", "state": "Healthy"}, {"name": "queue", "state": "Unknown"}]}`), dependencyAggregationIgnoreOptional)
+	require.Nil(t, err)
+	require.Equal(t, Unknown, p.ApplicationHealthState)
+
+	// the aggregated state of the application takes precedence
+	p, err = parseProbeResponse(strings.NewReader(`{"ApplicationHealthState": "Healthy", "dependencies": [{"name": "db", "state": "Unhealthy"}]}`), aggregationWorstOf)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, p.ApplicationHealthState)
+
+	// only optional dependencies
+	p, err = parseProbeResponse(strings.NewReader(`{"dependencies": [{"name": "cache", "state": "Unhealthy", "optional": true}]}`), dependencyAggregationIgnoreOptional)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, p.ApplicationHealthState)
+}
+
+func TestProbeDependencySubstatus(t *testing.T) {
+	s := ProbeDependency{Name: "cache", State: Unhealthy, Detail: "connection refused"}.substatus()
+	require.Equal(t, "Dependency/cache", s.Name)
+	require.Equal(t, StatusError, s.Status)
+	require.Equal(t, "Unhealthy: connection refused", s.FormattedMessage.Message)
+
+	s = ProbeDependency{Name: "db", State: Healthy}.substatus()
+	require.Equal(t, StatusSuccess, s.Status)
+	require.Equal(t, "Healthy", s.FormattedMessage.Message)
+}
+
+func TestCertificateExpiry(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// reported only
+	c := newCertificateExpiry(now.Add(10*24*time.Hour+time.Hour), now, 0)
+	require.Equal(t, 10, c.ExpiresInDays)
+	s, err := c.substatus()
+	require.Nil(t, err)
+	require.Equal(t, SubstatusKeyNameCertificate, s.Name)
+	require.Equal(t, StatusSuccess, s.Status)
+	require.Equal(t, `{"notAfter":"2024-03-11T13:00:00Z","expiresInDays":10}`, s.FormattedMessage.Message)
+
+	// outside and within the warning window
+	c = newCertificateExpiry(now.Add(10*24*time.Hour+time.Hour), now, 7*24*time.Hour)
+	s, _ = c.substatus()
+	require.Equal(t, StatusSuccess, s.Status)
+
+	c = newCertificateExpiry(now.Add(6*24*time.Hour), now, 7*24*time.Hour)
+	require.Equal(t, 6, c.ExpiresInDays)
+	s, _ = c.substatus()
+	require.Equal(t, StatusWarning, s.Status)
+
+	// expired
+	c = newCertificateExpiry(now.Add(-time.Hour), now, 7*24*time.Hour)
+	require.Equal(t, -1, c.ExpiresInDays)
+	s, _ = c.substatus()
+	require.Equal(t, StatusWarning, s.Status)
+}
+
+func TestParseProbeResponse_errors(t *testing.T) {
+	_, err := parseProbeResponse(strings.NewReader(" \n"), dependencyAggregationIgnoreOptional)
+	require.Equal(t, errEmptyResponseBody, err)
+
+	_, err = parseProbeResponse(strings.NewReader(`{"ApplicationHealthState": "Degraded",
+		"Description": "cache warming"}`), dependencyAggregationIgnoreOptional)
+	require.NotNil(t, err)
+	require.Equal(t, `Response body key 'ApplicationHealthState' has invalid value 'Degraded' (response body: '{"ApplicationHealthState": "Degraded", "Description": "cache warming"}')`, err.Error())
+
+	_, err = parseProbeResponse(strings.NewReader(`ApplicationHealthState=Healthy`), dependencyAggregationIgnoreOptional)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Response body is not a valid json object")
+	require.Contains(t, err.Error(), "(response body: 'ApplicationHealthState=Healthy')")
+
+	// long and binary bodies are truncated and made printable
+	_, err = parseProbeResponse(strings.NewReader("\x1f\x8b\x08"+strings.Repeat("x", 2*maxBodyExcerptLength)), dependencyAggregationIgnoreOptional)
+	require.NotNil(t, err)
+	excerpt := err.Error()[strings.Index(err.Error(), "(response body: '")+len("(response body: '") : len(err.Error())-2]
+	require.Len(t, excerpt, maxBodyExcerptLength)
+	require.True(t, strings.HasPrefix(excerpt, "???x"))
+	require.True(t, strings.HasSuffix(excerpt, truncatedSuffix))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// clockTicksPerSecond is USER_HZ, the unit of process start times in
+// /proc/<pid>/stat. It is 100 on all architectures Linux supports today.
+const clockTicksPerSecond = 100
+
+// ProcessHealthProbe considers the application healthy while a process,
+// identified by a pidfile or by its executable name, is running. A process
+// that has been running for less than MinimumUptime is Initializing.
+type ProcessHealthProbe struct {
+	PidFile       string
+	ProcessName   string
+	MinimumUptime time.Duration
+
+	// ProcRoot is where the proc filesystem is mounted, replaced in tests.
+	ProcRoot string
+}
+
+func NewProcessHealthProbe(pidFile, processName string, minimumUptime time.Duration) *ProcessHealthProbe {
+	return &ProcessHealthProbe{
+		PidFile:       pidFile,
+		ProcessName:   processName,
+		MinimumUptime: minimumUptime,
+		ProcRoot:      "/proc",
+	}
+}
+
+func (p *ProcessHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unhealthy
+
+	var (
+		pid int
+		err error
+	)
+	if p.PidFile != "" {
+		pid, err = p.pidFromFile()
+	} else {
+		pid, err = p.pidFromName()
+	}
+	if err != nil {
+		return probeResponse, err
+	}
+
+	if p.MinimumUptime > 0 {
+		uptime, err := p.processUptime(pid)
+		if err != nil {
+			return probeResponse, err
+		}
+		if uptime < p.MinimumUptime {
+			probeResponse.ApplicationHealthState = Initializing
+			return probeResponse, nil
+		}
+	}
+
+	probeResponse.ApplicationHealthState = Healthy
+	return probeResponse, nil
+}
+
+func (p *ProcessHealthProbe) address() string {
+	if p.PidFile != "" {
+		return p.PidFile
+	}
+	return p.ProcessName
+}
+
+func (p *ProcessHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
+
+// pidFromFile reads the pid from the pidfile and checks the process exists.
+func (p *ProcessHealthProbe) pidFromFile() (int, error) {
+	b, err := ioutil.ReadFile(p.PidFile)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read pid file")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, errors.New(fmt.Sprintf("Pid file '%s' does not contain a valid pid", p.PidFile))
+	}
+	if _, err := os.Stat(filepath.Join(p.ProcRoot, strconv.Itoa(pid))); err != nil {
+		return 0, errors.New(fmt.Sprintf("Process %d from pid file '%s' is not running", pid, p.PidFile))
+	}
+	return pid, nil
+}
+
+// pidFromName scans the proc filesystem for a process whose name matches
+// ProcessName. The oldest matching process is returned so that short-lived
+// children don't hide the main process. It is the first started, rather than
+// the lowest pid, as pids wrap around.
+func (p *ProcessHealthProbe) pidFromName() (int, error) {
+	pids, err := pidsByName(p.ProcRoot, p.ProcessName)
+	if err != nil {
+		return 0, err
+	}
+
+	found, foundStart := 0, uint64(0)
+	for _, pid := range pids {
+		start, err := p.processStartTicks(pid)
+		if err != nil {
+			// the process exited since it was listed
+			continue
+		}
+		if found == 0 || start < foundStart || (start == foundStart && pid < found) {
+			found, foundStart = pid, start
+		}
+	}
+	if found == 0 {
+		return 0, errors.New(fmt.Sprintf("No process named '%s' is running", p.ProcessName))
+	}
+	return found, nil
+}
+
+// pidsByName returns all the processes of the proc filesystem mounted at
+// procRoot whose name (comm) or executable base name matches processName.
+func pidsByName(procRoot, processName string) ([]int, error) {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list processes")
+	}
+
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		if processNameMatches(procRoot, pid, processName) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+func processNameMatches(procRoot string, pid int, processName string) bool {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	if comm, err := ioutil.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		if strings.TrimSpace(string(comm)) == processName {
+			return true
+		}
+	}
+	// comm is truncated to 15 characters, also look at the executable path and
+	// argv[0] for longer names
+	if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		if filepath.Base(strings.TrimSuffix(exe, " (deleted)")) == processName {
+			return true
+		}
+	}
+	if cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+		if argv0 != "" && filepath.Base(argv0) == processName {
+			return true
+		}
+	}
+	return false
+}
+
+// processUptime returns how long ago the process was started, using its start
+// time in clock ticks after boot and the system uptime.
+func (p *ProcessHealthProbe) processUptime(pid int) (time.Duration, error) {
+	startTicks, err := p.processStartTicks(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	uptimeContent, err := ioutil.ReadFile(filepath.Join(p.ProcRoot, "uptime"))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read system uptime")
+	}
+	uptimeFields := strings.Fields(string(uptimeContent))
+	if len(uptimeFields) == 0 {
+		return 0, errors.New("Unexpected system uptime format")
+	}
+	systemUptime, err := strconv.ParseFloat(uptimeFields[0], 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse system uptime")
+	}
+
+	started := float64(startTicks) / clockTicksPerSecond
+	return time.Duration((systemUptime - started) * float64(time.Second)), nil
+}
+
+// processStartTicks returns the start time of the process, in clock ticks
+// after boot.
+func (p *ProcessHealthProbe) processStartTicks(pid int) (uint64, error) {
+	stat, err := ioutil.ReadFile(filepath.Join(p.ProcRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read process stat")
+	}
+	// the process name (2nd field) may contain spaces and parentheses, so
+	// fields are counted from the last closing parenthesis
+	i := strings.LastIndex(string(stat), ")")
+	if i < 0 {
+		return 0, errors.New("Unexpected process stat format")
+	}
+	fields := strings.Fields(string(stat)[i+1:])
+	// starttime is field 22 overall, i.e. field 20 after the name
+	if len(fields) < 20 {
+		return 0, errors.New("Unexpected process stat format")
+	}
+	startTicks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse process start time")
+	}
+	return startTicks, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProc creates a proc filesystem with the given processes (pid -> comm)
+// started at startTicks clock ticks after boot, with the system up for
+// uptime seconds.
+func fakeProc(t *testing.T, processes map[int]string, startTicks int, uptime string) string {
+	root, err := ioutil.TempDir("", "proc")
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "uptime"), []byte(uptime+" 1000.00\n"), 0644))
+	for pid, comm := range processes {
+		dir := filepath.Join(root, strconv.Itoa(pid))
+		require.Nil(t, os.Mkdir(dir, 0755))
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0644))
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte("/usr/sbin/"+comm+"\x00--flag\x00"), 0644))
+		writeProcStat(t, root, pid, comm, startTicks)
+	}
+	return root
+}
+
+// writeProcStat writes the stat file of a process started at startTicks clock
+// ticks after boot.
+func writeProcStat(t *testing.T, root string, pid int, comm string, startTicks int) {
+	stat := strconv.Itoa(pid) + " (" + comm + " (x)) S 1 1 1 0 -1 4194560 100 0 0 0 0 0 0 0 20 0 1 0 " + strconv.Itoa(startTicks) + " 1000 100"
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, strconv.Itoa(pid), "stat"), []byte(stat), 0644))
+}
+
+func TestProcessHealthProbe_processName(t *testing.T) {
+	root := fakeProc(t, map[int]string{42: "nginx", 43: "sshd"}, 1000, "100.00")
+	defer os.RemoveAll(root)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewProcessHealthProbe("", "nginx", 0)
+	probe.ProcRoot = root
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// started 10s after boot, up for 90s
+	probe.MinimumUptime = 90 * time.Second
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	probe.MinimumUptime = 91 * time.Second
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Initializing, probeResponse.ApplicationHealthState)
+
+	probe = NewProcessHealthProbe("", "httpd", 0)
+	probe.ProcRoot = root
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, "No process named 'httpd' is running", err.Error())
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
+
+func TestProcessHealthProbe_oldestProcess(t *testing.T) {
+	root := fakeProc(t, map[int]string{42: "nginx", 32000: "nginx", 32001: "nginx"}, 1000, "100.00")
+	defer os.RemoveAll(root)
+
+	probe := NewProcessHealthProbe("", "nginx", 0)
+	probe.ProcRoot = root
+	pid, err := probe.pidFromName()
+	require.Nil(t, err)
+	require.Equal(t, 42, pid)
+
+	// once pids wrapped around, the main process has a higher pid than its
+	// children
+	writeProcStat(t, root, 32000, "nginx", 500)
+	writeProcStat(t, root, 42, "nginx", 9000)
+	pid, err = probe.pidFromName()
+	require.Nil(t, err)
+	require.Equal(t, 32000, pid)
+
+	// processes exiting while scanned are skipped
+	require.Nil(t, os.Remove(filepath.Join(root, "32000", "stat")))
+	pid, err = probe.pidFromName()
+	require.Nil(t, err)
+	require.Equal(t, 32001, pid)
+}
+
+func TestProcessHealthProbe_pidFile(t *testing.T) {
+	root := fakeProc(t, map[int]string{42: "nginx"}, 1000, "100.00")
+	defer os.RemoveAll(root)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	pidFile := filepath.Join(root, "nginx.pid")
+	probe := NewProcessHealthProbe(pidFile, "", 0)
+	probe.ProcRoot = root
+
+	// missing pid file
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	require.Nil(t, ioutil.WriteFile(pidFile, []byte("42\n"), 0644))
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// stale pid file
+	require.Nil(t, ioutil.WriteFile(pidFile, []byte("44\n"), 0644))
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "is not running")
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	// garbage
+	require.Nil(t, ioutil.WriteFile(pidFile, []byte("nginx\n"), 0644))
+	_, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not contain a valid pid")
+}
+
+func TestProcessHealthProbe_self(t *testing.T) {
+	pidFile, err := ioutil.TempFile("", "pid")
+	require.Nil(t, err)
+	defer os.Remove(pidFile.Name())
+	pidFile.WriteString(strconv.Itoa(os.Getpid()))
+	pidFile.Close()
+
+	probe := NewProcessHealthProbe(pidFile.Name(), "", time.Nanosecond)
+	probeResponse, err := probe.evaluate(log.NewContext(log.NewNopLogger()))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyConnectError is the refusal of the proxy to open a tunnel to the
+// endpoint, classified as a 'proxy' failure rather than the endpoint failing.
+type proxyConnectError struct {
+	proxy  string
+	status string
+}
+
+func (e *proxyConnectError) Error() string {
+	return fmt.Sprintf("proxy %s refused to connect: %s", e.proxy, e.status)
+}
+
+// connectProxyDialer opens the connections of http/https probes through a
+// tunnel of an HTTP proxy, established with CONNECT for both protocols, so
+// that endpoints such as the admin API of a sidecar can be reached through a
+// local proxy. The proxy of the settings is used instead of the proxy
+// environment variables of the extension process.
+type connectProxyDialer struct {
+	proxy *url.URL
+	// authorization is the value of the Proxy-Authorization header, if any.
+	authorization string
+	dialer        net.Dialer
+}
+
+func newConnectProxyDialer(proxy *url.URL, username, password string) *connectProxyDialer {
+	d := &connectProxyDialer{proxy: proxy}
+	if username != "" {
+		d.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	return d
+}
+
+// DialContext connects to the proxy and opens a tunnel to addr.
+func (d *connectProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, d.proxy.Host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to proxy %s", d.proxy.Host)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tunnel, err := d.connect(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// connect sends the CONNECT request of addr over the connection to the proxy.
+func (d *connectProxyDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.authorization != "" {
+		req.Header.Set("Proxy-Authorization", d.authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, errors.Wrapf(err, "failed to send CONNECT to proxy %s", d.proxy.Host)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CONNECT response of proxy %s", d.proxy.Host)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &proxyConnectError{proxy: d.proxy.Host, status: resp.Status}
+	}
+	if br.Buffered() > 0 {
+		// the endpoint spoke first, keep what was read past the response
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection part of whose input was already buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// startConnectProxy starts a proxy tunneling the CONNECT requests with the
+// authorization to their address, returning its URL and the addresses it
+// tunneled to.
+func startConnectProxy(t *testing.T, authorization string) (string, <-chan string) {
+	tunneled := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != authorization {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		tunneled <- r.Host
+		conn, rw, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(target, rw)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy.URL, tunneled
+}
+
+func TestNewHealthProbe_Proxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	}))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(server.Config.Handler)
+	defer tlsServer.Close()
+	proxyURL, tunneled := startConnectProxy(t, "Basic dXNlcjpwYXNzd29yZA==")
+	ctx := log.NewContext(log.NewNopLogger())
+
+	for _, target := range []*httptest.Server{server, tlsServer} {
+		u, _ := url.Parse(target.URL)
+		probe := NewHealthProbe(ctx, &handlerSettings{
+			publicSettings{Protocol: u.Scheme, RequestPath: "/health", ProxyUrl: proxyURL},
+			protectedSettings{ProxyUsername: "user", ProxyPassword: newSecretRef("password")},
+		}, 0).(*HttpHealthProbe)
+		probe.Address = target.URL + "/health"
+		probeResponse, err := probe.evaluate(ctx)
+		require.Nil(t, err, u.Scheme)
+		require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+		require.Equal(t, u.Host, <-tunneled)
+	}
+}
+
+func TestNewHealthProbe_ProxyRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	}))
+	defer server.Close()
+	proxyURL, _ := startConnectProxy(t, "Basic dXNlcjpwYXNzd29yZA==")
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// without the credentials of the proxy
+	probe := NewHealthProbe(ctx, &handlerSettings{publicSettings: publicSettings{Protocol: "http", RequestPath: "/health", ProxyUrl: proxyURL}}, 0).(*HttpHealthProbe)
+	probe.Address = server.URL + "/health"
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "407 Proxy Authentication Required")
+	require.Equal(t, probeFailureProxy, probeResponse.ProbeDetails.Failure)
+}
+
+func TestConnectProxyDialer_buffered(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		// the endpoint speaks first, in the same segment as the response
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-test\r\n"))
+	}()
+
+	d := newConnectProxyDialer(&url.URL{Scheme: "http", Host: l.Addr().String()}, "", "")
+	conn, err := d.DialContext(context.Background(), "tcp", "localhost:22")
+	require.Nil(t, err)
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.Nil(t, err)
+	require.Equal(t, "SSH-2.0-test\r\n", line)
+}
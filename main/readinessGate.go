@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// readinessGate writes a marker file once the application is first committed
+// Healthy, that is once the grace period ended with successful probes, and
+// removes it when the application is committed Unhealthy, so that cloud-init
+// scripts and deployment tools of the VM can wait for the application to be
+// ready by waiting for the file. The other states, such as Unknown during a
+// probe outage, leave the marker as it is.
+type readinessGate struct {
+	path string
+
+	// ready is whether the marker was written.
+	ready bool
+}
+
+// newReadinessGate returns the gate of the configured readiness file, or nil
+// when there is none. A marker left by a previous run of the extension is
+// removed, the application being ready again only once probed Healthy.
+func newReadinessGate(ctx *log.Context, cfg *handlerSettings) *readinessGate {
+	if cfg.readinessFilePath() == "" {
+		return nil
+	}
+	g := &readinessGate{path: cfg.readinessFilePath()}
+	if err := g.remove(); err != nil {
+		ctx.Log("error", err)
+	}
+	return g
+}
+
+// subscribe updates the marker with the committed state of the probe cycles
+// published on the bus.
+func (g *readinessGate) subscribe(bus *eventBus) {
+	bus.subscribe(busEventProbeCycle, func(ctx *log.Context, e busEvent) {
+		if err := g.observe(ctx, e.CommittedState, e.End); err != nil {
+			ctx.Log("error", err)
+		}
+	})
+}
+
+// observe writes or removes the marker for the committed state of the probe
+// cycle which ended at now. A failed write is retried on the next cycle.
+func (g *readinessGate) observe(ctx *log.Context, state HealthStatus, now time.Time) error {
+	switch {
+	case state == Healthy && !g.ready:
+		if err := g.write(now); err != nil {
+			return err
+		}
+		g.ready = true
+		ctx.Log("event", "readiness file written", "path", g.path)
+	case state == Unhealthy && g.ready:
+		if err := g.remove(); err != nil {
+			return err
+		}
+		g.ready = false
+		ctx.Log("event", "readiness file removed", "path", g.path)
+	}
+	return nil
+}
+
+// write writes the marker, holding the time the application became ready.
+func (g *readinessGate) write(now time.Time) error {
+	dir := filepath.Dir(g.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create readiness file folder")
+	}
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(g.path))
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	tmpFile.Close()
+	err = ioutil.WriteFile(tmpFile.Name(), []byte(now.UTC().Format(time.RFC3339)+"\n"), 0644)
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "failed to write readiness file")
+	}
+	if err := os.Rename(tmpFile.Name(), g.path); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "failed to move readiness file")
+	}
+	return nil
+}
+
+func (g *readinessGate) remove() error {
+	if err := os.Remove(g.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove readiness file")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadinessGate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "apphealth", "ready")
+	ctx := log.NewContext(log.NewNopLogger())
+	cfg := observabilityConfig(observabilitySettings{ReadinessFilePath: path})
+
+	// a marker of a previous run is removed
+	require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.Nil(t, ioutil.WriteFile(path, nil, 0644))
+	g := newReadinessGate(ctx, cfg)
+	require.False(t, fileExists(path))
+
+	ready := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.Nil(t, g.observe(ctx, Initializing, ready.Add(-time.Minute)))
+	require.False(t, fileExists(path))
+	require.Nil(t, g.observe(ctx, Healthy, ready))
+	require.Nil(t, g.observe(ctx, Healthy, ready.Add(time.Minute)))
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "2024-01-02T03:04:05Z\n", string(b))
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// an outage of the probe leaves the marker
+	require.Nil(t, g.observe(ctx, Unknown, ready.Add(2*time.Minute)))
+	require.True(t, fileExists(path))
+
+	require.Nil(t, g.observe(ctx, Unhealthy, ready.Add(3*time.Minute)))
+	require.False(t, fileExists(path))
+	require.Nil(t, g.observe(ctx, Healthy, ready.Add(4*time.Minute)))
+	b, err = ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "2024-01-02T03:08:05Z\n", string(b))
+
+	require.Nil(t, newReadinessGate(ctx, &handlerSettings{}))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
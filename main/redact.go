@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+)
+
+// redactedValue replaces secrets in logs, status messages and output.
+const redactedValue = "<redacted>"
+
+// minSecretLength is the length under which values are not considered secrets,
+// to avoid masking common short strings.
+const minSecretLength = 4
+
+var (
+	// secretKeyRegexp matches the names of logged values and settings which
+	// hold secrets.
+	secretKeyRegexp = regexp.MustCompile(`(?i)(password|passwd|secret|token|apikey|api_key|sharedkey|instrumentationkey|authorization|credential)`)
+
+	// secretAssignmentRegexp matches secret-like keys assigned a value inside
+	// a message, such as `Authorization: Bearer abc` or `token=abc`.
+	secretAssignmentRegexp = regexp.MustCompile(`(?i)((?:password|passwd|secret|token|apikey|api_key|sharedkey|authorization|credential)[a-z_-]*["']?\s*[:=]\s*["']?)((?:bearer |basic )?[^\s"',;&]+)`)
+)
+
+// secrets is the redactor of the extension logs and status, the values of the
+// protected settings are added to it once the settings are read.
+var secrets = &redactor{}
+
+// redactor masks secrets: known secret values, values following secret-like
+// keys in messages and logged values whose key is secret-like.
+type redactor struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// add registers secret values to mask.
+func (r *redactor) add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		if len(v) >= minSecretLength {
+			r.values = append(r.values, v)
+		}
+	}
+}
+
+// redact returns s with the secrets it contains masked.
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	for _, v := range r.values {
+		s = strings.Replace(s, v, redactedValue, -1)
+	}
+	r.mu.RUnlock()
+	return secretAssignmentRegexp.ReplaceAllString(s, "${1}"+redactedValue)
+}
+
+// secretValues returns the string values of the protected settings, which
+// are all considered secrets.
+func secretValues(protJSON interface{}) []string {
+	var values []string
+	switch v := protJSON.(type) {
+	case string:
+		values = append(values, v)
+	case map[string]interface{}:
+		for _, value := range v {
+			values = append(values, secretValues(value)...)
+		}
+	case []interface{}:
+		for _, value := range v {
+			values = append(values, secretValues(value)...)
+		}
+	}
+	return values
+}
+
+// redactStatus masks the secrets in the messages of a status report.
+func (r *redactor) redactStatus(s StatusReport) {
+	for i := range s {
+		status := &s[i].Status
+		status.FormattedMessage.Message = r.redact(status.FormattedMessage.Message)
+		for j := range status.SubstatusList {
+			substatus := &status.SubstatusList[j]
+			substatus.FormattedMessage.Message = r.redact(substatus.FormattedMessage.Message)
+		}
+	}
+}
+
+// redactingLogger masks the secrets in the logged values before passing them
+// to the underlying logger.
+type redactingLogger struct {
+	logger   log.Logger
+	redactor *redactor
+}
+
+func newRedactingLogger(logger log.Logger, r *redactor) log.Logger {
+	return &redactingLogger{logger: logger, redactor: r}
+}
+
+func (l *redactingLogger) Log(keyvals ...interface{}) error {
+	// keyvals may share its backing array with the keyvals of a log.Context
+	kvs := make([]interface{}, len(keyvals))
+	copy(kvs, keyvals)
+	for i := 1; i < len(kvs); i += 2 {
+		if key, ok := kvs[i-1].(string); ok && secretKeyRegexp.MatchString(key) {
+			kvs[i] = redactedValue
+			continue
+		}
+		switch v := kvs[i].(type) {
+		case string:
+			kvs[i] = l.redactor.redact(v)
+		case error, fmt.Stringer:
+			s := fmt.Sprint(v)
+			if redacted := l.redactor.redact(s); redacted != s {
+				kvs[i] = redacted
+			}
+		}
+	}
+	return l.logger.Log(kvs...)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_redactor_redact(t *testing.T) {
+	r := &redactor{}
+	r.add("s3cr3t-key", "abc", "")
+	require.Len(t, r.values, 1)
+
+	require.Equal(t, "key is <redacted>", r.redact("key is s3cr3t-key"))
+	require.Equal(t, "abc is too short", r.redact("abc is too short"))
+	require.Equal(t, "Authorization: <redacted>", r.redact("Authorization: Bearer eyJhbGciOi"))
+	require.Equal(t, `{"token": "<redacted>", "state": "Healthy"}`, r.redact(`{"token": "xyz123", "state": "Healthy"}`))
+	require.Equal(t, "url?token=<redacted>&x=1", r.redact("url?token=xyz123&x=1"))
+	require.Equal(t, "Application found to be healthy", r.redact("Application found to be healthy"))
+}
+
+func Test_secretValues(t *testing.T) {
+	values := secretValues(map[string]interface{}{
+		"logAnalyticsSharedKey": "key",
+		"headers":               []interface{}{"a", map[string]interface{}{"b": "c"}},
+		"port":                  float64(80),
+	})
+	sort.Strings(values)
+	require.Equal(t, []string{"a", "c", "key"}, values)
+	require.Nil(t, secretValues(nil))
+}
+
+func Test_redactor_redactStatus(t *testing.T) {
+	r := &redactor{}
+	r.add("s3cr3t-key")
+	s := NewStatus(StatusError, "Enable", "failed with s3cr3t-key")
+	s.AddSubstatus(StatusError, "ProbeDetails", "password=hunter22")
+	r.redactStatus(s)
+	require.Equal(t, "failed with <redacted>", s[0].Status.FormattedMessage.Message)
+	require.Equal(t, "password=<redacted>", s[0].Status.SubstatusList[0].FormattedMessage.Message)
+}
+
+func Test_redactingLogger(t *testing.T) {
+	r := &redactor{}
+	r.add("s3cr3t-key")
+	var buf bytes.Buffer
+	ctx := log.NewContext(newRedactingLogger(log.NewLogfmtLogger(&buf), r)).With("seq", 1)
+
+	ctx.Log("event", "using s3cr3t-key", "sharedKey", "other", "error", errors.New("bad s3cr3t-key"), "count", 3)
+	require.Equal(t, "seq=1 event=\"using <redacted>\" sharedKey=<redacted> error=\"bad <redacted>\" count=3\n", buf.String())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// redisHandshake authenticates with AUTH when a password is set and expects
+// PING to be answered with PONG. Without a password, a server requiring
+// authentication is considered to accept connections.
+func redisHandshake(conn net.Conn, user, password, database string) error {
+	r := bufio.NewReaderSize(conn, maxDatabaseMessageSize)
+	if password != "" {
+		args := []string{"AUTH", password}
+		if user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		reply, err := redisCommand(conn, r, args...)
+		if err != nil {
+			return err
+		}
+		if reply != "+OK" {
+			return &databaseError{probeFailureBadStatus, "Redis authentication failed: " + strings.TrimPrefix(reply, "-")}
+		}
+	}
+
+	reply, err := redisCommand(conn, r, "PING")
+	if err != nil {
+		return err
+	}
+	switch {
+	case reply == "+PONG":
+		return nil
+	case password == "" && strings.HasPrefix(reply, "-NOAUTH"):
+		return nil
+	case strings.HasPrefix(reply, "-"):
+		return &databaseError{probeFailureBadStatus, "Redis replied with error: " + reply[1:]}
+	default:
+		return &databaseError{probeFailureBadBody, fmt.Sprintf("Unexpected Redis reply to PING '%s'", bodyExcerpt([]byte(reply)))}
+	}
+}
+
+// redisCommand sends a command and returns the first line of the reply, which
+// is a simple string or an error for the commands of the handshake.
+func redisCommand(conn net.Conn, r *bufio.Reader, args ...string) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", &databaseError{probeFailureBadBody, "Redis reply exceeds the maximum allowed size"}
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
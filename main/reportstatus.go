@@ -1,7 +1,9 @@
 package main
 
 import (
-	"github.com/Azure/azure-docker-extension/pkg/vmextension"
+	"encoding/json"
+
+	"github.com/Azure/run-command-extension-linux/pkg/status"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
@@ -11,31 +13,59 @@ import (
 // status.
 //
 // If an error occurs reporting the status, it will be logged and returned.
-func reportStatus(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int, t StatusType, c cmd, msg string) error {
+func reportStatus(ctx *log.Context, paths handlerPaths, seqNum int, t StatusType, c cmd, msg string) error {
 	if !c.shouldReportStatus {
 		ctx.Log("status", "not reported for operation (by design)")
 		return nil
 	}
-	s := NewStatus(t, c.name, statusMsg(c, t, msg))
-	if err := s.Save(hEnv.HandlerEnvironment.StatusFolder, seqNum); err != nil {
-		ctx.Log("event", "failed to save handler status", "error", err)
-		return errors.Wrap(err, "failed to save handler status")
-	}
-	return nil
+	return saveStatus(ctx, paths, seqNum, NewStatus(t, c.name, statusMsg(c, t, msg)))
+}
+
+func reportStatusWithSubstatuses(ctx *log.Context, paths handlerPaths, seqNum int, t StatusType, op string, msg string, substatuses []SubstatusItem) error {
+	return saveStatus(ctx, paths, seqNum, newStatusWithSubstatuses(t, op, msg, substatuses))
+}
+
+func newStatusWithSubstatuses(t StatusType, op string, msg string, substatuses []SubstatusItem) StatusReport {
+	return status.NewBuilder(op).SetStatus(t).WithFormattedMessage(msg).AddSubstatus(substatuses...).Build()
 }
 
-func reportStatusWithSubstatuses(ctx *log.Context, hEnv vmextension.HandlerEnvironment, seqNum int, t StatusType, op string, msg string, substatuses []SubstatusItem) error {
-	s := NewStatus(t, op, msg)
-	for _, substatus := range substatuses {
-		s.AddSubstatusItem(substatus)
+// saveStatus prepares the status and saves it.
+func saveStatus(ctx *log.Context, paths handlerPaths, seqNum int, s StatusReport) error {
+	prepareStatus(ctx, s)
+	return writeStatus(ctx, paths, seqNum, s)
+}
+
+// prepareStatus adds the version substatus to the status, masks the secrets in
+// it and truncates it to fit maxStatusSizeInBytes.
+func prepareStatus(ctx *log.Context, s StatusReport) {
+	s.AddSubstatusItem(versionSubstatus())
+	secrets.redactStatus(s)
+	truncateStatus(ctx, s)
+}
+
+// truncateStatus truncates the status to fit maxStatusSizeInBytes.
+func truncateStatus(ctx *log.Context, s StatusReport) {
+	if size, truncated := s.TruncateToSize(maxStatusSizeInBytes, preservedSubstatuses); truncated {
+		ctx.Log("event", "status truncated", "sizeInBytes", size, "maxSizeInBytes", maxStatusSizeInBytes)
 	}
-	if err := s.Save(hEnv.HandlerEnvironment.StatusFolder, seqNum); err != nil {
+}
+
+// writeStatus writes a prepared status to the status file.
+func writeStatus(ctx *log.Context, paths handlerPaths, seqNum int, s StatusReport) error {
+	if err := s.Save(paths.statusFolder(), seqNum); err != nil {
 		ctx.Log("event", "failed to save handler status", "error", err)
 		return errors.Wrap(err, "failed to save handler status")
 	}
 	return nil
 }
 
+// versionSubstatus reports the version of the extension, so that mismatches
+// across a fleet are visible from the status.
+func versionSubstatus() SubstatusItem {
+	b, _ := json.Marshal(currentBuildInfo())
+	return NewSubstatus(SubstatusKeyNameExtensionVersion, StatusSuccess, string(b))
+}
+
 // statusMsg creates the reported status message based on the provided operation
 // type and the given message string.
 //
@@ -50,6 +80,8 @@ func statusMsg(c cmd, t StatusType, msg string) string {
 		s += " in progress"
 	case StatusError:
 		s += " failed"
+	case StatusWarning:
+		s += " succeeded with warnings"
 	}
 
 	if msg != "" {
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
-	"github.com/Azure/azure-docker-extension/pkg/vmextension"
 	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/require"
 )
@@ -20,11 +20,13 @@ func Test_statusMsg(t *testing.T) {
 
 	require.Equal(t, "Enable in progress", statusMsg(cmdEnable, StatusTransitioning, ""))
 	require.Equal(t, "Enable in progress: msg", statusMsg(cmdEnable, StatusTransitioning, "msg"))
+
+	require.Equal(t, "Enable succeeded with warnings", statusMsg(cmdEnable, StatusWarning, ""))
+	require.Equal(t, "Enable succeeded with warnings: msg", statusMsg(cmdEnable, StatusWarning, "msg"))
 }
 
 func Test_reportStatus_fails(t *testing.T) {
-	fakeEnv := vmextension.HandlerEnvironment{}
-	fakeEnv.HandlerEnvironment.StatusFolder = "/non-existing/dir/"
+	fakeEnv := handlerPaths{status: "/non-existing/dir/"}
 
 	err := reportStatus(log.NewContext(log.NewNopLogger()), fakeEnv, 1, StatusSuccess, cmdEnable, "")
 	require.NotNil(t, err)
@@ -36,8 +38,7 @@ func Test_reportStatus_fileExists(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(tmpDir)
 
-	fakeEnv := vmextension.HandlerEnvironment{}
-	fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
+	fakeEnv := handlerPaths{status: tmpDir}
 
 	require.Nil(t, reportStatus(log.NewContext(log.NewNopLogger()), fakeEnv, 1, StatusError, cmdEnable, "FOO ERROR"))
 
@@ -47,14 +48,34 @@ func Test_reportStatus_fileExists(t *testing.T) {
 	require.NotEqual(t, 0, len(b), ".status file not empty")
 }
 
+func Test_reportStatus_includesVersion(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	fakeEnv := handlerPaths{status: tmpDir}
+
+	defer func(v string) { Version = v }(Version)
+	Version = "1.2.3"
+	require.Nil(t, reportStatusWithSubstatuses(log.NewContext(log.NewNopLogger()), fakeEnv, 1, StatusSuccess, "Enable", "", nil))
+
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "1.status"))
+	require.Nil(t, err)
+	var report StatusReport
+	require.Nil(t, json.Unmarshal(b, &report))
+	substatuses := report[0].Status.SubstatusList
+	require.Len(t, substatuses, 1)
+	require.Equal(t, SubstatusKeyNameExtensionVersion, substatuses[0].Name)
+	require.Contains(t, substatuses[0].FormattedMessage.Message, `"version":"1.2.3"`)
+}
+
 func Test_reportStatus_checksIfShouldBeReported(t *testing.T) {
 	for _, c := range cmds {
 		tmpDir, err := ioutil.TempDir("", "status-"+c.name)
 		require.Nil(t, err)
 		defer os.RemoveAll(tmpDir)
 
-		fakeEnv := vmextension.HandlerEnvironment{}
-		fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
+		fakeEnv := handlerPaths{status: tmpDir}
 		require.Nil(t, reportStatus(log.NewContext(log.NewNopLogger()), fakeEnv, 2, StatusSuccess, c, ""))
 
 		fp := filepath.Join(tmpDir, "2.status")
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// The phases of an http request, labelling the probe phase metrics.
+const (
+	requestPhaseDnsLookup       = "dnsLookup"
+	requestPhaseConnect         = "connect"
+	requestPhaseTlsHandshake    = "tlsHandshake"
+	requestPhaseTimeToFirstByte = "timeToFirstByte"
+)
+
+// requestTiming is the time spent in each phase of an http probe request.
+// Phases which didn't happen, such as the DNS lookup of an IP address or the
+// connection of a reused one, are omitted.
+type requestTiming struct {
+	DnsLookup       string `json:"dnsLookup,omitempty"`
+	Connect         string `json:"connect,omitempty"`
+	TlsHandshake    string `json:"tlsHandshake,omitempty"`
+	TimeToFirstByte string `json:"timeToFirstByte,omitempty"`
+	Total           string `json:"total"`
+
+	// phases are the durations of the completed phases, recorded in the
+	// probe metrics.
+	phases map[string]time.Duration
+}
+
+// requestTrace records the timing of the phases of an http request.
+type requestTrace struct {
+	mu                        sync.Mutex
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+
+	// now returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+func newRequestTrace() *requestTrace {
+	t := &requestTrace{now: time.Now}
+	t.start = t.now()
+	return t
+}
+
+// clientTrace returns the hooks recording the phases of the request.
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.record(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.record(&t.dnsDone) },
+		// several addresses may be tried, the connect phase lasts from the
+		// first attempt to the last completion
+		ConnectStart: func(string, string) {
+			if t.get(&t.connectStart).IsZero() {
+				t.record(&t.connectStart)
+			}
+		},
+		ConnectDone:          func(string, string, error) { t.record(&t.connectDone) },
+		TLSHandshakeStart:    func() { t.record(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.record(&t.tlsDone) },
+		GotFirstResponseByte: func() { t.record(&t.firstByte) },
+	}
+}
+
+func (t *requestTrace) record(at *time.Time) {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*at = now
+}
+
+func (t *requestTrace) get(at *time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *at
+}
+
+// timing returns the duration of the phases recorded so far, the total being
+// the time elapsed since the request started.
+func (t *requestTrace) timing() *requestTiming {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing := &requestTiming{
+		Total:  now.Sub(t.start).Round(time.Microsecond).String(),
+		phases: make(map[string]time.Duration),
+	}
+	timing.DnsLookup = timing.phase(requestPhaseDnsLookup, t.dnsStart, t.dnsDone)
+	timing.Connect = timing.phase(requestPhaseConnect, t.connectStart, t.connectDone)
+	timing.TlsHandshake = timing.phase(requestPhaseTlsHandshake, t.tlsStart, t.tlsDone)
+	timing.TimeToFirstByte = timing.phase(requestPhaseTimeToFirstByte, t.start, t.firstByte)
+	return timing
+}
+
+// phase records the duration of a phase and formats it, or returns an empty
+// string when the phase didn't complete.
+func (timing *requestTiming) phase(name string, start, end time.Time) string {
+	if start.IsZero() || end.IsZero() {
+		return ""
+	}
+	d := end.Sub(start)
+	timing.phases[name] = d
+	return d.Round(time.Microsecond).String()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestTrace_timing(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	trace := &requestTrace{now: func() time.Time { return now }}
+	trace.start = now
+	hooks := trace.clientTrace()
+
+	advance := func(d time.Duration) { now = now.Add(d) }
+	hooks.DNSStart(httptrace.DNSStartInfo{Host: "contoso.com"})
+	advance(2 * time.Millisecond)
+	hooks.DNSDone(httptrace.DNSDoneInfo{})
+	hooks.ConnectStart("tcp", "10.0.0.1:443")
+	advance(3 * time.Millisecond)
+	hooks.ConnectStart("tcp", "10.0.0.2:443")
+	advance(time.Millisecond)
+	hooks.ConnectDone("tcp", "10.0.0.2:443", nil)
+	advance(500 * time.Microsecond)
+
+	// the request timed out during the TLS handshake
+	hooks.TLSHandshakeStart()
+	advance(10 * time.Millisecond)
+	require.Equal(t, &requestTiming{
+		DnsLookup: "2ms",
+		Connect:   "4ms",
+		Total:     "16.5ms",
+		phases: map[string]time.Duration{
+			requestPhaseDnsLookup: 2 * time.Millisecond,
+			requestPhaseConnect:   4 * time.Millisecond,
+		},
+	}, trace.timing())
+}
+
+func TestHttpHealthProbe_evaluate_FailureDetails(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("{\n  \"error\": \"database unavailable\"\n}"))
+	}))
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewHttpHealthProbe("http", "/health", 80)
+	probe.Address = server.URL + "/health"
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	details := probeResponse.ProbeDetails
+	require.Equal(t, probeFailureBadStatus, details.Failure)
+	require.Equal(t, "HTTP/1.1 503 Service Unavailable", details.StatusLine)
+	require.Equal(t, `{ "error": "database unavailable" }`, details.BodyExcerpt)
+	require.NotNil(t, details.Timing)
+	require.NotEmpty(t, details.Timing.Connect)
+	require.NotEmpty(t, details.Timing.TimeToFirstByte)
+	require.NotEmpty(t, details.Timing.Total)
+
+	// the body of invalid responses is excerpted as well
+	status = http.StatusOK
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, "HTTP/1.1 200 OK", probeResponse.ProbeDetails.StatusLine)
+	require.Equal(t, `{ "error": "database unavailable" }`, probeResponse.ProbeDetails.BodyExcerpt)
+
+	// healthy responses are not described, their timing is
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ApplicationHealthState": "Healthy"}`))
+	})
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.NotNil(t, probeResponse.ProbeDetails.Timing)
+	require.NotEmpty(t, probeResponse.ProbeDetails.Timing.TimeToFirstByte)
+	probeResponse.ProbeDetails.Timing = nil
+	require.Equal(t, ProbeDetails{Protocol: "HTTP/1.1", StatusCode: http.StatusOK}, probeResponse.ProbeDetails)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// resourceCheckInterval is the interval between the checks of the
+	// resources used by the extension process.
+	resourceCheckInterval = time.Minute
+
+	// resourceDiagnosticsFile receives the goroutine stacks of the extension
+	// when it exceeds a resource limit, in the data dir.
+	resourceDiagnosticsFile = "resource-limit-goroutines.txt"
+)
+
+var errResourceLimitRestart = errors.New("Extension restarting after exceeding its resource limits")
+
+// resourceUsage is the usage of the resources of the extension process.
+type resourceUsage struct {
+	RssBytes   int64
+	Goroutines int
+	OpenFiles  int
+}
+
+// resourceLimits are soft limits of the resources of the extension process,
+// the zero limits not being checked.
+type resourceLimits struct {
+	RssBytes   int64
+	Goroutines int
+	OpenFiles  int
+}
+
+// exceeded describes the limits the usage exceeds.
+func (l resourceLimits) exceeded(u resourceUsage) []string {
+	var exceeded []string
+	if l.RssBytes > 0 && u.RssBytes > l.RssBytes {
+		exceeded = append(exceeded, fmt.Sprintf("memory %d MB > %d MB", u.RssBytes/(1024*1024), l.RssBytes/(1024*1024)))
+	}
+	if l.Goroutines > 0 && u.Goroutines > l.Goroutines {
+		exceeded = append(exceeded, fmt.Sprintf("goroutines %d > %d", u.Goroutines, l.Goroutines))
+	}
+	if l.OpenFiles > 0 && u.OpenFiles > l.OpenFiles {
+		exceeded = append(exceeded, fmt.Sprintf("open files %d > %d", u.OpenFiles, l.OpenFiles))
+	}
+	return exceeded
+}
+
+// resourceMonitor checks, at most every resourceCheckInterval, the resources
+// used by the extension process against their limits, as extension processes
+// may slowly leak on long-lived VMs.
+type resourceMonitor struct {
+	limits    resourceLimits
+	lastCheck time.Duration
+	checked   bool
+	// exceeding records whether the limits were exceeded at the last check,
+	// to log the diagnostics only once until the usage is back under them.
+	exceeding bool
+
+	// usage reads the usage of the resources, replaced in tests.
+	usage func() (resourceUsage, error)
+	// dataDir receives the goroutine stacks when a limit is exceeded.
+	dataDir string
+}
+
+// newResourceMonitor returns the monitor of the configured limits, writing its
+// diagnostics to dataFolder, or nil when there is none.
+func newResourceMonitor(cfg *handlerSettings, dataFolder string) *resourceMonitor {
+	limits := cfg.resourceLimits()
+	if limits == (resourceLimits{}) {
+		return nil
+	}
+	return &resourceMonitor{limits: limits, usage: readResourceUsage, dataDir: dataFolder}
+}
+
+// check returns the limits the extension exceeds, when it is time to check
+// them. The first time they are exceeded, the usage is logged and the
+// goroutine stacks are written to the data dir.
+func (m *resourceMonitor) check(ctx *log.Context, now time.Duration) []string {
+	if m.checked && now-m.lastCheck < resourceCheckInterval {
+		return nil
+	}
+	m.checked, m.lastCheck = true, now
+
+	usage, err := m.usage()
+	if err != nil {
+		ctx.Log("error", errors.Wrap(err, "failed to read the resource usage of the extension"))
+		return nil
+	}
+	exceeded := m.limits.exceeded(usage)
+	if len(exceeded) > 0 && !m.exceeding {
+		ctx.Log("event", "Extension exceeds its resource limits: "+strings.Join(exceeded, ", "),
+			"rssBytes", usage.RssBytes, "goroutines", usage.Goroutines, "openFiles", usage.OpenFiles)
+		if path, err := m.writeGoroutines(); err != nil {
+			ctx.Log("error", err)
+		} else {
+			ctx.Log("event", "wrote goroutine stacks", "path", path)
+		}
+	}
+	m.exceeding = len(exceeded) > 0
+	return exceeded
+}
+
+// writeGoroutines writes the stacks of the goroutines of the extension.
+func (m *resourceMonitor) writeGoroutines() (string, error) {
+	var b bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&b, 1); err != nil {
+		return "", errors.Wrap(err, "failed to profile goroutines")
+	}
+	path := filepath.Join(m.dataDir, resourceDiagnosticsFile)
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return "", errors.Wrap(err, "failed to write goroutine stacks")
+	}
+	return path, nil
+}
+
+// readResourceUsage reads the usage of the resources of the extension process
+// from /proc.
+func readResourceUsage() (resourceUsage, error) {
+	usage := resourceUsage{Goroutines: runtime.NumGoroutine()}
+
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return usage, err
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return usage, errors.New("invalid /proc/self/statm")
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return usage, errors.Wrap(err, "invalid /proc/self/statm")
+	}
+	usage.RssBytes = pages * int64(os.Getpagesize())
+
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return usage, err
+	}
+	usage.OpenFiles = len(fds)
+	return usage, nil
+}
+
+// restartSelf replaces the extension process by a new instance of itself, with
+// the same arguments and environment, keeping its process id.
+func restartSelf() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to find the extension executable")
+	}
+	return errors.Wrap(syscall.Exec(executable, os.Args, os.Environ()), "failed to restart the extension")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResourceLimits_exceeded(t *testing.T) {
+	usage := resourceUsage{RssBytes: 100 * 1024 * 1024, Goroutines: 50, OpenFiles: 20}
+	require.Empty(t, resourceLimits{}.exceeded(usage))
+	require.Empty(t, resourceLimits{RssBytes: 200 * 1024 * 1024, Goroutines: 50}.exceeded(usage))
+	require.Equal(t, []string{"memory 100 MB > 64 MB", "open files 20 > 16"},
+		resourceLimits{RssBytes: 64 * 1024 * 1024, Goroutines: 100, OpenFiles: 16}.exceeded(usage))
+}
+
+func TestNewResourceMonitor(t *testing.T) {
+	require.Nil(t, newResourceMonitor(&handlerSettings{}, ""))
+	require.NotNil(t, newResourceMonitor(observabilityConfig(observabilitySettings{MaxOpenFiles: 64}), ""))
+}
+
+func TestResourceMonitor_check(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dir, err := ioutil.TempDir("", "resources")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	usage := resourceUsage{Goroutines: 10}
+	m := &resourceMonitor{
+		limits:  resourceLimits{Goroutines: 20},
+		usage:   func() (resourceUsage, error) { return usage, nil },
+		dataDir: dir,
+	}
+	require.Empty(t, m.check(ctx, 0))
+
+	// not checked again within the interval
+	usage.Goroutines = 30
+	require.Empty(t, m.check(ctx, resourceCheckInterval-time.Second))
+	_, err = os.Stat(filepath.Join(dir, resourceDiagnosticsFile))
+	require.True(t, os.IsNotExist(err))
+
+	require.Equal(t, []string{"goroutines 30 > 20"}, m.check(ctx, resourceCheckInterval))
+	b, err := ioutil.ReadFile(filepath.Join(dir, resourceDiagnosticsFile))
+	require.Nil(t, err)
+	require.Contains(t, string(b), "goroutine profile")
+	require.True(t, m.exceeding)
+
+	usage.Goroutines = 10
+	require.Empty(t, m.check(ctx, 2*resourceCheckInterval))
+	require.False(t, m.exceeding)
+
+	// failing to read the usage is not an exceeded limit
+	m.usage = func() (resourceUsage, error) { return resourceUsage{}, errors.New("no /proc") }
+	require.Empty(t, m.check(ctx, 3*resourceCheckInterval))
+}
+
+func TestReadResourceUsage(t *testing.T) {
+	usage, err := readResourceUsage()
+	require.Nil(t, err)
+	require.True(t, usage.RssBytes > 0)
+	require.True(t, usage.Goroutines > 0)
+	require.True(t, usage.OpenFiles > 0)
+}
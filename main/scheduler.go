@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// probeScheduler schedules the probe runs every interval since the first one,
+// rather than an interval after the end of the previous run, so that the runs
+// don't drift. The runs whose time passed while a run was late are skipped.
+// The runs are scheduled on the monotonic time, so that stepping the wall
+// clock neither skips runs nor delays them.
+type probeScheduler struct {
+	interval time.Duration
+	next     time.Duration
+	skipped  int
+
+	// clock schedules the runs on its monotonic time, replaced in tests.
+	clock clock
+}
+
+// probeSchedulingMetrics counts the runs and probes which didn't happen on
+// time, for all the applications.
+type probeSchedulingMetrics struct {
+	SkippedRuns             int `json:"skippedRuns"`
+	ProbesExceedingDeadline int `json:"probesExceedingDeadline"`
+}
+
+// newProbeScheduler creates a scheduler whose first run is now.
+func newProbeScheduler(interval time.Duration, c clock) *probeScheduler {
+	return &probeScheduler{interval: interval, next: c.monotonic(), clock: c}
+}
+
+// advance schedules the next run and returns the time to wait until then,
+// along with the number of runs skipped because their time already passed.
+func (s *probeScheduler) advance() (time.Duration, int) {
+	now := s.clock.monotonic()
+	s.next += s.interval
+	skipped := 0
+	if now >= s.next {
+		skipped = int((now-s.next)/s.interval) + 1
+		s.next += time.Duration(skipped) * s.interval
+	}
+	s.skipped += skipped
+	return s.next - now, skipped
+}
+
+// setInterval changes the interval the next runs are scheduled at, since the
+// last scheduled run.
+func (s *probeScheduler) setInterval(interval time.Duration) {
+	s.interval = interval
+}
+
+// remaining returns the time to wait until the scheduled run, after an out of
+// band run which doesn't shift the schedule.
+func (s *probeScheduler) remaining() time.Duration {
+	if now := s.clock.monotonic(); now < s.next {
+		return s.next - now
+	}
+	return 0
+}
+
+// metrics returns the runs skipped by the scheduler or by the applications
+// whose probe was still running, and the probes which exceeded their deadline.
+func (s *probeScheduler) metrics(apps []*application) probeSchedulingMetrics {
+	m := probeSchedulingMetrics{SkippedRuns: s.skipped}
+	for _, app := range apps {
+		m.SkippedRuns += app.skippedRuns
+		m.ProbesExceedingDeadline += app.deadlineExceeded
+	}
+	return m
+}
+
+// substatus returns the substatus reporting the scheduling metrics, only once
+// a run was skipped or a probe exceeded its deadline.
+func (s *probeScheduler) substatus(apps []*application) (SubstatusItem, bool, error) {
+	m := s.metrics(apps)
+	if m == (probeSchedulingMetrics{}) {
+		return SubstatusItem{}, false, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return SubstatusItem{}, false, err
+	}
+	return NewSubstatus(SubstatusKeyNameProbeScheduling, StatusSuccess, string(b)), true, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeScheduler_advance(t *testing.T) {
+	c := newFakeClock()
+	start := c.monotonic()
+	s := newProbeScheduler(5*time.Second, c)
+
+	// waits the rest of the interval
+	c.advance(2 * time.Second)
+	wait, skipped := s.advance()
+	require.Equal(t, 3*time.Second, wait)
+	require.Equal(t, 0, skipped)
+
+	// doesn't drift with the duration of the runs
+	c.advance(3*time.Second + 500*time.Millisecond)
+	wait, skipped = s.advance()
+	require.Equal(t, 4500*time.Millisecond, wait)
+	require.Equal(t, 0, skipped)
+
+	// skips the runs whose time passed
+	c.advance(15*time.Second + 500*time.Millisecond)
+	wait, skipped = s.advance()
+	require.Equal(t, 4*time.Second, wait)
+	require.Equal(t, 2, skipped)
+	require.Equal(t, start+25*time.Second, s.next)
+
+	// a run ending exactly on time of the next one skips it
+	c.advance(9 * time.Second)
+	wait, skipped = s.advance()
+	require.Equal(t, 5*time.Second, wait)
+	require.Equal(t, 1, skipped)
+	require.Equal(t, 3, s.skipped)
+}
+
+func TestProbeScheduler_remaining(t *testing.T) {
+	c := newFakeClock()
+	s := newProbeScheduler(5*time.Second, c)
+	c.advance(time.Second)
+	wait, _ := s.advance()
+	require.Equal(t, 4*time.Second, wait)
+
+	// an out of band run doesn't shift the schedule
+	c.advance(3 * time.Second)
+	require.Equal(t, time.Second, s.remaining())
+	c.advance(2 * time.Second)
+	require.Equal(t, time.Duration(0), s.remaining())
+	wait, skipped := s.advance()
+	require.Equal(t, 4*time.Second, wait)
+	require.Equal(t, 0, skipped)
+}
+
+func TestProbeScheduler_setInterval(t *testing.T) {
+	c := newFakeClock()
+	start := c.monotonic()
+	s := newProbeScheduler(5*time.Second, c)
+	c.advance(time.Second)
+	s.setInterval(20 * time.Second)
+	wait, _ := s.advance()
+	require.Equal(t, 19*time.Second, wait)
+	require.Equal(t, start+20*time.Second, s.next)
+}
+
+func TestProbeScheduler_clockJump(t *testing.T) {
+	c := newFakeClock()
+	s := newProbeScheduler(5*time.Second, c)
+
+	// stepping the wall clock forward doesn't skip runs
+	c.advance(time.Second)
+	c.step(time.Hour)
+	wait, skipped := s.advance()
+	require.Equal(t, 4*time.Second, wait)
+	require.Equal(t, 0, skipped)
+
+	// nor does stepping it backward delay them
+	c.advance(5 * time.Second)
+	c.step(-2 * time.Hour)
+	wait, skipped = s.advance()
+	require.Equal(t, 4*time.Second, wait)
+	require.Equal(t, 0, skipped)
+}
+
+func TestProbeScheduler_substatus(t *testing.T) {
+	s := newProbeScheduler(time.Second, systemClock{})
+	apps := []*application{{}, {}}
+
+	_, ok, err := s.substatus(apps)
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	s.skipped = 1
+	apps[0].skippedRuns, apps[1].deadlineExceeded = 2, 3
+	substatus, ok, err := s.substatus(apps)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, SubstatusKeyNameProbeScheduling, substatus.Name)
+	require.Equal(t, `{"skippedRuns":3,"probesExceedingDeadline":3}`, substatus.FormattedMessage.Message)
+}
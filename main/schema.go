@@ -10,33 +10,25 @@ import (
 // Refer to http://json-schema.org/ on how to use JSON Schemas.
 
 const (
-	publicSettingsSchema = `{
-  "$schema": "http://json-schema.org/draft-04/schema#",
-  "title": "Application Health - Public Settings",
-  "type": "object",
-  "properties": {
+	// probeSettingsSchemaProperties are the properties of the settings of a
+	// probe, accepted at the top level of the public settings as well as for
+	// each of the 'applications'.
+	probeSettingsSchemaProperties = `
     "protocol": {
-      "description": "Required - can be 'tcp', 'http', or 'https'.",
+      "description": "Required - can be 'tcp', 'udp', 'http', 'https', 'systemd', 'process', 'file', 'dns', 'metrics', 'fastcgi', 'mysql', 'postgresql', 'redis', 'ssh', 'icmp' or 'aggregator'.",
       "type": "string",
-      "enum": ["tcp", "http", "https"]
+      "enum": ["tcp", "udp", "http", "https", "systemd", "process", "file", "dns", "metrics", "fastcgi", "mysql", "postgresql", "redis", "ssh", "icmp", "aggregator"]
     },
 	"port": {
-	  "description": "Required when the protocol is 'tcp'. Optional when the protocol is 'http' or 'https'.",
+	  "description": "Required when the protocol is 'tcp' (unless 'discoverPortOfProcess' is specified), 'udp' or 'metrics'. Optional when the protocol is 'http' or 'https'. Mutually exclusive with 'fastcgiSocket' when the protocol is 'fastcgi' and with 'aggregatorSocket' when the protocol is 'aggregator'. Defaults to 80 and 443 when the protocol is 'http' and 'https', to 3306, 5432 and 6379 when the protocol is 'mysql', 'postgresql' and 'redis' and to 22 when the protocol is 'ssh', unless overridden by 'defaultPorts'. 0 is the same as not set.",
       "type": "integer",
-      "minimum": 1,
+      "minimum": 0,
       "maximum": 65535
 	},
     "requestPath": {
-      "description": "Path on which the web request should be sent. Required when the protocol is 'http' or 'https'.",
+      "description": "Path on which the web request should be sent. Required when the protocol is 'http' or 'https'. Defaults to '/metrics' when the protocol is 'metrics', to '/ping' when the protocol is 'fastcgi' and to '/checks' when the protocol is 'aggregator'.",
       "type": "string"
     },
-    "intervalInSeconds": {
-      "description": "The interval, in seconds, for how frequently to probe the endpoint for health status.",
-      "type": "integer",
-      "default": 5,
-      "minimum": 5,
-      "maximum": 60
-    },
     "numberOfProbes": {
       "description": "The number of probe reponses needed to change health state",
       "type": "integer",
@@ -45,12 +37,577 @@ const (
       "maximum": 24
     },
     "gracePeriod": {
-      "description": "The amount of time in seconds the application will default to 'Initializing' state if no valid health state is observed numberOfProbes consecutive times.",
-      "type": "integer",
+      "description": "The amount of time in seconds, or as a duration such as '10m', the application will default to 'Initializing' state if no valid health state is observed numberOfProbes consecutive times. A duration must be between 5s and 4h.",
+      "type": ["integer", "string"],
+      "pattern": "` + durationSettingPattern + `",
       "minimum": 5,
       "maximum": 14400
+    },
+    "maxResponseBodySizeInBytes": {
+      "description": "The maximum size, in bytes, of the response body read from the http/https endpoint, or of the sentinel file when 'parseFileState' is set. Larger responses result in 'Unknown' health state. Defaults to 4096; earlier versions read the response body without any limit, so endpoints returning larger bodies must raise it.",
+      "type": "integer",
+      "default": 4096,
+      "minimum": 256,
+      "maximum": 1048576
+    },
+    "expectedHeaders": {
+      "description": "Headers the http/https endpoint response must include. An empty value only requires the header to be present and non-empty, otherwise the header value must match (ignoring case and any ';' parameters).",
+      "type": "object",
+      "additionalProperties": {
+        "type": "string"
+      }
+    },
+    "userAgent": {
+      "description": "The User-Agent header sent with http/https probe requests. Defaults to 'ApplicationHealthExtension/1.0'.",
+      "type": "string",
+      "minLength": 1,
+      "maxLength": 256
+    },
+    "includeIdentificationHeaders": {
+      "description": "Whether http/https probe requests include headers identifying the extension version, VM name and sequence number.",
+      "type": "boolean",
+      "default": false
+    },
+    "richStates": {
+      "description": "Whether http/https probes read the health state from the 'ApplicationHealthState' of the response body, a 2xx response without a valid state being Unknown. When false, any 2xx response is Healthy regardless of the body.",
+      "type": "boolean",
+      "default": true
+    },
+    "responseJsonPath": {
+      "description": "JSONPath of the value of the response body http/https probes derive the health state from, instead of its 'ApplicationHealthState', such as '$.status' for the Spring Boot actuator. Members are selected as '.name' or \"['name']\" and array elements as '[0]'. The application is Healthy when the value equals 'expectedJsonPathValue' and Unhealthy otherwise.",
+      "type": "string",
+      "pattern": "^\\$"
+    },
+    "expectedJsonPathValue": {
+      "description": "The value at 'responseJsonPath' of a healthy application, compared to strings as is and to other values as their json text, such as 'true' or '1'. Required with 'responseJsonPath'.",
+      "type": "string"
+    },
+    "dependencyAggregation": {
+      "description": "How http/https probes compute the health state of a response body without 'ApplicationHealthState' from its 'dependencies' checks, and aggregator probes the health state from the 'checks' of the aggregator: 'worstOf' takes the worst state of all the dependencies, 'ignoreOptional' the worst state of the dependencies not marked optional. Defaults to 'ignoreOptional'.",
+      "type": "string",
+      "enum": ["worstOf", "ignoreOptional"]
+    },
+    "httpVersion": {
+      "description": "The HTTP version used by http/https probes. '2' forces HTTP/2, over TLS for 'https' and cleartext (h2c) for 'http'. Defaults to '1.1'.",
+      "type": "string",
+      "enum": ["1.1", "2"]
+    },
+    "certificateThumbprints": {
+      "description": "SHA-256 thumbprints, in hex optionally separated by ':', the certificate of the https endpoint must match one of. Without them, the certificate is not verified.",
+      "type": "array",
+      "items": {
+        "type": "string",
+        "pattern": "^([0-9a-fA-F]{2}:?){31}[0-9a-fA-F]{2}$"
+      },
+      "minItems": 1
+    },
+    "certificateExpiryWarningInDays": {
+      "description": "Number of days before the expiry of the certificate of the https endpoint it is reported as a warning in the 'Certificate' substatus. Without it, the expiry is only reported.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 365
+    },
+    "proxyUrl": {
+      "description": "URL of the HTTP proxy, such as 'http://localhost:3128', http/https probes reach their endpoint through with a CONNECT tunnel, instead of connecting directly. The proxy environment variables are never used. Its credentials are the protected 'proxyUsername' and 'proxyPassword'.",
+      "type": "string",
+      "pattern": "^http://[^/@]+/?$"
+    },
+    "tcpProbeMode": {
+      "description": "How the 'tcp' probe checks the port. 'connect' completes a full connection, 'halfOpen' only sends a SYN (requires CAP_NET_RAW, falls back to 'connect' otherwise). Defaults to 'connect'.",
+      "type": "string",
+      "enum": ["connect", "halfOpen"]
+    },
+    "tcpNoDelay": {
+      "description": "Whether the 'tcp' probe disables Nagle's algorithm (TCP_NODELAY) on its connection.",
+      "type": "boolean",
+      "default": true
+    },
+    "tcpConnectTimeoutInSeconds": {
+      "description": "How long, in seconds or as a duration such as '500ms', the 'tcp' probe waits for the connection to be established. A duration must be between 10ms and 30s.",
+      "type": ["integer", "string"],
+      "pattern": "` + durationSettingPattern + `",
+      "minimum": 1,
+      "maximum": 30,
+      "default": 30
+    },
+    "tcpLingerInSeconds": {
+      "description": "How the 'tcp' probe closes its connection (SO_LINGER). 0 resets the connection (RST), a positive value waits up to that many seconds for unsent data before closing it, -1 closes it gracefully (FIN) in the background.",
+      "type": "integer",
+      "minimum": -1,
+      "maximum": 60,
+      "default": 0
+    },
+    "udpPayload": {
+      "description": "Base64 encoded payload of the datagram sent by the 'udp' probe. Defaults to an empty datagram.",
+      "type": "string"
+    },
+    "udpExpectedResponse": {
+      "description": "Base64 encoded bytes the reply to the 'udp' probe must start with. When not set, any reply is considered healthy.",
+      "type": "string"
+    },
+    "unitName": {
+      "description": "Name of the systemd unit whose state is probed. Required when the protocol is 'systemd'.",
+      "type": "string",
+      "minLength": 1
+    },
+    "pidFile": {
+      "description": "Path of the pid file of the process probed when the protocol is 'process'. Mutually exclusive with 'processName'.",
+      "type": "string",
+      "minLength": 1
+    },
+    "processName": {
+      "description": "Executable name of the process probed when the protocol is 'process'. Mutually exclusive with 'pidFile'.",
+      "type": "string",
+      "minLength": 1
+    },
+    "minimumUptimeInSeconds": {
+      "description": "The time, in seconds, the probed process must have been running to be considered healthy. Until then the application is 'Initializing'.",
+      "type": "integer",
+      "minimum": 0,
+      "maximum": 86400
+    },
+    "filePath": {
+      "description": "Path of the sentinel file probed when the protocol is 'file'.",
+      "type": "string",
+      "minLength": 1
+    },
+    "maxFileAgeInSeconds": {
+      "description": "The time, in seconds, since the last modification of the sentinel file after which it is considered stale. When not set, only the existence of the file is checked.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 86400
+    },
+    "parseFileState": {
+      "description": "Whether the sentinel file contains a JSON health state in the same format as the http/https probe response.",
+      "type": "boolean",
+      "default": false
+    },
+    "dnsName": {
+      "description": "The name resolved when the protocol is 'dns'.",
+      "type": "string",
+      "minLength": 1
+    },
+    "dnsServer": {
+      "description": "The server ('host' or 'host:port') the 'dns' probe queries. Defaults to the system resolver.",
+      "type": "string",
+      "minLength": 1
+    },
+    "maxLatencyInMilliseconds": {
+      "description": "The maximum time, in milliseconds, resolving 'dnsName' may take for the resolver to be considered healthy when the protocol is 'dns', and the maximum average round trip time of the echo requests when the protocol is 'icmp'.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 60000
+    },
+    "expectedAddresses": {
+      "description": "Addresses 'dnsName' must resolve to for the resolver to be considered healthy.",
+      "type": "array",
+      "items": {
+        "type": "string"
+      }
+    },
+    "icmpAddress": {
+      "description": "The IPv4 address the echo requests are sent to when the protocol is 'icmp', such as the next hop of a network virtual appliance.",
+      "type": "string",
+      "pattern": "^([0-9]{1,3}\\.){3}[0-9]{1,3}$"
+    },
+    "icmpCount": {
+      "description": "The number of echo requests sent by each probe when the protocol is 'icmp', sharing the probe interval.",
+      "type": "integer",
+      "default": 3,
+      "minimum": 1,
+      "maximum": 20
+    },
+    "maxPacketLossPercent": {
+      "description": "The maximum percentage of echo requests without reply for the target to be considered healthy when the protocol is 'icmp'. Failing probes report the 'packetLoss' class of failure, or 'timeout' when no reply is received.",
+      "type": "integer",
+      "default": 50,
+      "minimum": 0,
+      "maximum": 99
+    },
+    "metricsRules": {
+      "description": "Threshold rules, such as 'up == 1' or 'queue_depth{queue=\"orders\"} < 1000', all the samples scraped from the Prometheus/OpenMetrics endpoint must satisfy for the application to be healthy when the protocol is 'metrics'.",
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "string",
+        "minLength": 1
+      }
+    },
+    "fastcgiSocket": {
+      "description": "Path of the unix socket of the FastCGI application, such as php-fpm, probed when the protocol is 'fastcgi'. Mutually exclusive with 'port'.",
+      "type": "string",
+      "minLength": 1
+    },
+    "aggregatorSocket": {
+      "description": "Path of the unix socket of the local health aggregator daemon queried when the protocol is 'aggregator'. The aggregator answers a GET of 'requestPath' with a json object whose 'checks' array holds the named checks, each with a 'name', a 'state', an optional 'detail' and whether it is 'optional'. Mutually exclusive with 'port'.",
+      "type": "string",
+      "minLength": 1
+    },
+    "databaseUser": {
+      "description": "User the 'mysql', 'postgresql' and 'redis' probes log in as when 'databasePassword' is set in the protected settings. Defaults to 'root' for 'mysql', 'postgres' for 'postgresql' and to the default user for 'redis'.",
+      "type": "string",
+      "minLength": 1
+    },
+    "databaseName": {
+      "description": "Database the 'mysql' and 'postgresql' probes connect to.",
+      "type": "string",
+      "minLength": 1
+    },
+    "discoverPortOfProcess": {
+      "description": "Executable name of a process whose listening port is discovered and probed, instead of a fixed 'port', when the protocol is 'tcp', 'http' or 'https'. The lowest port the process listens on is probed.",
+      "type": "string",
+      "minLength": 1
+    },
+    "fallbackPort": {
+      "description": "Port probed when nothing listens on 'port' (the connection is refused), such as the new port of an application during an in-place deployment, when the protocol is 'tcp', 'http' or 'https'. The 'ProbeDetails' substatus reports the target which produced the health state.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 65535
+    },
+    "checkLoopbackOnFailure": {
+      "description": "Whether http/https probes which could not reach the endpoint check the loopback networking of the VM by connecting to an ephemeral loopback port. When the check fails, the failure is classified as 'loopback' rather than as the application being unreachable.",
+      "type": "boolean",
+      "default": false
+    },
+    "failureStates": {
+      "description": "The health states the failures of tcp, udp, http, https, metrics and icmp probes are reported as, by class of failure, instead of the default state of the protocol (Unhealthy for tcp and udp, Unknown otherwise). 'unreachable' maps the 'dnsResolution', 'connectionRefused', 'connection' and 'timeout' classes which are not mapped individually.",
+      "type": "object",
+      "properties": {
+        "unreachable": { "$ref": "#/definitions/failureState" },
+        "dnsResolution": { "$ref": "#/definitions/failureState" },
+        "connectionRefused": { "$ref": "#/definitions/failureState" },
+        "connection": { "$ref": "#/definitions/failureState" },
+        "tls": { "$ref": "#/definitions/failureState" },
+        "timeout": { "$ref": "#/definitions/failureState" },
+        "redirect": { "$ref": "#/definitions/failureState" },
+        "proxy": { "$ref": "#/definitions/failureState" },
+        "badStatus": { "$ref": "#/definitions/failureState" },
+        "badHeaders": { "$ref": "#/definitions/failureState" },
+        "badBody": { "$ref": "#/definitions/failureState" },
+        "loopback": { "$ref": "#/definitions/failureState" },
+        "packetLoss": { "$ref": "#/definitions/failureState" },
+        "latency": { "$ref": "#/definitions/failureState" }
+      },
+      "additionalProperties": false
+    },
+    "circuitBreakerTimeouts": {
+      "description": "Number of consecutive probe timeouts after which probing stops for 'circuitBreakerCooldownInSeconds', reporting the last state, before a single trial probe is made. The circuit breaker is disabled when not set.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 100
+    },
+    "circuitBreakerCooldownInSeconds": {
+      "description": "The time, in seconds or as a duration such as '2m', probing stops for once the circuit breaker opened. A duration must be between 1s and 1h.",
+      "type": ["integer", "string"],
+      "pattern": "` + durationSettingPattern + `",
+      "default": 60,
+      "minimum": 1,
+      "maximum": 3600
+    },
+    "simulationFile": {
+      "description": "Absolute path of a file of health states, such as '/etc/apphealth/simulation', reported instead of probing the application, so that automatic repairs and rolling upgrades can be validated without breaking a real application. Each line is 'Healthy', 'Unhealthy' or 'Unknown', optionally followed by the number of probe cycles it lasts, such as 'Unhealthy 3'. The last state is reported once the file is exhausted, unless the last line is 'repeat'. The file is read again, from its first state, when it is modified. The probe details of the status report that the state is simulated.",
+      "type": "string",
+      "pattern": "^/.*[^/]$"
+    }`
+
+	// applicationSettingsSchemaProperties are the properties of each of the
+	// 'applications' and of each of the 'probes'.
+	applicationSettingsSchemaProperties = `
+          "name": {
+            "description": "The name of the application, used in its substatus name. Required for each of the 'applications' and when there are several 'probes'.",
+            "type": "string",
+            "pattern": "^[A-Za-z0-9_.-]+$",
+            "maxLength": 64
+          },
+          "weight": {
+            "description": "The weight of the application when using 'weighted' aggregation.",
+            "type": "number",
+            "default": 1,
+            "minimum": 0,
+            "exclusiveMinimum": true
+          },
+          "required": {
+            "description": "Whether the application is part of the subset determining the top level health state when using 'requiredSubset' aggregation.",
+            "type": "boolean",
+            "default": false
+          },` + probeSettingsSchemaProperties
+
+	// flatObservabilitySettingsSchemaProperties are the properties of the
+	// 'observability' settings which are also flat in version 1 settings.
+	flatObservabilitySettingsSchemaProperties = `
+    "escalateToErrorAfterMinutes": {
+      "description": "The time, in minutes, after which the status of the extension is escalated from 'warning' to 'error' while the application is Unhealthy. When not set, the status of the extension remains 'success'.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 1440
+    },
+    "mirrorLogsToSyslog": {
+      "description": "Whether the extension events are mirrored to syslog (and journald) with the 'ApplicationHealthExtension' identifier.",
+      "type": "boolean",
+      "default": false
+    },
+    "diagnosticsPort": {
+      "description": "Port of the diagnostics endpoint serving pprof profiles under /debug/pprof/, expvar variables under /debug/vars, the latest status under /status and the probe metrics, counting the probe results by outcome and the probe latencies, in the Prometheus text format under /metrics. The endpoint listens on localhost only and is disabled when not set.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 65535
+    },
+    "statusWriteMode": {
+      "description": "When the status file is written: 'everyInterval' after every probe interval, 'onChange' only when the health state or the status of a substatus changes, and every 'statusHeartbeatIntervals' intervals otherwise. The latest status is always served by the diagnostics endpoint. Defaults to 'everyInterval'.",
+      "type": "string",
+      "enum": ["everyInterval", "onChange"]
+    },
+    "statusHeartbeatIntervals": {
+      "description": "The number of probe intervals after which an unchanged status is written again when using 'onChange' status write mode. Defaults to 60.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 1440
+    }`
+
+	// observabilitySettingsSchemaProperties are the properties of the
+	// 'observability' settings, the ones added with version 2 having no flat
+	// version 1 counterpart.
+	observabilitySettingsSchemaProperties = flatObservabilitySettingsSchemaProperties + `,
+    "applicationName": {
+      "description": "Logical name of the application the VM runs. It is included in all the extension events and names the 'Application/<applicationName>' substatus reporting the health state, so that health dashboards can group VMs by application.",
+      "type": "string",
+      "pattern": "^[^/]+$",
+      "maxLength": 64
+    },
+    "environment": {
+      "description": "Environment tag of the VM, such as 'production'. It is included in all the extension events and, with 'applicationName', appended to the name of the 'Application' substatus.",
+      "type": "string",
+      "pattern": "^[^/]+$",
+      "maxLength": 64
+    },
+    "otlpEndpoint": {
+      "description": "Base URL of an OpenTelemetry collector, such as 'http://localhost:4318', the probe cycles are exported to using OTLP/HTTP with JSON encoding: a span per probe cycle with a child span timing each probe, and gauges of the health states and probe durations. Not exported when not set.",
+      "type": "string",
+      "pattern": "^https?://[^/]+"
+    },
+    "maxMemoryInMB": {
+      "description": "Soft limit of the resident memory of the extension process, in MB. When exceeded, the usage and the goroutine stacks of the extension are logged and an event is emitted. Not limited when not set.",
+      "type": "integer",
+      "minimum": 16,
+      "maximum": 4096
+    },
+    "maxGoroutines": {
+      "description": "Soft limit of the number of goroutines of the extension process, handled as 'maxMemoryInMB'.",
+      "type": "integer",
+      "minimum": 16,
+      "maximum": 100000
+    },
+    "maxOpenFiles": {
+      "description": "Soft limit of the number of file descriptors open by the extension process, handled as 'maxMemoryInMB'.",
+      "type": "integer",
+      "minimum": 16,
+      "maximum": 65536
+    },
+    "restartOnResourceLimit": {
+      "description": "Whether the extension restarts itself, once its services are stopped, when it exceeds one of its resource limits, to recover from leaks on long-lived VMs.",
+      "type": "boolean",
+      "default": false
+    },
+    "statusMessages": {
+      "description": "Templates overriding the status messages, using the Go template syntax. 'healthy' and 'unhealthy' are the messages of the 'AppHealthStatus' substatus and 'polling' the message of the extension status while it polls for the application health. The templates can use the {{.State}}, {{.Application}} and {{.Environment}} fields and, when a single probe is configured, the {{.Target}}, {{.Port}}, {{.Path}}, {{.Latency}} and {{.Failure}} fields of the probe.",
+      "type": "object",
+      "properties": {
+        "healthy": { "$ref": "#/definitions/statusMessage" },
+        "unhealthy": { "$ref": "#/definitions/statusMessage" },
+        "polling": { "$ref": "#/definitions/statusMessage" }
+      },
+      "additionalProperties": false
+    },
+    "stateFilePath": {
+      "description": "Absolute path, such as '/run/apphealth/state', the committed health state is written to after each probe cycle, atomically, for the other agents of the VM such as monitoring daemons or autoscaling hooks. Not written when not set.",
+      "type": "string",
+      "pattern": "^/.*[^/]$"
+    },
+    "stateFileFormat": {
+      "description": "Format of the 'stateFilePath' file. 'json' writes an object with the 'state', the time it was entered ('since'), the time of the write ('updatedAt') and the states of the 'applications'; 'line' writes the state alone on a line. Defaults to 'json'.",
+      "type": "string",
+      "enum": ["json", "line"]
+    },
+    "readinessFilePath": {
+      "description": "Absolute path, such as '/run/apphealth/ready', of a marker file written once the application is first found Healthy, after its grace period, and removed when it is found Unhealthy, so that cloud-init scripts and deployment tools of the VM can wait for the application to be ready. The file holds the time it was written. A file left by a previous run of the extension is removed when it starts. Not written when not set.",
+      "type": "string",
+      "pattern": "^/.*[^/]$"
+    },
+    "heartbeatSubstatus": {
+      "description": "Whether the status includes a 'Heartbeat' substatus with the time of the last probe cycle and the number of cycles since the extension started, so that a dead extension process can be told apart from a stable health state.",
+      "type": "boolean",
+      "default": false
+    },
+    "eventFilesFolder": {
+      "description": "Absolute path of the folder, such as '/var/log/apphealth/events', the telemetry events (probe results, health state transitions and exceeded resource limits) are written to, a file per batch with one json event per line. The files are named after an increasing sequence number, such as 'events-0000000001.jsonl', and the folder is pruned according to 'eventsMaxFiles', 'eventsMaxAge' and 'eventsMaxSizeInMB'. Defaults to the events folder of the handler environment; not written when the agent doesn't provide one.",
+      "type": "string",
+      "pattern": "^/.*[^/]$"
+    },
+    "compressEventFiles": {
+      "description": "Whether the event files, written to 'eventFilesFolder' or the events folder of the handler environment, are gzip compressed, with a '.gz' extension.",
+      "type": "boolean",
+      "default": false
+    },
+    "telemetryFlushInterval": {
+      "description": "The longest time, in seconds or as a duration such as '5m', the telemetry events are queued before being sent to the telemetry services or written to 'eventFilesFolder'. A batch is sent earlier once it holds 50 events. A duration must be between 1s and 1h. Defaults to 60.",
+      "type": ["integer", "string"],
+      "pattern": "` + durationSettingPattern + `",
+      "minimum": 1,
+      "maximum": 3600
+    },
+    "logDeduplication": {
+      "description": "Log levels whose repeated identical events, such as the errors of a flapping endpoint, are collapsed, mapped to the interval, in seconds or as a duration such as '5m', at which the repeats are summarized by a 'last message repeated N times' event. An event is logged once per interval. Errors are 'error', events about the application being unhealthy or unknown 'warning' and anything else 'info'. A duration must be between 1s and 1h.",
+      "type": "object",
+      "properties": {
+        "error": { "$ref": "#/definitions/logDeduplicationInterval" },
+        "warning": { "$ref": "#/definitions/logDeduplicationInterval" },
+        "info": { "$ref": "#/definitions/logDeduplicationInterval" }
+      },
+      "additionalProperties": false
+    },
+    "eventsMaxFiles": {
+      "description": "The most files kept in the events folder of the handler environment and in 'eventFilesFolder', the oldest being removed first. The folders are pruned after each event file written and every hour. Defaults to 100.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 100000
+    },
+    "eventsMaxAge": {
+      "description": "The age, in seconds or as a duration such as '72h', after which the files of the events folder of the handler environment and of 'eventFilesFolder' are removed. A duration must be between 1m and 8760h. Defaults to 168h, a week.",
+      "type": ["integer", "string"],
+      "pattern": "` + durationSettingPattern + `",
+      "minimum": 60,
+      "maximum": 31536000
+    },
+    "eventsMaxSizeInMB": {
+      "description": "The most space, in megabytes, taken by the files of the events folder of the handler environment and of 'eventFilesFolder', the oldest files being removed first. Defaults to 64.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 10240
+    }`
+
+	publicSettingsSchema = `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "Application Health - Public Settings",
+  "type": "object",
+  "definitions": {
+    "failureState": {
+      "type": "string",
+      "enum": ["Unhealthy", "Unknown"]
+    },
+    "statusMessage": {
+      "type": "string",
+      "minLength": 1,
+      "maxLength": 256
+    },
+    "port": {
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 65535
+    },
+    "logDeduplicationInterval": {
+      "type": ["integer", "string"],
+      "pattern": "` + durationSettingPattern + `",
+      "minimum": 1,
+      "maximum": 3600
     }
   },
+  "properties": {` + probeSettingsSchemaProperties + `,
+    "intervalInSeconds": {
+      "description": "The interval, in seconds or as a duration such as '7500ms', for how frequently to probe the endpoint for health status. A duration must be between 5s and 1m.",
+      "type": ["integer", "string"],
+      "pattern": "` + durationSettingPattern + `",
+      "default": 5,
+      "minimum": 5,
+      "maximum": 60
+    },
+    "maxIntervalInSeconds": {
+      "description": "Makes the probe interval adaptive: while the application is persistently Unhealthy, the interval doubles after each probe cycle up to this interval, in seconds or as a duration such as '5m', to reduce the pressure on the struggling application. The interval is shortened back to 'intervalInSeconds' as soon as a probe succeeds. Must be greater than 'intervalInSeconds' and a duration must be between 5s and 10m. The interval is fixed when not set.",
+      "type": ["integer", "string"],
+      "pattern": "` + durationSettingPattern + `",
+      "minimum": 6,
+      "maximum": 600
+    },
+    "defaultPorts": {
+      "description": "The ports probed on localhost, by protocol, when 'port' is not set or 0, overriding the well-known ports of the protocols: 80 for 'http', 443 for 'https', 22 for 'ssh', 3306 for 'mysql', 5432 for 'postgresql' and 6379 for 'redis'. Shared by all the probes.",
+      "type": "object",
+      "properties": {
+        "http": { "$ref": "#/definitions/port" },
+        "https": { "$ref": "#/definitions/port" },
+        "ssh": { "$ref": "#/definitions/port" },
+        "mysql": { "$ref": "#/definitions/port" },
+        "postgresql": { "$ref": "#/definitions/port" },
+        "redis": { "$ref": "#/definitions/port" }
+      },
+      "additionalProperties": false
+    },
+    "disableHealthProbe": {
+      "description": "Disables the monitoring of the application health: no probe runs and the status reports 'Health monitoring disabled' as a success, without health state substatuses, while the other services of the extension, such as the diagnostics endpoint, keep running. Cannot be combined with probe settings, 'applications' or 'probes'.",
+      "type": "boolean",
+      "default": false
+    },
+    "minimumStateDurationInSeconds": {
+      "description": "The time, in seconds, a health state is reported for at least before another transition is reported, even when the thresholds are crossed, so that automation reacting to the health state (such as autoheal or load balancer rotation) does not react to short oscillations. The end of the initialization is not delayed. Transitions are reported immediately when not set.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 3600
+    },
+    "applications": {
+      "description": "Applications probed independently and reported as named substatuses. The top level health state is aggregated from their states according to 'aggregation'. Cannot be combined with top level probe settings.",
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "object",
+        "properties": {
+` + applicationSettingsSchemaProperties + `
+        },
+        "required": ["name"],
+        "additionalProperties": false
+      }
+    },
+    "aggregation": {
+      "description": "How the top level health state is computed from the states of the 'applications': 'worstOf' takes the worst state, 'weighted' is Healthy when the weight of healthy applications reaches 'healthyWeightThreshold' of the total weight, 'requiredSubset' takes the worst state of the required applications. Defaults to 'worstOf'.",
+      "type": "string",
+      "enum": ["worstOf", "weighted", "requiredSubset"]
+    },
+    "healthyWeightThreshold": {
+      "description": "The fraction of the total weight of the 'applications' that must be healthy for the top level state to be Healthy when using 'weighted' aggregation.",
+      "type": "number",
+      "default": 0.5,
+      "minimum": 0,
+      "exclusiveMinimum": true,
+      "maximum": 1
+    },
+    "unhealthyWeightThreshold": {
+      "description": "The fraction of the total weight of the 'applications' below which the top level state is the worst state of the applications when using 'weighted' aggregation. Between it and 'healthyWeightThreshold', the top level state is degraded: Healthy, with a 'warning' extension status. When not set, there is no degraded state.",
+      "type": "number",
+      "minimum": 0,
+      "exclusiveMinimum": true,
+      "maximum": 1
+    },
+    "schemaVersion": {
+      "description": "The version of the structure of the settings. Version 1 settings are flat, version 2 settings group the probes in 'probes' and the observability settings in 'observability'. Defaults to 1.",
+      "type": "integer",
+      "enum": [1, 2]
+    },
+    "probes": {
+      "description": "Version 2 only - the probes, each probing an application. A single probe may be unnamed, the top level health state being its state. Otherwise, each probe must be named and is reported as a named substatus, the top level health state being aggregated according to 'aggregation'.",
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "object",
+        "properties": {` + applicationSettingsSchemaProperties + `
+        },
+        "additionalProperties": false
+      }
+    },
+    "observability": {
+      "description": "Version 2 only - the settings of how the extension reports and exposes the health of the VM.",
+      "type": "object",
+      "properties": {` + observabilitySettingsSchemaProperties + `
+      },
+      "additionalProperties": false
+    },` + flatObservabilitySettingsSchemaProperties + `
+  },
   "additionalProperties": false
 }`
 
@@ -59,6 +616,56 @@ const (
   "title": "Application Health - Protected Settings",
   "type": "object",
   "properties": {
+    "applicationInsightsInstrumentationKey": {
+      "description": "Instrumentation key of the Application Insights resource probe results and health state transitions are sent to.",
+      "type": "string",
+      "minLength": 1
+    },
+    "logAnalyticsWorkspaceId": {
+      "description": "Id of the Log Analytics workspace probe results and health state transitions are sent to, as records of the 'ApplicationHealth_CL' custom log.",
+      "type": "string",
+      "minLength": 1
+    },
+    "logAnalyticsSharedKey": {
+      "description": "Base64 encoded primary or secondary key of the Log Analytics workspace.",
+      "type": "string",
+      "minLength": 1
+    },
+    "databasePassword": {
+      "description": "Password the 'mysql', 'postgresql' and 'redis' probes authenticate with. Without it, the probes only check that the server accepts connections.",
+      "type": "string",
+      "minLength": 1
+    },
+    "requestHeaders": {
+      "description": "Headers sent with the requests of the http/https probes, such as API keys or authorization tokens. Their values are never logged.",
+      "type": "object",
+      "additionalProperties": {
+        "type": "string",
+        "minLength": 1
+      }
+    },
+    "clientCertificate": {
+      "description": "PEM encoded client certificate, and its chain, the https probes present for mutual TLS.",
+      "type": "string",
+      "minLength": 1
+    },
+    "clientKey": {
+      "description": "PEM encoded private key of the 'clientCertificate'.",
+      "type": "string",
+      "minLength": 1
+    },
+    "proxyUsername": {
+      "description": "User the http/https probes authenticate to their 'proxyUrl' as, with basic authentication.",
+      "type": "string",
+      "minLength": 1
+    },
+    "proxyPassword": {
+      "description": "Password of the 'proxyUsername'.",
+      "type": "string"
+    }
+  },
+  "dependencies": {
+    "proxyPassword": ["proxyUsername"]
   },
   "additionalProperties": false
 }`
@@ -97,6 +704,25 @@ func validateSettingsObject(settingsType, schemaJSON, docJSON string) error {
 	return nil
 }
 
+// settingsSchemaErrors validates docJSON with schemaJSON and returns all the
+// validation errors, rather than the first one.
+func settingsSchemaErrors(settingsType, schemaJSON, docJSON string) ([]string, error) {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schemaJSON))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load %s settings schema", settingsType)
+	}
+	res, err := schema.Validate(gojsonschema.NewStringLoader(docJSON))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s settings JSON", settingsType)
+	}
+
+	var errs []string
+	for _, err := range res.Errors() {
+		errs = append(errs, fmt.Sprintf("%s settings: %s", settingsType, err))
+	}
+	return errs, nil
+}
+
 func validatePublicSettings(json string) error {
 	return validateSettingsObject("public", publicSettingsSchema, json)
 }
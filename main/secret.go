@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// secretRef holds a secret delivered in the protected settings. Its value is
+// only returned by reveal: formatting, logging or marshaling a secretRef
+// yields redactedValue, so that the secret is not accidentally written to the
+// logs, the status or the output of the tool commands.
+type secretRef struct {
+	value string
+}
+
+func newSecretRef(value string) secretRef {
+	return secretRef{value: value}
+}
+
+// reveal returns the value of the secret, to be used only where the secret is
+// sent to the service it authenticates with.
+func (s secretRef) reveal() string {
+	return s.value
+}
+
+func (s secretRef) isSet() bool {
+	return s.value != ""
+}
+
+// String returns redactedValue, or an empty string when the secret is not set.
+func (s secretRef) String() string {
+	if !s.isSet() {
+		return ""
+	}
+	return redactedValue
+}
+
+// Format formats the secret as String does, whatever the verb.
+func (s secretRef) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, s.String())
+}
+
+// MarshalText marshals the secret as String does, for JSON and logfmt.
+func (s secretRef) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *secretRef) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &s.value)
+}
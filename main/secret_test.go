@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretRef(t *testing.T) {
+	s := newSecretRef("s3cr3t")
+	require.Equal(t, "s3cr3t", s.reveal())
+	require.True(t, s.isSet())
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q"} {
+		require.Equal(t, redactedValue, fmt.Sprintf(format, s), format)
+	}
+	require.Equal(t, "{<redacted>}", fmt.Sprintf("%v", struct{ Key secretRef }{s}))
+
+	b, err := json.Marshal(protectedSettings{DatabasePassword: s})
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "s3cr3t")
+	var m map[string]interface{}
+	require.Nil(t, json.Unmarshal(b, &m))
+	require.Equal(t, redactedValue, m["databasePassword"])
+
+	var buf bytes.Buffer
+	log.NewLogfmtLogger(&buf).Log("password", s)
+	require.Equal(t, "password=<redacted>\n", buf.String())
+
+	require.Equal(t, "", fmt.Sprint(secretRef{}))
+}
+
+func TestSecretRef_unmarshal(t *testing.T) {
+	var p protectedSettings
+	require.Nil(t, json.Unmarshal([]byte(`{"databasePassword": "s3cr3t", "requestHeaders": {"X-Api-Key": "k3y"}}`), &p))
+	require.Equal(t, "s3cr3t", p.DatabasePassword.reveal())
+	require.Equal(t, "k3y", p.RequestHeaders["X-Api-Key"].reveal())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// selfTestDialTimeout bounds the check that a probe target port is bound.
+const selfTestDialTimeout = time.Second
+
+// selfTestCheck is the outcome of a check of the self-test.
+type selfTestCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// selfTestReport is the outcome of the self-test run when the extension is
+// enabled, before the first probes. It catches misconfigurations, such as a
+// probe targeting a port nothing listens on, without waiting for the grace
+// period to expire.
+type selfTestReport struct {
+	Ready  bool            `json:"ready"`
+	Checks []selfTestCheck `json:"checks"`
+}
+
+// runSelfTest checks that the folders the extension writes to are writable and
+// that the targets of the probes exist.
+func runSelfTest(paths handlerPaths, cfg *handlerSettings) selfTestReport {
+	checks := []selfTestCheck{
+		checkWritable("statusFolder", paths.statusFolder()),
+		checkWritable("dataDir", paths.dataFolder()),
+	}
+	if paths.logFolder() != "" {
+		checks = append(checks, checkWritable("logFolder", paths.logFolder()))
+	}
+	for _, a := range cfg.applications() {
+		appCfg := a.handlerSettings(cfg)
+		name := "probeTarget"
+		if a.Name != "" {
+			name = fmt.Sprintf("probeTarget/%s", a.Name)
+		}
+		if check, ok := checkProbeTarget(name, &appCfg); ok {
+			checks = append(checks, check)
+		}
+	}
+
+	report := selfTestReport{Ready: true, Checks: checks}
+	for _, c := range checks {
+		report.Ready = report.Ready && c.Passed
+	}
+	return report
+}
+
+// message returns the status message of the self-test, naming the first
+// failed check.
+func (r selfTestReport) message() string {
+	for _, c := range r.Checks {
+		if !c.Passed {
+			return fmt.Sprintf("Extension self-test failed: %s: %s", c.Name, c.Detail)
+		}
+	}
+	return "Extension ready"
+}
+
+// substatus returns the substatus reporting the self-test, an error when a
+// check failed.
+func (r selfTestReport) substatus() (SubstatusItem, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return SubstatusItem{}, err
+	}
+	statusType := StatusSuccess
+	if !r.Ready {
+		statusType = StatusError
+	}
+	return NewSubstatus(SubstatusKeyNameSelfTest, statusType, string(b)), nil
+}
+
+// checkWritable checks that a file can be created in dir.
+func checkWritable(name, dir string) selfTestCheck {
+	f, err := ioutil.TempFile(dir, ".selftest")
+	if err != nil {
+		return selfTestCheck{Name: name, Detail: fmt.Sprintf("'%s' is not writable: %v", dir, err)}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return selfTestCheck{Name: name, Passed: true}
+}
+
+// checkProbeTarget checks that the target of a probe exists: that the port of
+// network probes is bound on localhost, that the folder of the files read by
+// file, process, fastcgi and aggregator probes exists, and that icmp probes are allowed to
+// open an ICMP socket. It reports false for probes whose target can't be
+// checked before probing.
+func checkProbeTarget(name string, cfg *handlerSettings) (selfTestCheck, bool) {
+	if cfg.discoverPortOfProcess() != "" {
+		return selfTestCheck{}, false
+	}
+
+	switch cfg.protocol() {
+	case "file":
+		return checkFolderExists(name, filepath.Dir(cfg.filePath())), true
+	case "process":
+		if cfg.pidFile() == "" {
+			return selfTestCheck{}, false
+		}
+		return checkFolderExists(name, filepath.Dir(cfg.pidFile())), true
+	case "fastcgi":
+		if socket := cfg.fastcgiSocket(); socket != "" {
+			if _, err := os.Stat(socket); err != nil {
+				return selfTestCheck{Name: name, Detail: fmt.Sprintf("socket '%s' does not exist", socket)}, true
+			}
+			return selfTestCheck{Name: name, Passed: true}, true
+		}
+	case "aggregator":
+		if socket := cfg.aggregatorSocket(); socket != "" {
+			if _, err := os.Stat(socket); err != nil {
+				return selfTestCheck{Name: name, Detail: fmt.Sprintf("socket '%s' does not exist", socket)}, true
+			}
+			return selfTestCheck{Name: name, Passed: true}, true
+		}
+	case "icmp":
+		socket, err := listenIcmp()
+		if err != nil {
+			return selfTestCheck{Name: name, Detail: err.Error()}, true
+		}
+		socket.conn.Close()
+		return selfTestCheck{Name: name, Passed: true}, true
+	}
+
+	port := selfTestPort(cfg)
+	if port == 0 {
+		return selfTestCheck{}, false
+	}
+	address := net.JoinHostPort("localhost", strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", address, selfTestDialTimeout)
+	if err != nil {
+		return selfTestCheck{Name: name, Detail: fmt.Sprintf("nothing listens on %s: %s", address, classifyRequestError(err))}, true
+	}
+	conn.Close()
+	return selfTestCheck{Name: name, Passed: true}, true
+}
+
+// selfTestPort returns the tcp port probed on localhost, 0 for probes which
+// don't connect to a tcp port.
+func selfTestPort(cfg *handlerSettings) int {
+	switch cfg.protocol() {
+	case "tcp", "fastcgi", "aggregator", "http", "https", "metrics", "ssh", "mysql", "postgresql", "redis":
+		return cfg.probePort()
+	default:
+		return 0
+	}
+}
+
+func checkFolderExists(name, dir string) selfTestCheck {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return selfTestCheck{Name: name, Detail: fmt.Sprintf("folder '%s' does not exist", dir)}
+	}
+	return selfTestCheck{Name: name, Passed: true}
+}
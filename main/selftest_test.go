@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selftest")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Equal(t, selfTestCheck{Name: "statusFolder", Passed: true}, checkWritable("statusFolder", dir))
+	files, _ := ioutil.ReadDir(dir)
+	require.Empty(t, files)
+
+	check := checkWritable("statusFolder", filepath.Join(dir, "missing"))
+	require.False(t, check.Passed)
+	require.Contains(t, check.Detail, "is not writable")
+}
+
+func TestCheckProbeTarget(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+
+	check, ok := checkProbeTarget("probeTarget", &handlerSettings{publicSettings: publicSettings{Protocol: "http", Port: port}})
+	require.True(t, ok)
+	require.Equal(t, selfTestCheck{Name: "probeTarget", Passed: true}, check)
+
+	// nothing listens on the port anymore
+	l.Close()
+	check, ok = checkProbeTarget("probeTarget", &handlerSettings{publicSettings: publicSettings{Protocol: "tcp", Port: port}})
+	require.True(t, ok)
+	require.False(t, check.Passed)
+	require.Contains(t, check.Detail, "nothing listens on")
+	require.Contains(t, check.Detail, "connectionRefused")
+
+	// file probe folder
+	check, ok = checkProbeTarget("probeTarget", &handlerSettings{publicSettings: publicSettings{Protocol: "file", FilePath: "/nonexistent/healthy"}})
+	require.True(t, ok)
+	require.Equal(t, "folder '/nonexistent' does not exist", check.Detail)
+
+	// targets which can't be checked before probing
+	_, ok = checkProbeTarget("probeTarget", &handlerSettings{publicSettings: publicSettings{Protocol: "systemd", UnitName: "nginx.service"}})
+	require.False(t, ok)
+	_, ok = checkProbeTarget("probeTarget", &handlerSettings{publicSettings: publicSettings{Protocol: "tcp", DiscoverPortOfProcess: "nginx"}})
+	require.False(t, ok)
+}
+
+func TestRunSelfTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selftest")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	h := handlerPaths{status: dir, data: dir}
+	report := runSelfTest(h, &handlerSettings{publicSettings: publicSettings{Protocol: "file", FilePath: filepath.Join(dir, "healthy")}})
+	require.True(t, report.Ready)
+	require.Equal(t, "Extension ready", report.message())
+	s, err := report.substatus()
+	require.Nil(t, err)
+	require.Equal(t, SubstatusKeyNameSelfTest, s.Name)
+	require.Equal(t, StatusSuccess, s.Status)
+
+	// named applications
+	report = runSelfTest(h, &handlerSettings{publicSettings: publicSettings{Applications: []applicationSettings{
+		{Name: "web", publicSettings: publicSettings{Protocol: "file", FilePath: filepath.Join(dir, "healthy")}},
+		{Name: "worker", publicSettings: publicSettings{Protocol: "file", FilePath: "/nonexistent/healthy"}},
+	}}})
+	require.False(t, report.Ready)
+	require.Equal(t, "Extension self-test failed: probeTarget/worker: folder '/nonexistent' does not exist", report.message())
+	s, err = report.substatus()
+	require.Nil(t, err)
+	require.Equal(t, StatusError, s.Status)
+}
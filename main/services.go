@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// runningServices are the services of the enabled extension, which the
+// diagnostics endpoint reports on.
+var runningServices = &serviceManager{}
+
+// service is an internal component of the extension which runs independently
+// of the others, such as the prober or the diagnostics endpoint.
+type service interface {
+	name() string
+	// start starts the service without blocking.
+	start(ctx *log.Context) error
+	// stop stops the service, returning once it stopped.
+	stop()
+	health() serviceHealth
+}
+
+// serviceHealth is the state of a service.
+type serviceHealth struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	Error   string `json:"error,omitempty"`
+}
+
+// serviceManager starts services and stops them in the reverse order, so that
+// a service is stopped before those it was started after.
+type serviceManager struct {
+	mu       sync.Mutex
+	services []service
+}
+
+// start starts a service, which is managed once it started.
+func (m *serviceManager) start(ctx *log.Context, s service) error {
+	if err := s.start(ctx); err != nil {
+		return errors.Wrapf(err, "failed to start %s", s.name())
+	}
+	m.mu.Lock()
+	m.services = append(m.services, s)
+	m.mu.Unlock()
+	ctx.Log("event", "started "+s.name())
+	return nil
+}
+
+// stopAll stops the managed services, the last started first.
+func (m *serviceManager) stopAll(ctx *log.Context) {
+	m.mu.Lock()
+	services := m.services
+	m.services = nil
+	m.mu.Unlock()
+	for i := len(services) - 1; i >= 0; i-- {
+		services[i].stop()
+		ctx.Log("event", "stopped "+services[i].name())
+	}
+}
+
+// report returns the health of the managed services.
+func (m *serviceManager) report() []serviceHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	report := make([]serviceHealth, 0, len(m.services))
+	for _, s := range m.services {
+		report = append(report, s.health())
+	}
+	return report
+}
+
+// loopService runs a function, such as the probe loop, in its own goroutine
+// until it returns or the service is stopped.
+type loopService struct {
+	serviceName string
+	// run runs until stop is closed, or fails.
+	run func(stop <-chan struct{}) error
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	done     chan struct{}
+	err      error
+}
+
+func newLoopService(name string, run func(stop <-chan struct{}) error) *loopService {
+	return &loopService{serviceName: name, run: run, stopCh: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (s *loopService) name() string {
+	return s.serviceName
+}
+
+func (s *loopService) start(ctx *log.Context) error {
+	go func() {
+		defer close(s.done)
+		s.err = s.run(s.stopCh)
+	}()
+	return nil
+}
+
+func (s *loopService) stop() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	<-s.done
+}
+
+// wait returns the error of the function once it returned.
+func (s *loopService) wait() error {
+	<-s.done
+	return s.err
+}
+
+func (s *loopService) health() serviceHealth {
+	h := serviceHealth{Name: s.serviceName, Running: true}
+	select {
+	case <-s.done:
+		h.Running = false
+		if s.err != nil {
+			h.Error = s.err.Error()
+		}
+	default:
+	}
+	return h
+}
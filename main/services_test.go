@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeService records when it is started and stopped.
+type fakeService struct {
+	serviceName string
+	startErr    error
+	events      *[]string
+}
+
+func (s *fakeService) name() string {
+	return s.serviceName
+}
+
+func (s *fakeService) start(ctx *log.Context) error {
+	*s.events = append(*s.events, "start "+s.serviceName)
+	return s.startErr
+}
+
+func (s *fakeService) stop() {
+	*s.events = append(*s.events, "stop "+s.serviceName)
+}
+
+func (s *fakeService) health() serviceHealth {
+	return serviceHealth{Name: s.serviceName, Running: true}
+}
+
+func TestServiceManager(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	var events []string
+	m := &serviceManager{}
+	require.Nil(t, m.start(ctx, &fakeService{serviceName: "diagnostics", events: &events}))
+	require.Nil(t, m.start(ctx, &fakeService{serviceName: "telemetry", events: &events}))
+	err := m.start(ctx, &fakeService{serviceName: "exporter", startErr: errors.New("no endpoint"), events: &events})
+	require.EqualError(t, err, "failed to start exporter: no endpoint")
+
+	// a service which failed to start is not managed
+	require.Equal(t, []serviceHealth{{Name: "diagnostics", Running: true}, {Name: "telemetry", Running: true}}, m.report())
+
+	m.stopAll(ctx)
+	require.Equal(t, []string{"start diagnostics", "start telemetry", "start exporter", "stop telemetry", "stop diagnostics"}, events)
+	require.Empty(t, m.report())
+}
+
+func TestLoopService(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// stopped
+	s := newLoopService("prober", func(stop <-chan struct{}) error {
+		<-stop
+		return errTerminated
+	})
+	require.Nil(t, s.start(ctx))
+	require.Equal(t, serviceHealth{Name: "prober", Running: true}, s.health())
+	s.stop()
+	s.stop()
+	require.Equal(t, errTerminated, s.wait())
+	require.Equal(t, serviceHealth{Name: "prober", Error: errTerminated.Error()}, s.health())
+
+	// returned on its own
+	s = newLoopService("prober", func(stop <-chan struct{}) error {
+		return nil
+	})
+	require.Nil(t, s.start(ctx))
+	require.Nil(t, s.wait())
+	require.Equal(t, serviceHealth{Name: "prober"}, s.health())
+	s.stop()
+}
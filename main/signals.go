@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// notifyOperatorSignals subscribes to the signals operators send to the
+// enabled extension during live troubleshooting: SIGUSR1 runs a probe cycle
+// and writes the status immediately, rather than at the next interval, and
+// SIGUSR2 logs the internal state of the extension. The returned function
+// unsubscribes.
+func notifyOperatorSignals() (<-chan os.Signal, func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	return signals, func() { signal.Stop(signals) }
+}
+
+// logInternalState logs the state of the applications, of the scheduling and
+// of the services, along with the latest status.
+func logInternalState(ctx *log.Context, apps []*application, scheduler *probeScheduler, now time.Duration) {
+	status := latestStatus.get()
+	metrics := scheduler.metrics(apps)
+	ctx.Log("event", "internal state",
+		"goroutines", runtime.NumGoroutine(),
+		"nextProbeIn", (scheduler.next - now).Round(time.Millisecond),
+		"skippedRuns", metrics.SkippedRuns,
+		"probesExceedingDeadline", metrics.ProbesExceedingDeadline,
+		"services", len(runningServices.report()))
+	if len(status) > 0 {
+		ctx.Log("event", "internal state: latest status", "status", status[0].Status.Status, "message", status[0].Status.FormattedMessage.Message)
+	}
+	for _, app := range apps {
+		ctx.Log("event", "internal state: application",
+			"application", app.name,
+			"committedState", app.committedState,
+			"lastHealthState", app.lastResponse.ApplicationHealthState,
+			"failure", app.lastResponse.ProbeDetails.Failure,
+			"lastProbeStart", app.lastProbeStart.UTC().Format(time.RFC3339),
+			"lastProbeDuration", app.lastProbeDuration.Round(time.Millisecond),
+			"probeInFlight", app.inFlight != nil,
+			"skippedRuns", app.skippedRuns,
+			"deadlineExceeded", app.deadlineExceeded)
+	}
+	for _, s := range runningServices.report() {
+		ctx.Log("event", "internal state: service", "service", s.Name, "running", s.Running, "error", s.Error)
+	}
+}
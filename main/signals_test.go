@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyOperatorSignals(t *testing.T) {
+	signals, stop := notifyOperatorSignals()
+	defer stop()
+
+	for _, sig := range []syscall.Signal{syscall.SIGUSR1, syscall.SIGUSR2} {
+		require.Nil(t, syscall.Kill(syscall.Getpid(), sig))
+		select {
+		case received := <-signals:
+			require.Equal(t, sig, received)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v not received", sig)
+		}
+	}
+}
+
+func TestLogInternalState(t *testing.T) {
+	var b bytes.Buffer
+	ctx := log.NewContext(log.NewLogfmtLogger(&b))
+	c := newFakeClock()
+	scheduler := newProbeScheduler(5*time.Second, c)
+	scheduler.advance()
+	app := &application{name: "web", committedState: Unhealthy, skippedRuns: 2}
+	app.lastResponse.ProbeDetails.Failure = probeFailureTimeout
+
+	logInternalState(ctx, []*application{app}, scheduler, c.monotonic())
+	require.Contains(t, b.String(), "nextProbeIn=5s skippedRuns=2")
+	require.Contains(t, b.String(), "application=web committedState=Unhealthy")
+	require.Contains(t, b.String(), "failure=timeout")
+}
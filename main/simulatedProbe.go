@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// simulationRepeat is the last line of a simulation file which replays its
+// states from the start once they are all reported.
+const simulationRepeat = "repeat"
+
+// simulatedStates are the states a simulation file can script, Unknown
+// standing for a failed probe.
+var simulatedStates = map[HealthStatus]bool{
+	Healthy:   true,
+	Unhealthy: true,
+	Unknown:   true,
+}
+
+// simulationStep is a state of a simulation file and the number of probe
+// cycles it is reported for.
+type simulationStep struct {
+	state  HealthStatus
+	cycles int
+}
+
+// SimulatedHealthProbe reports the states scripted in a local file instead of
+// probing the application, so that the automatic repairs and rolling upgrades
+// relying on the health of the VM can be validated end to end without
+// breaking a real application. Each line of the file is a state, optionally
+// followed by the number of probe cycles it lasts, such as 'Unhealthy 3';
+// blank lines and lines starting with '#' are ignored. The last state is
+// reported once the file is exhausted, unless its last line is 'repeat'. The
+// file is read again, from its first state, whenever it is modified.
+type SimulatedHealthProbe struct {
+	Path string
+
+	modTime time.Time
+	steps   []simulationStep
+	repeat  bool
+	// cycle is the number of probe cycles reported since the file was read.
+	cycle int
+}
+
+func NewSimulatedHealthProbe(path string) *SimulatedHealthProbe {
+	return &SimulatedHealthProbe{Path: path}
+}
+
+func (p *SimulatedHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unknown
+	probeResponse.ProbeDetails.Simulated = true
+
+	fi, err := os.Stat(p.Path)
+	if err != nil {
+		return probeResponse, errors.Wrap(err, "failed to stat simulation file")
+	}
+	if !fi.ModTime().Equal(p.modTime) || p.steps == nil {
+		steps, repeat, err := readSimulationFile(p.Path)
+		if err != nil {
+			return probeResponse, err
+		}
+		p.modTime, p.steps, p.repeat, p.cycle = fi.ModTime(), steps, repeat, 0
+		ctx.Log("event", "simulation file read", "path", p.Path, "states", len(steps), "repeat", repeat)
+	}
+
+	probeResponse.ApplicationHealthState = p.state(p.cycle)
+	p.cycle++
+	return probeResponse, nil
+}
+
+// state returns the state scripted for the probe cycle.
+func (p *SimulatedHealthProbe) state(cycle int) HealthStatus {
+	total := 0
+	for _, step := range p.steps {
+		total += step.cycles
+	}
+	if cycle >= total {
+		if !p.repeat {
+			return p.steps[len(p.steps)-1].state
+		}
+		cycle %= total
+	}
+	for _, step := range p.steps {
+		if cycle < step.cycles {
+			return step.state
+		}
+		cycle -= step.cycles
+	}
+	return p.steps[len(p.steps)-1].state
+}
+
+func (p *SimulatedHealthProbe) address() string {
+	return p.Path
+}
+
+func (p *SimulatedHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
+
+// readSimulationFile returns the steps of the simulation file and whether
+// they are repeated.
+func readSimulationFile(path string) ([]simulationStep, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to open simulation file")
+	}
+	defer f.Close()
+
+	var steps []simulationStep
+	repeat := false
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		invalid := func(reason string) error {
+			return errors.New(fmt.Sprintf("Line %d of simulation file is not valid: %s", n, reason))
+		}
+		if repeat {
+			return nil, false, invalid(fmt.Sprintf("'%s' must be the last line", simulationRepeat))
+		}
+		if line == simulationRepeat {
+			repeat = true
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, false, invalid("expected a state and an optional number of probe cycles")
+		}
+		step := simulationStep{state: HealthStatus(fields[0]), cycles: 1}
+		if !simulatedStates[step.state] {
+			return nil, false, invalid(fmt.Sprintf("'%s' is not one of Healthy, Unhealthy or Unknown", fields[0]))
+		}
+		if len(fields) == 2 {
+			if step.cycles, err = strconv.Atoi(fields[1]); err != nil || step.cycles < 1 {
+				return nil, false, invalid(fmt.Sprintf("'%s' is not a number of probe cycles", fields[1]))
+			}
+		}
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, errors.Wrap(err, "failed to read simulation file")
+	}
+	if len(steps) == 0 {
+		return nil, false, errors.New("Simulation file has no states")
+	}
+	return steps, repeat, nil
+}
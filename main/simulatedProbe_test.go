@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// evaluateSimulatedProbe returns the states of the next cycles of the probe.
+func evaluateSimulatedProbe(t *testing.T, p *SimulatedHealthProbe, cycles int) []HealthStatus {
+	var states []HealthStatus
+	for i := 0; i < cycles; i++ {
+		probeResponse, err := p.evaluate(log.NewContext(log.NewNopLogger()))
+		require.Nil(t, err)
+		require.True(t, probeResponse.ProbeDetails.Simulated)
+		states = append(states, probeResponse.ApplicationHealthState)
+	}
+	return states
+}
+
+func TestSimulatedHealthProbe_evaluate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simulation")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "simulation")
+	p := NewSimulatedHealthProbe(path)
+
+	// missing file
+	probeResponse, err := p.evaluate(log.NewContext(log.NewNopLogger()))
+	require.NotNil(t, err)
+	require.Equal(t, Unknown, probeResponse.ApplicationHealthState)
+
+	// the last state is held
+	require.Nil(t, ioutil.WriteFile(path, []byte("# rolling upgrade\nHealthy 2\n\nUnhealthy\nUnknown 2\n"), 0644))
+	require.Equal(t, []HealthStatus{Healthy, Healthy, Unhealthy, Unknown, Unknown, Unknown}, evaluateSimulatedProbe(t, p, 6))
+
+	// a modified file is replayed from its start
+	require.Nil(t, ioutil.WriteFile(path, []byte("Unhealthy\nHealthy 2\nrepeat\n"), 0644))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.Equal(t, []HealthStatus{Unhealthy, Healthy, Healthy, Unhealthy, Healthy, Healthy, Unhealthy}, evaluateSimulatedProbe(t, p, 7))
+}
+
+func TestReadSimulationFile_invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simulation")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "simulation")
+
+	for content, expected := range map[string]string{
+		"":                         "Simulation file has no states",
+		"# comment\nrepeat\n":      "Simulation file has no states",
+		"Healthy\nDegraded\n":      "Line 2 of simulation file is not valid: 'Degraded' is not one of Healthy, Unhealthy or Unknown",
+		"Healthy 0\n":              "Line 1 of simulation file is not valid: '0' is not a number of probe cycles",
+		"Healthy 1 2\n":            "Line 1 of simulation file is not valid: expected a state and an optional number of probe cycles",
+		"Healthy\nrepeat\nHealthy": "Line 3 of simulation file is not valid: 'repeat' must be the last line",
+	} {
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+		_, _, err := readSimulationFile(path)
+		require.NotNil(t, err, content)
+		require.Equal(t, expected, err.Error(), content)
+	}
+}
+
+func TestNewHealthProbe_simulationFile(t *testing.T) {
+	cfg := &handlerSettings{publicSettings: publicSettings{Protocol: "http", Port: 8080, SimulationFile: "/etc/apphealth/simulation", CircuitBreakerTimeouts: 3}}
+	p := NewHealthProbe(log.NewContext(log.NewNopLogger()), cfg, 0)
+	require.Equal(t, NewSimulatedHealthProbe("/etc/apphealth/simulation"), p)
+}
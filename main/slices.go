@@ -0,0 +1,11 @@
+package main
+
+// containsString returns whether s is one of values.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSshPort = 22
+	// maxSshBannerLineLength is the maximum length of the identification line,
+	// including CR LF (RFC 4253, section 4.2).
+	maxSshBannerLineLength = 255
+	// maxSshBannerLines bounds the lines the server may send before its
+	// identification line.
+	maxSshBannerLines = 16
+	sshIdentification = "SSH-2.0-ApplicationHealthExtension"
+)
+
+// SshHealthProbe connects to a local port and considers the application
+// healthy when an SSH identification line supporting protocol 2.0 is received
+// within Timeout, which a daemon accepting connections but wedged doesn't
+// send.
+type SshHealthProbe struct {
+	Address string
+	Timeout time.Duration
+}
+
+func NewSshHealthProbe(port int, timeout time.Duration) *SshHealthProbe {
+	if port == 0 {
+		port = defaultSshPort
+	}
+	return &SshHealthProbe{
+		Address: "localhost:" + strconv.Itoa(port),
+		Timeout: timeout,
+	}
+}
+
+func (p *SshHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unhealthy
+
+	conn, err := net.DialTimeout("tcp", p.address(), p.Timeout)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(p.Timeout)); err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureConnection
+		return probeResponse, err
+	}
+
+	if _, err := readSshBanner(bufio.NewReaderSize(conn, maxSshBannerLineLength)); err != nil {
+		if _, ok := err.(*sshBannerError); ok {
+			probeResponse.ProbeDetails.Failure = probeFailureBadBody
+		} else {
+			probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+			err = errors.Wrap(err, "No SSH identification received")
+		}
+		return probeResponse, err
+	}
+	// identify as well, so that the daemon doesn't report a client which
+	// didn't send its identification
+	conn.Write([]byte(sshIdentification + "\r\n"))
+
+	probeResponse.ApplicationHealthState = Healthy
+	return probeResponse, nil
+}
+
+func (p *SshHealthProbe) address() string {
+	return p.Address
+}
+
+func (p *SshHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
+
+// sshBannerError is an invalid identification from the server, as opposed to
+// a connection error.
+type sshBannerError struct {
+	message string
+}
+
+func (e *sshBannerError) Error() string {
+	return e.message
+}
+
+// readSshBanner returns the identification line of the server, skipping the
+// lines it may send before. Protocol versions 2.0 and 1.99, which supports
+// 2.0 as well, are accepted.
+func readSshBanner(r *bufio.Reader) (string, error) {
+	for i := 0; i < maxSshBannerLines; i++ {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return "", &sshBannerError{fmt.Sprintf("SSH identification line exceeds %d bytes", maxSshBannerLineLength)}
+		} else if err != nil {
+			return "", err
+		}
+
+		banner := strings.TrimRight(string(line), "\r\n")
+		if !strings.HasPrefix(banner, "SSH-") {
+			continue
+		}
+		if strings.HasPrefix(banner, "SSH-2.0-") || strings.HasPrefix(banner, "SSH-1.99-") {
+			return banner, nil
+		}
+		return "", &sshBannerError{fmt.Sprintf("Unsupported SSH identification '%s'", bodyExcerpt([]byte(banner)))}
+	}
+	return "", &sshBannerError{fmt.Sprintf("No SSH identification in the first %d lines", maxSshBannerLines)}
+}
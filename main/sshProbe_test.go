@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSshHealthProbe_evaluate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	banners := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(<-banners))
+			conn.Close()
+		}
+	}()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	probe := NewSshHealthProbe(l.Addr().(*net.TCPAddr).Port, 5*time.Second)
+	banners <- "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\n"
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	banners <- "SSH-1.5-OldServer\r\n"
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, "Unsupported SSH identification 'SSH-1.5-OldServer'", err.Error())
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureBadBody, probeResponse.ProbeDetails.Failure)
+
+	// a wedged daemon accepts the connection but doesn't identify
+	banners <- ""
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "No SSH identification received")
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
+
+func TestSshHealthProbe_evaluate_Timeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	// the connection is accepted by the kernel, nothing is ever sent
+	probe := NewSshHealthProbe(l.Addr().(*net.TCPAddr).Port, 100*time.Millisecond)
+	probeResponse, err := probe.evaluate(log.NewContext(log.NewNopLogger()))
+	require.NotNil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+	require.Equal(t, probeFailureTimeout, probeResponse.ProbeDetails.Failure)
+}
+
+func TestReadSshBanner(t *testing.T) {
+	// lines sent before the identification are skipped
+	banner, err := readSshBanner(bufio.NewReader(strings.NewReader("Welcome\r\nSSH-1.99-Cisco-1.25\r\n")))
+	require.Nil(t, err)
+	require.Equal(t, "SSH-1.99-Cisco-1.25", banner)
+
+	_, err = readSshBanner(bufio.NewReaderSize(strings.NewReader(strings.Repeat("a", 300)+"\r\n"), maxSshBannerLineLength))
+	require.NotNil(t, err)
+	require.Equal(t, "SSH identification line exceeds 255 bytes", err.Error())
+
+	_, err = readSshBanner(bufio.NewReader(strings.NewReader(strings.Repeat("motd\r\n", maxSshBannerLines))))
+	require.NotNil(t, err)
+	require.Equal(t, "No SSH identification in the first 16 lines", err.Error())
+}
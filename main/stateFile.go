@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	stateFileFormatJson = "json"
+	stateFileFormatLine = "line"
+)
+
+// stateFile is the content of the state file in the 'json' format.
+type stateFile struct {
+	State     HealthStatus `json:"state"`
+	Since     time.Time    `json:"since"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+	// Applications are the committed states of the named applications.
+	Applications map[string]HealthStatus `json:"applications,omitempty"`
+}
+
+// stateFileWriter writes the committed health state to a well-known path after
+// each probe cycle, so that the other agents of the VM can consume it without
+// parsing the status files. The file is replaced atomically, readers never
+// seeing a partial write; the 'updatedAt' time of the 'json' format tells
+// them whether it is stale.
+type stateFileWriter struct {
+	path   string
+	format string
+
+	state HealthStatus
+	since time.Time
+}
+
+// newStateFileWriter returns the writer of the configured state file, or nil
+// when there is none.
+func newStateFileWriter(cfg *handlerSettings) *stateFileWriter {
+	if cfg.stateFilePath() == "" {
+		return nil
+	}
+	return &stateFileWriter{path: cfg.stateFilePath(), format: cfg.stateFileFormat()}
+}
+
+// subscribe writes the committed state of the probe cycles published on the
+// bus.
+func (w *stateFileWriter) subscribe(bus *eventBus) {
+	bus.subscribe(busEventProbeCycle, func(ctx *log.Context, e busEvent) {
+		if err := w.write(e.CommittedState, e.Apps, e.End); err != nil {
+			ctx.Log("error", err)
+		}
+	})
+}
+
+// write writes the committed state of the probe cycle which ended at now.
+func (w *stateFileWriter) write(state HealthStatus, apps []*application, now time.Time) error {
+	if state != w.state {
+		w.state, w.since = state, now
+	}
+
+	var b []byte
+	if w.format == stateFileFormatLine {
+		b = []byte(string(state) + "\n")
+	} else {
+		f := stateFile{State: state, Since: w.since.UTC(), UpdatedAt: now.UTC()}
+		for _, app := range apps {
+			if app.name == "" {
+				continue
+			}
+			if f.Applications == nil {
+				f.Applications = make(map[string]HealthStatus)
+			}
+			f.Applications[app.name] = app.committedState
+		}
+		var err error
+		if b, err = json.Marshal(f); err != nil {
+			return errors.Wrap(err, "failed to marshal state file")
+		}
+		b = append(b, '\n')
+	}
+
+	dir := filepath.Dir(w.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create state file folder")
+	}
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(w.path))
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	tmpFile.Close()
+	// readable by the other agents, the temporary file being private
+	err = ioutil.WriteFile(tmpFile.Name(), b, 0644)
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "failed to write state file")
+	}
+	if err := os.Rename(tmpFile.Name(), w.path); err != nil {
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "failed to move state file")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateFileWriter_json(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "apphealth", "state")
+	w := newStateFileWriter(observabilityConfig(observabilitySettings{StateFilePath: path}))
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	apps := []*application{{name: "web", committedState: Healthy}, {name: "api", committedState: Unhealthy}}
+
+	require.Nil(t, w.write(Healthy, apps, start))
+	require.Nil(t, w.write(Healthy, apps, start.Add(5*time.Second)))
+	var f stateFile
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(b, &f))
+	require.Equal(t, stateFile{
+		State:        Healthy,
+		Since:        start,
+		UpdatedAt:    start.Add(5 * time.Second),
+		Applications: map[string]HealthStatus{"web": Healthy, "api": Unhealthy},
+	}, f)
+
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	// the temporary files are renamed
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+
+	require.Nil(t, w.write(Unhealthy, apps, start.Add(10*time.Second)))
+	b, err = ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(b, &f))
+	require.Equal(t, Unhealthy, f.State)
+	require.Equal(t, start.Add(10*time.Second), f.Since)
+}
+
+func TestStateFileWriter_line(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+	w := newStateFileWriter(observabilityConfig(observabilitySettings{StateFilePath: path, StateFileFormat: stateFileFormatLine}))
+
+	require.Nil(t, w.write(Initializing, []*application{{}}, time.Now()))
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "Initializing\n", string(b))
+
+	require.Nil(t, newStateFileWriter(&handlerSettings{}))
+}
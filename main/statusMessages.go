@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The status messages which can be overridden with 'statusMessages'.
+const (
+	// statusMessageHealthy and statusMessageUnhealthy are the messages of the
+	// AppHealthStatus substatus.
+	statusMessageHealthy   = "healthy"
+	statusMessageUnhealthy = "unhealthy"
+	// statusMessagePolling is the message of the extension status while it
+	// polls for the application health.
+	statusMessagePolling = "polling"
+)
+
+// statusMessageFields are the fields the status message templates can use,
+// such as {{.State}} or {{.Latency}}. The probe fields are only set when a
+// single probe is configured.
+type statusMessageFields struct {
+	State       HealthStatus
+	Application string
+	Environment string
+
+	Target  string
+	Port    int
+	Path    string
+	Latency string
+	Failure string
+}
+
+// statusMessages are the status message templates of the settings, so that
+// platform teams can standardize the wording of the status messages across
+// extensions.
+type statusMessages struct {
+	templates map[string]*template.Template
+}
+
+// newStatusMessages parses the status message templates, checking that they
+// only use the status message fields.
+func newStatusMessages(messages map[string]string) (*statusMessages, error) {
+	m := &statusMessages{templates: make(map[string]*template.Template)}
+	keys := make([]string, 0, len(messages))
+	for key := range messages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		t, err := template.New(key).Parse(messages[key])
+		if err == nil {
+			err = t.Execute(new(bytes.Buffer), statusMessageFields{})
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid 'statusMessages' template '%s'", key)
+		}
+		m.templates[key] = t
+	}
+	return m, nil
+}
+
+// message returns the message of the template of key, or defaultMessage when
+// it is not overridden.
+func (m *statusMessages) message(key, defaultMessage string, fields statusMessageFields) string {
+	t, ok := m.templates[key]
+	if !ok {
+		return defaultMessage
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, fields); err != nil {
+		return defaultMessage
+	}
+	return b.String()
+}
+
+// appHealthStatusMessage returns the message of the AppHealthStatus substatus.
+func (m *statusMessages) appHealthStatusMessage(fields statusMessageFields) string {
+	key := statusMessageHealthy
+	if fields.State.GetStatusTypeForAppHealthStatus() == StatusError {
+		key = statusMessageUnhealthy
+	}
+	return m.message(key, fields.State.GetMessageForAppHealthStatus(), fields)
+}
+
+// newStatusMessageFields returns the fields of the status messages of the
+// committed state of the applications.
+func newStatusMessageFields(cfg *handlerSettings, state HealthStatus, apps []*application) statusMessageFields {
+	fields := statusMessageFields{State: state, Application: cfg.applicationName(), Environment: cfg.environment()}
+	if len(apps) == 1 {
+		app := apps[0]
+		appCfg := cfg.applications()[0].handlerSettings(cfg)
+		fields.Target = app.probe.address()
+		fields.Port = appCfg.port()
+		fields.Path = appCfg.requestPath()
+		fields.Latency = app.lastProbeDuration.Round(time.Millisecond).String()
+		fields.Failure = string(app.lastResponse.ProbeDetails.Failure)
+	}
+	return fields
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStatusMessages(t *testing.T) {
+	m, err := newStatusMessages(nil)
+	require.Nil(t, err)
+	require.Empty(t, m.templates)
+
+	_, err = newStatusMessages(map[string]string{"healthy": "{{.State"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid 'statusMessages' template 'healthy'")
+
+	// unknown fields are rejected with the settings
+	_, err = newStatusMessages(map[string]string{"unhealthy": "{{.Port}} {{.Host}}"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid 'statusMessages' template 'unhealthy'")
+}
+
+func TestStatusMessages_message(t *testing.T) {
+	m, err := newStatusMessages(map[string]string{
+		statusMessageUnhealthy: "{{.Application}} is {{.State}} on port {{.Port}} ({{.Failure}})",
+		statusMessagePolling:   "Probing {{.Target}} in {{.Latency}}",
+	})
+	require.Nil(t, err)
+
+	fields := statusMessageFields{State: Unhealthy, Application: "checkout", Port: 8080, Failure: "timeout", Target: "localhost:8080", Latency: "12ms"}
+	require.Equal(t, "checkout is Unhealthy on port 8080 (timeout)", m.appHealthStatusMessage(fields))
+	require.Equal(t, "Probing localhost:8080 in 12ms", m.message(statusMessagePolling, statusMessage, fields))
+
+	// not overridden
+	fields.State = Healthy
+	require.Equal(t, "Application found to be healthy", m.appHealthStatusMessage(fields))
+}
+
+func TestNewStatusMessageFields(t *testing.T) {
+	cfg := handlerSettings{publicSettings: publicSettings{
+		SchemaVersion: settingsSchemaVersion2,
+		Probes:        []applicationSettings{{publicSettings: publicSettings{Protocol: "http", Port: 8080, RequestPath: "/health"}}},
+		Observability: &observabilitySettings{ApplicationName: "checkout"},
+	}}
+	apps := newApplications(log.NewContext(log.NewNopLogger()), &cfg, 0)
+	apps[0].lastProbeDuration = 12345 * time.Microsecond
+	apps[0].lastResponse.ProbeDetails.Failure = probeFailureTimeout
+
+	require.Equal(t, statusMessageFields{
+		State:       Unknown,
+		Application: "checkout",
+		Target:      "http://localhost:8080/health",
+		Port:        8080,
+		Path:        "/health",
+		Latency:     "12ms",
+		Failure:     "timeout",
+	}, newStatusMessageFields(&cfg, Unknown, apps))
+
+	// probe fields are only set for a single probe
+	require.Equal(t, statusMessageFields{State: Healthy, Application: "checkout"}, newStatusMessageFields(&cfg, Healthy, append(apps, apps[0])))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	statusWriteModeEveryInterval    = "everyInterval"
+	statusWriteModeOnChange         = "onChange"
+	defaultStatusHeartbeatIntervals = 60
+
+	// statusWriteRetries bounds the retries of a failed status write, the
+	// backoff doubling from statusWriteBackoff between them, so that the
+	// retries fit within the shortest probe interval.
+	statusWriteRetries = 3
+	statusWriteBackoff = 250 * time.Millisecond
+
+	droppedStatusWritesMessageFormat = "%d status writes dropped since the last successful write"
+)
+
+// latestStatus is the latest status of the extension, whether it was written
+// to the status file or not.
+var latestStatus = &statusCache{}
+
+// statusCache holds a status report shared with the diagnostics endpoint.
+type statusCache struct {
+	mu     sync.Mutex
+	status StatusReport
+}
+
+// set stores a copy of the status, which the caller may keep changing.
+func (c *statusCache) set(s StatusReport) {
+	s = s.Copy()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = s
+}
+
+// get returns a copy of the status, which the caller may change.
+func (c *statusCache) get() StatusReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status.Copy()
+}
+
+// statusWriter decides whether the status of a probe interval is written to
+// the status file. In 'onChange' mode, the status is only written when its
+// state changed since the last write, or as a heartbeat after
+// heartbeatIntervals intervals, to limit the disk writes of short intervals.
+type statusWriter struct {
+	onChange           bool
+	heartbeatIntervals int
+
+	lastState string
+	unwritten int
+
+	// pending is the status whose write failed, superseded by the status of
+	// the next interval, which is written regardless of the mode once reset.
+	pending StatusReport
+	// dropped counts the statuses which failed to be written, reported with
+	// the next status written.
+	dropped int
+	// sleep waits between the retries, replaced in tests.
+	sleep func(time.Duration)
+}
+
+func newStatusWriter(cfg *handlerSettings) *statusWriter {
+	return &statusWriter{
+		onChange:           cfg.statusWriteMode() == statusWriteModeOnChange,
+		heartbeatIntervals: cfg.statusHeartbeatIntervals(),
+		sleep:              time.Sleep,
+	}
+}
+
+// shouldWrite reports whether the status needs to be written and, if so,
+// records it as the last written one.
+func (w *statusWriter) shouldWrite(s StatusReport) bool {
+	state := statusState(s)
+	if w.onChange && state == w.lastState && w.unwritten+1 < w.heartbeatIntervals {
+		w.unwritten++
+		return false
+	}
+	w.lastState, w.unwritten = state, 0
+	return true
+}
+
+// reset makes the next status written, after the last one failed to be.
+func (w *statusWriter) reset() {
+	w.lastState = ""
+}
+
+// write saves the status, retrying a failed write with backoff. A status
+// which can't be written stays pending until the status of the next interval
+// supersedes it, when it is counted as dropped; the number of dropped writes
+// is reported in a substatus of the next status written, added to a copy of
+// the status which is truncated again to fit.
+func (w *statusWriter) write(ctx *log.Context, s StatusReport, save func(StatusReport) error) error {
+	if w.pending != nil {
+		w.pending = nil
+		w.dropped++
+	}
+	if w.dropped > 0 {
+		s = s.Copy()
+		s.AddSubstatusItem(NewSubstatus(SubstatusKeyNameStatusWrites, StatusWarning, fmt.Sprintf(droppedStatusWritesMessageFormat, w.dropped)))
+		truncateStatus(ctx, s)
+	}
+
+	err := save(s)
+	backoff := statusWriteBackoff
+	for retry := 1; err != nil && retry <= statusWriteRetries; retry++ {
+		ctx.Log("event", "retrying status write", "retry", retry, "backoff", backoff, "error", err)
+		w.sleep(backoff)
+		backoff *= 2
+		err = save(s)
+	}
+	if err != nil {
+		w.pending = s
+		w.reset()
+		return err
+	}
+	w.dropped = 0
+	return nil
+}
+
+// statusState summarizes the state of a status: its status type, the status
+// type of each substatus, the health states reported by substatuses and the
+// progress of the pending transitions. Messages, which include timestamps and
+// measurements varying every interval, are left out.
+func statusState(s StatusReport) string {
+	var b strings.Builder
+	for _, item := range s {
+		b.WriteString(string(item.Status.Status))
+		for _, substatus := range item.Status.SubstatusList {
+			b.WriteString("|" + substatus.Name + "=" + string(substatus.Status))
+			// the messages of these substatuses start with a health state
+			if strings.HasPrefix(substatus.Name, SubstatusKeyNameApplicationHealthState) || strings.HasPrefix(substatus.Name, SubstatusKeyNameDependency+"/") {
+				b.WriteString(":" + strings.SplitN(substatus.FormattedMessage.Message, ":", 2)[0])
+			}
+			if strings.HasPrefix(substatus.Name, SubstatusKeyNamePendingTransition) {
+				b.WriteString(":" + substatus.FormattedMessage.Message)
+			}
+		}
+	}
+	return b.String()
+}
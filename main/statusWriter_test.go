@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStatus(t StatusType, state HealthStatus, message string) StatusReport {
+	return newStatusWithSubstatuses(t, "enable", message, []SubstatusItem{
+		NewSubstatus(SubstatusKeyNameApplicationHealthState, state.GetStatusType(), string(state)),
+		NewSubstatus(SubstatusKeyNameAvailability, StatusSuccess, message),
+	})
+}
+
+func TestStatusWriter_everyInterval(t *testing.T) {
+	w := newStatusWriter(&handlerSettings{})
+	for i := 0; i < 3; i++ {
+		require.True(t, w.shouldWrite(newTestStatus(StatusSuccess, Healthy, "")))
+	}
+}
+
+func TestStatusWriter_onChange(t *testing.T) {
+	w := newStatusWriter(&handlerSettings{publicSettings: publicSettings{StatusWriteMode: statusWriteModeOnChange, StatusHeartbeatIntervals: 3}})
+
+	require.True(t, w.shouldWrite(newTestStatus(StatusSuccess, Healthy, "up for 5s")))
+	// messages are not part of the state
+	require.False(t, w.shouldWrite(newTestStatus(StatusSuccess, Healthy, "up for 10s")))
+
+	// health state changes with the same status type
+	require.True(t, w.shouldWrite(newTestStatus(StatusSuccess, Unhealthy, "")))
+	require.False(t, w.shouldWrite(newTestStatus(StatusSuccess, Unhealthy, "")))
+
+	// status type changes
+	require.True(t, w.shouldWrite(newTestStatus(StatusWarning, Unhealthy, "")))
+
+	// heartbeat
+	require.False(t, w.shouldWrite(newTestStatus(StatusWarning, Unhealthy, "")))
+	require.False(t, w.shouldWrite(newTestStatus(StatusWarning, Unhealthy, "")))
+	require.True(t, w.shouldWrite(newTestStatus(StatusWarning, Unhealthy, "")))
+
+	// a failed write is retried
+	w.reset()
+	require.True(t, w.shouldWrite(newTestStatus(StatusWarning, Unhealthy, "")))
+}
+
+func TestStatusState_dependencies(t *testing.T) {
+	healthy := newTestStatus(StatusSuccess, Healthy, "")
+	healthy.AddSubstatusItem(ProbeDependency{Name: "db", State: Unknown, Detail: "timeout"}.substatus())
+	unhealthy := newTestStatus(StatusSuccess, Healthy, "")
+	unhealthy.AddSubstatusItem(ProbeDependency{Name: "db", State: Unhealthy, Detail: "timeout"}.substatus())
+	require.NotEqual(t, statusState(healthy), statusState(unhealthy))
+}
+
+func TestStatusState_pendingTransition(t *testing.T) {
+	one := newTestStatus(StatusSuccess, Healthy, "")
+	one.AddSubstatusItem(NewSubstatus(SubstatusKeyNamePendingTransition, StatusTransitioning, `{"committedState":"Healthy","candidateState":"Unhealthy","observed":1,"required":3}`))
+	two := newTestStatus(StatusSuccess, Healthy, "")
+	two.AddSubstatusItem(NewSubstatus(SubstatusKeyNamePendingTransition, StatusTransitioning, `{"committedState":"Healthy","candidateState":"Unhealthy","observed":2,"required":3}`))
+	require.NotEqual(t, statusState(one), statusState(two))
+}
+
+func TestStatusWriter_writeRetries(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	w := newStatusWriter(&handlerSettings{publicSettings: publicSettings{StatusWriteMode: statusWriteModeOnChange, StatusHeartbeatIntervals: 3}})
+	var backoffs []time.Duration
+	w.sleep = func(d time.Duration) { backoffs = append(backoffs, d) }
+
+	// the write succeeds once retried
+	failures := 2
+	var saved []StatusReport
+	save := func(s StatusReport) error {
+		if failures > 0 {
+			failures--
+			return errors.New("disk full")
+		}
+		saved = append(saved, s)
+		return nil
+	}
+	require.True(t, w.shouldWrite(newTestStatus(StatusSuccess, Healthy, "")))
+	require.Nil(t, w.write(ctx, newTestStatus(StatusSuccess, Healthy, ""), save))
+	require.Equal(t, []time.Duration{statusWriteBackoff, 2 * statusWriteBackoff}, backoffs)
+	require.Len(t, saved, 1)
+
+	// the retries are bounded, the status stays pending and the next one is
+	// written despite the 'onChange' mode
+	backoffs, failures = nil, statusWriteRetries+1
+	require.True(t, w.shouldWrite(newTestStatus(StatusSuccess, Unhealthy, "")))
+	require.NotNil(t, w.write(ctx, newTestStatus(StatusSuccess, Unhealthy, ""), save))
+	require.Len(t, backoffs, statusWriteRetries)
+	require.Len(t, saved, 1)
+	require.NotNil(t, w.pending)
+
+	// the pending status is superseded and reported as dropped
+	require.True(t, w.shouldWrite(newTestStatus(StatusSuccess, Unhealthy, "")))
+	require.Nil(t, w.write(ctx, newTestStatus(StatusSuccess, Unhealthy, ""), save))
+	require.Len(t, saved, 2)
+	substatuses := saved[1][0].Status.SubstatusList
+	require.Equal(t, SubstatusKeyNameStatusWrites, substatuses[len(substatuses)-1].Name)
+	require.Equal(t, "1 status writes dropped since the last successful write", substatuses[len(substatuses)-1].FormattedMessage.Message)
+	require.Nil(t, w.pending)
+
+	// the count is reset once reported
+	require.Nil(t, w.write(ctx, newTestStatus(StatusSuccess, Unhealthy, ""), save))
+	require.Len(t, saved[2][0].Status.SubstatusList, 2)
+}
+
+func TestStatusWriter_droppedWritesSubstatus(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	w := newStatusWriter(&handlerSettings{})
+	w.sleep = func(time.Duration) {}
+	var saved []StatusReport
+	failing := func(StatusReport) error { return errors.New("disk full") }
+	save := func(s StatusReport) error {
+		saved = append(saved, s)
+		return nil
+	}
+
+	// a status already truncated to the maximum size
+	s := newStatusWithSubstatuses(StatusSuccess, "enable", "", []SubstatusItem{
+		NewSubstatus(SubstatusKeyNameApplicationHealthState, StatusSuccess, string(Healthy)),
+		NewSubstatus(SubstatusKeyNameAvailability, StatusSuccess, strings.Repeat("m", maxStatusSizeInBytes)),
+	})
+	prepareStatus(ctx, s)
+	require.NotNil(t, w.write(ctx, s, failing))
+	require.Nil(t, w.write(ctx, s, save))
+
+	// the substatus is added to a copy, truncated again to fit
+	require.Len(t, saved, 1)
+	substatuses := saved[0][0].Status.SubstatusList
+	require.Equal(t, SubstatusKeyNameStatusWrites, substatuses[len(substatuses)-1].Name)
+	require.True(t, saved[0].SerializedSize() <= maxStatusSizeInBytes)
+	require.NotEqual(t, SubstatusKeyNameStatusWrites, s[0].Status.SubstatusList[len(s[0].Status.SubstatusList)-1].Name)
+}
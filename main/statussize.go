@@ -0,0 +1,15 @@
+package main
+
+const (
+	// maxStatusSizeInBytes is the budget of a serialized status report, below
+	// the size at which the guest agent truncates status files.
+	maxStatusSizeInBytes = 128 * 1024
+)
+
+// preservedSubstatuses are never truncated nor dropped, as they carry the
+// health state consumed by the platform.
+var preservedSubstatuses = map[string]bool{
+	SubstatusKeyNameAppHealthStatus:        true,
+	SubstatusKeyNameApplicationHealthState: true,
+	SubstatusKeyNameExtensionVersion:       true,
+}
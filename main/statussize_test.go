@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/run-command-extension-linux/pkg/status"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_truncateToSize_fits(t *testing.T) {
+	s := NewStatus(StatusSuccess, "Enable", "Application found to be healthy")
+	s.AddSubstatus(StatusSuccess, SubstatusKeyNameApplicationHealthState, "Healthy")
+	size, truncated := s.TruncateToSize(maxStatusSizeInBytes, preservedSubstatuses)
+	require.False(t, truncated)
+	require.Equal(t, s.SerializedSize(), size)
+}
+
+func Test_truncateToSize_truncatesLongestVerboseSubstatus(t *testing.T) {
+	s := NewStatus(StatusSuccess, "Enable", "Application found to be healthy")
+	s.AddSubstatus(StatusSuccess, SubstatusKeyNameApplicationHealthState, strings.Repeat("h", 2000))
+	s.AddSubstatus(StatusSuccess, SubstatusKeyNameProbeDetails, strings.Repeat("d", 3000))
+	s.AddSubstatus(StatusSuccess, SubstatusKeyNameCustomMetrics, strings.Repeat("m", 1000))
+
+	size, truncated := s.TruncateToSize(5000, preservedSubstatuses)
+	require.True(t, truncated)
+	require.True(t, size > 5000)
+	require.True(t, s.SerializedSize() <= 5000)
+
+	substatuses := s[0].Status.SubstatusList
+	require.Len(t, substatuses, 3)
+	require.Equal(t, strings.Repeat("h", 2000), substatuses[0].FormattedMessage.Message)
+	require.True(t, strings.HasSuffix(substatuses[1].FormattedMessage.Message, status.TruncatedMarker))
+	require.Equal(t, strings.Repeat("m", 1000), substatuses[2].FormattedMessage.Message)
+	require.Equal(t, "Application found to be healthy", s[0].Status.FormattedMessage.Message)
+}
+
+func Test_truncateToSize_dropsSubstatusesThenTruncatesMessage(t *testing.T) {
+	s := NewStatus(StatusError, "Enable", strings.Repeat("e", 1000))
+	s.AddSubstatus(StatusError, SubstatusKeyNameApplicationHealthState, "Unhealthy")
+	s.AddSubstatus(StatusError, SubstatusKeyNameProbeDetails, strings.Repeat("d", 1000))
+
+	_, truncated := s.TruncateToSize(600, preservedSubstatuses)
+	require.True(t, truncated)
+	require.True(t, s.SerializedSize() <= 600)
+	require.Equal(t, StatusError, s[0].Status.Status)
+	require.Len(t, s[0].Status.SubstatusList, 1)
+	require.Equal(t, SubstatusKeyNameApplicationHealthState, s[0].Status.SubstatusList[0].Name)
+	require.True(t, strings.HasSuffix(s[0].Status.FormattedMessage.Message, status.TruncatedMarker))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/syslog"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// syslogTag is the stable identifier of the extension events in syslog and
+// journald (SYSLOG_IDENTIFIER).
+const syslogTag = "ApplicationHealthExtension"
+
+// mirrorLogger logs to a logger and, once a mirror is set, to the mirror as
+// well. It allows mirroring the extension events to another sink when the
+// settings enabling it are known, after the logging context was created.
+type mirrorLogger struct {
+	logger log.Logger
+
+	mu     sync.Mutex
+	mirror log.Logger
+}
+
+func newMirrorLogger(logger log.Logger) *mirrorLogger {
+	return &mirrorLogger{logger: logger}
+}
+
+func (l *mirrorLogger) Log(keyvals ...interface{}) error {
+	err := l.logger.Log(keyvals...)
+	l.mu.Lock()
+	mirror := l.mirror
+	l.mu.Unlock()
+	if mirror != nil {
+		mirror.Log(keyvals...)
+	}
+	return err
+}
+
+func (l *mirrorLogger) setMirror(mirror log.Logger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mirror = mirror
+}
+
+// syslogWriter is the subset of *syslog.Writer used by syslogLogger.
+type syslogWriter interface {
+	Err(m string) error
+	Warning(m string) error
+	Info(m string) error
+}
+
+// syslogLogger writes the events in logfmt format to the local syslog daemon,
+// which journald also listens on.
+type syslogLogger struct {
+	w syslogWriter
+}
+
+func newSyslogLogger() (*syslogLogger, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to syslog")
+	}
+	return &syslogLogger{w: w}, nil
+}
+
+func (l *syslogLogger) Log(keyvals ...interface{}) error {
+	var buf bytes.Buffer
+	if err := log.NewLogfmtLogger(&buf).Log(keyvals...); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(buf.String(), "\n")
+
+	switch syslogPriority(keyvals) {
+	case syslog.LOG_ERR:
+		return l.w.Err(msg)
+	case syslog.LOG_WARNING:
+		return l.w.Warning(msg)
+	default:
+		return l.w.Info(msg)
+	}
+}
+
+// syslogPriority maps the level of an event to a syslog priority.
+func syslogPriority(keyvals []interface{}) syslog.Priority {
+	switch eventLogLevel(keyvals) {
+	case logLevelError:
+		return syslog.LOG_ERR
+	case logLevelWarning:
+		return syslog.LOG_WARNING
+	default:
+		return syslog.LOG_INFO
+	}
+}
+
+// eventLogLevel returns the level of an event: errors are 'error', events
+// about the application being unhealthy or unknown are 'warning' and anything
+// else is 'info'.
+func eventLogLevel(keyvals []interface{}) string {
+	level := logLevelInfo
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		switch keyvals[i] {
+		case "error":
+			return logLevelError
+		case "event":
+			event := strings.ToLower(fmt.Sprint(keyvals[i+1]))
+			if strings.HasSuffix(event, "unhealthy") || strings.HasSuffix(event, "unknown") {
+				level = logLevelWarning
+			}
+		}
+	}
+	return level
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/syslog"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSyslogWriter records the messages written at each priority.
+type fakeSyslogWriter struct {
+	messages map[syslog.Priority][]string
+}
+
+func (w *fakeSyslogWriter) write(p syslog.Priority, m string) error {
+	if w.messages == nil {
+		w.messages = make(map[syslog.Priority][]string)
+	}
+	w.messages[p] = append(w.messages[p], m)
+	return nil
+}
+
+func (w *fakeSyslogWriter) Err(m string) error     { return w.write(syslog.LOG_ERR, m) }
+func (w *fakeSyslogWriter) Warning(m string) error { return w.write(syslog.LOG_WARNING, m) }
+func (w *fakeSyslogWriter) Info(m string) error    { return w.write(syslog.LOG_INFO, m) }
+
+func TestSyslogPriority(t *testing.T) {
+	require.Equal(t, syslog.LOG_INFO, syslogPriority([]interface{}{"event", "Committed health state is healthy"}))
+	require.Equal(t, syslog.LOG_WARNING, syslogPriority([]interface{}{"event", "Committed health state is unhealthy"}))
+	require.Equal(t, syslog.LOG_WARNING, syslogPriority([]interface{}{"event", "Health state changed to unknown"}))
+	require.Equal(t, syslog.LOG_ERR, syslogPriority([]interface{}{"seq", 1, "error", "failed"}))
+}
+
+func TestMirrorLogger(t *testing.T) {
+	w := &fakeSyslogWriter{}
+	mirror := newMirrorLogger(log.NewNopLogger())
+	ctx := log.NewContext(mirror).With("operation", "enable")
+
+	ctx.Log("event", "before mirroring")
+	require.Empty(t, w.messages)
+
+	mirror.setMirror(&syslogLogger{w: w})
+	ctx.Log("event", "Health state changed to healthy")
+	ctx.Log("event", "Health state changed to unhealthy")
+	ctx.Log("error", "probe failed")
+	require.Equal(t, []string{`operation=enable event="Health state changed to healthy"`}, w.messages[syslog.LOG_INFO])
+	require.Equal(t, []string{`operation=enable event="Health state changed to unhealthy"`}, w.messages[syslog.LOG_WARNING])
+	require.Equal(t, []string{`operation=enable error="probe failed"`}, w.messages[syslog.LOG_ERR])
+}
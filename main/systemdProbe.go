@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// SystemdHealthProbe derives the application health from the state of a
+// systemd unit: active units are Healthy, activating/reloading ones are
+// Initializing and anything else is Unhealthy.
+type SystemdHealthProbe struct {
+	UnitName string
+	Timeout  time.Duration
+
+	// showUnit returns the requested properties of the unit, it is replaced in
+	// tests.
+	showUnit func(ctx context.Context, unit string, properties ...string) (map[string]string, error)
+}
+
+func NewSystemdHealthProbe(unitName string, timeout time.Duration) *SystemdHealthProbe {
+	return &SystemdHealthProbe{
+		UnitName: unitName,
+		Timeout:  timeout,
+		showUnit: systemctlShow,
+	}
+}
+
+func (p *SystemdHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unhealthy
+
+	showCtx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	props, err := p.showUnit(showCtx, p.UnitName, "LoadState", "ActiveState", "SubState")
+	if err != nil {
+		return probeResponse, err
+	}
+
+	activeState, subState := props["ActiveState"], props["SubState"]
+	probeResponse.ProbeDetails.UnitState = fmt.Sprintf("%s (%s)", activeState, subState)
+
+	if props["LoadState"] == "not-found" {
+		return probeResponse, errors.New(fmt.Sprintf("Unit '%s' not found", p.UnitName))
+	}
+
+	switch activeState {
+	case "active":
+		probeResponse.ApplicationHealthState = Healthy
+	case "activating", "reloading":
+		probeResponse.ApplicationHealthState = Initializing
+	default:
+		return probeResponse, errors.New(fmt.Sprintf("Unit '%s' is %s (%s)", p.UnitName, activeState, subState))
+	}
+	return probeResponse, nil
+}
+
+func (p *SystemdHealthProbe) address() string {
+	return p.UnitName
+}
+
+func (p *SystemdHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
+
+// systemctlCommand is the systemctl binary run by systemctlShow, it is
+// replaced in tests.
+var systemctlCommand = "systemctl"
+
+// systemctlShow queries the given properties of unit with 'systemctl show'. The
+// command is killed once ctx is done so that a hung systemd cannot stall the
+// probe beyond its timeout.
+func systemctlShow(ctx context.Context, unit string, properties ...string) (map[string]string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, systemctlCommand, "show", unit, "--property="+strings.Join(properties, ","))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errors.Wrapf(ctx.Err(), "timed out querying unit '%s'", unit)
+		}
+		return nil, errors.Wrapf(err, "failed to query unit '%s': %s", unit, strings.TrimSpace(stderr.String()))
+	}
+	return parseSystemctlShow(stdout.Bytes()), nil
+}
+
+// parseSystemctlShow parses the Key=Value lines printed by 'systemctl show'.
+func parseSystemctlShow(out []byte) map[string]string {
+	props := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 {
+			props[kv[0]] = kv[1]
+		}
+	}
+	return props
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSystemctlShow(t *testing.T) {
+	props := parseSystemctlShow([]byte("LoadState=loaded\nActiveState=active\nSubState=running\nDescription=A=B\n"))
+	require.Equal(t, map[string]string{
+		"LoadState":   "loaded",
+		"ActiveState": "active",
+		"SubState":    "running",
+		"Description": "A=B",
+	}, props)
+}
+
+func TestSystemdHealthProbe_evaluate(t *testing.T) {
+	testCases := []struct {
+		props         map[string]string
+		expectedState HealthStatus
+		expectedErr   string
+	}{
+		{map[string]string{"LoadState": "loaded", "ActiveState": "active", "SubState": "running"}, Healthy, ""},
+		{map[string]string{"LoadState": "loaded", "ActiveState": "reloading", "SubState": "running"}, Initializing, ""},
+		{map[string]string{"LoadState": "loaded", "ActiveState": "activating", "SubState": "start-pre"}, Initializing, ""},
+		{map[string]string{"LoadState": "loaded", "ActiveState": "failed", "SubState": "failed"}, Unhealthy, "Unit 'nginx.service' is failed (failed)"},
+		{map[string]string{"LoadState": "loaded", "ActiveState": "inactive", "SubState": "dead"}, Unhealthy, "Unit 'nginx.service' is inactive (dead)"},
+		{map[string]string{"LoadState": "not-found", "ActiveState": "inactive", "SubState": "dead"}, Unhealthy, "Unit 'nginx.service' not found"},
+	}
+
+	ctx := log.NewContext(log.NewNopLogger())
+	for _, tc := range testCases {
+		probe := NewSystemdHealthProbe("nginx.service", time.Second)
+		probe.showUnit = func(ctx context.Context, unit string, properties ...string) (map[string]string, error) {
+			require.Equal(t, "nginx.service", unit)
+			return tc.props, nil
+		}
+
+		probeResponse, err := probe.evaluate(ctx)
+		require.Equal(t, tc.expectedState, probeResponse.ApplicationHealthState)
+		require.Equal(t, tc.props["ActiveState"]+" ("+tc.props["SubState"]+")", probeResponse.ProbeDetails.UnitState)
+		if tc.expectedErr == "" {
+			require.Nil(t, err)
+		} else {
+			require.NotNil(t, err)
+			require.Equal(t, tc.expectedErr, err.Error())
+		}
+	}
+
+	probe := NewSystemdHealthProbe("nginx.service", time.Second)
+	probe.showUnit = func(ctx context.Context, unit string, properties ...string) (map[string]string, error) {
+		return nil, errors.New("systemctl not found")
+	}
+	probeResponse, err := probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
+
+func TestSystemdHealthProbe_hungSystemctlTimesOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemctl")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	hung := filepath.Join(dir, "systemctl")
+	require.Nil(t, ioutil.WriteFile(hung, []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
+
+	defer func(cmd string) { systemctlCommand = cmd }(systemctlCommand)
+	systemctlCommand = hung
+
+	probe := NewSystemdHealthProbe("nginx.service", 200*time.Millisecond)
+	start := time.Now()
+	probeResponse, err := probe.evaluate(log.NewContext(log.NewNopLogger()))
+	require.NotNil(t, err)
+	require.True(t, time.Since(start) < 5*time.Second, "probe took %v", time.Since(start))
+	require.Contains(t, err.Error(), "timed out querying unit 'nginx.service'")
+	require.True(t, isTimeout(err))
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tcpFlagSyn = 0x02
+	tcpFlagRst = 0x04
+	tcpFlagAck = 0x10
+
+	tcpHeaderLength = 20
+)
+
+var (
+	loopbackAddr = [4]byte{127, 0, 0, 1}
+
+	errHalfOpenNoReply = errors.New("No SYN-ACK or RST received for half-open tcp probe")
+)
+
+// canProbeHalfOpen reports whether the process is allowed to open the raw
+// socket needed by halfOpenProbe (requires CAP_NET_RAW).
+func canProbeHalfOpen() bool {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	if err != nil {
+		return false
+	}
+	syscall.Close(fd)
+	return true
+}
+
+// isHalfOpenNotPermitted reports whether err was caused by missing privileges
+// to use raw sockets.
+func isHalfOpenNotPermitted(err error) bool {
+	return os.IsPermission(errors.Cause(err))
+}
+
+// halfOpenProbe checks whether something is listening on the given loopback
+// port without completing a TCP handshake. It sends a single SYN over a raw
+// socket and waits for either a SYN-ACK (listening) or a RST (closed). As the
+// kernel knows nothing about the connection, it answers the SYN-ACK with a RST
+// itself, so the application never sees an accepted connection.
+func halfOpenProbe(port int, timeout time.Duration) (listening bool, _ error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	if err != nil {
+		return false, errors.Wrap(os.NewSyscallError("socket", err), "failed to open raw socket")
+	}
+	defer syscall.Close(fd)
+
+	// reserve a local port by binding (but never connecting) a regular socket,
+	// so the kernel neither hands it out nor accepts the SYN-ACK sent to it
+	srcFd, srcPort, err := reserveLoopbackPort()
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(srcFd)
+
+	seq := rand.Uint32()
+	if err := syscall.Sendto(fd, synPacket(srcPort, port, seq), 0, &syscall.SockaddrInet4{Addr: loopbackAddr}); err != nil {
+		return false, errors.Wrap(err, "failed to send SYN")
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, errHalfOpenNoReply
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return false, errors.Wrap(err, "failed to set receive timeout")
+		}
+
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return false, errors.Wrap(err, "failed to receive reply")
+		}
+
+		flags, ok := matchReply(buf[:n], port, srcPort, seq)
+		if !ok {
+			continue
+		}
+		if flags&tcpFlagRst != 0 {
+			return false, nil
+		}
+		if flags&(tcpFlagSyn|tcpFlagAck) == tcpFlagSyn|tcpFlagAck {
+			return true, nil
+		}
+	}
+}
+
+// reserveLoopbackPort binds a TCP socket to an ephemeral loopback port and
+// returns it along with the port number.
+func reserveLoopbackPort() (int, int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to open socket")
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: loopbackAddr}); err != nil {
+		syscall.Close(fd)
+		return 0, 0, errors.Wrap(err, "failed to bind socket")
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return 0, 0, errors.Wrap(err, "failed to get socket name")
+	}
+	return fd, sa.(*syscall.SockaddrInet4).Port, nil
+}
+
+// synPacket builds a bare TCP SYN segment from srcPort to dstPort on loopback.
+func synPacket(srcPort, dstPort int, seq uint32) []byte {
+	b := make([]byte, tcpHeaderLength)
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	b[12] = (tcpHeaderLength / 4) << 4 // data offset
+	b[13] = tcpFlagSyn
+	binary.BigEndian.PutUint16(b[14:16], 65535) // window
+	binary.BigEndian.PutUint16(b[16:18], tcpChecksum(loopbackAddr, loopbackAddr, b))
+	return b
+}
+
+// tcpChecksum computes the TCP checksum of segment, including the IPv4
+// pseudo header.
+func tcpChecksum(src, dst [4]byte, segment []byte) uint16 {
+	pseudo := make([]byte, 0, 12+len(segment))
+	pseudo = append(pseudo, src[:]...)
+	pseudo = append(pseudo, dst[:]...)
+	pseudo = append(pseudo, 0, syscall.IPPROTO_TCP, byte(len(segment)>>8), byte(len(segment)))
+	pseudo = append(pseudo, segment...)
+	return internetChecksum(pseudo)
+}
+
+// matchReply parses an IPv4 packet read from the raw socket and returns the
+// TCP flags if it is the reply to our SYN.
+func matchReply(packet []byte, srcPort, dstPort int, seq uint32) (byte, bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return 0, false
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	if len(packet) < ihl+tcpHeaderLength {
+		return 0, false
+	}
+	tcp := packet[ihl:]
+	if int(binary.BigEndian.Uint16(tcp[0:2])) != srcPort || int(binary.BigEndian.Uint16(tcp[2:4])) != dstPort {
+		return 0, false
+	}
+	flags := tcp[13]
+	if flags&tcpFlagAck != 0 && binary.BigEndian.Uint32(tcp[8:12]) != seq+1 {
+		return 0, false
+	}
+	return flags, true
+}
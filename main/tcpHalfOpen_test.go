@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTcpChecksum(t *testing.T) {
+	segment := synPacket(40000, 8080, 1)
+	// a segment including its own checksum sums up to zero
+	require.Equal(t, uint16(0), tcpChecksum(loopbackAddr, loopbackAddr, segment))
+}
+
+func TestMatchReply(t *testing.T) {
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	synAck := synPacket(8080, 40000, 7)
+	synAck[13] = tcpFlagSyn | tcpFlagAck
+	synAck[8], synAck[9], synAck[10], synAck[11] = 0, 0, 0, 2 // ack = seq + 1
+
+	flags, ok := matchReply(append(ip, synAck...), 8080, 40000, 1)
+	require.True(t, ok)
+	require.Equal(t, byte(tcpFlagSyn|tcpFlagAck), flags)
+
+	// different ports
+	_, ok = matchReply(append(ip, synAck...), 8081, 40000, 1)
+	require.False(t, ok)
+
+	// unexpected acknowledgement number
+	_, ok = matchReply(append(ip, synAck...), 8080, 40000, 5)
+	require.False(t, ok)
+}
+
+func TestHalfOpenProbe(t *testing.T) {
+	if !canProbeHalfOpen() {
+		t.Skip("raw sockets not permitted")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+
+	probe := &TcpHealthProbe{Address: l.Addr().String(), Port: port, HalfOpen: true}
+	probeResponse, err := probe.evaluate(log.NewContext(log.NewNopLogger()))
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// the handshake was never completed, so nothing was accepted
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = l.Accept()
+	require.NotNil(t, err)
+
+	l.Close()
+	probeResponse, err = probe.evaluate(log.NewContext(log.NewNopLogger()))
+	require.NotNil(t, err)
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
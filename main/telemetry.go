@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	telemetryEventProbeResult           = "ProbeResult"
+	telemetryEventHealthStateTransition = "HealthStateTransition"
+	telemetryEventResourceLimitExceeded = "ResourceLimitExceeded"
+
+	telemetryBatchSize          = 50
+	telemetryQueuedBatches      = 4
+	telemetryFlushInterval      = time.Minute
+	telemetryMaxEventsPerMinute = 60
+	telemetryRequestTimeout     = 10 * time.Second
+	telemetryRetryBackoff       = time.Second
+
+	applicationInsightsEndpoint = "https://dc.services.visualstudio.com/v2/track"
+	logAnalyticsEndpointFormat  = "https://%s.ods.opinsights.azure.com/api/logs?api-version=2016-04-01"
+	logAnalyticsLogType         = "ApplicationHealth"
+)
+
+// telemetryEvent is an event sent to the telemetry sinks.
+type telemetryEvent struct {
+	Name       string
+	Time       time.Time
+	Properties map[string]string
+}
+
+// telemetrySink sends batches of events to a telemetry service.
+type telemetrySink interface {
+	send(events []telemetryEvent) error
+	name() string
+}
+
+// telemetryEmitter batches the events sent to the configured telemetry sinks
+// and limits their rate. Events beyond telemetryMaxEventsPerMinute are dropped,
+// except essential ones (such as health state transitions). The batches are
+// sent in the background, a batch flushed while telemetryQueuedBatches are
+// still waiting to be sent is dropped.
+type telemetryEmitter struct {
+	sinks []telemetrySink
+	// tags are the properties added to all the events.
+	tags map[string]string
+
+	events []telemetryEvent
+	// flushInterval is the longest time events are queued before being sent.
+	flushInterval time.Duration
+	lastFlush     time.Duration
+	windowStart   time.Duration
+	windowCount   int
+	dropped       int
+
+	// queue holds the batches waiting to be sent by the goroutine started
+	// with the service, which closes done once the queue is closed and
+	// drained.
+	queue chan []telemetryEvent
+	done  chan struct{}
+
+	// clock timestamps the events and measures the flush interval and the
+	// rate limiting window on its monotonic time, replaced in tests.
+	clock clock
+	// ctx logs the failures of the flush when the service is stopped.
+	ctx *log.Context
+}
+
+// newTelemetryEmitter creates the emitter of the sinks configured in the
+// protected settings and of the event files, written to 'eventFilesFolder' or
+// else to the eventsFolder of the handler environment. Without any sink,
+// events are discarded.
+func newTelemetryEmitter(cfg *handlerSettings, eventsFolder string) *telemetryEmitter {
+	e := &telemetryEmitter{
+		clock:         systemClock{},
+		tags:          make(map[string]string),
+		flushInterval: cfg.telemetryFlushInterval(),
+		queue:         make(chan []telemetryEvent, telemetryQueuedBatches),
+	}
+	if name := cfg.applicationName(); name != "" {
+		e.tags["applicationName"] = name
+	}
+	if environment := cfg.environment(); environment != "" {
+		e.tags["environment"] = environment
+	}
+	client := newInstrumentedClient(&http.Client{Timeout: telemetryRequestTimeout})
+	// the batches are sent in the background, the retries don't delay the
+	// probes
+	client.Retry = retryPolicy{Attempts: 2, Backoff: telemetryRetryBackoff, Retryable: retryTransientFailures}
+	if key := cfg.applicationInsightsInstrumentationKey(); key != "" {
+		e.sinks = append(e.sinks, &applicationInsightsSink{
+			instrumentationKey: key,
+			endpoint:           applicationInsightsEndpoint,
+			client:             client,
+		})
+	}
+	if workspaceID := cfg.logAnalyticsWorkspaceId(); workspaceID != "" {
+		e.sinks = append(e.sinks, &logAnalyticsSink{
+			workspaceID: workspaceID,
+			sharedKey:   cfg.logAnalyticsSharedKey(),
+			endpoint:    fmt.Sprintf(logAnalyticsEndpointFormat, workspaceID),
+			client:      client,
+			now:         time.Now,
+		})
+	}
+	folder := cfg.eventFilesFolder()
+	if folder == "" {
+		folder = eventsFolder
+	}
+	if folder != "" {
+		e.sinks = append(e.sinks, newEventFileSink(folder, cfg.compressEventFiles(), cfg.eventsRetention()))
+	}
+	e.lastFlush = e.clock.monotonic()
+	return e
+}
+
+// subscribe emits the probe results, state transitions and exceeded resource
+// limits published on the bus.
+func (e *telemetryEmitter) subscribe(bus *eventBus) {
+	bus.subscribe(busEventProbeCycle, func(ctx *log.Context, ev busEvent) {
+		for _, app := range ev.Apps {
+			e.emit(ctx, telemetryEventProbeResult, map[string]string{
+				"application":    app.name,
+				"healthState":    string(app.lastResponse.ApplicationHealthState),
+				"committedState": string(app.committedState),
+				"skippedRuns":    strconv.Itoa(app.skippedRuns),
+				"failure":        string(app.lastResponse.ProbeDetails.Failure),
+			}, false)
+		}
+	})
+	bus.subscribe(busEventStateTransition, func(ctx *log.Context, ev busEvent) {
+		e.emit(ctx, telemetryEventHealthStateTransition, map[string]string{
+			"previousState": string(ev.Transition.From),
+			"state":         string(ev.Transition.To),
+		}, true)
+	})
+	bus.subscribe(busEventResourceLimitExceeded, func(ctx *log.Context, ev busEvent) {
+		e.emit(ctx, telemetryEventResourceLimitExceeded, map[string]string{
+			"exceeded": strings.Join(ev.Exceeded, ", "),
+		}, true)
+	})
+}
+
+// emit queues an event and sends the queued events when the batch is full or
+// the flush interval elapsed.
+func (e *telemetryEmitter) emit(ctx *log.Context, name string, properties map[string]string, essential bool) {
+	if len(e.sinks) == 0 {
+		return
+	}
+
+	t := e.clock.monotonic()
+	if t-e.windowStart >= time.Minute {
+		e.windowStart, e.windowCount = t, 0
+	}
+	if !essential && e.windowCount >= telemetryMaxEventsPerMinute {
+		e.dropped++
+	} else {
+		e.windowCount++
+		if len(e.tags) > 0 {
+			tagged := make(map[string]string, len(properties)+len(e.tags))
+			for k, v := range properties {
+				tagged[k] = v
+			}
+			for k, v := range e.tags {
+				tagged[k] = v
+			}
+			properties = tagged
+		}
+		e.events = append(e.events, telemetryEvent{Name: name, Time: e.clock.now(), Properties: properties})
+	}
+
+	if len(e.events) >= telemetryBatchSize || t-e.lastFlush >= e.flushInterval {
+		e.flush(ctx)
+	}
+}
+
+// flush queues the pending events as a batch to send to all the sinks, without
+// waiting for it to be sent.
+func (e *telemetryEmitter) flush(ctx *log.Context) {
+	e.lastFlush = e.clock.monotonic()
+	if e.dropped > 0 {
+		ctx.Log("event", fmt.Sprintf("Dropped %d telemetry events exceeding %d events per minute", e.dropped, telemetryMaxEventsPerMinute))
+		e.dropped = 0
+	}
+	if len(e.events) == 0 {
+		return
+	}
+
+	select {
+	case e.queue <- e.events:
+	default:
+		ctx.Log("event", fmt.Sprintf("Dropped %d telemetry events, %d batches are still waiting to be sent", len(e.events), telemetryQueuedBatches))
+	}
+	e.events = nil
+}
+
+// sendQueued sends the queued batches until the queue is closed.
+func (e *telemetryEmitter) sendQueued(ctx *log.Context) {
+	defer close(e.done)
+	for events := range e.queue {
+		// events which could not be sent are not retried
+		for _, sink := range e.sinks {
+			if err := sink.send(events); err != nil {
+				ctx.Log("error", errors.Wrapf(err, "failed to send %d telemetry events to %s", len(events), sink.name()))
+			}
+		}
+	}
+}
+
+// The emitter is a service of the extension, which sends the pending and
+// queued events when it is stopped.
+
+func (e *telemetryEmitter) name() string {
+	return "telemetry"
+}
+
+func (e *telemetryEmitter) start(ctx *log.Context) error {
+	e.ctx = ctx
+	e.done = make(chan struct{})
+	go e.sendQueued(ctx)
+	return nil
+}
+
+func (e *telemetryEmitter) stop() {
+	if len(e.events) > 0 {
+		e.queue <- e.events
+		e.events = nil
+	}
+	close(e.queue)
+	<-e.done
+}
+
+func (e *telemetryEmitter) health() serviceHealth {
+	return serviceHealth{Name: e.name(), Running: true}
+}
+
+// applicationInsightsSink sends events as custom events to an Application
+// Insights resource.
+type applicationInsightsSink struct {
+	instrumentationKey string
+	endpoint           string
+	client             *instrumentedClient
+}
+
+type applicationInsightsEnvelope struct {
+	Name string                  `json:"name"`
+	Time string                  `json:"time"`
+	IKey string                  `json:"iKey"`
+	Tags map[string]string       `json:"tags,omitempty"`
+	Data applicationInsightsData `json:"data"`
+}
+
+type applicationInsightsData struct {
+	BaseType string                       `json:"baseType"`
+	BaseData applicationInsightsEventData `json:"baseData"`
+}
+
+type applicationInsightsEventData struct {
+	Ver        int               `json:"ver"`
+	Name       string            `json:"name"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+func (s *applicationInsightsSink) name() string {
+	return "Application Insights"
+}
+
+func (s *applicationInsightsSink) send(events []telemetryEvent) error {
+	envelopes := make([]applicationInsightsEnvelope, 0, len(events))
+	for _, event := range events {
+		envelopes = append(envelopes, applicationInsightsEnvelope{
+			Name: "Microsoft.ApplicationInsights.Event",
+			Time: event.Time.UTC().Format(time.RFC3339Nano),
+			IKey: s.instrumentationKey,
+			Tags: map[string]string{"ai.internal.sdkVersion": "ApplicationHealthExtension:" + VersionString()},
+			Data: applicationInsightsData{
+				BaseType: "EventData",
+				BaseData: applicationInsightsEventData{Ver: 2, Name: event.Name, Properties: event.Properties},
+			},
+		})
+	}
+	body, err := json.Marshal(envelopes)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doTelemetryRequest(s.client, req)
+}
+
+// logAnalyticsSink sends events as records of the ApplicationHealth custom log
+// of a Log Analytics workspace, using the HTTP Data Collector API.
+type logAnalyticsSink struct {
+	workspaceID string
+	sharedKey   string
+	endpoint    string
+	client      *instrumentedClient
+
+	// now returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+func (s *logAnalyticsSink) name() string {
+	return "Log Analytics"
+}
+
+func (s *logAnalyticsSink) send(events []telemetryEvent) error {
+	records := make([]map[string]string, 0, len(events))
+	for _, event := range events {
+		record := map[string]string{
+			"EventName":     event.Name,
+			"TimeGenerated": event.Time.UTC().Format(time.RFC3339Nano),
+		}
+		for k, v := range event.Properties {
+			record[k] = v
+		}
+		records = append(records, record)
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	date := s.now().UTC().Format(http.TimeFormat)
+	signature, err := s.signature(date, len(body))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Log-Type", logAnalyticsLogType)
+	req.Header.Set("x-ms-date", date)
+	req.Header.Set("time-generated-field", "TimeGenerated")
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", s.workspaceID, signature))
+	return doTelemetryRequest(s.client, req)
+}
+
+// signature computes the shared key signature of a Data Collector API request.
+func (s *logAnalyticsSink) signature(date string, contentLength int) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(s.sharedKey)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid shared key")
+	}
+	stringToSign := "POST\n" + strconv.Itoa(contentLength) + "\napplication/json\nx-ms-date:" + date + "\n/api/logs"
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func doTelemetryRequest(client *instrumentedClient, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Unsuccessful response status code %v", resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTelemetrySink records the batches of events it is sent.
+type fakeTelemetrySink struct {
+	batches [][]telemetryEvent
+}
+
+func (s *fakeTelemetrySink) send(events []telemetryEvent) error {
+	s.batches = append(s.batches, events)
+	return nil
+}
+
+func (s *fakeTelemetrySink) name() string {
+	return "fake"
+}
+
+func TestNewTelemetryEmitter(t *testing.T) {
+	e := newTelemetryEmitter(&handlerSettings{}, "")
+	require.Empty(t, e.sinks)
+	// without sinks, events are discarded
+	e.emit(log.NewContext(log.NewNopLogger()), telemetryEventProbeResult, nil, false)
+	require.Empty(t, e.events)
+
+	e = newTelemetryEmitter(&handlerSettings{protectedSettings: protectedSettings{
+		ApplicationInsightsInstrumentationKey: newSecretRef("key"),
+		LogAnalyticsWorkspaceId:               "workspace",
+		LogAnalyticsSharedKey:                 newSecretRef("c2VjcmV0"),
+	}}, "")
+	require.Len(t, e.sinks, 2)
+	require.Equal(t, "https://workspace.ods.opinsights.azure.com/api/logs?api-version=2016-04-01", e.sinks[1].(*logAnalyticsSink).endpoint)
+
+	// the event files are written to the events folder of the handler
+	// environment, unless 'eventFilesFolder' is set
+	e = newTelemetryEmitter(&handlerSettings{}, "/var/lib/waagent/events")
+	require.Len(t, e.sinks, 1)
+	require.Equal(t, "/var/lib/waagent/events", e.sinks[0].(*eventFileSink).folder)
+	e = newTelemetryEmitter(observabilityConfig(observabilitySettings{EventFilesFolder: "/var/log/apphealth/events"}), "/var/lib/waagent/events")
+	require.Equal(t, "/var/log/apphealth/events", e.sinks[0].(*eventFileSink).folder)
+}
+
+func TestTelemetryEmitter_tags(t *testing.T) {
+	sink := &fakeTelemetrySink{}
+	e := newTelemetryEmitter(observabilityConfig(observabilitySettings{ApplicationName: "checkout", Environment: "production"}), "")
+	e.sinks = []telemetrySink{sink}
+
+	e.emit(log.NewContext(log.NewNopLogger()), telemetryEventProbeResult, map[string]string{"healthState": "Healthy"}, false)
+	e.emit(log.NewContext(log.NewNopLogger()), telemetryEventProbeResult, nil, false)
+	require.Equal(t, map[string]string{"healthState": "Healthy", "applicationName": "checkout", "environment": "production"}, e.events[0].Properties)
+	require.Equal(t, map[string]string{"applicationName": "checkout", "environment": "production"}, e.events[1].Properties)
+}
+
+func TestTelemetryEmitter_subscribe(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	sink := &fakeTelemetrySink{}
+	e := newTelemetryEmitter(&handlerSettings{}, "")
+	e.sinks = []telemetrySink{sink}
+	bus := newEventBus()
+	e.subscribe(bus)
+
+	app := &application{name: "web", committedState: Healthy, lastResponse: ProbeResponse{ApplicationHealthState: Healthy}}
+	bus.publish(ctx, busEvent{Kind: busEventProbeCycle, CommittedState: Healthy, Apps: []*application{app}})
+	bus.publish(ctx, busEvent{Kind: busEventStateTransition, Transition: stateTransition{From: Empty, To: Healthy}})
+	bus.publish(ctx, busEvent{Kind: busEventResourceLimitExceeded, Exceeded: []string{"maxMemoryInMB", "maxGoroutines"}})
+	require.Len(t, e.events, 3)
+	require.Equal(t, telemetryEventProbeResult, e.events[0].Name)
+	require.Equal(t, "web", e.events[0].Properties["application"])
+	require.Equal(t, map[string]string{"previousState": "", "state": "Healthy"}, e.events[1].Properties)
+	require.Equal(t, map[string]string{"exceeded": "maxMemoryInMB, maxGoroutines"}, e.events[2].Properties)
+}
+
+func TestTelemetryEmitter_batchesAndRateLimits(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	sink := &fakeTelemetrySink{}
+	c := newFakeClock()
+	e := &telemetryEmitter{sinks: []telemetrySink{sink}, flushInterval: telemetryFlushInterval, lastFlush: c.monotonic(), clock: c, queue: make(chan []telemetryEvent, telemetryQueuedBatches)}
+
+	for i := 0; i < telemetryMaxEventsPerMinute+10; i++ {
+		e.emit(ctx, telemetryEventProbeResult, nil, false)
+	}
+	// a full batch was queued, the events beyond the rate were dropped
+	require.Len(t, e.queue, 1)
+	require.Len(t, <-e.queue, telemetryBatchSize)
+	require.Len(t, e.events, telemetryMaxEventsPerMinute-telemetryBatchSize)
+	require.Equal(t, 10, e.dropped)
+
+	// essential events are never dropped
+	e.emit(ctx, telemetryEventHealthStateTransition, nil, true)
+	require.Len(t, e.events, telemetryMaxEventsPerMinute-telemetryBatchSize+1)
+
+	// the pending events are queued once the flush interval elapsed
+	c.advance(telemetryFlushInterval)
+	e.emit(ctx, telemetryEventProbeResult, nil, false)
+	require.Len(t, e.queue, 1)
+	require.Len(t, <-e.queue, telemetryMaxEventsPerMinute-telemetryBatchSize+2)
+	require.Empty(t, e.events)
+	require.Equal(t, 0, e.dropped)
+}
+
+func TestTelemetryEmitter_clockJump(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	sink := &fakeTelemetrySink{}
+	c := newFakeClock()
+	e := &telemetryEmitter{sinks: []telemetrySink{sink}, flushInterval: telemetryFlushInterval, lastFlush: c.monotonic(), clock: c, queue: make(chan []telemetryEvent, telemetryQueuedBatches)}
+
+	// stepping the wall clock forward neither flushes the events nor resets
+	// the rate limiting window
+	e.emit(ctx, telemetryEventProbeResult, nil, false)
+	c.step(time.Hour)
+	e.windowCount = telemetryMaxEventsPerMinute
+	e.emit(ctx, telemetryEventProbeResult, nil, false)
+	require.Equal(t, 0, len(e.queue))
+	require.Equal(t, 1, e.dropped)
+
+	// the events are timestamped with the wall clock
+	require.Equal(t, c.now().Add(-time.Hour), e.events[0].Time)
+
+	// stepping it backward doesn't delay the flush
+	c.step(-2 * time.Hour)
+	c.advance(telemetryFlushInterval)
+	e.emit(ctx, telemetryEventProbeResult, nil, false)
+	require.Len(t, e.queue, 1)
+}
+
+func TestApplicationInsightsSink_send(t *testing.T) {
+	var envelopes []applicationInsightsEnvelope
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&envelopes))
+	}))
+	defer server.Close()
+
+	sink := &applicationInsightsSink{instrumentationKey: "key", endpoint: server.URL, client: newInstrumentedClient(server.Client())}
+	require.Nil(t, sink.send([]telemetryEvent{{
+		Name:       telemetryEventHealthStateTransition,
+		Time:       time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Properties: map[string]string{"state": "Healthy"},
+	}}))
+	require.Len(t, envelopes, 1)
+	require.Equal(t, "key", envelopes[0].IKey)
+	require.Equal(t, "2024-01-01T00:00:00Z", envelopes[0].Time)
+	require.Equal(t, "EventData", envelopes[0].Data.BaseType)
+	require.Equal(t, telemetryEventHealthStateTransition, envelopes[0].Data.BaseData.Name)
+	require.Equal(t, map[string]string{"state": "Healthy"}, envelopes[0].Data.BaseData.Properties)
+}
+
+func TestLogAnalyticsSink_send(t *testing.T) {
+	var (
+		headers http.Header
+		body    []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	sink := &logAnalyticsSink{
+		workspaceID: "workspace",
+		sharedKey:   "c2VjcmV0",
+		endpoint:    server.URL,
+		client:      newInstrumentedClient(server.Client()),
+		now:         func() time.Time { return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC) },
+	}
+	require.Nil(t, sink.send([]telemetryEvent{{
+		Name:       telemetryEventProbeResult,
+		Time:       time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Properties: map[string]string{"healthState": "Healthy"},
+	}}))
+	require.Equal(t, `[{"EventName":"ProbeResult","TimeGenerated":"2024-01-01T00:00:00Z","healthState":"Healthy"}]`, string(body))
+	require.Equal(t, "ApplicationHealth", headers.Get("Log-Type"))
+	require.Equal(t, "Mon, 01 Jan 2024 00:00:00 GMT", headers.Get("x-ms-date"))
+
+	signature, err := sink.signature("Mon, 01 Jan 2024 00:00:00 GMT", len(body))
+	require.Nil(t, err)
+	require.Equal(t, "SharedKey workspace:"+signature, headers.Get("Authorization"))
+
+	server.Close()
+	require.NotNil(t, sink.send([]telemetryEvent{{Name: telemetryEventProbeResult}}))
+}
+
+func TestTelemetryEmitter_stopFlushes(t *testing.T) {
+	sink := &fakeTelemetrySink{}
+	e := newTelemetryEmitter(&handlerSettings{}, "")
+	e.sinks = []telemetrySink{sink}
+	require.Nil(t, e.start(log.NewContext(log.NewNopLogger())))
+
+	e.emit(e.ctx, telemetryEventProbeResult, nil, false)
+	require.Empty(t, sink.batches)
+	e.stop()
+	require.Len(t, sink.batches, 1)
+}
+
+// blockingTelemetrySink blocks sending a batch until it is released.
+type blockingTelemetrySink struct {
+	fakeTelemetrySink
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingTelemetrySink) send(events []telemetryEvent) error {
+	select {
+	case s.sending <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return s.fakeTelemetrySink.send(events)
+}
+
+func TestTelemetryEmitter_slowSinkDoesNotBlockEmit(t *testing.T) {
+	sink := &blockingTelemetrySink{sending: make(chan struct{}, 1), release: make(chan struct{})}
+	e := newTelemetryEmitter(&handlerSettings{}, "")
+	e.sinks = []telemetrySink{sink}
+	require.Nil(t, e.start(log.NewContext(log.NewNopLogger())))
+
+	// the first batch is being sent, the next ones fill the queue and the
+	// last one is dropped
+	for i := 0; i < telemetryBatchSize; i++ {
+		e.emit(e.ctx, telemetryEventHealthStateTransition, nil, true)
+	}
+	<-sink.sending
+	for i := 0; i < (telemetryQueuedBatches+1)*telemetryBatchSize; i++ {
+		e.emit(e.ctx, telemetryEventHealthStateTransition, nil, true)
+	}
+	require.Len(t, e.queue, telemetryQueuedBatches)
+	require.Empty(t, e.events)
+
+	close(sink.release)
+	e.stop()
+	require.Len(t, sink.batches, telemetryQueuedBatches+1)
+}
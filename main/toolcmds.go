@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// toolCmdFunc runs a tool subcommand with its command line arguments and
+// returns the exit code of the process.
+type toolCmdFunc func(args []string, stdout, stderr io.Writer) int
+
+// toolCmds are subcommands meant to be run by hand or in pipelines, as opposed
+// to the handler commands invoked by the guest agent. They don't need a
+// handler environment and don't report status.
+var toolCmds = map[string]toolCmdFunc{
+	"probe":               probeCmd,
+	"validate":            validateCmd,
+	"status":              statusCmd,
+	"version":             versionCmd,
+	"collect-diagnostics": collectDiagnosticsCmd,
+}
+
+// probeCmd constructs the probes described by a settings file, evaluates each
+// of them once and prints the results.
+func probeCmd(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("probe", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	settingsFile := flags.String("settings", "", "path of the settings file, either the public settings or an object with 'publicSettings' and 'protectedSettings'")
+	verbose := flags.Bool("verbose", false, "print the events logged while probing")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *settingsFile == "" {
+		fmt.Fprintln(stderr, "--settings is required")
+		flags.Usage()
+		return 2
+	}
+
+	logger := log.NewLogfmtLogger(ioutil.Discard)
+	if *verbose {
+		logger = log.NewLogfmtLogger(stderr)
+	}
+	ctx := log.NewContext(logger)
+
+	pubJSON, protJSON, err := readSettingsFile(*settingsFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	cfg, err := validateSettings(ctx, pubJSON, protJSON)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	exitCode := 0
+	for _, a := range cfg.applications() {
+		appCfg := a.handlerSettings(&cfg)
+		appCfg.protectedSettings = cfg.protectedSettings
+		probe := NewHealthProbe(ctx, &appCfg, 0)
+
+		start := time.Now()
+		probeResponse, err := probe.evaluate(ctx)
+		latency := time.Since(start)
+		probeResponse.ApplicationHealthState = mapFailureState(appCfg.failureStates(), probeResponse)
+
+		if a.Name != "" {
+			fmt.Fprintf(stdout, "application: %s\n", a.Name)
+		}
+		fmt.Fprintf(stdout, "probe: %s %s\n", appCfg.protocol(), probe.address())
+		fmt.Fprintf(stdout, "state: %s\n", probeResponse.ApplicationHealthState)
+		fmt.Fprintf(stdout, "latency: %v\n", latency.Round(time.Millisecond))
+		if b, err := json.Marshal(probeResponse); err == nil {
+			fmt.Fprintf(stdout, "response: %s\n", b)
+		}
+		if !probeResponse.ProbeDetails.isEmpty() {
+			if b, err := json.Marshal(probeResponse.ProbeDetails); err == nil {
+				fmt.Fprintf(stdout, "details: %s\n", b)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(stdout, "error: %v\n", err)
+		}
+		fmt.Fprintln(stdout)
+
+		if probeResponse.ApplicationHealthState != Healthy {
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
+
+// validateCmd validates a settings file against the schema and the logical
+// rules, printing all the schema errors or the effective configuration.
+func validateCmd(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	settingsFile := flags.String("settings", "", "path of the settings file, either the public settings or an object with 'publicSettings' and 'protectedSettings'")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *settingsFile == "" {
+		fmt.Fprintln(stderr, "--settings is required")
+		flags.Usage()
+		return 2
+	}
+
+	pubJSON, protJSON, err := readSettingsFile(*settingsFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	var errs []string
+	for _, s := range []struct {
+		settingsType string
+		schema       string
+		json         map[string]interface{}
+	}{
+		{"public", publicSettingsSchema, pubJSON},
+		{"protected", protectedSettingsSchema, protJSON},
+	} {
+		doc, err := toJSON(s.json)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		schemaErrs, err := settingsSchemaErrors(s.settingsType, s.schema, doc)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		errs = append(errs, schemaErrs...)
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(stdout, err)
+		}
+		return 1
+	}
+
+	cfg, err := validateSettings(log.NewContext(log.NewNopLogger()), pubJSON, protJSON)
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+
+	effective := map[string]interface{}{
+		"publicSettings":    withoutZeroValues(cfg.effectivePublicSettings()),
+		"protectedSettings": redacted(withoutZeroValues(cfg.protectedSettings)),
+	}
+	fmt.Fprintln(stdout, "settings are valid, effective configuration:")
+	enc := json.NewEncoder(stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(effective); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return 0
+}
+
+// withoutZeroValues converts v to a JSON object without the properties which
+// are not set (null, false, zero, empty strings, arrays and objects).
+func withoutZeroValues(v interface{}) map[string]interface{} {
+	var o map[string]interface{}
+	if b, err := json.Marshal(v); err != nil || json.Unmarshal(b, &o) != nil {
+		return nil
+	}
+	return removeZeroValues(o).(map[string]interface{})
+}
+
+func removeZeroValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			value = removeZeroValues(value)
+			if isZeroJSONValue(value) {
+				delete(v, k)
+			} else {
+				v[k] = value
+			}
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = removeZeroValues(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func isZeroJSONValue(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
+
+// redacted replaces the values of the settings with redactedValue.
+func redacted(o map[string]interface{}) map[string]interface{} {
+	for k := range o {
+		o[k] = redactedValue
+	}
+	return o
+}
+
+// versionCmd prints the version of the extension and how it was built.
+func versionCmd(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("version", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	jsonOutput := flags.Bool("json", false, "print the version information as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if !*jsonOutput {
+		fmt.Fprintln(stdout, DetailedVersionString())
+		return 0
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(currentBuildInfo()); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// statusSummary summarizes the latest status reported by the extension and
+// the recent transitions of the committed health state.
+type statusSummary struct {
+	SequenceNumber    int                `json:"sequenceNumber"`
+	Timestamp         string             `json:"timestamp"`
+	Status            StatusType         `json:"status"`
+	Message           string             `json:"message"`
+	HealthState       string             `json:"healthState,omitempty"`
+	Substatuses       []substatusSummary `json:"substatuses,omitempty"`
+	RecentTransitions []stateTransition  `json:"recentTransitions"`
+}
+
+type substatusSummary struct {
+	Name    string     `json:"name"`
+	Status  StatusType `json:"status"`
+	Message string     `json:"message"`
+}
+
+// statusCmd prints a summary of the latest status file and of the recent
+// transitions of the health state.
+func statusCmd(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	statusFolder := flags.String("status-folder", "", "folder of the .status files, defaults to the one of the handler environment")
+	dataFolder := flags.String("data-dir", dataDir, "folder of the persisted extension state")
+	jsonOutput := flags.Bool("json", false, "print the summary as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *statusFolder == "" {
+		paths, err := findHandlerPaths()
+		if err != nil {
+			fmt.Fprintln(stderr, errors.Wrap(err, "failed to find the status folder, use --status-folder"))
+			return 2
+		}
+		*statusFolder = paths.statusFolder()
+	}
+
+	summary, err := readStatusSummary(*statusFolder, *dataFolder)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summary); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Sequence number: %d\n", summary.SequenceNumber)
+	fmt.Fprintf(stdout, "Reported at:     %s\n", summary.Timestamp)
+	fmt.Fprintf(stdout, "Status:          %s (%s)\n", summary.Status, summary.Message)
+	if summary.HealthState != "" {
+		fmt.Fprintf(stdout, "Health state:    %s\n", summary.HealthState)
+	}
+	if len(summary.Substatuses) > 0 {
+		fmt.Fprintln(stdout, "Substatuses:")
+		for _, s := range summary.Substatuses {
+			fmt.Fprintf(stdout, "  %s [%s]: %s\n", s.Name, s.Status, s.Message)
+		}
+	}
+	fmt.Fprintln(stdout, "Recent transitions:")
+	if len(summary.RecentTransitions) == 0 {
+		fmt.Fprintln(stdout, "  none")
+	}
+	for _, t := range summary.RecentTransitions {
+		from := string(t.From)
+		if from == "" {
+			from = "(none)"
+		}
+		fmt.Fprintf(stdout, "  %s %s -> %s\n", t.Time.Format(time.RFC3339), from, t.To)
+	}
+	return 0
+}
+
+// readStatusSummary reads the status file with the highest sequence number
+// in statusFolder and the transition history in dataFolder.
+func readStatusSummary(statusFolder, dataFolder string) (statusSummary, error) {
+	var summary statusSummary
+	files, err := filepath.Glob(filepath.Join(statusFolder, "*.status"))
+	if err != nil {
+		return summary, err
+	}
+	seqNum, path := -1, ""
+	for _, f := range files {
+		n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(f), ".status"))
+		if err == nil && n > seqNum {
+			seqNum, path = n, f
+		}
+	}
+	if path == "" {
+		return summary, errors.New(fmt.Sprintf("No status file found in '%s'", statusFolder))
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return summary, errors.Wrap(err, "failed to read status file")
+	}
+	var report StatusReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		return summary, errors.Wrap(err, "failed to parse status file")
+	}
+	if len(report) == 0 {
+		return summary, errors.New(fmt.Sprintf("Status file '%s' is empty", path))
+	}
+
+	status := report[0]
+	summary.SequenceNumber = seqNum
+	summary.Timestamp = status.TimestampUTC
+	summary.Status = status.Status.Status
+	summary.Message = status.Status.FormattedMessage.Message
+	for _, s := range status.Status.SubstatusList {
+		if s.Name == SubstatusKeyNameApplicationHealthState {
+			summary.HealthState = s.FormattedMessage.Message
+		}
+		summary.Substatuses = append(summary.Substatuses, substatusSummary{Name: s.Name, Status: s.Status, Message: s.FormattedMessage.Message})
+	}
+
+	if summary.RecentTransitions, err = readTransitions(dataFolder); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// collectDiagnosticsCmd gathers the files needed to troubleshoot the extension
+// into a tarball in the log folder and prints its path.
+func collectDiagnosticsCmd(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("collect-diagnostics", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	statusFolder := flags.String("status-folder", "", "folder of the .status files, defaults to the one of the handler environment")
+	configFolder := flags.String("config-folder", "", "folder of the .settings files, defaults to the one of the handler environment")
+	logFolder := flags.String("log-folder", "", "folder of the extension logs, where the tarball is written, defaults to the one of the handler environment")
+	dataFolder := flags.String("data-dir", dataDir, "folder of the persisted extension state")
+	output := flags.String("output", "", "path of the tarball, defaults to a timestamped file in the log folder")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *statusFolder == "" || *configFolder == "" || *logFolder == "" {
+		paths, err := findHandlerPaths()
+		if err != nil {
+			fmt.Fprintln(stderr, errors.Wrap(err, "failed to find the extension folders, use --status-folder, --config-folder and --log-folder"))
+			return 2
+		}
+		if *statusFolder == "" {
+			*statusFolder = paths.statusFolder()
+		}
+		if *configFolder == "" {
+			*configFolder = paths.configFolder()
+		}
+		if *logFolder == "" {
+			*logFolder = paths.logFolder()
+		}
+	}
+
+	now := time.Now()
+	if *output == "" {
+		*output = filepath.Join(*logFolder, diagnosticsBundlePrefix+now.UTC().Format("20060102T150405Z")+".tar.gz")
+	}
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fmt.Fprintln(stderr, errors.Wrap(err, "failed to create diagnostics bundle"))
+		return 1
+	}
+	err = collectDiagnostics(f, diagnosticsSources{
+		statusFolder: *statusFolder,
+		configFolder: *configFolder,
+		logFolder:    *logFolder,
+		dataFolder:   *dataFolder,
+		procFolder:   "/proc",
+	}, now)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintln(stdout, *output)
+	return 0
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSettingsFile writes content to a settings file in a temporary
+// directory and returns its path.
+func writeSettingsFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "settings")
+	require.Nil(t, err)
+	path := filepath.Join(dir, "settings.json")
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestReadSettingsFile(t *testing.T) {
+	path := writeSettingsFile(t, `{"protocol": "tcp", "port": 80}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	pub, prot, err := readSettingsFile(path)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"protocol": "tcp", "port": float64(80)}, pub)
+	require.Nil(t, prot)
+
+	path = writeSettingsFile(t, `{"publicSettings": {"protocol": "tcp"}, "protectedSettings": {"applicationInsightsInstrumentationKey": "key"}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	pub, prot, err = readSettingsFile(path)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"protocol": "tcp"}, pub)
+	require.Equal(t, map[string]interface{}{"applicationInsightsInstrumentationKey": "key"}, prot)
+
+	path = writeSettingsFile(t, `{"publicSettings": "tcp"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	_, _, err = readSettingsFile(path)
+	require.EqualError(t, err, "'publicSettings' in settings file is not an object")
+
+	_, _, err = readSettingsFile("/non-existing/settings.json")
+	require.NotNil(t, err)
+}
+
+func TestProbeCmd(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ApplicationHealthState": "Healthy"}`)
+	}))
+	defer server.Close()
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+
+	path := writeSettingsFile(t, `{"protocol": "http", "port": `+port+`, "requestPath": "health"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, probeCmd([]string{"--settings", path}, &stdout, &stderr))
+	require.Contains(t, stdout.String(), "probe: http http://localhost:"+port+"/health\n")
+	require.Contains(t, stdout.String(), "state: Healthy\n")
+	require.Contains(t, stdout.String(), "latency: ")
+	require.Contains(t, stdout.String(), `response: {"applicationHealthState":"Healthy"}`)
+	require.Empty(t, stderr.String())
+}
+
+func TestProbeCmd_unhealthy(t *testing.T) {
+	path := writeSettingsFile(t, `{"applications": [{"name": "closed", "protocol": "tcp", "port": 1}]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 1, probeCmd([]string{"--settings", path}, &stdout, &stderr))
+	require.Contains(t, stdout.String(), "application: closed\n")
+	require.Contains(t, stdout.String(), "state: Unhealthy\n")
+	require.Contains(t, stdout.String(), "error: ")
+}
+
+func TestProbeCmd_invalidSettings(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 2, probeCmd(nil, &stdout, &stderr))
+	require.Contains(t, stderr.String(), "--settings is required")
+
+	path := writeSettingsFile(t, `{"protocol": "tcp"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	stderr.Reset()
+	require.Equal(t, 2, probeCmd([]string{"--settings", path}, &stdout, &stderr))
+	require.Contains(t, stderr.String(), errTcpConfigurationMustIncludePort.Error())
+	require.Empty(t, stdout.String())
+}
+
+func TestValidateCmd(t *testing.T) {
+	path := writeSettingsFile(t, `{
+		"publicSettings": {"protocol": "http", "port": 8080, "requestPath": "health"},
+		"protectedSettings": {"applicationInsightsInstrumentationKey": "secret"}
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, validateCmd([]string{"--settings", path}, &stdout, &stderr))
+	require.Equal(t, `settings are valid, effective configuration:
+{
+  "protectedSettings": {
+    "applicationInsightsInstrumentationKey": "<redacted>"
+  },
+  "publicSettings": {
+    "dependencyAggregation": "ignoreOptional",
+    "gracePeriod": 5,
+    "httpVersion": "1.1",
+    "intervalInSeconds": 5,
+    "maxResponseBodySizeInBytes": 4096,
+    "numberOfProbes": 1,
+    "port": 8080,
+    "protocol": "http",
+    "requestPath": "health",
+    "richStates": true,
+    "userAgent": "ApplicationHealthExtension/1.0"
+  }
+}
+`, stdout.String())
+	require.NotContains(t, stdout.String(), "secret")
+}
+
+func TestValidateCmd_applications(t *testing.T) {
+	path := writeSettingsFile(t, `{"intervalInSeconds": 10, "applications": [{"name": "db", "protocol": "tcp", "port": 5432}]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, validateCmd([]string{"--settings", path}, &stdout, &stderr))
+	require.Contains(t, stdout.String(), `"aggregation": "worstOf"`)
+	require.Contains(t, stdout.String(), `"gracePeriod": 10`)
+	require.Contains(t, stdout.String(), `"tcpProbeMode": "connect"`)
+	require.Contains(t, stdout.String(), `"weight": 1`)
+}
+
+func TestValidateCmd_v2(t *testing.T) {
+	path := writeSettingsFile(t, `{"schemaVersion": 2, "probes": [{"protocol": "tcp", "port": 5432}], "observability": {"mirrorLogsToSyslog": true}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, validateCmd([]string{"--settings", path}, &stdout, &stderr))
+	require.Contains(t, stdout.String(), `"schemaVersion": 2`)
+	require.Contains(t, stdout.String(), `"tcpProbeMode": "connect"`)
+	require.Contains(t, stdout.String(), `"mirrorLogsToSyslog": true`)
+	require.NotContains(t, stdout.String(), `"weight"`)
+}
+
+func TestValidateCmd_invalid(t *testing.T) {
+	// all the schema errors are printed
+	path := writeSettingsFile(t, `{
+		"publicSettings": {"protocol": "ftp", "port": "80"},
+		"protectedSettings": {"unknown": "value"}
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 1, validateCmd([]string{"--settings", path}, &stdout, &stderr))
+	require.Equal(t, 3, strings.Count(stdout.String(), "\n"), stdout.String())
+	require.Contains(t, stdout.String(), "public settings: protocol: protocol must be one of the following")
+	require.Contains(t, stdout.String(), "public settings: port: Invalid type. Expected: integer, given: string")
+	require.Contains(t, stdout.String(), "protected settings: unknown: Additional property unknown is not allowed")
+
+	// logical validation
+	path = writeSettingsFile(t, `{"protocol": "tcp"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	stdout.Reset()
+	require.Equal(t, 1, validateCmd([]string{"--settings", path}, &stdout, &stderr))
+	require.Contains(t, stdout.String(), errTcpConfigurationMustIncludePort.Error())
+}
+
+func TestStatusCmd(t *testing.T) {
+	statusDir, err := ioutil.TempDir("", "status")
+	require.Nil(t, err)
+	defer os.RemoveAll(statusDir)
+	dataDir, err := ioutil.TempDir("", "data")
+	require.Nil(t, err)
+	defer os.RemoveAll(dataDir)
+
+	require.Nil(t, NewStatus(StatusTransitioning, "Enable", "old").Save(statusDir, 1))
+	report := NewStatus(StatusSuccess, "Enable", "Application found to be healthy")
+	report.AddSubstatus(StatusSuccess, SubstatusKeyNameApplicationHealthState, "Healthy")
+	require.Nil(t, report.Save(statusDir, 2))
+	require.Nil(t, appendTransition(dataDir, stateTransition{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), To: Healthy}))
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, statusCmd([]string{"--status-folder", statusDir, "--data-dir", dataDir}, &stdout, &stderr))
+	require.Contains(t, stdout.String(), "Sequence number: 2\n")
+	require.Contains(t, stdout.String(), "Status:          success (Application found to be healthy)\n")
+	require.Contains(t, stdout.String(), "Health state:    Healthy\n")
+	require.Contains(t, stdout.String(), "  2020-01-01T00:00:00Z (none) -> Healthy\n")
+
+	stdout.Reset()
+	require.Equal(t, 0, statusCmd([]string{"--status-folder", statusDir, "--data-dir", dataDir, "--json"}, &stdout, &stderr))
+	var summary statusSummary
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &summary))
+	require.Equal(t, 2, summary.SequenceNumber)
+	require.Equal(t, StatusSuccess, summary.Status)
+	require.Equal(t, "Healthy", summary.HealthState)
+	require.Len(t, summary.Substatuses, 1)
+	require.Len(t, summary.RecentTransitions, 1)
+}
+
+func TestStatusCmd_noStatusFile(t *testing.T) {
+	statusDir, err := ioutil.TempDir("", "status")
+	require.Nil(t, err)
+	defer os.RemoveAll(statusDir)
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 1, statusCmd([]string{"--status-folder", statusDir, "--data-dir", statusDir}, &stdout, &stderr))
+	require.Contains(t, stderr.String(), "No status file found")
+}
+
+func TestCollectDiagnosticsCmd(t *testing.T) {
+	s := writeDiagnosticsSources(t)
+	defer os.RemoveAll(filepath.Dir(s.statusFolder))
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, collectDiagnosticsCmd([]string{
+		"--status-folder", s.statusFolder,
+		"--config-folder", s.configFolder,
+		"--log-folder", s.logFolder,
+		"--data-dir", s.dataFolder,
+	}, &stdout, &stderr), stderr.String())
+
+	path := strings.TrimSpace(stdout.String())
+	require.Equal(t, s.logFolder, filepath.Dir(path))
+	require.True(t, strings.HasPrefix(filepath.Base(path), diagnosticsBundlePrefix))
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	files := readBundle(t, f)
+	require.Contains(t, files, "settings.json")
+	require.Contains(t, files, "logs/extension.log")
+}
+
+func TestVersionCmd(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "1.2.3"
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, versionCmd(nil, &stdout, &stderr))
+	require.True(t, strings.HasPrefix(stdout.String(), "v1.2.3 "))
+
+	stdout.Reset()
+	require.Equal(t, 0, versionCmd([]string{"--json"}, &stdout, &stderr))
+	var info buildInfo
+	require.Nil(t, json.Unmarshal(stdout.Bytes(), &info))
+	require.Equal(t, "1.2.3", info.Version)
+	require.NotEmpty(t, info.GoVersion)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const maxDatagramSize = 65535
+
+// UdpHealthProbe sends a datagram to a local port and considers the
+// application healthy when any reply (or a reply starting with
+// ExpectedResponse, if set) arrives within Timeout.
+type UdpHealthProbe struct {
+	Address          string
+	Payload          []byte
+	ExpectedResponse []byte
+	Timeout          time.Duration
+}
+
+func (p *UdpHealthProbe) evaluate(ctx *log.Context) (ProbeResponse, error) {
+	var probeResponse ProbeResponse
+	probeResponse.ApplicationHealthState = Unhealthy
+
+	conn, err := net.DialTimeout("udp", p.address(), p.Timeout)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(p.Timeout)); err != nil {
+		probeResponse.ProbeDetails.Failure = probeFailureConnection
+		return probeResponse, err
+	}
+	if _, err := conn.Write(p.Payload); err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, udpError(err, p.Timeout)
+	}
+
+	reply := make([]byte, maxDatagramSize)
+	n, err := conn.Read(reply)
+	if err != nil {
+		probeResponse.ProbeDetails.Failure = classifyRequestError(err)
+		return probeResponse, udpError(err, p.Timeout)
+	}
+
+	if len(p.ExpectedResponse) > 0 && !bytes.HasPrefix(reply[:n], p.ExpectedResponse) {
+		probeResponse.ProbeDetails.Failure = probeFailureBadBody
+		return probeResponse, errors.New(fmt.Sprintf("Udp reply of %d bytes does not match the expected response", n))
+	}
+
+	probeResponse.ApplicationHealthState = Healthy
+	return probeResponse, nil
+}
+
+// udpError turns the errors of a connected udp socket into descriptive ones:
+// an ICMP port-unreachable surfaces as ECONNREFUSED, no reply as a timeout.
+func udpError(err error, timeout time.Duration) error {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok && sysErr.Err == syscall.ECONNREFUSED {
+			return errors.New("Udp port unreachable")
+		}
+		if opErr.Timeout() {
+			return errors.New(fmt.Sprintf("No udp reply received within %v", timeout))
+		}
+	}
+	return err
+}
+
+func (p *UdpHealthProbe) address() string {
+	return p.Address
+}
+
+func (p *UdpHealthProbe) healthStatusAfterGracePeriodExpires() HealthStatus {
+	return Unhealthy
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUdpHealthProbe_evaluate(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "ping" {
+				conn.WriteTo([]byte("pong"), addr)
+			} else {
+				conn.WriteTo([]byte("what?"), addr)
+			}
+		}
+	}()
+
+	ctx := log.NewContext(log.NewNopLogger())
+	probe := &UdpHealthProbe{
+		Address: conn.LocalAddr().String(),
+		Payload: []byte("ping"),
+		Timeout: time.Second,
+	}
+
+	// any reply
+	probeResponse, err := probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// matching reply
+	probe.ExpectedResponse = []byte("pong")
+	probeResponse, err = probe.evaluate(ctx)
+	require.Nil(t, err)
+	require.Equal(t, Healthy, probeResponse.ApplicationHealthState)
+
+	// mismatching reply
+	probe.Payload = []byte("hello")
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "does not match the expected response")
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+
+	// port unreachable
+	conn.Close()
+	probeResponse, err = probe.evaluate(ctx)
+	require.NotNil(t, err)
+	require.Equal(t, "Udp port unreachable", err.Error())
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
+
+func TestUdpHealthProbe_evaluate_NoReply(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	probe := &UdpHealthProbe{Address: conn.LocalAddr().String(), Timeout: 100 * time.Millisecond}
+	probeResponse, err := probe.evaluate(log.NewContext(log.NewNopLogger()))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "No udp reply received within 100ms")
+	require.Equal(t, Unhealthy, probeResponse.ApplicationHealthState)
+}
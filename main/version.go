@@ -5,7 +5,7 @@ import (
 	"runtime"
 )
 
-// These fields are populated by govvv at compile-time.
+// These fields are populated at compile-time with -ldflags "-X main.Version=...".
 var (
 	Version   string
 	GitCommit string
@@ -17,7 +17,6 @@ var (
 // vVERSION/git@GitCommit[-State].
 func VersionString() string {
 	return fmt.Sprintf("v%s/git@%s-%s", Version, GitCommit, GitState)
-
 }
 
 // DetailedVersionString returns a detailed version string including version
@@ -26,3 +25,23 @@ func DetailedVersionString() string {
 	// e.g. v2.2.0 git:03669cef-clean build:2016-07-22T16:22:26.556103000+00:00 go:go1.6.2
 	return fmt.Sprintf("v%s git:%s-%s build:%s %s", Version, GitCommit, GitState, BuildDate, runtime.Version())
 }
+
+// buildInfo is the version information of the binary, as reported in the
+// status and printed by the version subcommand.
+type buildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit,omitempty"`
+	GitState  string `json:"gitState,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		GitState:  GitState,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
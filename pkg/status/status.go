@@ -0,0 +1,200 @@
+// Package status builds the status documents an extension handler reports to
+// the guest agent: a status file holding the status of the last operation and
+// its substatuses, each with a formatted message.
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Report is the document of a status file.
+type Report []Item
+
+type Item struct {
+	Version      float64 `json:"version"`
+	TimestampUTC string  `json:"timestampUTC"`
+	Status       Status  `json:"status"`
+}
+
+// Type is the status of an operation or of a substatus.
+type Type string
+
+const (
+	Transitioning Type = "transitioning"
+	Error         Type = "error"
+	Warning       Type = "warning"
+	Success       Type = "success"
+)
+
+type Status struct {
+	Operation                   string           `json:"operation"`
+	ConfigurationAppliedTimeUTC string           `json:"configurationAppliedTime"`
+	Status                      Type             `json:"status"`
+	FormattedMessage            FormattedMessage `json:"formattedMessage"`
+	SubstatusList               []Substatus      `json:"substatus,omitempty"`
+}
+
+type FormattedMessage struct {
+	Lang    string `json:"lang"`
+	Message string `json:"message"`
+}
+
+type Substatus struct {
+	Name             string           `json:"name"`
+	Status           Type             `json:"status"`
+	FormattedMessage FormattedMessage `json:"formattedMessage"`
+}
+
+// formattedMessage returns the message in the language of the statuses.
+func formattedMessage(message string) FormattedMessage {
+	return FormattedMessage{Lang: "en", Message: message}
+}
+
+// New returns the report of an operation with the given status and message,
+// timestamped now.
+func New(t Type, operation, message string) Report {
+	return NewBuilder(operation).SetStatus(t).WithFormattedMessage(message).Build()
+}
+
+func NewSubstatus(name string, t Type, message string) Substatus {
+	return Substatus{
+		Name:             name,
+		Status:           t,
+		FormattedMessage: formattedMessage(message),
+	}
+}
+
+// AddSubstatus appends a substatus with the given status, name and message.
+func (r Report) AddSubstatus(t Type, name, message string) {
+	r.AddSubstatusItem(NewSubstatus(name, t, message))
+}
+
+func (r Report) AddSubstatusItem(substatus Substatus) {
+	if len(r) > 0 {
+		r[0].Status.SubstatusList = append(r[0].Status.SubstatusList, substatus)
+	}
+}
+
+// Copy returns a copy of the report which can be changed, or shared with
+// another goroutine, independently of it.
+func (r Report) Copy() Report {
+	if r == nil {
+		return nil
+	}
+	c := append(Report(nil), r...)
+	for i := range c {
+		c[i].Status.SubstatusList = append([]Substatus(nil), r[i].Status.SubstatusList...)
+	}
+	return c
+}
+
+// Marshal returns the json document of the report, as written to the status
+// file.
+func (r Report) Marshal() ([]byte, error) {
+	return json.MarshalIndent(r, "", "\t")
+}
+
+// Save persists the status message to the specified status folder using the
+// sequence number. The operation consists of writing to a temporary file in the
+// same folder and moving it to the final destination for atomicity.
+func (r Report) Save(statusFolder string, seqNum int) error {
+	fn := fmt.Sprintf("%d.status", seqNum)
+	path := filepath.Join(statusFolder, fn)
+	tmpFile, err := ioutil.TempFile(statusFolder, fn)
+	if err != nil {
+		return fmt.Errorf("status: failed to create temporary file: %v", err)
+	}
+	tmpFile.Close()
+
+	b, err := r.Marshal()
+	if err != nil {
+		return fmt.Errorf("status: failed to marshal into json: %v", err)
+	}
+	if err := ioutil.WriteFile(tmpFile.Name(), b, 0644); err != nil {
+		return fmt.Errorf("status: failed to write to path=%s error=%v", tmpFile.Name(), err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("status: failed to move to path=%s error=%v", path, err)
+	}
+	return nil
+}
+
+// Builder assembles a report, so that the components reporting a status
+// compose it the same way.
+type Builder struct {
+	operation   string
+	status      Type
+	message     string
+	substatuses []Substatus
+	timestamp   time.Time
+}
+
+// NewBuilder returns the builder of the report of an operation, transitioning
+// until its status is set.
+func NewBuilder(operation string) *Builder {
+	return &Builder{operation: operation, status: Transitioning}
+}
+
+// SetOperation sets the operation the report is the status of.
+func (b *Builder) SetOperation(operation string) *Builder {
+	b.operation = operation
+	return b
+}
+
+// SetStatus sets the status of the operation.
+func (b *Builder) SetStatus(t Type) *Builder {
+	b.status = t
+	return b
+}
+
+// WithFormattedMessage sets the message of the operation.
+func (b *Builder) WithFormattedMessage(message string) *Builder {
+	b.message = message
+	return b
+}
+
+// AddSubstatus appends substatuses, reported in the order they are added.
+func (b *Builder) AddSubstatus(substatuses ...Substatus) *Builder {
+	b.substatuses = append(b.substatuses, substatuses...)
+	return b
+}
+
+// SetTimestamp sets the time of the report, the time Build is called unless
+// set.
+func (b *Builder) SetTimestamp(t time.Time) *Builder {
+	b.timestamp = t
+	return b
+}
+
+// Build returns the report. The builder can be reused, later changes not
+// affecting the reports already built.
+func (b *Builder) Build() Report {
+	timestamp := b.timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	now := timestamp.UTC().Format(time.RFC3339)
+	var substatuses []Substatus
+	if len(b.substatuses) > 0 {
+		substatuses = append([]Substatus(nil), b.substatuses...)
+	}
+	return Report{
+		{
+			Version:      1.0,
+			TimestampUTC: now,
+			Status: Status{
+				Operation:                   b.operation,
+				ConfigurationAppliedTimeUTC: now,
+				Status:                      b.status,
+				FormattedMessage:            formattedMessage(b.message),
+				SubstatusList:               substatuses,
+			},
+		},
+	}
+}
@@ -0,0 +1,109 @@
+package status
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files of testdata")
+
+var reportTime = time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+// requireGolden compares the report with the golden file of testdata.
+func requireGolden(t *testing.T, name string, r Report) {
+	b, err := r.Marshal()
+	require.Nil(t, err)
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		require.Nil(t, ioutil.WriteFile(path, b, 0644))
+	}
+	expected, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, string(expected), string(b))
+}
+
+func TestBuilder_golden(t *testing.T) {
+	r := NewBuilder("Enable").
+		SetTimestamp(reportTime).
+		SetStatus(Success).
+		WithFormattedMessage("Application health found").
+		AddSubstatus(
+			NewSubstatus("AppHealthStatus", Success, "Application found to be healthy"),
+			NewSubstatus("ApplicationHealthState", Success, "Healthy"),
+		).
+		Build()
+	requireGolden(t, "substatuses", r)
+
+	r = NewBuilder("Enable").SetTimestamp(reportTime).Build()
+	requireGolden(t, "transitioning", r)
+
+	r = NewBuilder("Install").
+		SetTimestamp(reportTime).
+		SetOperation("Uninstall").
+		SetStatus(Error).
+		WithFormattedMessage("failed").
+		Build()
+	requireGolden(t, "error", r)
+}
+
+func TestBuilder_reuse(t *testing.T) {
+	b := NewBuilder("Enable").AddSubstatus(NewSubstatus("a", Success, "a"))
+	r := b.Build()
+	b.AddSubstatus(NewSubstatus("b", Success, "b"))
+	require.Len(t, r[0].Status.SubstatusList, 1)
+	require.Len(t, b.Build()[0].Status.SubstatusList, 2)
+
+	// the report is timestamped when built
+	r = NewBuilder("Enable").Build()
+	ts, err := time.Parse(time.RFC3339, r[0].TimestampUTC)
+	require.Nil(t, err)
+	require.WithinDuration(t, time.Now(), ts, time.Minute)
+}
+
+func TestReport_AddSubstatus(t *testing.T) {
+	r := New(Success, "Enable", "message")
+	r.AddSubstatus(Warning, "name", "substatus")
+	require.Equal(t, []Substatus{{Name: "name", Status: Warning, FormattedMessage: FormattedMessage{Lang: "en", Message: "substatus"}}}, r[0].Status.SubstatusList)
+
+	// an empty report is left empty
+	var empty Report
+	empty.AddSubstatus(Warning, "name", "substatus")
+	require.Empty(t, empty)
+}
+
+func TestReport_Copy(t *testing.T) {
+	r := New(Success, "Enable", "message")
+	r.AddSubstatus(Success, "a", "a")
+	c := r.Copy()
+	require.Equal(t, r, c)
+
+	c.AddSubstatus(Warning, "b", "b")
+	c[0].Status.SubstatusList[0].FormattedMessage.Message = "changed"
+	require.Len(t, r[0].Status.SubstatusList, 1)
+	require.Equal(t, "a", r[0].Status.SubstatusList[0].FormattedMessage.Message)
+
+	require.Nil(t, Report(nil).Copy())
+}
+
+func TestReport_Save(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := NewBuilder("Enable").SetTimestamp(reportTime).SetStatus(Success).Build()
+	require.Nil(t, r.Save(dir, 3))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "3.status"))
+	require.Nil(t, err)
+	expected, err := r.Marshal()
+	require.Nil(t, err)
+	require.Equal(t, expected, b)
+	entries, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+}
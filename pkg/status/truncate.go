@@ -0,0 +1,72 @@
+package status
+
+import (
+	"unicode/utf8"
+)
+
+// TruncatedMarker is appended to the messages which were truncated.
+const TruncatedMarker = "...truncated"
+
+// TruncateToSize truncates the messages of the report until its serialized
+// size fits maxSize. The longest messages of the substatuses are truncated
+// first, then the top level message. Substatuses whose message can't be
+// truncated further are dropped. The status types and the substatuses named
+// in preserved are left untouched. It returns the serialized size of the
+// report before truncation and whether it was truncated.
+func (r Report) TruncateToSize(maxSize int, preserved map[string]bool) (int, bool) {
+	size := r.SerializedSize()
+	if len(r) == 0 || size <= maxSize {
+		return size, false
+	}
+
+	status := &r[0].Status
+	for current := size; current > maxSize; current = r.SerializedSize() {
+		excess := current - maxSize
+
+		longest := -1
+		for i, s := range status.SubstatusList {
+			if preserved[s.Name] {
+				continue
+			}
+			if longest < 0 || len(s.FormattedMessage.Message) > len(status.SubstatusList[longest].FormattedMessage.Message) {
+				longest = i
+			}
+		}
+
+		switch {
+		case longest >= 0 && len(status.SubstatusList[longest].FormattedMessage.Message) > len(TruncatedMarker):
+			msg := &status.SubstatusList[longest].FormattedMessage.Message
+			*msg = truncateMessage(*msg, excess)
+		case longest >= 0:
+			status.SubstatusList = append(status.SubstatusList[:longest], status.SubstatusList[longest+1:]...)
+		case len(status.FormattedMessage.Message) > len(TruncatedMarker):
+			status.FormattedMessage.Message = truncateMessage(status.FormattedMessage.Message, excess)
+		default:
+			// only the preserved substatuses are left
+			return size, true
+		}
+	}
+	return size, true
+}
+
+// SerializedSize returns the size of the json document of the report.
+func (r Report) SerializedSize() int {
+	b, err := r.Marshal()
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// truncateMessage shortens msg by at least excess bytes, on a rune boundary,
+// and appends TruncatedMarker.
+func truncateMessage(msg string, excess int) string {
+	n := len(msg) - excess - len(TruncatedMarker)
+	if n < 0 {
+		n = 0
+	}
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return msg[:n] + TruncatedMarker
+}
@@ -0,0 +1,49 @@
+package status
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport_TruncateToSize(t *testing.T) {
+	r := New(Success, "op", strings.Repeat("o", 500))
+	r.AddSubstatus(Success, "preserved", strings.Repeat("p", 500))
+	r.AddSubstatus(Success, "details", strings.Repeat("d", 2000))
+	r.AddSubstatus(Success, "metrics", strings.Repeat("m", 1000))
+
+	size, truncated := r.TruncateToSize(2000, map[string]bool{"preserved": true})
+	require.True(t, truncated)
+	require.True(t, size > 2000)
+	require.True(t, r.SerializedSize() <= 2000)
+	subs := r[0].Status.SubstatusList
+	require.Equal(t, strings.Repeat("p", 500), subs[0].FormattedMessage.Message)
+	for _, s := range subs[1:] {
+		require.True(t, strings.HasSuffix(s.FormattedMessage.Message, TruncatedMarker))
+	}
+
+	// a report within the size is left unchanged
+	r = New(Success, "op", "message")
+	_, truncated = r.TruncateToSize(2000, nil)
+	require.False(t, truncated)
+	require.Equal(t, "message", r[0].Status.FormattedMessage.Message)
+}
+
+func TestReport_TruncateToSize_dropsSubstatuses(t *testing.T) {
+	r := New(Error, "op", "")
+	for i := 0; i < 20; i++ {
+		r.AddSubstatus(Error, "s", "x")
+	}
+	_, truncated := r.TruncateToSize(400, nil)
+	require.True(t, truncated)
+	require.True(t, r.SerializedSize() <= 400)
+	require.True(t, len(r[0].Status.SubstatusList) < 20)
+}
+
+func Test_truncateMessage(t *testing.T) {
+	require.Equal(t, "abcd"+TruncatedMarker, truncateMessage("abcdefghijklmnopqrstuvwxyz", 10))
+	require.Equal(t, TruncatedMarker, truncateMessage("abc", 10))
+	// does not split the multi-byte rune
+	require.Equal(t, "a"+TruncatedMarker, truncateMessage("aé"+strings.Repeat("b", 20), 9))
+}